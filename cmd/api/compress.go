@@ -0,0 +1,202 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes are the response media types worth gzipping. Anything
+// else, images or archives say, is likely compressed already.
+var compressibleTypes = map[string]bool{
+	"application/json":     true,
+	"application/xml":      true,
+	"text/xml":             true,
+	"application/atom+xml": true,
+	"text/csv":             true,
+	"application/x-ndjson": true,
+	jsonapiMediaType:       true,
+	msgpackMediaType:       true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compress gzips responses for clients that accept it. Only compressible
+// types are compressed, and only when the body is at least minBytes long or
+// its length isn't known up front, as with streamed exports. It sits inside
+// metrics, so the response size counted there is the compressed one.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept-Encoding")
+
+		// An upgraded connection takes over the raw socket, so it must not
+		// be wrapped.
+		if !acceptsGzip(r) || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, request: r, minBytes: app.config.compression.minBytes}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || (coding != "gzip" && coding != "*") {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter decides whether to compress when the header is
+// written, from the Content-Type and Content-Length the handler set.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	minBytes    int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if w.shouldCompress(status) {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) shouldCompress(status int) bool {
+	if w.request.Method == http.MethodHead || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+
+	h := w.Header()
+	// Byte ranges refer to the stored file, so a resource served in ranges
+	// must go out as stored.
+	if h.Get("Content-Encoding") != "" || h.Get("Accept-Ranges") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !compressibleTypes[mediaType] {
+		return false
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < w.minBytes {
+		return false
+	}
+	return true
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush sends what has been compressed so far, so streamed responses keep
+// streaming.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
+
+// decompressRequest decodes gzip request bodies, so that readJSON and the CSV
+// import see plain data. The handlers' body size limits then apply to the
+// decompressed stream, which is what keeps a small, highly compressed body
+// from using up memory. Other encodings are rejected with a 415.
+func (app *application) decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				app.badRequestResponse(w, r, &bodyEncodingError{err})
+				return
+			}
+			r.Body = gzipBody{zr: zr, body: r.Body}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			app.unsupportedContentEncodingResponse(w, r, encoding)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyEncodingError reports a request body that isn't the gzip data its
+// Content-Encoding claims.
+type bodyEncodingError struct {
+	err error
+}
+
+func (e *bodyEncodingError) Error() string {
+	return fmt.Sprintf("body is not valid gzip data: %v", e.err)
+}
+
+func (e *bodyEncodingError) Unwrap() error {
+	return e.err
+}
+
+// gzipBody is a request body read through a gzip.Reader.
+type gzipBody struct {
+	zr   *gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = &bodyEncodingError{err}
+	}
+	return n, err
+}
+
+func (b gzipBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
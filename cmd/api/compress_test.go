@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// gunzip returns the decompressed body.
+func gunzip(t *testing.T, body []byte) []byte {
+	t.Helper()
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.minBytes = 1024
+	large := strings.Repeat(`{"title":"Song","artist":"Band"},`, 100)
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		body           string
+		// streamed bodies are sent without a Content-Length.
+		streamed     bool
+		wantCompress bool
+	}{
+		{"large JSON", http.MethodGet, "gzip", "application/json", large, false, true},
+		{"large CSV", http.MethodGet, "gzip, deflate", "text/csv; charset=utf-8", large, false, true},
+		{"streamed", http.MethodGet, "gzip", "application/x-ndjson", large, true, true},
+		{"any encoding", http.MethodGet, "*", "application/json", large, false, true},
+		{"small JSON", http.MethodGet, "gzip", "application/json", `{"status":"ok"}`, false, false},
+		{"not accepted", http.MethodGet, "", "application/json", large, false, false},
+		{"refused", http.MethodGet, "gzip;q=0, identity", "application/json", large, false, false},
+		{"already compressed type", http.MethodGet, "gzip", "image/png", large, false, false},
+		{"HEAD", http.MethodHead, "gzip", "application/json", large, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if !tt.streamed {
+					w.Header().Set("Content-Length", strconv.Itoa(len(tt.body)))
+				}
+				io.WriteString(w, tt.body)
+			}))
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := serve(h, r)
+
+			if got := rr.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q; want Accept-Encoding", got)
+			}
+
+			if !tt.wantCompress {
+				if got := rr.Header().Get("Content-Encoding"); got != "" {
+					t.Errorf("got Content-Encoding %q; want none", got)
+				}
+				if rr.Body.String() != tt.body {
+					t.Errorf("got a body of %d bytes; want the %d sent", rr.Body.Len(), len(tt.body))
+				}
+				return
+			}
+
+			if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("got Content-Encoding %q; want gzip", got)
+			}
+			if got := rr.Header().Get("Content-Length"); got != "" {
+				t.Errorf("got Content-Length %s of the uncompressed body", got)
+			}
+			if rr.Body.Len() >= len(tt.body) {
+				t.Errorf("got %d compressed bytes; want fewer than %d", rr.Body.Len(), len(tt.body))
+			}
+			if got := gunzip(t, rr.Body.Bytes()); string(got) != tt.body {
+				t.Errorf("got %q decompressed; want the body sent", got)
+			}
+		})
+	}
+}
+
+func TestCompressListMusics(t *testing.T) {
+	app := newListTestApplication(t)
+	app.config.compression.minBytes = 0
+	h := app.routes()
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/musics?title=song", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		return serve(h, r)
+	}
+
+	plain := get("identity")
+	compressed := get("gzip")
+	if compressed.Header().Get("Content-Encoding") != "gzip" || plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got Content-Encoding %q and %q; want gzip and none",
+			compressed.Header().Get("Content-Encoding"), plain.Header().Get("Content-Encoding"))
+	}
+	if got := gunzip(t, compressed.Body.Bytes()); !bytes.Equal(got, plain.Body.Bytes()) {
+		t.Errorf("got\n%s\ndecompressed; want\n%s", got, plain.Body)
+	}
+	for _, rr := range []*httptest.ResponseRecorder{plain, compressed} {
+		if !strings.Contains(rr.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("got Vary %q; want it to include Accept-Encoding", rr.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCompressMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.minBytes = 0
+	body := strings.Repeat("compressible ", 1000)
+
+	h := app.metrics(app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	before := totalResponseBytes.Value()
+	rr := serve(h, r)
+
+	if got, want := totalResponseBytes.Value()-before, int64(rr.Body.Len()); got != want || want >= int64(len(body)) {
+		t.Errorf("counted %d response bytes; want the %d compressed ones", got, want)
+	}
+}
+
+// gzipped returns s gzip-compressed.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestDecompressRequestJSON(t *testing.T) {
+	const music = `{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}`
+	// bomb inflates past the 1MB readJSON allows from a few kilobytes.
+	bomb := gzipped(t, `{"title":"`+strings.Repeat("a", 4<<20)+`"}`)
+	valid := gzipped(t, music)
+
+	tests := []struct {
+		name        string
+		encoding    string
+		body        string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"gzip", "gzip", valid, http.StatusCreated, ""},
+		{"gzip in other case", " GZIP ", valid, http.StatusCreated, ""},
+		{"identity", "identity", music, http.StatusCreated, ""},
+		{"bomb", "gzip", bomb, http.StatusBadRequest, "body must not be larger than 1048576 bytes"},
+		{"garbage", "gzip", "not gzip at all", http.StatusBadRequest, "body is not valid gzip data"},
+		{"truncated", "gzip", valid[:len(valid)-10], http.StatusBadRequest, "body is not valid gzip data"},
+		{"not gzipped", "gzip", music, http.StatusBadRequest, "body is not valid gzip data"},
+		{"unsupported encoding", "br", music, http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "bomb" && len(tt.body) > 16<<10 {
+				t.Fatalf("bomb is %d bytes compressed; want it small", len(tt.body))
+			}
+
+			app := newTestApplication(t)
+			db := openMusicStubDB()
+			defer db.Close()
+			app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/musics", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Content-Encoding", tt.encoding)
+			rr := serve(app.decompressRequest(http.HandlerFunc(app.createMusicHandler)), r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantMessage != "" && !strings.Contains(rr.Body.String(), tt.wantMessage) {
+				t.Errorf("got %s; want the message %q", rr.Body, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestDecompressRequestImport(t *testing.T) {
+	csv := importCSV(3, "")
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"gzip", gzipped(t, csv), http.StatusOK},
+		{"bomb", gzipped(t, importCSV(0, strings.Repeat("Song,180,pop,0.5\n", 100000))), http.StatusRequestEntityTooLarge},
+		{"garbage", "title,duration\n", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.imports.maxBytes = 64 << 10
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/musics/import?dry_run=true", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "text/csv")
+			r.Header.Set("Content-Encoding", "gzip")
+			if int64(len(tt.body)) > app.config.imports.maxBytes {
+				t.Fatalf("body is %d bytes compressed; want it under the limit", len(tt.body))
+			}
+			rr := serve(app.decompressRequest(http.HandlerFunc(app.importMusicsHandler)), r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus == http.StatusOK && !strings.Contains(rr.Body.String(), `"imported":3`) {
+				t.Errorf("got %s; want 3 records imported", rr.Body)
+			}
+		})
+	}
+}
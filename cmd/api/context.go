@@ -22,3 +22,130 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+const authTokenContextKey = contextKey("auth_token")
+
+func (app *application) contextSetAuthToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), authTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetAuthToken returns the plaintext of the authentication token the
+// request was made with, or "" for anonymous users.
+func (app *application) contextGetAuthToken(r *http.Request) string {
+	token, _ := r.Context().Value(authTokenContextKey).(string)
+	return token
+}
+
+const apiVersionContextKey = contextKey("api_version")
+
+func (app *application) contextSetAPIVersion(r *http.Request, version int) *http.Request {
+	ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIVersion returns the API version the request is served under,
+// which is v1 for routes that aren't versioned.
+func (app *application) contextGetAPIVersion(r *http.Request) int {
+	version, ok := r.Context().Value(apiVersionContextKey).(int)
+	if !ok {
+		return apiV1
+	}
+	return version
+}
+
+const requestIDContextKey = contextKey("request_id")
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// requestID returns the id assigned to the request by the requestID
+// middleware, or "" outside of it.
+func (app *application) requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+const permissionsContextKey = contextKey("permissions")
+
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	if holder, ok := r.Context().Value(permissionsHolderContextKey).(*permissionsHolder); ok {
+		holder.permissions = permissions
+	}
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissions returns the permissions authenticate loaded for the
+// caller, which are empty for anonymous users. Middleware running before
+// authenticate gets them from the holder contextSetPermissionsHolder put on
+// the request.
+func (app *application) contextGetPermissions(r *http.Request) data.Permissions {
+	if permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions); ok {
+		return permissions
+	}
+	if holder, ok := r.Context().Value(permissionsHolderContextKey).(*permissionsHolder); ok {
+		return holder.permissions
+	}
+	return nil
+}
+
+const permissionsHolderContextKey = contextKey("permissions_holder")
+
+// permissionsHolder passes the permissions authenticate loads back out to
+// the middleware wrapping it, which only has the request it was called
+// with.
+type permissionsHolder struct {
+	permissions data.Permissions
+}
+
+func (app *application) contextSetPermissionsHolder(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsHolderContextKey, &permissionsHolder{})
+	return r.WithContext(ctx)
+}
+
+const readOnlyContextKey = contextKey("read_only")
+
+func (app *application) contextSetReadOnly(r *http.Request, readOnly bool) *http.Request {
+	ctx := context.WithValue(r.Context(), readOnlyContextKey, readOnly)
+	return r.WithContext(ctx)
+}
+
+// contextGetReadOnly reports whether the request was made with a read-only
+// authentication token, which only the ReadOnlyPermissions of its user
+// apply to.
+func (app *application) contextGetReadOnly(r *http.Request) bool {
+	readOnly, _ := r.Context().Value(readOnlyContextKey).(bool)
+	return readOnly
+}
+
+const rateLimitExemptContextKey = contextKey("rate_limit_exempt")
+
+func (app *application) contextSetRateLimitExempt(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), rateLimitExemptContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// contextGetRateLimitExempt reports whether rateLimit found the request
+// exempt, which spares it the tiers applied after authenticate too.
+func (app *application) contextGetRateLimitExempt(r *http.Request) bool {
+	exempt, _ := r.Context().Value(rateLimitExemptContextKey).(bool)
+	return exempt
+}
+
+const errorMembersContextKey = contextKey("error_members")
+
+// contextSetErrorMembers adds members to the envelope of any error response
+// to r, next to "error", for handlers that have more to say about how far
+// they got.
+func (app *application) contextSetErrorMembers(r *http.Request, members envelope) *http.Request {
+	ctx := context.WithValue(r.Context(), errorMembersContextKey, members)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetErrorMembers(r *http.Request) envelope {
+	members, _ := r.Context().Value(errorMembersContextKey).(envelope)
+	return members
+}
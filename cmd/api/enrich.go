@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/enrich"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxEnrichRecords caps the records a bulk enrichment may select.
+	maxEnrichRecords = 10_000
+	// enrichProgressEvery is how many records a job processes between
+	// progress updates.
+	enrichProgressEvery = 25
+	// enrichMaxConsecutiveFailures stops a job whose lookups keep failing,
+	// since the catalogue is most likely down.
+	enrichMaxConsecutiveFailures = 10
+)
+
+// enrichMusicHandler fills in the fields record :id is missing from the
+// configured catalogue, or replaces them all with overwrite=true. A record
+// the catalogue doesn't know is returned unchanged, with no enriched fields.
+func (app *application) enrichMusicHandler(w http.ResponseWriter, r *http.Request) {
+	if app.enricher == nil {
+		app.enrichmentUnavailableResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	overwrite := app.readBool(r.URL.Query(), "overwrite", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	music, err := app.models.Musics.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, music.Id, music.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	changed, err := app.enrichMusic(r.Context(), music, overwrite)
+	if err != nil {
+		var rateErr *enrich.RateLimitError
+		var upstreamErr *enrich.UpstreamError
+		switch {
+		case errors.As(err, &rateErr):
+			app.upstreamRateLimitedResponse(w, r, rateErr.Source, rateErr.RetryAfter)
+		case errors.As(err, &upstreamErr):
+			app.upstreamFailedResponse(w, r, upstreamErr.Source, err)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.constraintErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(music.Id, music.Version))
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"music": music, "enriched_fields": changed}, "music", headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// enrichMusic looks music up in the catalogue and saves the fields Apply
+// fills in, returning their names. Nothing is saved when there's no match or
+// nothing to fill in.
+func (app *application) enrichMusic(ctx context.Context, music *data.Music, overwrite bool) ([]string, error) {
+	track, err := app.enricher.Lookup(ctx, enrich.QueryFor(music))
+	if err != nil {
+		if errors.Is(err, enrich.ErrNoMatch) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	changed := enrich.Apply(music, track, overwrite)
+	if len(changed) == 0 {
+		return []string{}, nil
+	}
+
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		if err := app.models.Musics.EnrichTx(tx, music, app.enricher.Name()); err != nil {
+			return err
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, music))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// enrichMusicsHandler starts a background enrichment of the records matching
+// the listing filters and answers 202 with the job, whose progress is at
+// its Location.
+func (app *application) enrichMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.enricher == nil {
+		app.enrichmentUnavailableResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+	v := validator.New()
+	filter := app.readMusicFilter(qs, v)
+	overwrite := app.readBool(qs, "overwrite", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	count, err := app.models.Musics.Count(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if count > maxEnrichRecords {
+		v.AddError("filter", validator.MsgTooManyMatches, maxEnrichRecords)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The ids are read up front so that the job doesn't hold a query open
+	// while it waits on the catalogue.
+	ids := make([]int64, 0, count)
+	filters := data.Filters{Sort: "id", SortSafeList: []string{"id"}}
+	err = app.models.Musics.StreamAll(r.Context(), filter, filters, func(m *data.Music) error {
+		ids = append(ids, m.Id)
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	job := &data.EnrichmentJob{
+		Query:     r.URL.RawQuery,
+		Overwrite: overwrite,
+		Total:     len(ids),
+		UserID:    app.contextGetUser(r).ID,
+	}
+	if err := app.models.Enrichments.Insert(job); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		app.runEnrichmentJob(job, ids)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v%d/musics/enrich/%d", app.contextGetAPIVersion(r), job.ID))
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"enrichment_job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showEnrichmentJobHandler reports the progress of an enrichment job.
+func (app *application) showEnrichmentJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job, err := app.models.Enrichments.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"enrichment_job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runEnrichmentJob enriches the records ids one at a time, saving progress
+// as it goes. When the catalogue rate limits the job, it waits as long as
+// asked and retries the record. A shutdown stops the job, leaving it
+// interrupted; its user is notified when it ends otherwise.
+func (app *application) runEnrichmentJob(job *data.EnrichmentJob, ids []int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-app.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logFields := map[string]string{"enrichment_job_id": strconv.FormatInt(job.ID, 10)}
+	saveProgress := func() {
+		if err := app.models.Enrichments.UpdateProgress(job); err != nil {
+			app.logger.PrintError(err, logFields)
+		}
+	}
+
+	failures := 0
+	for job.Processed < len(ids) && job.Status == data.JobRunning {
+		if ctx.Err() != nil {
+			job.Status = data.JobInterrupted
+			break
+		}
+
+		changed, err := app.enrichRecord(ctx, ids[job.Processed], job.Overwrite)
+		var rateErr *enrich.RateLimitError
+		switch {
+		case errors.As(err, &rateErr):
+			timer := time.NewTimer(rateErr.RetryAfter)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			continue
+		case ctx.Err() != nil:
+			continue
+		case err != nil:
+			app.logger.PrintError(err, logFields)
+			job.Failed++
+			failures++
+			if failures == enrichMaxConsecutiveFailures {
+				job.Status = data.JobFailed
+				job.Error = err.Error()
+			}
+		case len(changed) > 0:
+			job.Enriched++
+			failures = 0
+		default:
+			job.Skipped++
+			failures = 0
+		}
+
+		job.Processed++
+		if job.Processed%enrichProgressEvery == 0 {
+			saveProgress()
+		}
+	}
+
+	if job.Status == data.JobRunning {
+		job.Status = data.JobCompleted
+	}
+	saveProgress()
+
+	if job.Status != data.JobInterrupted {
+		app.notifyUser(job.UserID, "enrichment."+job.Status, fmt.Sprintf(
+			"enrichment job %d %s: %d of %d records enriched, %d skipped, %d failed",
+			job.ID, job.Status, job.Enriched, job.Total, job.Skipped, job.Failed,
+		))
+	}
+}
+
+// enrichRecord enriches record id for a job. A record deleted since the job
+// started is skipped, and an edit made while it was being looked up is
+// kept, skipping the record too.
+func (app *application) enrichRecord(ctx context.Context, id int64, overwrite bool) ([]string, error) {
+	music, err := app.models.Musics.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	changed, err := app.enrichMusic(ctx, music, overwrite)
+	if errors.Is(err, data.ErrEditConflict) {
+		return nil, nil
+	}
+	return changed, err
+}
@@ -1,21 +1,144 @@
 package main
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Error codes are part of the public API: clients switch on them, so existing
+// values must never change. Each code also identifies its message in the
+// validator package's catalogue.
+const (
+	codeServerError              = "server_error"
+	codeRecordNotFound           = "record_not_found"
+	codeMethodNotAllowed         = "method_not_allowed"
+	codeBadRequest               = "bad_request"
+	codeValidationFailed         = "validation_failed"
+	codeRateLimited              = "rate_limited"
+	codeEditConflict             = "edit_conflict"
+	codePreconditionFailed       = "precondition_failed"
+	codeIdempotencyKeyReused     = "idempotency_key_reused"
+	codeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	codeInvalidCredentials       = "invalid_credentials"
+	codeInvalidAuthToken         = "invalid_authentication_token"
+	codeAuthenticationRequired   = "authentication_required"
+	codeInactiveAccount          = "inactive_account"
+	codeAccountSuspended         = "account_suspended"
+	codeNotPermitted             = "not_permitted"
+	codeReadOnlyToken            = "read_only_token"
+	codeQueryTimeout             = "query_timeout"
+	codeExportTooLarge           = "export_too_large"
+	codeUnsupportedMediaType     = "unsupported_media_type"
+	codeBodyTooLarge             = "body_too_large"
+	codeNotAcceptable            = "not_acceptable"
+	codeUnsupportedEncoding      = "unsupported_content_encoding"
+	codeEnrichmentUnavailable    = "enrichment_unavailable"
+	codeUpstreamFailed           = "upstream_failed"
+	codeUpstreamRateLimited      = "upstream_rate_limited"
+	codeExportNotReady           = "export_not_ready"
+	codeExportExpired            = "export_expired"
+	codeImportFinished           = "import_finished"
+	codeLastHolder               = "last_holder"
+	codeLastHolderRevoke         = "last_holder_revoke"
+	codeLastHolderSuspend        = "last_holder_suspend"
+	codeTOTPRequired             = "totp_required"
+	codeInvalidTOTPCode          = "invalid_totp_code"
+	codeTwoFactorEnabled         = "two_factor_enabled"
+	codeTwoFactorNotPending      = "two_factor_not_pending"
+	codeTwoFactorUnavailable     = "two_factor_unavailable"
+)
+
+// totalQueryTimeouts counts the listing queries that ran past the database
+// query timeout.
+var totalQueryTimeouts = expvar.NewInt("total_query_timeouts")
+
+type apiError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Debug     *errorDebug       `json:"debug,omitempty"`
+}
+
+// errorDebug carries the detail of a server error, which is only shown to
+// admins or when the server runs with -debug-errors.
+type errorDebug struct {
+	Error string   `json:"error"`
+	Stack []string `json:"stack,omitempty"`
+}
+
+// maxStackLines caps the stack trace included in debug error detail.
+const maxStackLines = 20
+
+// panicError is the error recoverPanic reports for a recovered panic.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("%s", e.value)
+}
+
+// frames returns the stack from the panicking function outwards, without
+// the frames of the panic machinery and recoverPanic itself.
+func (e *panicError) frames() []string {
+	lines := strings.Split(strings.TrimSpace(string(e.stack)), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "panic(") {
+			lines = lines[i+2:]
+			break
+		}
+	}
+
+	frames := make([]string, 0, maxStackLines)
+	for _, line := range lines {
+		if len(frames) == maxStackLines {
+			break
+		}
+		frames = append(frames, strings.TrimSpace(line))
+	}
+	return frames
+}
+
+// requestLanguage is the catalogue language that best matches the
+// request's Accept-Language header.
+func requestLanguage(r *http.Request) string {
+	return validator.Language(r.Header.Get("Accept-Language"))
+}
+
+// newAPIError returns the error for code, with its message looked up in the
+// catalogue in the request's language.
+func (app *application) newAPIError(r *http.Request, code string, args ...interface{}) apiError {
+	return apiError{Code: code, Message: validator.Translate(requestLanguage(r), code, args...)}
+}
+
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.requestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, apiErr apiError) {
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", requestLanguage(r))
+
+	env := envelope{"error": apiErr}
+	for key, value := range app.contextGetErrorMembers(r) {
+		env[key] = value
+	}
 
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeResponse(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -24,60 +147,235 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
-	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+
+	// The request id lets users point us at the matching log line.
+	apiErr := app.newAPIError(r, codeServerError)
+	apiErr.RequestID = app.requestID(r)
+
+	if app.config.debugErrors || app.contextGetPermissions(r).Include("admin") {
+		apiErr.Debug = &errorDebug{Error: err.Error()}
+
+		var panicErr *panicError
+		if errors.As(err, &panicErr) {
+			apiErr.Debug.Stack = panicErr.frames()
+		}
+	}
+
+	app.errorResponse(w, r, http.StatusInternalServerError, apiErr)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
-	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, app.newAPIError(r, codeRecordNotFound))
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, app.newAPIError(r, codeMethodNotAllowed, r.Method))
 }
 
+// badRequestResponse passes err's text through as is; it describes the exact
+// problem with the request and isn't in the catalogue.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, apiError{Code: codeBadRequest, Message: err.Error()})
+}
+
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]validator.Message) {
+	apiErr := app.newAPIError(r, codeValidationFailed)
+	lang := requestLanguage(r)
+	apiErr.Fields = make(map[string]string, len(errors))
+	for key, message := range errors {
+		apiErr.Fields[key] = message.Text(lang)
+	}
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, apiErr)
+}
+
+// constraintFields maps database constraints to the request field, and the
+// message, a violation is reported against.
+var constraintFields = map[string]struct {
+	field   string
+	message validator.Message
+}{
+	"musics_isrc_key":       {"isrc", validator.Message{ID: validator.MsgDuplicateISRC}},
+	"musics_duration_check": {"duration", validator.Message{ID: validator.MsgNotNegative}},
+	"genres_length_check":   {"genres", validator.Message{ID: validator.MsgGenresRange, Args: []interface{}{1, 5}}},
+	"users_email_key":       {"email", validator.Message{ID: validator.MsgDuplicateEmail}},
+	"tokens_user_id_fkey":   {"user_id", validator.Message{ID: validator.MsgUnknownReference}},
+
+	"saved_searches_user_id_name_key": {"name", validator.Message{ID: validator.MsgDuplicateName}},
+}
+
+// constraintErrorResponse reports a write rejected by a known database
+// constraint as a validation failure on the matching field. Any other error,
+// including violations of constraints missing from constraintFields, is a
+// server error.
+func (app *application) constraintErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var constraintErr *data.ConstraintError
+	if errors.As(err, &constraintErr) {
+		if mapping, ok := constraintFields[constraintErr.Constraint]; ok {
+			app.failedValidationResponse(w, r, map[string]validator.Message{mapping.field: mapping.message})
+			return
+		}
+	}
+	app.serverErrorResponse(w, r, err)
+}
+
+// rateLimitExceededResponse turns away a client over its rate limit, telling
+// it in Retry-After how many seconds until it may try again.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	app.errorResponse(w, r, http.StatusTooManyRequests, app.newAPIError(r, codeRateLimited))
+}
+
+// queryTimeoutResponse answers a request whose query ran out of time. The
+// query string is logged so slow filter shapes can be found.
+func (app *application) queryTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	totalQueryTimeouts.Add(1)
+	app.logger.PrintInfo("query timed out", map[string]string{
+		"request_id": app.requestID(r),
+		"path":       r.URL.Path,
+		"query":      r.URL.RawQuery,
+	})
+
+	w.Header().Set("Retry-After", "5")
+	app.errorResponse(w, r, http.StatusServiceUnavailable, app.newAPIError(r, codeQueryTimeout))
+}
+
+func (app *application) exportTooLargeResponse(w http.ResponseWriter, r *http.Request, count, limit int) {
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, app.newAPIError(r, codeExportTooLarge, count, limit))
+}
+
+// exportNotReadyResponse answers a download of an export that hasn't
+// completed, naming its status.
+func (app *application) exportNotReadyResponse(w http.ResponseWriter, r *http.Request, status string) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeExportNotReady, status))
+}
+
+func (app *application) exportExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusGone, app.newAPIError(r, codeExportExpired))
+}
+
+func (app *application) importFinishedResponse(w http.ResponseWriter, r *http.Request, status string) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeImportFinished, status))
+}
+
+// lastHolderResponse refuses to delete the account of the only user holding
+// permission code, which nobody could then grant again.
+func (app *application) lastHolderResponse(w http.ResponseWriter, r *http.Request, code string) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeLastHolder, code))
+}
+
+// lastHolderRevokeResponse refuses to revoke permission code from the only
+// user holding it.
+func (app *application) lastHolderRevokeResponse(w http.ResponseWriter, r *http.Request, code string) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeLastHolderRevoke, code))
+}
+
+// lastHolderSuspendResponse refuses to suspend the only active user holding
+// permission code.
+func (app *application) lastHolderSuspendResponse(w http.ResponseWriter, r *http.Request, code string) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeLastHolderSuspend, code))
+}
+
+// totpRequiredResponse asks a user with two-factor authentication enabled
+// for a totp_code to sign in with.
+func (app *application) totpRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusUnauthorized, app.newAPIError(r, codeTOTPRequired))
+}
+
+func (app *application) invalidTOTPCodeResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusUnauthorized, app.newAPIError(r, codeInvalidTOTPCode))
+}
+
+func (app *application) twoFactorEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeTwoFactorEnabled))
+}
+
+func (app *application) twoFactorNotPendingResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeTwoFactorNotPending))
+}
+
+func (app *application) twoFactorUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusServiceUnavailable, app.newAPIError(r, codeTwoFactorUnavailable))
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, mediaType string) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, app.newAPIError(r, codeUnsupportedMediaType, mediaType))
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusNotAcceptable, app.newAPIError(r, codeNotAcceptable, supportedMediaTypes))
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+func (app *application) unsupportedContentEncodingResponse(w http.ResponseWriter, r *http.Request, encoding string) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, app.newAPIError(r, codeUnsupportedEncoding, encoding))
+}
+
+func (app *application) bodyTooLargeResponse(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, app.newAPIError(r, codeBodyTooLarge, maxBytes))
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
-	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeEditConflict))
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusPreconditionFailed, app.newAPIError(r, codePreconditionFailed))
+}
+
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, app.newAPIError(r, codeIdempotencyKeyReused))
+}
+
+func (app *application) idempotencyKeyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusConflict, app.newAPIError(r, codeIdempotencyKeyInProgress))
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
-	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, app.newAPIError(r, codeInvalidCredentials))
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
-	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, app.newAPIError(r, codeInvalidAuthToken))
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
-	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, app.newAPIError(r, codeAuthenticationRequired))
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, app.newAPIError(r, codeInactiveAccount))
+}
+
+// accountSuspendedResponse turns away a suspended user, who can't get
+// anywhere by signing in again.
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusForbidden, app.newAPIError(r, codeAccountSuspended))
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
-	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, app.newAPIError(r, codeNotPermitted))
+}
+
+// readOnlyTokenResponse refuses a request made with a read-only token that
+// needs a permission making changes, whether or not the user holds it.
+func (app *application) readOnlyTokenResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusForbidden, app.newAPIError(r, codeReadOnlyToken))
+}
+
+func (app *application) enrichmentUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusServiceUnavailable, app.newAPIError(r, codeEnrichmentUnavailable))
+}
+
+// upstreamFailedResponse answers a request that an external service we
+// depend on failed, logging why; the client gets 502 rather than a server
+// error, since retrying later may well work.
+func (app *application) upstreamFailedResponse(w http.ResponseWriter, r *http.Request, service string, err error) {
+	app.logError(r, err)
+	app.errorResponse(w, r, http.StatusBadGateway, app.newAPIError(r, codeUpstreamFailed, service))
+}
+
+func (app *application) upstreamRateLimitedResponse(w http.ResponseWriter, r *http.Request, service string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	app.errorResponse(w, r, http.StatusServiceUnavailable, app.newAPIError(r, codeUpstreamRateLimited, service, seconds))
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// recentEvents is how many events are kept for clients reconnecting
+	// with Last-Event-ID.
+	recentEvents = 256
+	// eventHeartbeat is how often an idle stream gets a comment, so proxies
+	// don't time it out.
+	eventHeartbeat = 15 * time.Second
+	// eventStreamLifetime ends a stream before the server's write timeout
+	// cuts it off; the client reconnects after eventRetry and resumes from
+	// the last event it saw.
+	eventStreamLifetime = serverWriteTimeout - 5*time.Second
+	eventRetry          = time.Second
+)
+
+// musicEventsHandler streams music changes as server-sent events; user
+// notifications go to WebSocket clients only. A client reconnecting with
+// Last-Event-ID (or ?last_event_id=) first gets the events it missed, as far
+// as they are still remembered.
+func (app *application) musicEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("response writer does not support flushing"))
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var since int64
+	if lastID != "" {
+		n, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || n < 0 {
+			app.badRequestResponse(w, r, errors.New("invalid Last-Event-ID"))
+			return
+		}
+		since = n
+	}
+
+	backlog, sub := app.events.Subscribe(since)
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	for _, e := range backlog {
+		if !e.For(0) {
+			continue
+		}
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	lifetime := time.NewTimer(eventStreamLifetime)
+	defer lifetime.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind; the client reconnects and
+				// catches up from its last event id.
+				return
+			}
+			if !e.For(0) {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-lifetime.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes e as one server-sent event.
+func writeEvent(w http.ResponseWriter, e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, payload)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumns are the CSV columns of a musics export, named as in v1.
+var exportColumns = []string{"id", "isrc", "title", "artist", "duration", "genres", "popularity", "created_at", "updated_at", "version"}
+
+// exportMusicsCSV streams every record matching filter as CSV, ignoring
+// pagination. Exports over the configured row limit are refused with 413
+// before anything is written, since a failure halfway through a streamed
+// body can't be reported.
+func (app *application) exportMusicsCSV(w http.ResponseWriter, r *http.Request, filter data.MusicFilter, filters data.Filters) {
+	count, err := app.models.Musics.Count(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if count > app.config.export.maxRows {
+		app.exportTooLargeResponse(w, r, count, app.config.export.maxRows)
+		return
+	}
+
+	filename := fmt.Sprintf("musics-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write(musicFields(app.contextGetAPIVersion(r), exportColumns))
+
+	err = app.models.Musics.StreamAll(r.Context(), filter, filters, func(m *data.Music) error {
+		return cw.Write(musicCSVRecord(m))
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil && r.Context().Err() == nil {
+		// The status line is already out; all that's left is to log it.
+		app.logError(r, err)
+	}
+}
+
+// musicCSVRecord is the row of m in a CSV export, in exportColumns order.
+func musicCSVRecord(m *data.Music) []string {
+	return []string{
+		strconv.FormatInt(m.Id, 10),
+		m.ISRC,
+		m.Title,
+		m.Artist,
+		strconv.Itoa(int(m.Duration)),
+		strings.Join(m.Genres, ";"),
+		strconv.FormatFloat(float64(m.Popularity), 'f', -1, 32),
+		m.CreatedAt.Format(time.RFC3339),
+		m.UpdatedAt.Format(time.RFC3339),
+		strconv.Itoa(int(m.Version)),
+	}
+}
+
+// ndjsonFlushEvery is how many NDJSON lines are written between flushes.
+const ndjsonFlushEvery = 100
+
+// exportMusicsNDJSON streams every record matching filter as one JSON object
+// per line, ignoring pagination. The total is sent up front in
+// X-Total-Count, as there's no envelope to carry metadata.
+func (app *application) exportMusicsNDJSON(w http.ResponseWriter, r *http.Request, filter data.MusicFilter, filters data.Filters, fields []string) {
+	count, err := app.models.Musics.Count(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	written := 0
+
+	err = app.models.Musics.StreamAll(r.Context(), filter, filters, func(m *data.Music) error {
+		selected, err := selectFields(m, fields)
+		if err != nil {
+			return err
+		}
+		payload, err := app.versionedPayload(r, selected)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(payload); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+	}
+}
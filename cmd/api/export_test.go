@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportTestApplication returns an application whose database counts
+// count matching records and streams rows, noting whether a stream ran.
+func newExportTestApplication(t *testing.T, count int64, rows [][]driver.Value) (*application, *bool) {
+	t.Helper()
+
+	app := newTestApplication(t)
+	columns, _ := stubMusicRow()
+	streamed := false
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SELECT count(*) FROM") {
+			return []string{"count"}, [][]driver.Value{{count}}, nil
+		}
+		streamed = true
+		return append([]string{"rank"}, columns...), rows, nil
+	})
+	t.Cleanup(func() { db.Close() })
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+	return app, &streamed
+}
+
+var exportFilenameRX = regexp.MustCompile(`^attachment; filename="musics-\d{8}-\d{6}\.csv"$`)
+
+func TestExportMusicsCSV(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 30, 0, time.UTC)
+	// Streamed rows lead with the rank.
+	rows := [][]driver.Value{
+		append([]driver.Value{nil}, stubMusic(map[string]driver.Value{
+			"isrc": "USS1Z9900001", "title": `Say "Hello", World`, "artist": "Band, The", "genres": []byte(`{rock,"hip hop"}`), "popularity": 0.75,
+			"created_at": at, "updated_at": at, "version": int64(3),
+		})...),
+		append([]driver.Value{nil}, stubMusic(map[string]driver.Value{
+			"id": int64(2), "title": "Line one\nLine two", "artist": "Singer", "duration": int64(240), "genres": []byte("{}"),
+			"created_at": at, "updated_at": at.Add(time.Hour),
+		})...),
+	}
+	app, _ := newExportTestApplication(t, int64(len(rows)), rows)
+
+	rr := serve(app.routes(), httptest.NewRequest(http.MethodGet, "/v1/musics?format=csv&genres_any=rock,pop", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := rr.Header().Get("Content-Disposition"); !exportFilenameRX.MatchString(got) {
+		t.Errorf("got Content-Disposition %q", got)
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "isrc", "title", "artist", "duration", "genres", "popularity", "created_at", "updated_at", "version"},
+		{"1", "USS1Z9900001", `Say "Hello", World`, "Band, The", "180", "rock;hip hop", "0.75", "2021-06-01T12:00:30Z", "2021-06-01T12:00:30Z", "3"},
+		{"2", "", "Line one\nLine two", "Singer", "240", "", "0.5", "2021-06-01T12:00:30Z", "2021-06-01T13:00:30Z", "1"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got\n%q\nwant\n%q", records, want)
+	}
+}
+
+func TestExportMusicsCSVTooLarge(t *testing.T) {
+	app, streamed := newExportTestApplication(t, 11, nil)
+	app.config.export.maxRows = 10
+
+	rr := serve(app.routes(), httptest.NewRequest(http.MethodGet, "/v1/musics?format=csv&genres=pop", nil))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusRequestEntityTooLarge, rr.Body)
+	}
+	if code := readAPIError(t, rr).Code; code != codeExportTooLarge {
+		t.Errorf("got error code %q; want %q", code, codeExportTooLarge)
+	}
+	if got := rr.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("got Content-Disposition %q on a refusal", got)
+	}
+	if *streamed {
+		t.Error("the records were read for a refused export")
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// exportBatchSize is how many records an export reads per query, and
+	// writes between progress updates.
+	exportBatchSize = 1000
+	// exportSweepInterval is how often expired export files are removed.
+	exportSweepInterval = 10 * time.Minute
+)
+
+// exportMediaTypes are the formats an export can be written in, with the
+// Content-Type its file is downloaded as.
+var exportMediaTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// exportPath is where the file of export id is written, in format. The file
+// is written under a ".part" suffix and renamed once complete.
+func (app *application) exportPath(id int64, format string) string {
+	return filepath.Join(app.config.export.dir, fmt.Sprintf("export-%d.%s", id, format))
+}
+
+// createExportHandler starts a background export of the records matching the
+// listing query in the body and answers 202 with the export, whose progress
+// is at its Location. Unlike ?format=csv on GET /musics, an export has no
+// row limit.
+func (app *application) createExportHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query  string `json:"query"`
+		Format string `json:"format"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	export := &data.Export{
+		Query:  data.NormalizeSavedSearchQuery(input.Query),
+		Format: strings.ToLower(strings.TrimSpace(input.Format)),
+		UserID: app.contextGetUser(r).ID,
+	}
+	if export.Format == "" {
+		export.Format = "csv"
+	}
+
+	v := validator.New()
+	v.Check(len(export.Query) <= 2000, "query", validator.MsgMaxBytes, 2000)
+	_, ok := exportMediaTypes[export.Format]
+	v.Check(ok, "format", validator.MsgOneOf, "csv, ndjson")
+	qs, err := url.ParseQuery(export.Query)
+	v.Check(err == nil, "query", validator.MsgInvalidQuery)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	filter := app.readMusicFilter(qs, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	export.Total, err = app.models.Musics.Count(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Exports.Insert(export); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		app.runExport(export, filter)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/exports/%d", export.ID))
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listExportsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "created_at", "-id", "-created_at"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	exports, metadata, err := app.models.Exports.GetAllForUser(app.contextGetUser(r).ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"exports": exports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, ok := app.readExport(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadExportHandler sends the file of a completed export. Range and
+// If-Range requests are honoured, so an interrupted download can be resumed.
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, ok := app.readExport(w, r)
+	if !ok {
+		return
+	}
+
+	switch export.Status {
+	case data.JobCompleted:
+	case data.JobExpired:
+		app.exportExpiredResponse(w, r)
+		return
+	default:
+		app.exportNotReadyResponse(w, r, export.Status)
+		return
+	}
+
+	f, err := os.Open(app.exportPath(export.ID, export.Format))
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			app.exportExpiredResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	// The file never changes once written, so its id is enough of an ETag
+	// for If-Range.
+	filename := fmt.Sprintf("musics-export-%d.%s", export.ID, export.Format)
+	w.Header().Set("Content-Type", exportMediaTypes[export.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("ETag", fmt.Sprintf(`"export-%d"`, export.ID))
+	w.Header().Set("Cache-Control", "private")
+
+	var modified time.Time
+	if export.CompletedAt != nil {
+		modified = *export.CompletedAt
+	}
+	http.ServeContent(w, r, filename, modified, f)
+}
+
+// readExport looks up export :id of the requesting user, answering the
+// request itself when it can't.
+func (app *application) readExport(w http.ResponseWriter, r *http.Request) (*data.Export, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	export, err := app.models.Exports.GetForUser(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return export, true
+}
+
+// runExport writes the records matching filter to the file of export, in
+// batches read in id order, saving progress after each. A shutdown stops the
+// export, leaving it interrupted; its user is notified when it ends
+// otherwise. The file of an export that doesn't complete is removed.
+func (app *application) runExport(export *data.Export, filter data.MusicFilter) {
+	logFields := map[string]string{"export_id": strconv.FormatInt(export.ID, 10)}
+	saveProgress := func() {
+		if err := app.models.Exports.UpdateProgress(export); err != nil {
+			app.logger.PrintError(err, logFields)
+		}
+	}
+
+	export.Status = data.JobRunning
+	saveProgress()
+
+	path := app.exportPath(export.ID, export.Format)
+	err := app.writeExport(export, filter, path+".part", saveProgress)
+	if err == nil {
+		err = os.Rename(path+".part", path)
+	}
+
+	now := time.Now()
+	switch {
+	case errors.Is(err, errShutdown):
+		export.Status = data.JobInterrupted
+		export.ExpiresAt = &now
+	case err != nil:
+		app.logger.PrintError(err, logFields)
+		export.Status = data.JobFailed
+		export.Error = err.Error()
+		export.ExpiresAt = &now
+	default:
+		expires := now.Add(app.config.export.ttl)
+		export.Status = data.JobCompleted
+		export.CompletedAt = &now
+		export.ExpiresAt = &expires
+	}
+	if err != nil {
+		os.Remove(path + ".part")
+	}
+	saveProgress()
+
+	if export.Status != data.JobInterrupted {
+		app.notifyUser(export.UserID, "export."+export.Status, fmt.Sprintf(
+			"export %d %s: %d records written", export.ID, export.Status, export.RowsWritten,
+		))
+	}
+}
+
+// errShutdown stops a job when the server shuts down.
+var errShutdown = errors.New("server shutting down")
+
+// writeExport writes the file of export to path, calling saveProgress after
+// every batch, and sets its size once done.
+func (app *application) writeExport(export *data.Export, filter data.MusicFilter, path string, saveProgress func()) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	var write func(*data.Music) error
+	flush := buf.Flush
+	switch export.Format {
+	case "ndjson":
+		enc := json.NewEncoder(buf)
+		write = func(m *data.Music) error { return enc.Encode(m) }
+	default:
+		cw := csv.NewWriter(buf)
+		if err := cw.Write(exportColumns); err != nil {
+			return err
+		}
+		write = func(m *data.Music) error { return cw.Write(musicCSVRecord(m)) }
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return buf.Flush()
+		}
+	}
+
+	var after int64
+	for {
+		select {
+		case <-app.shutdown:
+			return errShutdown
+		default:
+		}
+
+		batch, err := app.models.Musics.GetAfter(filter, after, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, m := range batch {
+			if err := write(m); err != nil {
+				return err
+			}
+		}
+		if len(batch) > 0 {
+			after = batch[len(batch)-1].Id
+			export.RowsWritten += len(batch)
+			saveProgress()
+		}
+		if len(batch) < exportBatchSize {
+			break
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	export.Size = info.Size()
+	return f.Close()
+}
+
+// sweepExports removes the files of expired, failed and interrupted exports
+// every exportSweepInterval, starting straight away so that those left by an
+// earlier process are cleared at startup, until the server shuts down.
+func (app *application) sweepExports() {
+	ticker := time.NewTicker(exportSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		exports, err := app.models.Exports.Sweep()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		for _, export := range exports {
+			path := app.exportPath(export.ID, export.Format)
+			for _, name := range []string{path, path + ".part"} {
+				if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+					app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+				}
+			}
+		}
+		if len(exports) > 0 {
+			app.logger.PrintInfo("swept expired exports", map[string]string{
+				"count": strconv.Itoa(len(exports)),
+			})
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+		}
+	}
+}
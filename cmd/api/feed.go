@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// feedSize is the number of records in the Atom feed.
+	feedSize = 50
+	// feedTTL is how long a rendered feed is served from the cache.
+	feedTTL = time.Minute
+	// maxCachedFeeds caps the distinct genre filters whose feeds are cached.
+	maxCachedFeeds = 100
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Author     *atomPerson    `xml:"author,omitempty"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// feedCache keeps rendered feeds, keyed by their URL, for feedTTL.
+type feedCache struct {
+	mu      sync.Mutex
+	entries map[string]renderedFeed
+}
+
+type renderedFeed struct {
+	body    []byte
+	newest  time.Time
+	expires time.Time
+}
+
+// musicsFeedHandler serves an Atom feed of the most recently added records,
+// optionally limited to those tagged with every genre in ?genres=.
+func (app *application) musicsFeedHandler(w http.ResponseWriter, r *http.Request) {
+	genres := app.readCSV(r.URL.Query(), "genres", []string{})
+	sort.Strings(genres)
+
+	self := app.baseURL(r) + r.URL.Path
+	if len(genres) > 0 {
+		self += "?" + url.Values{"genres": {strings.Join(genres, ",")}}.Encode()
+	}
+
+	feed, err := app.musicsFeed(r, self, genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	tag := fmt.Sprintf(`W/"feed-%d"`, feed.newest.UnixNano())
+	if app.notModified(w, r, tag, feed.newest) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(feed.body)))
+	w.Write(feed.body)
+}
+
+// musicsFeed returns the feed published at self, rendering it unless a
+// fresh copy is cached.
+func (app *application) musicsFeed(r *http.Request, self string, genres []string) (renderedFeed, error) {
+	app.feeds.mu.Lock()
+	defer app.feeds.mu.Unlock()
+
+	if feed, ok := app.feeds.entries[self]; ok && time.Now().Before(feed.expires) {
+		return feed, nil
+	}
+
+	filters := data.Filters{
+		Page:         1,
+		PageSize:     feedSize,
+		Sort:         "-created_at",
+		SortSafeList: []string{"-created_at"},
+		SkipCount:    true,
+	}
+	musics, _, err := app.models.Musics.GetAll(data.MusicFilter{Genres: genres}, filters)
+	if err != nil {
+		return renderedFeed{}, err
+	}
+
+	feed, err := app.renderMusicsFeed(r, self, genres, musics)
+	if err != nil {
+		return renderedFeed{}, err
+	}
+
+	if app.feeds.entries == nil || len(app.feeds.entries) >= maxCachedFeeds {
+		app.feeds.entries = make(map[string]renderedFeed)
+	}
+	app.feeds.entries[self] = feed
+	return feed, nil
+}
+
+// renderMusicsFeed writes musics, newest first, as an Atom document. Entry
+// ids are tag URIs minted from the host and creation date, so they stay the
+// same however often the feed is rendered.
+func (app *application) renderMusicsFeed(r *http.Request, self string, genres []string, musics []*data.Music) (renderedFeed, error) {
+	base := app.baseURL(r)
+	host := strings.TrimPrefix(strings.TrimPrefix(base, "https://"), "http://")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	resourceURL := fmt.Sprintf("%s/v%d/musics", base, app.contextGetAPIVersion(r))
+
+	title := "New musics"
+	if len(genres) > 0 {
+		title += " in " + strings.Join(genres, ", ")
+	}
+
+	feed := atomFeed{
+		ID:     self,
+		Title:  title,
+		Author: atomPerson{Name: "musicdb"},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "application/json", Href: resourceURL + "?sort=-created_at"},
+		},
+	}
+
+	newest := time.Now().UTC().Truncate(time.Second)
+	if len(musics) > 0 {
+		newest = musics[0].CreatedAt.UTC().Truncate(time.Second)
+	}
+	feed.Updated = newest.Format(time.RFC3339)
+
+	for _, m := range musics {
+		created := m.CreatedAt.UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			ID:        fmt.Sprintf("tag:%s,%s:musics/%d", host, m.CreatedAt.UTC().Format("2006-01-02"), m.Id),
+			Title:     m.Title,
+			Updated:   created,
+			Published: created,
+			Links:     []atomLink{{Rel: "alternate", Type: "application/json", Href: fmt.Sprintf("%s/%d", resourceURL, m.Id)}},
+		}
+		if m.Artist != "" {
+			entry.Author = &atomPerson{Name: m.Artist}
+		}
+		for _, genre := range m.Genres {
+			entry.Categories = append(entry.Categories, atomCategory{Term: genre})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return renderedFeed{}, err
+	}
+	buf.WriteByte('\n')
+
+	return renderedFeed{body: buf.Bytes(), newest: newest, expires: time.Now().Add(feedTTL)}, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// atomDocument is an Atom feed as a feed reader decodes it, keeping what the
+// schema requires of a feed and its entries.
+type atomDocument struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Author  []struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Links []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+	Entries []struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Author  []struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+		Categories []struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+	} `xml:"entry"`
+}
+
+var tagURIRX = regexp.MustCompile(`^tag:[a-z0-9.-]+,\d{4}-\d{2}-\d{2}:musics/\d+$`)
+
+// newFeedTestApplication returns an application whose database lists two
+// records created at newest and an hour before, counting the listings run.
+func newFeedTestApplication(t *testing.T, newest time.Time) (*application, *int, *[]driver.Value) {
+	t.Helper()
+
+	app := newTestApplication(t)
+	var queries int
+	var lastArgs []driver.Value
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		queries++
+		lastArgs = args
+		rows := [][]driver.Value{
+			stubListRow(0, stubMusic(map[string]driver.Value{
+				"id": int64(2), "title": "Newer & <louder>", "genres": []byte("{rock,pop}"), "created_at": newest, "updated_at": newest,
+			})),
+			stubListRow(0, stubMusic(map[string]driver.Value{
+				"id": int64(1), "title": "Older", "artist": "", "duration": int64(200), "created_at": newest.Add(-time.Hour), "updated_at": newest,
+			})),
+		}
+		return stubListColumns(), rows, nil
+	})
+	t.Cleanup(func() { db.Close() })
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+	return app, &queries, &lastArgs
+}
+
+func TestMusicsFeed(t *testing.T) {
+	newest := time.Date(2021, 6, 1, 12, 0, 30, 0, time.UTC)
+	app, _, _ := newFeedTestApplication(t, newest)
+
+	rr := serve(app.routes(), httptest.NewRequest(http.MethodGet, "http://example.com/v1/musics/feed.atom", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/atom+xml; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if got := rr.Header().Get("Last-Modified"); got != newest.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q; want %q", got, newest.Format(http.TimeFormat))
+	}
+
+	var feed atomDocument
+	if err := xml.Unmarshal(rr.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	// A feed needs an id, title, updated and, with entries lacking one, an
+	// author; a self link is recommended.
+	if feed.ID != "http://example.com/v1/musics/feed.atom" || feed.Title == "" || len(feed.Author) != 1 || feed.Author[0].Name == "" {
+		t.Errorf("got feed %q %q by %v; want its id, title and author", feed.ID, feed.Title, feed.Author)
+	}
+	if updated, err := time.Parse(time.RFC3339, feed.Updated); err != nil || !updated.Equal(newest) {
+		t.Errorf("got feed updated %q; want %s", feed.Updated, newest.Format(time.RFC3339))
+	}
+	var self string
+	for _, link := range feed.Links {
+		if link.Rel == "self" {
+			self = link.Href
+		}
+	}
+	if self != feed.ID {
+		t.Errorf("got self link %q; want %q", self, feed.ID)
+	}
+
+	if len(feed.Entries) != 2 {
+		t.Fatalf("got %d entries; want 2", len(feed.Entries))
+	}
+	wantIDs := []string{"tag:example.com,2021-06-01:musics/2", "tag:example.com,2021-06-01:musics/1"}
+	wantLinks := []string{"http://example.com/v1/musics/2", "http://example.com/v1/musics/1"}
+	wantGenres := [][]string{{"rock", "pop"}, {"pop"}}
+	for i, entry := range feed.Entries {
+		if !tagURIRX.MatchString(entry.ID) || entry.ID != wantIDs[i] {
+			t.Errorf("entry %d: got id %q; want %q", i, entry.ID, wantIDs[i])
+		}
+		if entry.Title == "" {
+			t.Errorf("entry %d: got no title", i)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry %d: got updated %q: %v", i, entry.Updated, err)
+		}
+		if len(entry.Links) != 1 || entry.Links[0].Rel != "alternate" || entry.Links[0].Href != wantLinks[i] {
+			t.Errorf("entry %d: got links %v; want %s", i, entry.Links, wantLinks[i])
+		}
+		var genres []string
+		for _, category := range entry.Categories {
+			genres = append(genres, category.Term)
+		}
+		if strings.Join(genres, ",") != strings.Join(wantGenres[i], ",") {
+			t.Errorf("entry %d: got categories %v; want %v", i, genres, wantGenres[i])
+		}
+	}
+	if feed.Entries[0].Title != "Newer & <louder>" || len(feed.Entries[0].Author) != 1 || len(feed.Entries[1].Author) != 0 {
+		t.Errorf("got entries %+v", feed.Entries)
+	}
+}
+
+func TestMusicsFeedConditional(t *testing.T) {
+	newest := time.Date(2021, 6, 1, 12, 0, 30, 0, time.UTC)
+	app, _, _ := newFeedTestApplication(t, newest)
+	h := app.routes()
+
+	tests := []struct {
+		name  string
+		since time.Time
+		want  int
+	}{
+		{"at newest", newest, http.StatusNotModified},
+		{"after newest", newest.Add(time.Hour), http.StatusNotModified},
+		{"before newest", newest.Add(-time.Second), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/musics/feed.atom", nil)
+			r.Header.Set("If-Modified-Since", tt.since.Format(http.TimeFormat))
+			if rr := serve(h, r); rr.Code != tt.want {
+				t.Errorf("got status %d; want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMusicsFeedCache(t *testing.T) {
+	app, queries, lastArgs := newFeedTestApplication(t, time.Now())
+	h := app.routes()
+
+	get := func(target string) string {
+		t.Helper()
+		rr := serve(h, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+		}
+		return rr.Body.String()
+	}
+
+	first := get("/v1/musics/feed.atom")
+	if again := get("/v1/musics/feed.atom"); again != first || *queries != 1 {
+		t.Errorf("got %d queries for two requests; want the second served from the cache", *queries)
+	}
+
+	get("/v1/musics/feed.atom?genres=rock,pop")
+	if *queries != 2 {
+		t.Errorf("got %d queries; want a filtered feed to be rendered separately", *queries)
+	}
+	if len(*lastArgs) == 0 || (*lastArgs)[0] != `{"pop","rock"}` {
+		t.Errorf("got query args %v; want the sorted genres first", *lastArgs)
+	}
+	get("/v1/musics/feed.atom?genres=pop,rock")
+	if *queries != 2 {
+		t.Errorf("got %d queries; want genres in any order to share a feed", *queries)
+	}
+
+	// Once the cached copy expires, the feed is rendered again.
+	app.feeds.mu.Lock()
+	for key, feed := range app.feeds.entries {
+		feed.expires = time.Now().Add(-time.Second)
+		app.feeds.entries[key] = feed
+	}
+	app.feeds.mu.Unlock()
+	get("/v1/musics/feed.atom")
+	if *queries != 3 {
+		t.Errorf("got %d queries; want the expired feed rendered again", *queries)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// jsonFields returns the keys a value of the given struct type marshals to,
+// in declaration order.
+func jsonFields(value interface{}) []string {
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// readFields parses a sparse fieldset such as ?fields=title,duration.
+// Requested names must appear in valid; "id" is always added to the result.
+// It returns nil when the parameter is absent, meaning "every field".
+func (app *application) readFields(qs url.Values, key string, valid []string, v *validator.Validator) []string {
+	requested := app.readCSV(qs, key, nil)
+	if requested == nil {
+		return nil
+	}
+
+	fields := []string{"id"}
+	for _, field := range requested {
+		field = strings.TrimSpace(field)
+		if !validator.In(field, valid...) {
+			v.AddError(key, validator.MsgUnknownField, field, strings.Join(valid, ", "))
+			return nil
+		}
+		if field != "id" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// readMusicFields reads the ?fields= parameter of a music request, accepting
+// the field names of the request's API version and returning their v1 names.
+func (app *application) readMusicFields(r *http.Request, v *validator.Validator) []string {
+	version := app.contextGetAPIVersion(r)
+	fields := app.readFields(r.URL.Query(), "fields", musicFields(version, jsonFields(data.Music{})), v)
+	for i := range fields {
+		fields[i] = unversionedField(version, fields[i])
+	}
+	return fields
+}
+
+// selectFields trims value, a struct or a slice of structs, down to the given
+// JSON keys. A nil fields list leaves value untouched.
+func selectFields(value interface{}, fields []string) (interface{}, error) {
+	if fields == nil {
+		return value, nil
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := func(object map[string]json.RawMessage) map[string]json.RawMessage {
+		selected := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if raw, ok := object[field]; ok {
+				selected[field] = raw
+			}
+		}
+		return selected
+	}
+
+	if reflect.Indirect(reflect.ValueOf(value)).Kind() == reflect.Slice {
+		var objects []map[string]json.RawMessage
+		if err := json.Unmarshal(js, &objects); err != nil {
+			return nil, err
+		}
+		selected := make([]map[string]json.RawMessage, len(objects))
+		for i := range objects {
+			selected[i] = keep(objects[i])
+		}
+		return selected, nil
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(js, &object); err != nil {
+		return nil, err
+	}
+	return keep(object), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response formats. Every response can be rendered as JSON, XML, JSON:API or
+// MessagePack;
+// the music listing can also be streamed as CSV or NDJSON, and music changes
+// as server-sent events.
+const (
+	formatJSON        = "json"
+	formatCSV         = "csv"
+	formatNDJSON      = "ndjson"
+	formatXML         = "xml"
+	formatJSONAPI     = "jsonapi"
+	formatEventStream = "event-stream"
+	formatMsgPack     = "msgpack"
+)
+
+// formatMediaTypes maps media types in an Accept header to the formats
+// serving them. A bare wildcard is answered with JSON.
+var formatMediaTypes = map[string]string{
+	"application/json":      formatJSON,
+	"text/csv":              formatCSV,
+	"application/x-ndjson":  formatNDJSON,
+	"application/xml":       formatXML,
+	"text/xml":              formatXML,
+	jsonapiMediaType:        formatJSONAPI,
+	"application/atom+xml":  formatXML,
+	"text/event-stream":     formatEventStream,
+	msgpackMediaType:        formatMsgPack,
+	"application/x-msgpack": formatMsgPack,
+	"*/*":                   formatJSON,
+}
+
+// supportedMediaTypes lists the media types a client may ask for, as shown
+// in 406 responses.
+const supportedMediaTypes = "application/json, application/xml, text/xml, application/vnd.api+json, application/atom+xml, application/msgpack, text/csv, application/x-ndjson, text/event-stream"
+
+// acceptable reports whether the Accept header of r, if there is one, allows
+// at least one media type we can produce. Wildcard subtypes such as text/*
+// match any of our types of that kind.
+func acceptable(r *http.Request) bool {
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return true
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		if _, ok := formatMediaTypes[mediaType]; ok {
+			return true
+		}
+		if strings.HasSuffix(mediaType, "/*") {
+			for known := range formatMediaTypes {
+				if strings.HasPrefix(known, strings.TrimSuffix(mediaType, "*")) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// addVary adds value to the Vary header unless it's already listed.
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// responseFormat picks the format of a response. An explicit
+// ?format= wins; otherwise the Accept media type with the highest q-value
+// that has a known format is used, and JSON when there is none.
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := formatMediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
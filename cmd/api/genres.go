@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"strings"
+)
+
+// listGenresHandler lists the genres in use with the number of records
+// tagged with each, most used first by default.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filter := data.GenreFilter{
+		Prefix:    strings.TrimSpace(app.readString(qs, "q", "")),
+		Normalize: app.readBool(qs, "normalize", false, v),
+	}
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-count"),
+		SortSafeList: []string{"name", "count", "-name", "-count"},
+		MaxOffset:    app.config.pagination.maxOffset,
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	genres, metadata, err := app.models.Genres.GetAll(filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genres": genres, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) renameGenreHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		DryRun bool   `json:"dry_run"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.From = strings.TrimSpace(input.From)
+	input.To = strings.TrimSpace(input.To)
+
+	v := validator.New()
+	v.Check(input.From != "", "from", validator.MsgRequired)
+	v.Check(input.To != "", "to", validator.MsgRequired)
+	v.Check(input.To != input.From, "to", validator.MsgMustDiffer, "from")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var affected, merged int
+	if input.DryRun {
+		affected, merged, err = app.models.Musics.RenameGenre(input.From, input.To, true)
+	} else {
+		err = app.saveMusicChange(func(tx *sql.Tx) error {
+			renamed, n, err := app.models.Musics.RenameGenreTx(tx, input.From, input.To)
+			if err != nil {
+				return err
+			}
+			for _, music := range renamed {
+				if err := app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, music)); err != nil {
+					return err
+				}
+			}
+			affected, merged = len(renamed), n
+			return nil
+		})
+	}
+	if err != nil {
+		app.constraintErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"from":             input.From,
+		"to":               input.To,
+		"dry_run":          input.DryRun,
+		"records_affected": affected,
+		"records_merged":   merged,
+	}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/graphql"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// graphqlMaxDepth caps how deeply a GraphQL operation may nest its
+	// selections.
+	graphqlMaxDepth = 8
+	// graphqlMaxComplexity caps the summed cost of an operation's fields,
+	// where a page of records counts each field once per record.
+	graphqlMaxComplexity = 5000
+)
+
+const graphqlContextKey = contextKey("graphql")
+
+// graphqlRequest is what resolvers need of the request being executed.
+type graphqlRequest struct {
+	r      *http.Request
+	musics *musicLoader
+}
+
+func graphqlRequestFrom(ctx context.Context) *graphqlRequest {
+	return ctx.Value(graphqlContextKey).(*graphqlRequest)
+}
+
+// graphqlHandler runs a GraphQL query or mutation. Errors in the operation
+// are reported in the GraphQL response itself, with a 200 status; only a
+// body that can't be read gets an error response of ours.
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if strings.TrimSpace(input.Query) == "" {
+		app.failedValidationResponse(w, r, map[string]validator.Message{"query": {ID: validator.MsgRequired}})
+		return
+	}
+
+	req := &graphqlRequest{r: r, musics: &musicLoader{models: app.models}}
+	result := graphql.Execute(app.graphql, graphql.Params{
+		Context:       context.WithValue(r.Context(), graphqlContextKey, req),
+		Query:         input.Query,
+		OperationName: input.OperationName,
+		Variables:     input.Variables,
+		MaxDepth:      graphqlMaxDepth,
+		MaxComplexity: graphqlMaxComplexity,
+		Flush:         req.musics.flush,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, result, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphqlSchemaHandler serves the schema in the schema definition language.
+func (app *application) graphqlSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(app.graphql.SDL()))
+}
+
+// musicLoader batches the record lookups of a GraphQL request: the ids
+// queued while a selection is prepared are fetched with a single GetMany
+// when the executor flushes, and every record is fetched once at most.
+type musicLoader struct {
+	models data.Models
+	queued []int64
+	// cache holds nil for ids known to have no record.
+	cache map[int64]*data.Music
+	err   error
+}
+
+func (l *musicLoader) queue(id int64) {
+	if _, ok := l.cache[id]; !ok {
+		l.queued = append(l.queued, id)
+	}
+}
+
+func (l *musicLoader) flush() {
+	if len(l.queued) == 0 {
+		return
+	}
+	ids := l.queued
+	l.queued = nil
+
+	musics, err := l.models.Musics.GetMany(ids)
+	if err != nil {
+		l.err = err
+		return
+	}
+	if l.cache == nil {
+		l.cache = make(map[int64]*data.Music)
+	}
+	for _, id := range ids {
+		l.cache[id] = nil
+	}
+	for _, music := range musics {
+		l.cache[music.Id] = music
+	}
+}
+
+// load returns record id, or nil when there's none, fetching it alone if it
+// wasn't batched.
+func (l *musicLoader) load(id int64) (*data.Music, error) {
+	if music, ok := l.cache[id]; ok {
+		return music, nil
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	music, err := l.models.Musics.Get(id)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+	if l.cache == nil {
+		l.cache = make(map[int64]*data.Music)
+	}
+	l.cache[id] = music
+	return music, nil
+}
+
+// graphqlError is the GraphQL form of our error code, with the message in
+// the request's language.
+func (app *application) graphqlError(r *http.Request, code string, args ...interface{}) *graphql.Error {
+	apiErr := app.newAPIError(r, code, args...)
+	return &graphql.Error{Message: apiErr.Message, Extensions: map[string]interface{}{"code": apiErr.Code}}
+}
+
+func (app *application) graphqlValidationError(r *http.Request, errs map[string]validator.Message) *graphql.Error {
+	gqlErr := app.graphqlError(r, codeValidationFailed)
+	lang := requestLanguage(r)
+	fields := make(map[string]string, len(errs))
+	for key, message := range errs {
+		if name, ok := graphqlArgumentNames[key]; ok {
+			key = name
+		}
+		fields[key] = message.Text(lang)
+	}
+	gqlErr.Extensions["fields"] = fields
+	return gqlErr
+}
+
+// graphqlModelError reports an error from a model method as
+// constraintErrorResponse and its siblings would.
+func (app *application) graphqlModelError(r *http.Request, err error) *graphql.Error {
+	var constraintErr *data.ConstraintError
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return app.graphqlError(r, codeRecordNotFound)
+	case errors.Is(err, data.ErrEditConflict):
+		return app.graphqlError(r, codeEditConflict)
+	case errors.Is(err, data.ErrQueryTimeout):
+		totalQueryTimeouts.Add(1)
+		return app.graphqlError(r, codeQueryTimeout)
+	case errors.As(err, &constraintErr):
+		if mapping, ok := constraintFields[constraintErr.Constraint]; ok {
+			return app.graphqlValidationError(r, map[string]validator.Message{mapping.field: mapping.message})
+		}
+	}
+
+	app.logError(r, err)
+	gqlErr := app.graphqlError(r, codeServerError)
+	gqlErr.Extensions["request_id"] = app.requestID(r)
+	return gqlErr
+}
+
+// graphqlFilterParams maps the fields of the MusicFilter input to the query
+// parameters of the music listing, whose parsing and validation they reuse.
+var graphqlFilterParams = map[string]string{
+	"title":         "title",
+	"searchMode":    "search_mode",
+	"titleExact":    "title_exact",
+	"q":             "q",
+	"genres":        "genres",
+	"genresAny":     "genres_any",
+	"excludeGenres": "exclude_genres",
+	"durationMin":   "duration_min",
+	"durationMax":   "duration_max",
+	"popularityMin": "popularity_min",
+	"popularityMax": "popularity_max",
+	"createdAfter":  "created_after",
+	"createdBefore": "created_before",
+	"filter":        "filter",
+}
+
+// graphqlArgumentNames maps the keys of validation errors back to the
+// GraphQL names of the fields and arguments they are about.
+var graphqlArgumentNames = func() map[string]string {
+	names := map[string]string{"page_size": "pageSize", "musicbrainz_id": "musicbrainzId"}
+	for field, param := range graphqlFilterParams {
+		names[param] = field
+	}
+	return names
+}()
+
+// filterQuery encodes a MusicFilter input as listing query parameters.
+func filterQuery(filter map[string]interface{}) url.Values {
+	qs := url.Values{}
+	for field, value := range filter {
+		var s string
+		switch value := value.(type) {
+		case string:
+			s = value
+		case int:
+			s = strconv.Itoa(value)
+		case float64:
+			s = strconv.FormatFloat(value, 'f', -1, 64)
+		case []interface{}:
+			parts := make([]string, len(value))
+			for i, part := range value {
+				parts[i], _ = part.(string)
+			}
+			s = strings.Join(parts, ",")
+		default:
+			continue
+		}
+		qs.Set(graphqlFilterParams[field], s)
+	}
+	return qs
+}
+
+// graphqlID parses an ID argument. Ids that can't name a record are
+// reported as zero.
+func graphqlID(arg interface{}) int64 {
+	s, _ := arg.(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0
+	}
+	return id
+}
+
+// graphqlStrings converts a coerced [String!] argument.
+func graphqlStrings(arg interface{}) []string {
+	items, _ := arg.([]interface{})
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// pageCost is the cost of a field returning a page of pageSize items.
+func pageCost(args map[string]interface{}, childCost int) int {
+	pageSize, _ := args["pageSize"].(int)
+	if pageSize < 1 {
+		pageSize = 1
+	}
+	return 1 + pageSize*childCost
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newGraphQLSchema builds the schema served at /v1/graphql.
+func (app *application) newGraphQLSchema() *graphql.Schema {
+	nonNull := func(t graphql.Type) graphql.Type { return &graphql.NonNull{Of: t} }
+	listOf := func(t graphql.Type) graphql.Type { return nonNull(&graphql.List{Of: nonNull(t)}) }
+
+	musicField := func(t graphql.Type, fn func(m *data.Music) interface{}) *graphql.Field {
+		return &graphql.Field{Type: t, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return fn(p.Source.(*data.Music)), nil
+		}}
+	}
+	music := &graphql.Object{Name: "Music", Description: "A music record.", Fields: graphql.Fields{
+		"id": musicField(nonNull(graphql.ID), func(m *data.Music) interface{} { return m.Id }),
+		"isrc": musicField(graphql.String, func(m *data.Music) interface{} {
+			if m.ISRC == "" {
+				return nil
+			}
+			return m.ISRC
+		}),
+		"title":      musicField(nonNull(graphql.String), func(m *data.Music) interface{} { return m.Title }),
+		"artist":     musicField(nonNull(graphql.String), func(m *data.Music) interface{} { return m.Artist }),
+		"duration":   musicField(nonNull(graphql.Int), func(m *data.Music) interface{} { return m.Duration }),
+		"popularity": musicField(nonNull(graphql.Float), func(m *data.Music) interface{} { return m.Popularity }),
+		"genres": musicField(listOf(graphql.String), func(m *data.Music) interface{} {
+			if m.Genres == nil {
+				return []string{}
+			}
+			return []string(m.Genres)
+		}),
+		"createdAt": musicField(nonNull(graphql.String), func(m *data.Music) interface{} { return timestamp(m.CreatedAt) }),
+		"updatedAt": musicField(nonNull(graphql.String), func(m *data.Music) interface{} { return timestamp(m.UpdatedAt) }),
+		"version":   musicField(nonNull(graphql.Int), func(m *data.Music) interface{} { return m.Version }),
+		"musicbrainzId": musicField(graphql.String, func(m *data.Music) interface{} {
+			if m.MusicBrainzID == "" {
+				return nil
+			}
+			return m.MusicBrainzID
+		}),
+	}}
+
+	metadataField := func(fn func(m data.Metadata) int) *graphql.Field {
+		return &graphql.Field{Type: nonNull(graphql.Int), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return fn(p.Source.(data.Metadata)), nil
+		}}
+	}
+	metadata := &graphql.Object{Name: "Metadata", Description: "Pagination of a listing.", Fields: graphql.Fields{
+		"currentPage":  metadataField(func(m data.Metadata) int { return m.CurrentPage }),
+		"pageSize":     metadataField(func(m data.Metadata) int { return m.PageSize }),
+		"firstPage":    metadataField(func(m data.Metadata) int { return m.FirstPage }),
+		"lastPage":     metadataField(func(m data.Metadata) int { return m.LastPage }),
+		"totalRecords": metadataField(func(m data.Metadata) int { return m.TotalRecords }),
+	}}
+
+	type musicPage struct {
+		musics   []*data.Music
+		metadata data.Metadata
+	}
+	page := &graphql.Object{Name: "MusicPage", Description: "A page of music records.", Fields: graphql.Fields{
+		"musics": {Type: listOf(music), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*musicPage).musics, nil
+		}},
+		"metadata": {Type: nonNull(metadata), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*musicPage).metadata, nil
+		}},
+	}}
+
+	genre := &graphql.Object{Name: "Genre", Description: "A genre in use, with its record count.", Fields: graphql.Fields{
+		"name": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(data.Genre).Name, nil
+		}},
+		"count": {Type: nonNull(graphql.Int), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(data.Genre).Count, nil
+		}},
+	}}
+
+	savedSearch := &graphql.Object{Name: "SavedSearch", Description: "A music listing query saved by a user.", Fields: graphql.Fields{
+		"id": {Type: nonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.SavedSearch).ID, nil
+		}},
+		"name": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.SavedSearch).Name, nil
+		}},
+		"query": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.SavedSearch).Query, nil
+		}},
+		"createdAt": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return timestamp(p.Source.(*data.SavedSearch).CreatedAt), nil
+		}},
+	}}
+
+	pageArgs := func(sort string, safeList []string) graphql.Args {
+		return graphql.Args{
+			"sort":     {Type: graphql.String, Default: sort, Description: "One of " + strings.Join(safeList, ", ") + "."},
+			"page":     {Type: graphql.Int, Default: 1},
+			"pageSize": {Type: graphql.Int, Default: 20},
+		}
+	}
+	readFilters := func(p graphql.ResolveParams, safeList []string) data.Filters {
+		return data.Filters{
+			Page:         p.Args["page"].(int),
+			PageSize:     p.Args["pageSize"].(int),
+			Sort:         p.Args["sort"].(string),
+			SortSafeList: safeList,
+			MaxOffset:    app.config.pagination.maxOffset,
+		}
+	}
+
+	searchSortSafeList := []string{"id", "name", "created_at", "-id", "-name", "-created_at"}
+	user := &graphql.Object{Name: "User", Description: "The authenticated user.", Fields: graphql.Fields{
+		"id": {Type: nonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.User).ID, nil
+		}},
+		"name": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.User).Name, nil
+		}},
+		"email": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.User).Email, nil
+		}},
+		"activated": {Type: nonNull(graphql.Boolean), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*data.User).Activated, nil
+		}},
+		"createdAt": {Type: nonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return timestamp(p.Source.(*data.User).CreatedAt), nil
+		}},
+		"savedSearches": {
+			Type: listOf(savedSearch),
+			Args: pageArgs("id", searchSortSafeList),
+			Cost: pageCost,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r := graphqlRequestFrom(p.Context).r
+				filters := readFilters(p, searchSortSafeList)
+				v := validator.New()
+				if data.ValidateFilters(v, filters); !v.Valid() {
+					return nil, app.graphqlValidationError(r, v.Errors)
+				}
+				searches, _, err := app.models.SavedSearches.GetAllForUser(p.Source.(*data.User).ID, filters)
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return searches, nil
+			},
+		},
+	}}
+
+	musicFilter := &graphql.InputObject{Name: "MusicFilter", Description: "Selects records as the query parameters of GET /v1/musics do.", Fields: graphql.Args{
+		"title":         {Type: graphql.String},
+		"searchMode":    {Type: graphql.String, Description: "fulltext or fuzzy, for title."},
+		"titleExact":    {Type: graphql.String},
+		"q":             {Type: graphql.String},
+		"genres":        {Type: &graphql.List{Of: nonNull(graphql.String)}},
+		"genresAny":     {Type: &graphql.List{Of: nonNull(graphql.String)}},
+		"excludeGenres": {Type: &graphql.List{Of: nonNull(graphql.String)}},
+		"durationMin":   {Type: graphql.Int},
+		"durationMax":   {Type: graphql.Int},
+		"popularityMin": {Type: graphql.Float},
+		"popularityMax": {Type: graphql.Float},
+		"createdAfter":  {Type: graphql.String, Description: "An RFC 3339 timestamp or YYYY-MM-DD date."},
+		"createdBefore": {Type: graphql.String, Description: "An RFC 3339 timestamp or YYYY-MM-DD date."},
+		"filter":        {Type: graphql.String, Description: "A filter expression."},
+	}}
+
+	query := &graphql.Object{Name: "Query", Fields: graphql.Fields{
+		"music": {
+			Type:        music,
+			Description: "The record with the id, or null.",
+			Args:        graphql.Args{"id": {Type: nonNull(graphql.ID)}},
+			Prepare: func(p graphql.ResolveParams) {
+				if id := graphqlID(p.Args["id"]); id != 0 {
+					graphqlRequestFrom(p.Context).musics.queue(id)
+				}
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				req := graphqlRequestFrom(p.Context)
+				id := graphqlID(p.Args["id"])
+				if id == 0 {
+					return nil, nil
+				}
+				music, err := req.musics.load(id)
+				if err != nil {
+					return nil, app.graphqlModelError(req.r, err)
+				}
+				return music, nil
+			},
+		},
+		"musics": {
+			Type: nonNull(page),
+			Args: func() graphql.Args {
+				args := pageArgs("id", musicSortSafeList)
+				args["filter"] = &graphql.Argument{Type: musicFilter}
+				return args
+			}(),
+			Cost: pageCost,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r := graphqlRequestFrom(p.Context).r
+				v := validator.New()
+				filterArg, _ := p.Args["filter"].(map[string]interface{})
+				filter := app.readMusicFilter(filterQuery(filterArg), v)
+				filters := readFilters(p, musicSortSafeList)
+				filters.MaxPageSize = app.maxPageSize(r)
+				v.Check(filter.Searches() || strings.TrimPrefix(filters.Sort, "-") != "relevance", "sort", validator.MsgRelevanceNeedsTitle)
+				if data.ValidateFilters(v, filters); !v.Valid() {
+					return nil, app.graphqlValidationError(r, v.Errors)
+				}
+
+				musics, metadata, err := app.models.Musics.GetAll(filter, filters)
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return &musicPage{musics: musics, metadata: metadata}, nil
+			},
+		},
+		"genres": {
+			Type: listOf(genre),
+			Args: func() graphql.Args {
+				args := pageArgs("-count", []string{"name", "count", "-name", "-count"})
+				args["prefix"] = &graphql.Argument{Type: graphql.String}
+				return args
+			}(),
+			Cost: pageCost,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r := graphqlRequestFrom(p.Context).r
+				prefix, _ := p.Args["prefix"].(string)
+				filters := readFilters(p, []string{"name", "count", "-name", "-count"})
+				v := validator.New()
+				if data.ValidateFilters(v, filters); !v.Valid() {
+					return nil, app.graphqlValidationError(r, v.Errors)
+				}
+				genres, _, err := app.models.Genres.GetAll(data.GenreFilter{Prefix: strings.TrimSpace(prefix)}, filters)
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return genres, nil
+			},
+		},
+		"me": {
+			Type: nonNull(user),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return app.contextGetUser(graphqlRequestFrom(p.Context).r), nil
+			},
+		},
+	}}
+
+	musicInput := &graphql.InputObject{Name: "MusicInput", Description: "A new music record.", Fields: graphql.Args{
+		"title":      {Type: nonNull(graphql.String)},
+		"artist":     {Type: nonNull(graphql.String)},
+		"duration":   {Type: nonNull(graphql.Int)},
+		"popularity": {Type: graphql.Float, Default: 0},
+		"genres":     {Type: listOf(graphql.String)},
+	}}
+	musicPatch := &graphql.InputObject{Name: "MusicPatch", Description: "Changes to a music record; omitted fields are kept.", Fields: graphql.Args{
+		"title":         {Type: graphql.String},
+		"artist":        {Type: graphql.String},
+		"duration":      {Type: graphql.Int},
+		"popularity":    {Type: graphql.Float},
+		"genres":        {Type: &graphql.List{Of: nonNull(graphql.String)}},
+		"musicbrainzId": {Type: graphql.String, Description: "The MusicBrainz recording to link to; an empty string removes the link."},
+	}}
+
+	// writable loads the request for a mutation, which takes the same
+	// permission as the REST endpoints changing records.
+	writable := func(p graphql.ResolveParams) (*http.Request, error) {
+		r := graphqlRequestFrom(p.Context).r
+		if app.contextGetReadOnly(r) {
+			return nil, app.graphqlError(r, codeReadOnlyToken)
+		}
+		if !app.contextGetPermissions(r).Include("musics:write") {
+			return nil, app.graphqlError(r, codeNotPermitted)
+		}
+		return r, nil
+	}
+	// applyMusicInput copies the given fields of a MusicInput or
+	// MusicPatch into m.
+	applyMusicInput := func(m *data.Music, input map[string]interface{}) {
+		if title, ok := input["title"].(string); ok {
+			m.Title = title
+		}
+		if artist, ok := input["artist"].(string); ok {
+			m.Artist = artist
+		}
+		if duration, ok := input["duration"].(int); ok {
+			m.Duration = int16(duration)
+		}
+		if popularity, ok := input["popularity"].(float64); ok {
+			m.Popularity = float32(popularity)
+		}
+		if genres, ok := input["genres"]; ok && genres != nil {
+			m.Genres = graphqlStrings(genres)
+		}
+		if id, ok := input["musicbrainzId"].(string); ok {
+			m.MusicBrainzID = data.NormalizeMusicBrainzID(id)
+		}
+	}
+
+	mutation := &graphql.Object{Name: "Mutation", Fields: graphql.Fields{
+		"createMusic": {
+			Type: nonNull(music),
+			Args: graphql.Args{"input": {Type: nonNull(musicInput)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r, err := writable(p)
+				if err != nil {
+					return nil, err
+				}
+
+				m := &data.Music{}
+				applyMusicInput(m, p.Args["input"].(map[string]interface{}))
+				v := validator.New()
+				if data.ValidateMovie(v, m); !v.Valid() {
+					return nil, app.graphqlValidationError(r, v.Errors)
+				}
+
+				err = app.saveMusicChange(func(tx *sql.Tx) error {
+					if err := app.models.Musics.InsertTx(tx, m); err != nil {
+						return err
+					}
+					return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicCreated, m))
+				})
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return m, nil
+			},
+		},
+		"updateMusic": {
+			Type:        nonNull(music),
+			Description: "Updates a record. When version is given, the update fails unless the record is still at that version.",
+			Args: graphql.Args{
+				"id":      {Type: nonNull(graphql.ID)},
+				"version": {Type: graphql.Int},
+				"input":   {Type: nonNull(musicPatch)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r, err := writable(p)
+				if err != nil {
+					return nil, err
+				}
+
+				input := p.Args["input"].(map[string]interface{})
+				if len(input) == 0 {
+					return nil, app.graphqlValidationError(r, map[string]validator.Message{
+						"input": {ID: validator.MsgNoUpdatableFields, Args: []interface{}{"title, artist, duration, genres, popularity, musicbrainzId"}},
+					})
+				}
+
+				m, err := app.models.Musics.Get(graphqlID(p.Args["id"]))
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				if version, ok := p.Args["version"].(int); ok && int32(version) != m.Version {
+					return nil, app.graphqlError(r, codeEditConflict)
+				}
+
+				applyMusicInput(m, input)
+				v := validator.New()
+				if m.MusicBrainzID != "" {
+					data.ValidateMusicBrainzID(v, m.MusicBrainzID)
+				}
+				if data.ValidateMovie(v, m); !v.Valid() {
+					return nil, app.graphqlValidationError(r, v.Errors)
+				}
+
+				err = app.saveMusicChange(func(tx *sql.Tx) error {
+					if err := app.models.Musics.UpdateTx(tx, m); err != nil {
+						return err
+					}
+					return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, m))
+				})
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return m, nil
+			},
+		},
+		"deleteMusic": {
+			Type:        nonNull(music),
+			Description: "Deletes a record and returns it as it was.",
+			Args:        graphql.Args{"id": {Type: nonNull(graphql.ID)}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				r, err := writable(p)
+				if err != nil {
+					return nil, err
+				}
+
+				var m *data.Music
+				err = app.saveMusicChange(func(tx *sql.Tx) error {
+					var err error
+					m, err = app.models.Musics.DeleteTx(tx, graphqlID(p.Args["id"]))
+					if err != nil {
+						return err
+					}
+					return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicDeleted, m))
+				})
+				if err != nil {
+					return nil, app.graphqlModelError(r, err)
+				}
+				return m, nil
+			},
+		},
+	}}
+
+	return &graphql.Schema{Query: query, Mutation: mutation}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/graphql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// graphqlResponse is a GraphQL response as the handler writes it.
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// postGraphQL runs query through graphqlHandler as user, with the given
+// permissions and token kind.
+func postGraphQL(t *testing.T, app *application, user *data.User, permissions data.Permissions, readOnly bool, query string) graphqlResponse {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/graphql", strings.NewReader(string(body)))
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, permissions)
+	r = app.contextSetReadOnly(r, readOnly)
+
+	rr := serve(http.HandlerFunc(app.graphqlHandler), r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var resp graphqlResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func newGraphQLTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	app.graphql = app.newGraphQLSchema()
+	db := openMusicStubDB()
+	t.Cleanup(func() { db.Close() })
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+	return app
+}
+
+var graphqlTestUser = &data.User{ID: 7, Name: "Test User", Email: "test@example.com", Activated: true}
+
+func TestGraphQLNestedQuery(t *testing.T) {
+	app := newTestApplication(t)
+	app.graphql = app.newGraphQLSchema()
+
+	// Both music fields are prepared before either is resolved, so they
+	// share one lookup.
+	lookups := 0
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "id = ANY($1)") {
+			lookups++
+		}
+		columns, row := stubMusicRow()
+		return columns, [][]driver.Value{row}, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	resp := postGraphQL(t, app, graphqlTestUser, nil, false, `{
+		me { id name }
+		first: music(id: 1) { title genres }
+		again: music(id: "1") { id artist }
+		missing: music(id: "abc") { id }
+	}`)
+	if len(resp.Errors) > 0 {
+		t.Fatalf("got errors %+v", resp.Errors)
+	}
+
+	want := map[string]string{
+		"me":      `{"id":"7","name":"Test User"}`,
+		"first":   `{"title":"Song","genres":["pop"]}`,
+		"again":   `{"id":"1","artist":"Band"}`,
+		"missing": `null`,
+	}
+	for key, value := range want {
+		if got := string(resp.Data[key]); got != value {
+			t.Errorf("%s = %s; want %s", key, got, value)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("got %d record lookups; want 1", lookups)
+	}
+}
+
+func TestGraphQLMaxDepth(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The API's schema doesn't nest deeply enough to reach the limit, so
+	// the handler runs one that nests without end.
+	node := &graphql.Object{Name: "Node"}
+	node.Fields = graphql.Fields{
+		"child": {Type: node, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return struct{}{}, nil }},
+		"leaf":  {Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return 1, nil }},
+	}
+	app.graphql = &graphql.Schema{Query: &graphql.Object{Name: "Query", Fields: graphql.Fields{
+		"root": {Type: node, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return struct{}{}, nil }},
+	}}}
+
+	nested := func(depth int) string {
+		return "{ root " + strings.Repeat("{ child ", depth-2) + "{ leaf }" + strings.Repeat(" }", depth-2) + " }"
+	}
+
+	resp := postGraphQL(t, app, graphqlTestUser, nil, false, nested(graphqlMaxDepth))
+	if len(resp.Errors) > 0 || resp.Data == nil {
+		t.Errorf("query %d levels deep got errors %+v", graphqlMaxDepth, resp.Errors)
+	}
+
+	resp = postGraphQL(t, app, graphqlTestUser, nil, false, nested(graphqlMaxDepth+1))
+	want := fmt.Sprintf("operation is nested deeper than the %d levels allowed", graphqlMaxDepth)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != want || resp.Data != nil {
+		t.Errorf("got %+v; want only the error %q", resp, want)
+	}
+}
+
+func TestGraphQLMaxComplexity(t *testing.T) {
+	app := newGraphQLTestApplication(t)
+
+	// Each alias costs 1 + 100×(1 + 2) = 301.
+	var b strings.Builder
+	b.WriteString("{")
+	n := graphqlMaxComplexity/301 + 1
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, " p%d: musics(pageSize: 100) { musics { id title } }", i)
+	}
+	b.WriteString(" }")
+
+	resp := postGraphQL(t, app, graphqlTestUser, nil, false, b.String())
+	want := fmt.Sprintf("operation has a complexity of %d, over the limit of %d", n*301, graphqlMaxComplexity)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != want || resp.Data != nil {
+		t.Errorf("got %+v; want only the error %q", resp, want)
+	}
+}
+
+func TestGraphQLMutationPermissions(t *testing.T) {
+	const mutation = `mutation { createMusic(input: {title: "Song", artist: "Band", duration: 180, genres: ["pop"], popularity: 0.5}) { id title } }`
+
+	tests := []struct {
+		name        string
+		permissions data.Permissions
+		readOnly    bool
+		wantCode    string
+	}{
+		{"allowed", data.Permissions{"musics:read", "musics:write"}, false, ""},
+		{"without musics:write", data.Permissions{"musics:read"}, false, codeNotPermitted},
+		{"read-only token", data.Permissions{"musics:read", "musics:write"}, true, codeReadOnlyToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newGraphQLTestApplication(t)
+			resp := postGraphQL(t, app, graphqlTestUser, tt.permissions, tt.readOnly, mutation)
+
+			if tt.wantCode == "" {
+				if len(resp.Errors) > 0 {
+					t.Fatalf("got errors %+v", resp.Errors)
+				}
+				if got, want := string(resp.Data["createMusic"]), `{"id":"1","title":"Song"}`; got != want {
+					t.Errorf("createMusic = %s; want %s", got, want)
+				}
+				return
+			}
+
+			if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != tt.wantCode {
+				t.Fatalf("got errors %+v; want one with code %q", resp.Errors, tt.wantCode)
+			}
+			if path := resp.Errors[0].Path; len(path) != 1 || path[0] != "createMusic" {
+				t.Errorf("got error path %v; want [createMusic]", path)
+			}
+			// createMusic is non-null, so its failure nulls the data.
+			if resp.Data != nil {
+				t.Errorf("got data %v; want null", resp.Data)
+			}
+		})
+	}
+}
@@ -1,30 +1,176 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/msgpack"
 	"github.com/SPA-Final/musicdb/internal/validator"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type envelope map[string]interface{}
 
+var (
+	errInvalidIDParam    = errors.New("invalid id parameter: must be a positive integer")
+	errIDParamOutOfRange = fmt.Errorf("invalid id parameter: must not be greater than %d", int64(math.MaxInt64))
+)
+
+// readIDParam returns the :id route parameter. Failures are reported as
+// errInvalidIDParam or errIDParamOutOfRange, which callers surface as 400s.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(params.ByName("id"), "-") {
+		return 0, errIDParamOutOfRange
+	}
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, errInvalidIDParam
 	}
 	return id, nil
 }
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+func (app *application) readISRCParam(r *http.Request) string {
+	params := httprouter.ParamsFromContext(r.Context())
+	return data.NormalizeISRC(params.ByName("isrc"))
+}
+
+// etag returns the weak entity tag for a record at the given version. It
+// changes whenever the record's version is bumped.
+func etag(id int64, version int32) string {
+	return fmt.Sprintf(`W/"%d-%d"`, id, version)
+}
+
+// etagMatches reports whether header, a comma separated list of entity tags as
+// sent in If-Match or If-None-Match, names tag. Comparison is weak.
+func etagMatches(header, tag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || strings.TrimPrefix(value, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag and, unless lastModified is zero, Last-Modified
+// headers. If the request's conditional headers show the client already has
+// this version, it writes a bodiless 304 and reports true. As in RFC 7232,
+// If-Modified-Since is only consulted when If-None-Match is absent, and an
+// unparseable date is ignored rather than rejected.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, tag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", tag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etagMatches(header, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err == nil && !lastModified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch reports whether the If-Match header of r, if present, names the
+// record identified by id at its current version. Clients may send either the
+// ETag we issued or the bare version number. A request without the header
+// always matches.
+func (app *application) ifMatch(r *http.Request, id int64, version int32) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	if etagMatches(header, etag(id, version)) {
+		return true
+	}
+	for _, value := range strings.Split(header, ",") {
+		if strings.Trim(strings.TrimSpace(value), `"`) == strconv.Itoa(int(version)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unenveloped reports whether the client asked for responses without the
+// envelope, via ?envelope=false or an X-No-Envelope header.
+func unenveloped(r *http.Request) bool {
+	if enveloped, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil && !enveloped {
+		return true
+	}
+	noEnvelope, err := strconv.ParseBool(r.Header.Get("X-No-Envelope"))
+	return err == nil && noEnvelope
+}
+
+// writeEnvelope writes env with writeResponse, unless the client asked for an
+// unenveloped response or is on API v2, which never uses the envelope. In that
+// case only env[key], the primary payload, is written; when env also carries
+// metadata the two are written as an object with top-level items and metadata.
+func (app *application) writeEnvelope(w http.ResponseWriter, r *http.Request, status int, env envelope, key string, headers http.Header) error {
+	w.Header().Add("Vary", "X-No-Envelope")
+
+	if responseFormat(r) == formatJSONAPI {
+		payload, err := app.versionedPayload(r, env[key])
+		if err != nil {
+			return err
+		}
+		env[key] = payload
+		addVary(w.Header(), "Accept")
+		return app.writeJSONAPI(w, r, status, env, key, headers)
+	}
+
+	if app.contextGetAPIVersion(r) == apiV1 && !unenveloped(r) {
+		return app.writeResponse(w, r, status, env, headers)
+	}
+
+	payload, err := app.versionedPayload(r, env[key])
+	if err != nil {
+		return err
+	}
+
+	if metadata, ok := env["metadata"]; ok {
+		return app.writeResponse(w, r, status, envelope{"items": payload, "metadata": metadata}, headers)
+	}
+	return app.writeResponse(w, r, status, payload, headers)
+}
+
+// writeResponse writes data as XML or JSON:API when the client negotiated
+// it, through Accept or ?format=, and as JSON otherwise.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers http.Header) error {
+	addVary(w.Header(), "Accept")
+
+	switch responseFormat(r) {
+	case formatXML:
+		return app.writeXML(w, status, data, headers)
+	case formatJSONAPI:
+		return app.writeJSONAPI(w, r, status, data, "", headers)
+	case formatMsgPack:
+		return app.writeMsgPack(w, status, data, headers)
+	}
+	return app.writeJSON(w, status, data, headers)
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
 	res, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -36,19 +182,67 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
 	w.WriteHeader(status)
 	w.Write(res)
 	return nil
 }
 
-func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+// jsonMode selects how forgiving readJSON is about the shape of a body.
+// Duplicated keys and bodies holding more than one JSON value are rejected in
+// either mode.
+type jsonMode int
+
+const (
+	// jsonLenient ignores unknown keys.
+	jsonLenient jsonMode = iota
+	// jsonStrict rejects unknown keys and bodies nested deeper than
+	// maxJSONDepth.
+	jsonStrict
+)
+
+const maxJSONDepth = 10
+
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}, mode jsonMode) error {
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return err
+	}
+
+	// A MessagePack body is decoded as its JSON equivalent, so it's held to
+	// the same rules.
+	if msgpackRequest(r) {
+		if body, err = msgpack.ToJSON(body); err != nil {
+			return fmt.Errorf("body contains badly-formed MessagePack: %v", strings.TrimPrefix(err.Error(), "msgpack: "))
+		}
+	}
+
+	maxDepth := 0
+	if mode == jsonStrict {
+		maxDepth = maxJSONDepth
+	}
+	if err := checkJSONKeys(body, maxDepth); err != nil {
+		return err
+	}
+
+	if jsonapiRequest(r) {
+		if body, err = jsonapiAttributes(body); err != nil {
+			return err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if mode == jsonStrict {
+		dec.DisallowUnknownFields()
+	}
 
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -69,8 +263,6 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
 		default:
@@ -78,15 +270,101 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 		}
 	}
 
-	// two JSON objects not allowed
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+	// Anything but whitespace after the first value, be it a second document
+	// or trailing garbage, is rejected.
+	if rest := bytes.TrimLeft(body[dec.InputOffset():], " \t\r\n"); len(rest) != 0 {
+		return fmt.Errorf("body must only contain a single JSON value (found more data at character %d)", len(body)-len(rest))
 	}
 
 	return nil
 }
 
+// checkJSONKeys walks the tokens of body and rejects objects that repeat a
+// key, naming the key by its path from the root (e.g. "genres[1].name"). A
+// maxDepth above zero also rejects objects and arrays nested deeper than
+// that. Syntax errors are left for the decoder to report.
+func checkJSONKeys(body []byte, maxDepth int) error {
+	type level struct {
+		path      string
+		object    bool
+		expectKey bool
+		key       string
+		index     int
+		keys      map[string]bool
+	}
+
+	// childPath is the path of the value about to be read at l.
+	childPath := func(l *level) string {
+		switch {
+		case !l.object:
+			return fmt.Sprintf("%s[%d]", l.path, l.index)
+		case l.path == "":
+			return l.key
+		default:
+			return l.path + "." + l.key
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var stack []*level
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		var top *level
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		if t, ok := tok.(string); ok && top != nil && top.object && top.expectKey {
+			// encoding/json matches keys to fields ignoring case, so
+			// "title" and "Title" name the same field.
+			top.key = t
+			folded := strings.ToLower(t)
+			if top.keys[folded] {
+				return fmt.Errorf("body contains duplicate key %q", childPath(top))
+			}
+			top.keys[folded] = true
+			top.expectKey = false
+			continue
+		}
+
+		// The walk ends with the first value; whatever follows it is
+		// rejected by readJSON as more than a single JSON value.
+		if t, ok := tok.(json.Delim); ok && (t == '}' || t == ']') {
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return nil
+			}
+			continue
+		}
+
+		// Anything else is a value: a scalar, or the start of a nested
+		// object or array.
+		path := ""
+		if top != nil {
+			path = childPath(top)
+			if top.object {
+				top.expectKey = true
+			} else {
+				top.index++
+			}
+		}
+
+		if t, ok := tok.(json.Delim); ok {
+			if maxDepth > 0 && len(stack) >= maxDepth {
+				return fmt.Errorf("body must not be nested more than %d levels deep", maxDepth)
+			}
+			stack = append(stack, &level{path: path, object: t == '{', expectKey: t == '{', keys: map[string]bool{}})
+		} else if top == nil {
+			return nil
+		}
+	}
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -103,6 +381,25 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+func (app *application) readIDs(qs url.Values, key string, v *validator.Validator) []int64 {
+	csv := qs.Get(key)
+	if csv == "" {
+		return nil
+	}
+
+	values := strings.Split(csv, ",")
+	ids := make([]int64, 0, len(values))
+	for _, value := range values {
+		id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || id < 1 {
+			v.AddError(key, validator.MsgPositiveIDs, strconv.Quote(value))
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
 	s := qs.Get(key)
 	if s == "" {
@@ -111,12 +408,83 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, validator.MsgInteger)
 		return defaultValue
 	}
 	return i
 }
 
+// readOptionalInt is readInt for parameters without a default: it returns
+// nil when key is absent or malformed.
+func (app *application) readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	if qs.Get(key) == "" {
+		return nil
+	}
+
+	i, err := strconv.Atoi(qs.Get(key))
+	if err != nil {
+		v.AddError(key, validator.MsgInteger)
+		return nil
+	}
+	return &i
+}
+
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		v.AddError(key, validator.MsgNumber)
+		return defaultValue
+	}
+	return f
+}
+
+// readOptionalFloat is readFloat for parameters without a default: it
+// returns nil when key is absent.
+func (app *application) readOptionalFloat(qs url.Values, key string, v *validator.Validator) *float64 {
+	if qs.Get(key) == "" {
+		return nil
+	}
+
+	f := app.readFloat(qs, key, 0, v)
+	return &f
+}
+
+// readTime parses key as an RFC 3339 timestamp or a bare YYYY-MM-DD date,
+// which is taken as midnight UTC. It returns nil when key is absent.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	v.AddError(key, validator.MsgTimestamp)
+	return nil
+}
+
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, validator.MsgBoolean)
+		return defaultValue
+	}
+	return b
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 	go func() {
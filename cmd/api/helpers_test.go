@@ -0,0 +1,231 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadJSON(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name    string
+		mode    jsonMode
+		body    string
+		wantErr string
+	}{
+		{"valid", jsonStrict, `{"title":"Song","genres":["pop"],"meta":{"label":"x"}}`, ""},
+		{"unknown key", jsonStrict, `{"titel":"Song"}`, `body contains unknown key "titel"`},
+		{"unknown key lenient", jsonLenient, `{"titel":"Song"}`, ""},
+		{"too deep", jsonStrict, `{"deep":` + strings.Repeat("[", maxJSONDepth) + strings.Repeat("]", maxJSONDepth) + `}`, "body must not be nested more than"},
+		{"badly-formed", jsonStrict, `{"title":}`, "body contains badly-formed JSON"},
+		{"wrong type", jsonStrict, `{"title":3}`, `body contains incorrect JSON type for field "title"`},
+		{"empty", jsonStrict, ``, "body must not be empty"},
+		{"two values", jsonStrict, `{"title":"a"} {"title":"b"}`, "body must only contain a single JSON value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst struct {
+				Title  string            `json:"title"`
+				Genres []string          `json:"genres"`
+				Meta   map[string]string `json:"meta"`
+				Other  map[string]string `json:"other"`
+				Deep   interface{}       `json:"deep"`
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			err := app.readJSON(httptest.NewRecorder(), r, &dst, tt.mode)
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("got no error; want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.HasPrefix(err.Error(), tt.wantErr):
+				t.Errorf("got error %q; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadJSONDuplicateKeys(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name    string
+		mode    jsonMode
+		body    string
+		wantErr string
+	}{
+		{"distinct keys", jsonStrict, `{"title":"a","meta":{"label":"a"},"items":[{"name":"a"},{"name":"b"}]}`, ""},
+		{"top level", jsonStrict, `{"title":"a","title":"b"}`, `body contains duplicate key "title"`},
+		{"top level lenient", jsonLenient, `{"title":"a","title":"b"}`, `body contains duplicate key "title"`},
+		{"same value", jsonStrict, `{"title":"a","title":"a"}`, `body contains duplicate key "title"`},
+		{"other case", jsonStrict, `{"title":"a","Title":"b"}`, `body contains duplicate key "Title"`},
+		{"nested object", jsonStrict, `{"meta":{"label":"a","LABEL":"b"}}`, `body contains duplicate key "meta.LABEL"`},
+		{"nested twice", jsonStrict, `{"nested":{"meta":{"label":"a","label":"b"}}}`, `body contains duplicate key "nested.meta.label"`},
+		{"same key in sibling objects", jsonStrict, `{"meta":{"label":"a"},"other":{"label":"b"}}`, ""},
+		{"parent key reused in child", jsonStrict, `{"meta":{"meta":"a"}}`, ""},
+		{"object in array", jsonStrict, `{"items":[{"name":"a"},{"name":"b","name":"c"}]}`, `body contains duplicate key "items[1].name"`},
+		{"same key across array items", jsonStrict, `{"items":[{"name":"a"},{"name":"a"}]}`, ""},
+		{"after array", jsonStrict, `{"items":[{"name":"a"}],"items":[]}`, `body contains duplicate key "items"`},
+		{"array of arrays", jsonStrict, `{"grid":[[{"name":"a"}],[{"name":"a","NAME":"b"}]]}`, `body contains duplicate key "grid[1][0].NAME"`},
+		// Keys are only compared within a document; a second document is
+		// rejected for being there at all.
+		{"repeated document", jsonStrict, `{"title":"a"} {"title":"a"}`, "body must only contain a single JSON value"},
+		{"duplicate in second document", jsonStrict, `{"title":"a"} {"meta":{"label":"a","label":"b"}}`, "body must only contain a single JSON value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst struct {
+				Title  string                       `json:"title"`
+				Meta   map[string]string            `json:"meta"`
+				Other  map[string]string            `json:"other"`
+				Nested map[string]map[string]string `json:"nested"`
+				Items  []struct {
+					Name string `json:"name"`
+				} `json:"items"`
+				Grid [][]map[string]string `json:"grid"`
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			err := app.readJSON(httptest.NewRecorder(), r, &dst, tt.mode)
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("got no error; want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.HasPrefix(err.Error(), tt.wantErr):
+				t.Errorf("got error %q; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNotModifiedETag(t *testing.T) {
+	app := newTestApplication(t)
+	tag := etag(1, 2)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{"no header", "", http.StatusOK},
+		{"matching", `W/"1-2"`, http.StatusNotModified},
+		{"matching strong form", `"1-2"`, http.StatusNotModified},
+		{"earlier version", `W/"1-1"`, http.StatusOK},
+		{"other record", `W/"2-2"`, http.StatusOK},
+		{"list containing it", `W/"1-1", W/"1-2"`, http.StatusNotModified},
+		{"list without it", `W/"1-1",W/"2-2"`, http.StatusOK},
+		{"any", "*", http.StatusNotModified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !app.notModified(w, r, tag, time.Time{}) {
+					w.Write([]byte("body"))
+				}
+			})
+			r := httptest.NewRequest(http.MethodGet, "/v1/musics/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			rr := serve(h, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.want)
+			}
+			if got := rr.Header().Get("ETag"); got != tag {
+				t.Errorf("got ETag %q; want %q", got, tag)
+			}
+			if tt.want == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("got body %q on a 304", rr.Body)
+			}
+		})
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	app := newTestApplication(t)
+	modified := time.Date(2021, 6, 1, 12, 0, 30, 500_000_000, time.UTC)
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		ifNoneMatch     string
+		want            int
+	}{
+		{"no header", "", "", http.StatusOK},
+		{"same second", "Tue, 01 Jun 2021 12:00:30 GMT", "", http.StatusNotModified},
+		{"later", "Tue, 01 Jun 2021 12:00:31 GMT", "", http.StatusNotModified},
+		{"second before", "Tue, 01 Jun 2021 12:00:29 GMT", "", http.StatusOK},
+		{"malformed", "yesterday", "", http.StatusOK},
+		{"empty date", " ", "", http.StatusOK},
+		{"If-None-Match takes precedence", "Tue, 01 Jun 2021 12:00:31 GMT", `W/"1-1"`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !app.notModified(w, r, etag(1, 2), modified) {
+					w.Write([]byte("body"))
+				}
+			})
+			r := httptest.NewRequest(http.MethodGet, "/v1/musics/1", nil)
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			rr := serve(h, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.want)
+			}
+			if got, want := rr.Header().Get("Last-Modified"), "Tue, 01 Jun 2021 12:00:30 GMT"; got != want {
+				t.Errorf("got Last-Modified %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadIDParam(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name    string
+		id      string
+		want    int64
+		wantErr error
+	}{
+		{"valid", "42", 42, nil},
+		{"largest", "9223372036854775807", math.MaxInt64, nil},
+		{"non-numeric", "abc", 0, errInvalidIDParam},
+		{"empty", "", 0, errInvalidIDParam},
+		{"zero", "0", 0, errInvalidIDParam},
+		{"negative", "-3", 0, errInvalidIDParam},
+		{"overflow", "9223372036854775808", 0, errIDParamOutOfRange},
+		{"negative overflow", "-9223372036854775809", 0, errInvalidIDParam},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withIDParam(httptest.NewRequest(http.MethodGet, "/", nil), tt.id)
+			id, err := app.readIDParam(r)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if id != tt.want {
+				t.Errorf("got id %d; want %d", id, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// idempotencyRecorder forwards a response to the client while keeping a copy
+// of it, so that it can be stored against the request's Idempotency-Key.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes next safe to retry when the client sends an
+// Idempotency-Key header. The first request with a key runs normally and its
+// response is stored; replays with the same key and body get the stored
+// response back. It must run after authentication, as keys are scoped per user.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		v.Check(len(key) <= 255, "idempotency_key", validator.MsgMaxBytes, 255)
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1_048_576+1))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		record := &data.IdempotencyRecord{
+			Key:         key,
+			UserID:      app.contextGetUser(r).ID,
+			RequestHash: hash[:],
+			Expiry:      time.Now().Add(data.IdempotencyKeyTTL),
+		}
+
+		claimed, err := app.models.Idempotency.Insert(record)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !claimed {
+			app.replayIdempotentResponse(w, r, record)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				app.models.Idempotency.Delete(record.Key, record.UserID)
+				panic(err)
+			}
+
+			if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				err := app.models.Idempotency.Delete(record.Key, record.UserID)
+				if err != nil {
+					app.logError(r, err)
+				}
+				return
+			}
+
+			record.Status = rec.status
+			record.Headers = map[string][]string{}
+			for _, name := range []string{"Content-Type", "Location"} {
+				if values := rec.Header().Values(name); len(values) > 0 {
+					record.Headers[name] = values
+				}
+			}
+			record.Body = rec.body.Bytes()
+
+			err := app.models.Idempotency.Complete(record)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	}
+}
+
+func (app *application) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, record *data.IdempotencyRecord) {
+	stored, err := app.models.Idempotency.Get(record.Key, record.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.idempotencyKeyInProgressResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !bytes.Equal(stored.RequestHash, record.RequestHash) {
+		app.idempotencyKeyReusedResponse(w, r)
+		return
+	}
+
+	if stored.Status == 0 {
+		app.idempotencyKeyInProgressResponse(w, r)
+		return
+	}
+
+	for name, values := range stored.Headers {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Content-Length", strconv.Itoa(len(stored.Body)))
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// purgeExpiredIdempotencyKeys deletes the expired idempotency keys every
+// hour until the server shuts down.
+func (app *application) purgeExpiredIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		n, err := app.models.Idempotency.PurgeExpired()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+		app.logger.PrintInfo("purged expired idempotency keys", map[string]string{
+			"count": strconv.FormatInt(n, 10),
+		})
+	}
+}
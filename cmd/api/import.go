@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// importBatchSize is the number of records saved per transaction.
+	importBatchSize = 500
+	// maxImportErrors caps the rejected rows listed in an import summary;
+	// the count of rejected rows stays exact.
+	maxImportErrors = 100
+)
+
+// importColumns are the CSV columns an import understands. title, duration,
+// genres and popularity are required.
+var importColumns = []string{"title", "artist", "duration", "genres", "popularity"}
+
+// importRowError reports why a CSV row was rejected. Line counts from 1 at
+// the header row, so it is the file line unless an earlier quoted field
+// spans several lines.
+type importRowError struct {
+	Line   int               `json:"line"`
+	Fields map[string]string `json:"fields"`
+}
+
+// importMusicsHandler creates records from a text/csv body with a header row
+// naming importColumns. Genres are separated by ";". Rows failing validation
+// are reported and skipped; the others are saved in batches, or only
+// validated when dry_run=true. Batches are committed as they fill, so when
+// the import fails partway the error response also gives "imported", the
+// records already saved, and "line", the first line that wasn't, which a
+// retry can start from.
+func (app *application) importMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" {
+		app.unsupportedMediaTypeResponse(w, r, "text/csv")
+		return
+	}
+
+	maxBytes := app.config.imports.maxBytes
+	if r.ContentLength > maxBytes {
+		app.bodyTooLargeResponse(w, r, maxBytes)
+		return
+	}
+
+	v := validator.New()
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The BOM some spreadsheet programs write would otherwise end up in the
+	// first column name.
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBytes))
+	if bom, err := body.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		body.Discard(3)
+	}
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		app.csvErrorResponse(w, r, err, maxBytes)
+		return
+	}
+	columns, err := importHeader(header)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	lang := requestLanguage(r)
+	imported, rejected := 0, 0
+	rowErrors := []importRowError{}
+	var batch []*data.Music
+	// unsaved is the first line not covered by a committed batch.
+	unsaved := 2
+
+	save := func(next int) error {
+		if dryRun || len(batch) == 0 {
+			return nil
+		}
+		err := app.saveMusicChange(func(tx *sql.Tx) error {
+			if err := app.models.Musics.InsertBatchTx(tx, batch); err != nil {
+				return err
+			}
+			for _, music := range batch {
+				if err := app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicCreated, music)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		unsaved = next
+		return nil
+	}
+	// progress lets the client know what a failure left saved.
+	progress := func(r *http.Request) *http.Request {
+		if dryRun || imported == 0 {
+			return r
+		}
+		return app.contextSetErrorMembers(r, envelope{"imported": imported, "line": unsaved})
+	}
+
+	line := 2
+	for ; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			app.csvErrorResponse(w, progress(r), err, maxBytes)
+			return
+		}
+
+		music, v := importRecord(record, columns)
+		if !v.Valid() {
+			rejected++
+			if len(rowErrors) < maxImportErrors {
+				fields := make(map[string]string, len(v.Errors))
+				for key, message := range v.Errors {
+					fields[key] = message.Text(lang)
+				}
+				rowErrors = append(rowErrors, importRowError{Line: line, Fields: fields})
+			}
+			continue
+		}
+
+		if dryRun {
+			imported++
+			continue
+		}
+		batch = append(batch, music)
+		if len(batch) == importBatchSize {
+			if err := save(line + 1); err != nil {
+				app.constraintErrorResponse(w, progress(r), err)
+				return
+			}
+		}
+	}
+	if err := save(line); err != nil {
+		app.constraintErrorResponse(w, progress(r), err)
+		return
+	}
+
+	env := envelope{
+		"dry_run":  dryRun,
+		"imported": imported,
+		"rejected": rejected,
+		"errors":   rowErrors,
+	}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importHeader maps each of importColumns present in header to its index.
+func importHeader(header []string) (map[string]int, error) {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !validator.In(name, importColumns...) {
+			return nil, fmt.Errorf("unknown CSV column %q, expected %s", name, strings.Join(importColumns, ", "))
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("duplicate CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"title", "duration", "genres", "popularity"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing CSV column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// importRecord builds a music from a CSV record and validates it.
+func importRecord(record []string, columns map[string]int) (*data.Music, *validator.Validator) {
+	v := validator.New()
+	field := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	music := &data.Music{
+		Title:  field("title"),
+		Artist: field("artist"),
+	}
+
+	if s := field("duration"); s != "" {
+		duration, err := strconv.ParseInt(s, 10, 16)
+		v.Check(err == nil, "duration", validator.MsgInteger)
+		music.Duration = int16(duration)
+	}
+	if s := field("popularity"); s != "" {
+		popularity, err := strconv.ParseFloat(s, 32)
+		v.Check(err == nil, "popularity", validator.MsgNumber)
+		music.Popularity = float32(popularity)
+	}
+	if s := field("genres"); s != "" {
+		for _, genre := range strings.Split(s, ";") {
+			music.Genres = append(music.Genres, strings.TrimSpace(genre))
+		}
+	}
+
+	data.ValidateMovie(v, music)
+	return music, v
+}
+
+// csvErrorResponse reports a failure reading the CSV body: 413 when it was
+// cut off at maxBytes, 400 for malformed CSV or gzip data.
+func (app *application) csvErrorResponse(w http.ResponseWriter, r *http.Request, err error, maxBytes int64) {
+	var parseErr *csv.ParseError
+	var encodingErr *bodyEncodingError
+	switch {
+	case errors.Is(err, io.EOF):
+		app.badRequestResponse(w, r, errors.New("body must not be empty"))
+	case err.Error() == "http: request body too large":
+		app.bodyTooLargeResponse(w, r, maxBytes)
+	case errors.As(err, &parseErr):
+		app.badRequestResponse(w, r, fmt.Errorf("malformed CSV: %w", parseErr))
+	case errors.As(err, &encodingErr):
+		app.badRequestResponse(w, r, err)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// importCSV returns a CSV body of n valid rows followed by tail.
+func importCSV(n int, tail string) string {
+	var b strings.Builder
+	b.WriteString("title,duration,genres,popularity\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "Song %d,180,pop;rock,0.5\n", i)
+	}
+	b.WriteString(tail)
+	return b.String()
+}
+
+func postImport(t *testing.T, app *application, query, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/musics/import"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/csv")
+	rr := serve(http.HandlerFunc(app.importMusicsHandler), r)
+
+	var env map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, env
+}
+
+func TestImportDryRun(t *testing.T) {
+	app := newTestApplication(t)
+
+	code, env := postImport(t, app, "?dry_run=true", importCSV(3, ",180,pop,0.5\n"))
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", code, http.StatusOK)
+	}
+	if env["imported"] != 3.0 || env["rejected"] != 1.0 {
+		t.Errorf("got imported %v, rejected %v; want 3, 1", env["imported"], env["rejected"])
+	}
+}
+
+func TestImportMalformedBeforeSaving(t *testing.T) {
+	app := newTestApplication(t)
+
+	code, env := postImport(t, app, "?dry_run=true", importCSV(3, "\"unterminated,180,pop,0.5\n"))
+	if code != http.StatusBadRequest {
+		t.Fatalf("got status %d; want %d", code, http.StatusBadRequest)
+	}
+	if _, ok := env["imported"]; ok {
+		t.Error("nothing was saved, but the response reports imported records")
+	}
+}
+
+func TestImportFailurePartway(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	// The first batch is committed before the malformed row is read.
+	code, env := postImport(t, app, "", importCSV(importBatchSize+10, "\"unterminated,180,pop,0.5\n"))
+	if code != http.StatusBadRequest {
+		t.Fatalf("got status %d; want %d", code, http.StatusBadRequest)
+	}
+	if env["imported"] != float64(importBatchSize) {
+		t.Errorf("got imported %v; want %d", env["imported"], importBatchSize)
+	}
+	if want := float64(importBatchSize + 2); env["line"] != want {
+		t.Errorf("got line %v; want %v", env["line"], want)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// importPath is where the uploaded file of import id is spooled until the
+// import finishes.
+func (app *application) importPath(id int64) string {
+	return filepath.Join(app.config.imports.spoolDir, fmt.Sprintf("import-%d.csv", id))
+}
+
+// createImportHandler spools a text/csv body like the one POST
+// /musics/import takes and answers 202 with an import, whose progress is at
+// its Location. A background worker imports the rows; only the header is
+// checked before answering.
+func (app *application) createImportHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" {
+		app.unsupportedMediaTypeResponse(w, r, "text/csv")
+		return
+	}
+
+	maxBytes := app.config.imports.jobMaxBytes
+	if r.ContentLength > maxBytes {
+		app.bodyTooLargeResponse(w, r, maxBytes)
+		return
+	}
+
+	spool, err := os.CreateTemp(app.config.imports.spoolDir, "upload-*.csv")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer spool.Close()
+	// Until the import is saved the upload is removed on the way out;
+	// renaming it clears spooled.
+	spooled := spool.Name()
+	defer func() {
+		if spooled != "" {
+			os.Remove(spooled)
+		}
+	}()
+
+	size, err := io.Copy(spool, http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		app.csvErrorResponse(w, r, err, maxBytes)
+		return
+	}
+	if err := spool.Close(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	reader, f, err := openImportFile(spooled)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	header, err := reader.Read()
+	f.Close()
+	if err != nil {
+		app.csvErrorResponse(w, r, err, maxBytes)
+		return
+	}
+	if _, err := importHeader(header); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	job := &data.Import{
+		Size:     size,
+		Language: requestLanguage(r),
+		UserID:   app.contextGetUser(r).ID,
+	}
+	if err := app.models.Imports.Insert(job); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := os.Rename(spooled, app.importPath(job.ID)); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	spooled = ""
+
+	app.background(func() {
+		app.runImport(job)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/imports/%d", job.ID))
+
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"import": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showImportHandler reports the progress of an import, with a page of the
+// rows it rejected so far.
+func (app *application) showImportHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.readImport(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "line",
+		SortSafeList: []string{"line"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rowErrors, metadata, err := app.models.Imports.GetErrors(job.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"import": job, "errors": rowErrors, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelImportHandler cancels an import that hasn't finished. A running
+// import stops at its next checkpoint, keeping the rows saved until then.
+func (app *application) cancelImportHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := app.readImport(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Imports.Cancel(job)
+	if errors.Is(err, data.ErrEditConflict) {
+		// The import finished in the meantime.
+		job, err = app.models.Imports.GetForUser(job.ID, job.UserID)
+		if err == nil {
+			app.importFinishedResponse(w, r, job.Status)
+			return
+		}
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"import": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readImport looks up import :id of the requesting user, answering the
+// request itself when it can't.
+func (app *application) readImport(w http.ResponseWriter, r *http.Request) (*data.Import, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	job, err := app.models.Imports.GetForUser(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+// openImportFile opens the CSV file at path, past the BOM some spreadsheet
+// programs write. The caller closes the returned file.
+func openImportFile(path string) (*csv.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := bufio.NewReader(f)
+	if bom, err := body.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		body.Discard(3)
+	}
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return reader, f, nil
+}
+
+// runImport runs job to the end, unless the server shuts down first: the
+// import is then left running, and resumed from its checkpoint at the next
+// startup. Its spooled file is removed once it has finished or been
+// cancelled, and its user is notified when it finishes.
+func (app *application) runImport(job *data.Import) {
+	logFields := map[string]string{"import_id": strconv.FormatInt(job.ID, 10)}
+	path := app.importPath(job.ID)
+
+	err := app.models.Imports.Start(job)
+	switch {
+	case errors.Is(err, data.ErrJobCancelled):
+		os.Remove(path)
+		return
+	case err != nil:
+		// The import stays pending, to be started at the next startup.
+		app.logger.PrintError(err, logFields)
+		return
+	}
+
+	err = app.importFile(job, path)
+	switch {
+	case errors.Is(err, errShutdown):
+		return
+	case errors.Is(err, data.ErrJobCancelled):
+		os.Remove(path)
+		return
+	case err != nil:
+		app.logger.PrintError(err, logFields)
+		job.Status = data.JobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = data.JobCompleted
+	}
+
+	err = app.models.Imports.Finish(job)
+	switch {
+	case errors.Is(err, data.ErrJobCancelled):
+		os.Remove(path)
+		return
+	case err != nil:
+		// The import stays running, to be retried from its checkpoint.
+		app.logger.PrintError(err, logFields)
+		return
+	}
+	os.Remove(path)
+
+	app.notifyUser(job.UserID, "import."+job.Status, fmt.Sprintf(
+		"import %d %s: %d of %d rows imported, %d rejected", job.ID, job.Status, job.Imported, job.Total, job.Rejected,
+	))
+}
+
+// importFile imports the rows of the file at path after job's checkpoint.
+// The rows are saved in batches of importBatchSize, each in a transaction
+// with its rejected rows, the outbox events of the records it creates and the
+// checkpoint after it, so rows are neither lost nor imported twice when the
+// import is resumed. The server shutting
+// down stops the import after a batch with errShutdown.
+func (app *application) importFile(job *data.Import, path string) error {
+	if job.Total == 0 {
+		total, err := countImportRows(path)
+		if err != nil {
+			return err
+		}
+		job.Total = total
+	}
+
+	reader, f, err := openImportFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return importReadError(err)
+	}
+	columns, err := importHeader(header)
+	if err != nil {
+		return err
+	}
+
+	var batch []*data.Music
+	var rejected []data.ImportError
+	checkpoint := func() error {
+		err := app.saveMusicChange(func(tx *sql.Tx) error {
+			if len(batch) > 0 {
+				if err := app.models.Musics.InsertBatchTx(tx, batch); err != nil {
+					return err
+				}
+			}
+			for _, music := range batch {
+				if err := app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicCreated, music)); err != nil {
+					return err
+				}
+			}
+			return app.models.Imports.CheckpointTx(tx, job, rejected)
+		})
+		batch, rejected = batch[:0], rejected[:0]
+		return err
+	}
+
+	pending := 0
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The rows read so far are kept, as they would have been by
+			// the synchronous import.
+			if err := checkpoint(); err != nil {
+				return err
+			}
+			return importReadError(err)
+		}
+		if line <= job.LastLine {
+			continue
+		}
+
+		music, v := importRecord(record, columns)
+		if v.Valid() {
+			batch = append(batch, music)
+			job.Imported++
+		} else {
+			fields := make(map[string]string, len(v.Errors))
+			for key, message := range v.Errors {
+				fields[key] = message.Text(job.Language)
+			}
+			rejected = append(rejected, data.ImportError{Line: line, Fields: fields})
+			job.Rejected++
+		}
+		job.Processed++
+		job.LastLine = line
+
+		pending++
+		if pending < importBatchSize {
+			continue
+		}
+		pending = 0
+		if err := checkpoint(); err != nil {
+			return err
+		}
+
+		select {
+		case <-app.shutdown:
+			return errShutdown
+		default:
+		}
+	}
+	return checkpoint()
+}
+
+// countImportRows counts the rows of the CSV file at path, not counting the
+// header.
+func countImportRows(path string) (int, error) {
+	reader, f, err := openImportFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rows := -1
+	for {
+		_, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, importReadError(err)
+		}
+		rows++
+	}
+	if rows < 0 {
+		rows = 0
+	}
+	return rows, nil
+}
+
+// importReadError describes a failure reading an import's file, for its
+// error field.
+func importReadError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("malformed CSV: %w", parseErr)
+	}
+	return err
+}
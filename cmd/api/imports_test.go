@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestImportResumesFromCheckpoint has a worker pick up an import whose
+// first three rows were checkpointed by a worker that then died, and checks
+// that it carries on from the next row without saving any row twice.
+func TestImportResumesFromCheckpoint(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.imports.spoolDir = t.TempDir()
+	user := insertTestUser(t, app, "importer@example.com")
+
+	fixture, err := os.ReadFile("testdata/import_resume.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &data.Import{UserID: user.ID, Size: int64(len(fixture)), Language: "en"}
+	if err := app.models.Imports.Insert(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(app.importPath(job.ID), fixture, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	// The earlier worker saved lines 2 to 4 with their checkpoint.
+	if err := app.models.Imports.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	saved := []*data.Music{
+		{Title: "First", Duration: 180, Genres: []string{"pop"}, Popularity: 0.5},
+		{Title: "Second", Duration: 200, Genres: []string{"rock"}, Popularity: 0.4},
+		{Title: "Third", Duration: 210, Genres: []string{"jazz", "blues"}, Popularity: 0.3},
+	}
+	job.Total, job.Processed, job.Imported, job.LastLine = 6, 3, 3, 4
+	err = app.models.Transact(func(tx *sql.Tx) error {
+		if err := app.models.Musics.InsertBatchTx(tx, saved); err != nil {
+			return err
+		}
+		return app.models.Imports.CheckpointTx(tx, job, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := app.models.Imports.GetUnfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].LastLine != 4 {
+		t.Fatalf("got unfinished imports %+v; want import %d at line 4", jobs, job.ID)
+	}
+	app.runImport(jobs[0])
+
+	job, err = app.models.Imports.GetForUser(job.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != data.JobCompleted || job.Processed != 6 || job.Imported != 5 || job.Rejected != 1 {
+		t.Errorf("got import %s, %d processed, %d imported, %d rejected; want %s, 6, 5, 1",
+			job.Status, job.Processed, job.Imported, job.Rejected, data.JobCompleted)
+	}
+
+	musics, _, err := app.models.Musics.GetAll(data.MusicFilter{}, data.Filters{
+		Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, m := range musics {
+		titles = append(titles, m.Title)
+	}
+	if want := []string{"First", "Second", "Third", "Fifth", "Sixth"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("got records %q; want %q", titles, want)
+	}
+
+	rowErrors, _, err := app.models.Imports.GetErrors(job.ID, data.Filters{Page: 1, PageSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowErrors) != 1 || rowErrors[0].Line != 5 {
+		t.Errorf("got row errors %+v; want one for line 5", rowErrors)
+	}
+
+	// Only the rows the resumed worker saved have events in the outbox.
+	var created []int64
+	_, err = app.models.Outbox.Dispatch(outboxBatchSize, func(batch []*data.OutboxEvent) error {
+		for _, e := range batch {
+			if e.Event != data.EventMusicCreated {
+				t.Errorf("got a %q event; want %q", e.Event, data.EventMusicCreated)
+			}
+			created = append(created, e.MusicID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(musics) == 5 {
+		if want := []int64{musics[3].Id, musics[4].Id}; !reflect.DeepEqual(created, want) {
+			t.Errorf("got created events for %v; want %v", created, want)
+		}
+	}
+
+	if _, err := os.Stat(app.importPath(job.ID)); !os.IsNotExist(err) {
+		t.Errorf("spooled file still there after the import finished: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonapiMediaType is the JSON:API media type, which clients opt in to
+// through Accept and, for bodies, Content-Type.
+const jsonapiMediaType = "application/vnd.api+json"
+
+// jsonapiTypes maps the envelope keys that hold resources to their JSON:API
+// resource types. Payloads under any other key go into the document's meta.
+var jsonapiTypes = map[string]string{
+	"music":          "musics",
+	"musics":         "musics",
+	"user":           "users",
+	"saved_search":   "saved_searches",
+	"saved_searches": "saved_searches",
+}
+
+// writeJSONAPI writes data, an envelope, as a JSON:API document. The
+// resource under key, or when key is empty the first key of jsonapiTypes
+// present, becomes the primary data; the envelope's metadata and any other
+// non-resource values become meta. An error envelope becomes an errors
+// document.
+func (app *application) writeJSONAPI(w http.ResponseWriter, r *http.Request, status int, data interface{}, key string, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	var env map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(&env); err != nil {
+		return errors.New("writeJSONAPI: data must be an object")
+	}
+
+	doc := map[string]interface{}{}
+	if apiErr, ok := env["error"].(map[string]interface{}); ok && len(env) == 1 {
+		doc["errors"] = jsonapiErrors(r, status, apiErr)
+	} else {
+		if key == "" {
+			keys := make([]string, 0, len(jsonapiTypes))
+			for k := range jsonapiTypes {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if _, ok := env[k]; ok {
+					key = k
+					break
+				}
+			}
+		}
+
+		meta := map[string]interface{}{}
+		for k, v := range env {
+			if metadata, ok := v.(map[string]interface{}); ok && k == "metadata" {
+				for mk, mv := range metadata {
+					meta[mk] = mv
+				}
+				continue
+			}
+			if _, ok := jsonapiTypes[k]; !ok && k != key {
+				meta[k] = v
+			}
+		}
+
+		if key != "" {
+			resourceType, ok := jsonapiTypes[key]
+			if !ok {
+				resourceType = key
+			}
+			doc["data"] = jsonapiResources(resourceType, env[key])
+		}
+		if len(meta) > 0 || key == "" {
+			doc["meta"] = meta
+		}
+	}
+
+	res, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	res = append(res, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", jsonapiMediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+	w.WriteHeader(status)
+	w.Write(res)
+	return nil
+}
+
+// jsonapiResources turns a record, or a list of them, into resource objects
+// of the given type: the id moves to the top level, as a string, and every
+// other member goes under attributes.
+func jsonapiResources(resourceType string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		resources := make([]interface{}, len(value))
+		for i, v := range value {
+			resources[i] = jsonapiResources(resourceType, v)
+		}
+		return resources
+	case map[string]interface{}:
+		resource := map[string]interface{}{"type": resourceType}
+		attributes := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			if k == "id" {
+				resource["id"] = fmt.Sprint(v)
+				continue
+			}
+			attributes[k] = v
+		}
+		resource["attributes"] = attributes
+		return resource
+	}
+	return value
+}
+
+// jsonapiErrors turns an apiError, decoded from JSON, into JSON:API error
+// objects: one per failed field, each with a source naming the field, or a
+// single one when the error isn't about fields.
+func jsonapiErrors(r *http.Request, status int, apiErr map[string]interface{}) []map[string]interface{} {
+	newError := func() map[string]interface{} {
+		e := map[string]interface{}{
+			"status": strconv.Itoa(status),
+			"code":   apiErr["code"],
+			"title":  apiErr["message"],
+		}
+		if id, ok := apiErr["request_id"]; ok {
+			e["id"] = id
+		}
+		if debug, ok := apiErr["debug"]; ok {
+			e["meta"] = map[string]interface{}{"debug": debug}
+		}
+		return e
+	}
+
+	fields, _ := apiErr["fields"].(map[string]interface{})
+	if len(fields) == 0 {
+		return []map[string]interface{}{newError()}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	errs := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		e := newError()
+		e["detail"] = fields[k]
+		e["source"] = jsonapiSource(r, k)
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+var jsonapiIndexRX = regexp.MustCompile(`\[(\d+)\]`)
+
+// jsonapiSource names the part of the request a validator field key refers
+// to. On requests without a body the keys are query parameters; otherwise
+// they're attributes of the body, with "genres[1]" style paths turned into
+// JSON pointers.
+func jsonapiSource(r *http.Request, field string) map[string]string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return map[string]string{"parameter": field}
+	}
+	if field == "id" {
+		return map[string]string{"pointer": "/data/id"}
+	}
+
+	path := jsonapiIndexRX.ReplaceAllString(field, "/$1")
+	path = strings.ReplaceAll(path, ".", "/")
+	return map[string]string{"pointer": "/data/attributes/" + path}
+}
+
+// jsonapiRequest reports whether the body of r is a JSON:API document.
+func jsonapiRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == jsonapiMediaType
+}
+
+// jsonapiAttributes unwraps a JSON:API request document to the attributes of
+// its primary data, which handlers decode as they would a plain JSON body. A
+// data array becomes an array of attribute objects.
+func jsonapiAttributes(body []byte) ([]byte, error) {
+	var doc struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body, nil
+	}
+	if len(doc.Data) == 0 || string(doc.Data) == "null" {
+		return nil, errors.New("body must contain a JSON:API data member")
+	}
+
+	type resource struct {
+		Type       string          `json:"type"`
+		Attributes json.RawMessage `json:"attributes"`
+	}
+	attributes := func(res resource) (json.RawMessage, error) {
+		if res.Type == "" {
+			return nil, errors.New("body data must have a type")
+		}
+		if len(res.Attributes) == 0 {
+			return json.RawMessage("{}"), nil
+		}
+		return res.Attributes, nil
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(doc.Data), []byte("[")) {
+		var resources []resource
+		if err := json.Unmarshal(doc.Data, &resources); err != nil {
+			return nil, errors.New("body data must be a resource object or an array of them")
+		}
+		all := make([]json.RawMessage, len(resources))
+		for i, res := range resources {
+			a, err := attributes(res)
+			if err != nil {
+				return nil, err
+			}
+			all[i] = a
+		}
+		return json.Marshal(all)
+	}
+
+	var res resource
+	if err := json.Unmarshal(doc.Data, &res); err != nil {
+		return nil, errors.New("body data must be a resource object or an array of them")
+	}
+	return attributes(res)
+}
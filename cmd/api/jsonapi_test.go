@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// jsonapiDocument is a JSON:API response document.
+type jsonapiDocument struct {
+	Data   json.RawMessage        `json:"data"`
+	Meta   map[string]interface{} `json:"meta"`
+	Errors []struct {
+		Status string            `json:"status"`
+		Code   string            `json:"code"`
+		Detail string            `json:"detail"`
+		Source map[string]string `json:"source"`
+	} `json:"errors"`
+}
+
+type jsonapiResource struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// serveJSONAPI serves r asking for JSON:API and decodes the response.
+func serveJSONAPI(t *testing.T, h http.Handler, r *http.Request) (int, jsonapiDocument) {
+	t.Helper()
+
+	r.Header.Set("Accept", jsonapiMediaType)
+	rr := serve(h, r)
+	if got := rr.Header().Get("Content-Type"); got != jsonapiMediaType {
+		t.Fatalf("got Content-Type %q; want %q", got, jsonapiMediaType)
+	}
+	var doc jsonapiDocument
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("%v: %s", err, rr.Body)
+	}
+	return rr.Code, doc
+}
+
+func TestJSONAPICreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		// wantSources are the source pointers of the errors, in order.
+		wantSources []string
+	}{
+		{
+			"JSON:API body", jsonapiMediaType,
+			`{"data":{"type":"musics","attributes":{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}}}`,
+			http.StatusCreated, nil,
+		},
+		{
+			"plain JSON body", "application/json",
+			`{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}`,
+			http.StatusCreated, nil,
+		},
+		{
+			"invalid attributes", jsonapiMediaType,
+			`{"data":{"type":"musics","attributes":{"title":"","artist":"Band","duration":180,"genres":["pop","pop"],"popularity":0.5}}}`,
+			http.StatusUnprocessableEntity, []string{"/data/attributes/genres", "/data/attributes/title"},
+		},
+		{
+			"no data", jsonapiMediaType, `{"title":"Song"}`,
+			http.StatusBadRequest, nil,
+		},
+		{
+			"no type", jsonapiMediaType, `{"data":{"attributes":{"title":"Song"}}}`,
+			http.StatusBadRequest, nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			db := openMusicStubDB()
+			defer db.Close()
+			app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/musics", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			status, doc := serveJSONAPI(t, http.HandlerFunc(app.createMusicHandler), r)
+			if status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %+v", status, tt.wantStatus, doc)
+			}
+
+			if status != http.StatusCreated {
+				if doc.Data != nil || len(doc.Errors) == 0 {
+					t.Fatalf("got %+v; want an errors document", doc)
+				}
+				var sources []string
+				for _, e := range doc.Errors {
+					if e.Status != "422" && e.Status != "400" {
+						t.Errorf("got error status %q", e.Status)
+					}
+					if pointer, ok := e.Source["pointer"]; ok {
+						sources = append(sources, pointer)
+					}
+				}
+				if !reflect.DeepEqual(sources, tt.wantSources) {
+					t.Errorf("got sources %v; want %v", sources, tt.wantSources)
+				}
+				return
+			}
+
+			var resource jsonapiResource
+			if err := json.Unmarshal(doc.Data, &resource); err != nil {
+				t.Fatal(err)
+			}
+			if resource.Type != "musics" || resource.ID != "1" || resource.Attributes["title"] != "Song" {
+				t.Errorf("got %+v; want music 1", resource)
+			}
+			if _, ok := resource.Attributes["id"]; ok {
+				t.Error("got id among the attributes")
+			}
+			if _, ok := doc.Meta["musics"]; ok {
+				t.Error("got the legacy musics key in meta")
+			}
+		})
+	}
+}
+
+func TestJSONAPIList(t *testing.T) {
+	h := newListTestApplication(t).routes()
+
+	status, doc := serveJSONAPI(t, h, httptest.NewRequest(http.MethodGet, "/v1/musics?title=song&page_size=1", nil))
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", status, http.StatusOK)
+	}
+	var resources []jsonapiResource
+	if err := json.Unmarshal(doc.Data, &resources); err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 || resources[0].Type != "musics" || resources[0].ID != "1" || resources[1].ID != "2" {
+		t.Errorf("got data %+v; want musics 1 and 2", resources)
+	}
+	if resources[0].Attributes["title"] != "Rock & <Roll>" {
+		t.Errorf("got attributes %v", resources[0].Attributes)
+	}
+	for key, want := range map[string]interface{}{"current_page": 1.0, "page_size": 1.0, "last_page": 2.0, "total_records": 2.0, "count": data.CountExact} {
+		if doc.Meta[key] != want {
+			t.Errorf("got meta %s %v; want %v", key, doc.Meta[key], want)
+		}
+	}
+	if _, ok := doc.Meta["musics"]; ok {
+		t.Error("got the records in meta as well")
+	}
+
+	// A bad query parameter is reported by its name.
+	status, doc = serveJSONAPI(t, h, httptest.NewRequest(http.MethodGet, "/v1/musics?page_size=0", nil))
+	if status != http.StatusUnprocessableEntity || len(doc.Errors) != 1 || doc.Errors[0].Source["parameter"] != "page_size" {
+		t.Errorf("got status %d and %+v; want a page_size parameter error", status, doc)
+	}
+}
@@ -3,15 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/enrich"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"github.com/SPA-Final/musicdb/internal/graphql"
 	"github.com/SPA-Final/musicdb/internal/jsonlog"
 	"github.com/SPA-Final/musicdb/internal/mailer"
+	"github.com/SPA-Final/musicdb/internal/mbz"
+	"github.com/SPA-Final/musicdb/internal/pwned"
 	_ "github.com/lib/pq"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,18 +33,32 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port        int
+	env         string
+	debugErrors bool
+	trustProxy  bool
+	statsTTL    time.Duration
+	pagination  struct {
+		maxOffset       int
+		maxPageSize     int
+		bulkMaxPageSize int
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
 	}
 	rateLimiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		// rps and burst limit anonymous requests per IP, userRPS and
+		// userBurst those of signed in users per user.
+		rps            float64
+		burst          int
+		userRPS        float64
+		userBurst      int
+		enabled        bool
+		exemptNetworks []*net.IPNet
 	}
 	smtp struct {
 		host     string
@@ -46,44 +70,91 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	legacy struct {
+		createEnvelope bool
+	}
+	export struct {
+		maxRows int
+		dir     string
+		ttl     time.Duration
+	}
+	imports struct {
+		maxBytes    int64
+		jobMaxBytes int64
+		spoolDir    string
+	}
+	compression struct {
+		minBytes int
+	}
+	search struct {
+		fuzzyThreshold float64
+		highlightStart string
+		highlightStop  string
+	}
+	versions struct {
+		v1Deprecation time.Time
+		v1Sunset      time.Time
+	}
+	spotify struct {
+		clientID     string
+		clientSecret string
+	}
+	musicbrainz struct {
+		baseURL   string
+		userAgent string
+	}
+	tokens struct {
+		authTTL    time.Duration
+		refreshTTL time.Duration
+		probeTTL   time.Duration
+	}
+	pwned struct {
+		enabled bool
+		baseURL string
+	}
+	totp struct {
+		// key seals the TOTP secrets of two-factor authentication; nil
+		// turns setting it up off.
+		key []byte
+	}
 }
 
 type application struct {
 	config config
 	logger *jsonlog.Logger
 	models data.Models
-	mailer mailer.Mailer
+	mailer mailer.Sender
 	wg     sync.WaitGroup
+	stats  statsCache
+	feeds  feedCache
+	events *events.Hub
+	// graphql is the schema served at /v1/graphql, built by routes().
+	graphql *graphql.Schema
+	// enricher fills in missing record metadata; nil when no catalogue is
+	// configured.
+	enricher enrich.Source
+	// musicbrainz searches MusicBrainz for the recordings records may be
+	// linked to.
+	musicbrainz mbz.Client
+	// pwned checks new passwords against breach data; nil when the check is
+	// off.
+	pwned pwned.Checker
+	// shutdown is closed when the server starts shutting down, for the
+	// connections it doesn't manage itself.
+	shutdown chan struct{}
+	// outboxWake wakes the outbox dispatcher when events have been
+	// committed.
+	outboxWake chan struct{}
+	// registeredRoutes is filled in by routes() and described by the
+	// OpenAPI document.
+	registeredRoutes []registeredRoute
+	// limits are the buckets of the rate limiter, created by routes().
+	limits *rateLimits
 }
 
 func main() {
 	var cfg config
-	//port, _ := strconv.Atoi(os.Getenv("PORT"))
-
-	flag.IntVar(&cfg.port, "port", 8000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("MOVIFY_DB_DSN"), "PostgreSQL DSN")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
-
-	flag.Float64Var(&cfg.rateLimiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.rateLimiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.rateLimiter.enabled, "limiter-enabled", false, "Enable rate limiter")
-
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "99cbfd4f7f103e", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "d868a832f69c95", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Movify <no-reply@movify.zsalman.net>", "SMTP sender")
-
-	cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, "http://localhost:4200")
-
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Fields(val)
-		return nil
-	})
+	defineFlags(flag.CommandLine, &cfg)
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -119,17 +190,174 @@ func main() {
 	}))
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:      cfg,
+		logger:      logger,
+		models:      data.NewModels(db, cfg.db.queryTimeout),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		events:      events.NewHub(recentEvents),
+		musicbrainz: mbz.New(cfg.musicbrainz.baseURL, cfg.musicbrainz.userAgent),
+		shutdown:    make(chan struct{}),
+		outboxWake:  make(chan struct{}, 1),
+	}
+	defer app.models.Close()
+	if err := app.models.Prepare(); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.spotify.clientID != "" {
+		app.enricher = enrich.NewSpotify(cfg.spotify.clientID, cfg.spotify.clientSecret)
+	}
+	if cfg.pwned.enabled {
+		app.pwned = pwned.New(cfg.pwned.baseURL, nil)
+	}
+	if n, err := app.models.Enrichments.InterruptRunning(); err != nil {
+		logger.PrintError(err, nil)
+	} else if n > 0 {
+		logger.PrintInfo("marked unfinished enrichment jobs as interrupted", map[string]string{"jobs": strconv.FormatInt(n, 10)})
+	}
+
+	if err := os.MkdirAll(cfg.export.dir, 0o750); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if n, err := app.models.Exports.InterruptUnfinished(); err != nil {
+		logger.PrintError(err, nil)
+	} else if n > 0 {
+		logger.PrintInfo("marked unfinished exports as interrupted", map[string]string{"exports": strconv.FormatInt(n, 10)})
+	}
+
+	expvar.Publish("outbox_lag_seconds", expvar.Func(outboxLag))
+
+	if err := os.MkdirAll(cfg.imports.spoolDir, 0o750); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	imports, err := app.models.Imports.GetUnfinished()
+	if err != nil {
+		logger.PrintError(err, nil)
+	} else if len(imports) > 0 {
+		logger.PrintInfo("resuming unfinished imports", map[string]string{"imports": strconv.Itoa(len(imports))})
 	}
+	for _, job := range imports {
+		job := job
+		app.background(func() {
+			app.runImport(job)
+		})
+	}
+
+	app.background(app.purgeExpiredIdempotencyKeys)
+	app.background(app.sweepExports)
+	app.background(app.dispatchOutbox)
 
 	if err = app.serve(); err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }
 
+// defineFlags registers the command-line flags on fs, which fill in cfg when
+// fs is parsed. Until then cfg holds their defaults.
+func defineFlags(fs *flag.FlagSet, cfg *config) {
+	cfg.search.highlightStart = "["
+	cfg.search.highlightStop = "]"
+
+	fs.IntVar(&cfg.port, "port", 8000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+
+	fs.BoolVar(&cfg.debugErrors, "debug-errors", false, "Include error details in server error responses for all callers")
+	fs.BoolVar(&cfg.trustProxy, "trust-proxy", false, "Trust X-Forwarded-Proto and X-Forwarded-Host from a reverse proxy")
+
+	fs.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("MOVIFY_DB_DSN"), "PostgreSQL DSN")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "Timeout for music listing and count queries")
+
+	fs.Float64Var(&cfg.rateLimiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second per IP for anonymous requests")
+	fs.IntVar(&cfg.rateLimiter.burst, "limiter-burst", 4, "Rate limiter maximum burst per IP for anonymous requests")
+	fs.Float64Var(&cfg.rateLimiter.userRPS, "limiter-user-rps", 10, "Rate limiter maximum requests per second per signed in user")
+	fs.IntVar(&cfg.rateLimiter.userBurst, "limiter-user-burst", 20, "Rate limiter maximum burst per signed in user")
+	fs.BoolVar(&cfg.rateLimiter.enabled, "limiter-enabled", false, "Enable rate limiter")
+
+	fs.Func("limiter-exempt-cidrs", "CIDR ranges exempt from rate limiting (space separated)", func(val string) error {
+		for _, cidr := range strings.Fields(val) {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			cfg.rateLimiter.exemptNetworks = append(cfg.rateLimiter.exemptNetworks, network)
+		}
+		return nil
+	})
+
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "99cbfd4f7f103e", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "d868a832f69c95", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Movify <no-reply@movify.zsalman.net>", "SMTP sender")
+
+	cfg.cors.trustedOrigins = append(cfg.cors.trustedOrigins, "http://localhost:4200")
+
+	fs.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+
+	fs.IntVar(&cfg.pagination.maxPageSize, "max-page-size", data.DefaultMaxPageSize, "Largest page_size for listings")
+	fs.IntVar(&cfg.pagination.bulkMaxPageSize, "bulk-max-page-size", 500, "Largest page_size for callers with the musics:bulk-read permission")
+	fs.IntVar(&cfg.pagination.maxOffset, "max-offset", 100_000, "Largest row offset a listing page may start at (0 for no limit)")
+	fs.DurationVar(&cfg.statsTTL, "stats-cache-ttl", time.Minute, "How long GET /musics/stats results are cached")
+
+	fs.Int64Var(&cfg.imports.maxBytes, "import-max-bytes", 10<<20, "Largest CSV body POST /musics/import accepts")
+	fs.Int64Var(&cfg.imports.jobMaxBytes, "import-job-max-bytes", 1<<30, "Largest CSV file POST /imports accepts")
+	fs.StringVar(&cfg.imports.spoolDir, "import-spool-dir", filepath.Join(os.TempDir(), "musicdb-imports"), "Directory the files of POST /imports jobs are kept in until imported")
+	fs.IntVar(&cfg.export.maxRows, "export-max-rows", 100_000, "Most records a CSV export of GET /musics may contain")
+	fs.StringVar(&cfg.export.dir, "export-dir", filepath.Join(os.TempDir(), "musicdb-exports"), "Directory the files of POST /exports jobs are written to")
+	fs.DurationVar(&cfg.export.ttl, "export-ttl", 24*time.Hour, "How long the file of a completed export is kept")
+	fs.DurationVar(&cfg.tokens.authTTL, "auth-token-ttl", 24*time.Hour, "How long an authentication token is valid")
+	fs.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "How long a refresh token is valid")
+	fs.DurationVar(&cfg.tokens.probeTTL, "probe-token-ttl", 365*24*time.Hour, "How long a probe token, exempting its bearer from rate limiting, is valid")
+	fs.IntVar(&cfg.compression.minBytes, "gzip-min-bytes", 1024, "Smallest response body gzipped for clients that accept it")
+
+	fs.Float64Var(&cfg.search.fuzzyThreshold, "search-fuzzy-threshold", 0.3, "Minimum trigram similarity for search_mode=fuzzy title matches")
+	fs.Func("search-highlight-start", "Marker put before matched words when highlight=true (default \"[\")", highlightMarker(&cfg.search.highlightStart))
+	fs.Func("search-highlight-stop", "Marker put after matched words when highlight=true (default \"]\")", highlightMarker(&cfg.search.highlightStop))
+
+	fs.BoolVar(&cfg.legacy.createEnvelope, "legacy-create-envelope", true, "Also return created musics under the deprecated \"musics\" envelope key")
+
+	fs.Func("v1-deprecation-date", "Date (YYYY-MM-DD) announced in the Deprecation header of v1 responses", func(val string) error {
+		t, err := time.Parse("2006-01-02", val)
+		cfg.versions.v1Deprecation = t
+		return err
+	})
+	fs.Func("v1-sunset-date", "Date (YYYY-MM-DD) announced in the Sunset header of v1 responses", func(val string) error {
+		t, err := time.Parse("2006-01-02", val)
+		cfg.versions.v1Sunset = t
+		return err
+	})
+
+	fs.StringVar(&cfg.spotify.clientID, "spotify-client-id", os.Getenv("MOVIFY_SPOTIFY_CLIENT_ID"), "Spotify client ID for metadata enrichment (enrichment is off when empty)")
+	fs.StringVar(&cfg.spotify.clientSecret, "spotify-client-secret", os.Getenv("MOVIFY_SPOTIFY_CLIENT_SECRET"), "Spotify client secret for metadata enrichment")
+	fs.StringVar(&cfg.musicbrainz.baseURL, "musicbrainz-url", mbz.DefaultBaseURL, "MusicBrainz web service URL")
+	fs.StringVar(&cfg.musicbrainz.userAgent, "musicbrainz-user-agent", "musicdb ( https://github.com/SPA-Final/musicdb )", "User-Agent sent to MusicBrainz, naming the application and a contact")
+
+	fs.BoolVar(&cfg.pwned.enabled, "pwned-passwords", false, "Reject new passwords found in the Pwned Passwords breach data")
+	fs.StringVar(&cfg.pwned.baseURL, "pwned-passwords-url", pwned.DefaultBaseURL, "Pwned Passwords range API URL")
+
+	setTOTPKey := func(val string) error {
+		key, err := hex.DecodeString(val)
+		if err == nil && len(key) != 32 {
+			err = errors.New("must be 32 bytes")
+		}
+		cfg.totp.key = key
+		return err
+	}
+	if val := os.Getenv("MOVIFY_TOTP_KEY"); val != "" {
+		if err := setTOTPKey(val); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid MOVIFY_TOTP_KEY: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	fs.Func("totp-key", "Hex-encoded 32 byte key sealing two-factor secrets, by default $MOVIFY_TOTP_KEY (two-factor setup is off when unset)", setTOTPKey)
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -152,3 +380,15 @@ func openDB(cfg config) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+// highlightMarker returns a flag.Func parser for a ts_headline marker, which
+// has to be quoted in the options string and so can't contain quotes or commas.
+func highlightMarker(dst *string) func(string) error {
+	return func(val string) error {
+		if val == "" || strings.ContainsAny(val, `",`) {
+			return errors.New("marker must be non-empty and must not contain double quotes or commas")
+		}
+		*dst = val
+		return nil
+	}
+}
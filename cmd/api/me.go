@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// profile is the caller's user record as GET /v1/me shows it, with the
+// codes of their permissions, sorted, and the expiry of the token the
+// request was made with and whether it's read-only.
+type profile struct {
+	*data.User
+	Permissions   []string  `json:"permissions"`
+	TokenExpiry   time.Time `json:"token_expiry"`
+	TokenReadOnly bool      `json:"token_read_only"`
+}
+
+func (app *application) showMeHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeProfile(w, r, http.StatusOK, app.contextGetUser(r))
+}
+
+// updateMeHandler updates the caller's profile from a partial body. Email
+// addresses aren't changed here, since a new one has to be verified.
+func (app *application) updateMeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  *string `json:"name"`
+		Email *string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.Email != nil {
+		v.AddError("email", validator.MsgEmailChangeSeparate)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// An update that supplies no fields would still bump the version.
+	if input.Name == nil {
+		app.failedValidationResponse(w, r, map[string]validator.Message{
+			"body": {ID: validator.MsgNoUpdatableFields, Args: []interface{}{"name"}},
+		})
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeProfile(w, r, http.StatusOK, user)
+}
+
+// writeProfile answers with the profile of user, the caller.
+func (app *application) writeProfile(w http.ResponseWriter, r *http.Request, status int, user *data.User) {
+	// authenticate has loaded the permissions, in code order.
+	permissions := []string(app.contextGetPermissions(r))
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	expiry, err := app.models.Tokens.GetExpiry(data.ScopeAuthentication, app.contextGetAuthToken(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// The token was deleted since authenticate checked it.
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, status, envelope{"user": profile{user, permissions, expiry, app.contextGetReadOnly(r)}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateMyPasswordHandler changes the caller's password, given the current
+// one. Every other session of the caller is ended, in the transaction saving
+// the password, so those opened with the old password die; the session of
+// the request itself ends too unless keep_current_session is set.
+func (app *application) updateMyPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword    string `json:"current_password"`
+		Password           string `json:"password"`
+		KeepCurrentSession bool   `json:"keep_current_session"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", validator.MsgRequired)
+	data.ValidateNewPassword(v, input.Password)
+	if app.checkPasswordBreach(r, v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	keep := ""
+	if input.KeepCurrentSession {
+		keep = app.contextGetAuthToken(r)
+	}
+	err = app.models.Transact(func(tx *sql.Tx) error {
+		if err := app.models.Users.UpdateTx(tx, user); err != nil {
+			return err
+		}
+		return app.invalidateSessionsTx(tx, user.ID, &user.ID, keep, "password_changed")
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your password was successfully changed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler records the address in the body as the caller's
+// pending email and mails a confirmation token there, along with a notice
+// to the current address. The email only changes once the token is
+// confirmed; asking again replaces the pending address and its token.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", validator.MsgCurrentEmail)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", validator.MsgDuplicateEmail)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.PendingEmail = data.NormalizeEmail(input.Email)
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	oldEmail, newEmail := user.Email, user.PendingEmail
+	app.background(func() {
+		err := app.mailer.Send(newEmail, "token_email_change.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = app.mailer.Send(oldEmail, "email_change_notice.tmpl", map[string]interface{}{
+			"newEmail": newEmail,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	app.writeProfile(w, r, http.StatusAccepted, user)
+}
+
+// confirmEmailChangeHandler makes the caller's pending email their email,
+// given the token mailed to it. The caller's other sessions are ended.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// A token of another user is as good as none.
+	if err != nil || user.ID != app.contextGetUser(r).ID || user.PendingEmail == "" {
+		v.AddError("token", validator.MsgInvalidEmailChangeToken)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Both columns change in the one UPDATE, so the swap is atomic; the
+	// unique index on email catches an address taken since the request.
+	user.Email, user.PendingEmail = user.PendingEmail, ""
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", validator.MsgDuplicateEmail)
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Tokens.DeleteSessions(user.ID, app.contextGetAuthToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeProfile(w, r, http.StatusOK, user)
+}
+
+// invalidateSessionsTx ends the sessions of userID but the one of
+// authentication token keep, if any, in tx, and records that in the audit
+// log with actorID and reason.
+func (app *application) invalidateSessionsTx(tx *sql.Tx, userID int64, actorID *int64, keep, reason string) error {
+	if err := app.models.Tokens.DeleteSessionsTx(tx, userID, keep); err != nil {
+		return err
+	}
+	return app.models.Audit.InsertTx(tx, &data.AuditEntry{
+		UserID:  userID,
+		ActorID: actorID,
+		Action:  data.AuditSessionsInvalidated,
+		Reason:  reason,
+	})
+}
+
+// protectedPermissions are those whose last holder can't delete their
+// account, have them revoked or be suspended: with nobody left holding them,
+// nobody could grant them again.
+var protectedPermissions = []string{"admin"}
+
+// errLastHolder aborts an account deletion, revocation or suspension that
+// would leave a protected permission with no active holder.
+type errLastHolder struct {
+	code string
+}
+
+func (e errLastHolder) Error() string {
+	return "last holder of the " + e.code + " permission"
+}
+
+// deleteMeHandler deletes the caller's account, given their password, and
+// everything that belongs to it, in one transaction. The files of their
+// exports and unfinished imports are removed once it commits.
+func (app *application) deleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Password != "", "password", validator.MsgRequired); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	permissions := app.contextGetPermissions(r)
+	var exports []*data.Export
+	var imports []int64
+	err = app.models.Transact(func(tx *sql.Tx) error {
+		for _, code := range protectedPermissions {
+			if !permissions.Include(code) {
+				continue
+			}
+			others, err := app.models.Permissions.CountOtherHoldersTx(tx, code, user.ID)
+			if err != nil {
+				return err
+			}
+			if others == 0 {
+				return errLastHolder{code}
+			}
+		}
+
+		if exports, err = app.models.Exports.DeleteAllForUserTx(tx, user.ID); err != nil {
+			return err
+		}
+		if imports, err = app.models.Imports.DeleteAllForUserTx(tx, user.ID); err != nil {
+			return err
+		}
+		return app.models.Users.DeleteWithDependencies(tx, user.ID)
+	})
+	if err != nil {
+		var lastHolder errLastHolder
+		switch {
+		case errors.As(err, &lastHolder):
+			app.lastHolderResponse(w, r, lastHolder.code)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, export := range exports {
+		path := app.exportPath(export.ID, export.Format)
+		for _, name := range []string{path, path + ".part"} {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+	for _, id := range imports {
+		if err := os.Remove(app.importPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			app.logger.PrintError(err, nil)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSessionsHandler lists the caller's sessions, their authentication
+// tokens, by metadata only.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.models.Tokens.GetSessions(app.contextGetUser(r).ID, app.contextGetAuthToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionHandler ends session :id of the caller.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteSession(app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
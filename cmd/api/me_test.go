@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepCurrent bool
+		wantCurrent int
+	}{
+		{"keeping the current session", true, http.StatusOK},
+		{"ending every session", false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestDBApplication(t)
+			h := app.routes()
+			user := insertTestUser(t, app, "alice@example.com")
+			laptop := newTestToken(t, app, user, false)
+			phone := newTestToken(t, app, user, false)
+
+			body := fmt.Sprintf(`{"current_password":"pa55word","password":"correct horse battery","keep_current_session":%t}`, tt.keepCurrent)
+			if rr := sendAs(h, laptop, http.MethodPut, "/v1/me/password", body); rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			if code := authenticatedStatus(h, phone); code != http.StatusUnauthorized {
+				t.Errorf("other session: got status %d; want %d", code, http.StatusUnauthorized)
+			}
+			if code := authenticatedStatus(h, laptop); code != tt.wantCurrent {
+				t.Errorf("current session: got status %d; want %d", code, tt.wantCurrent)
+			}
+
+			// Only the new password signs in.
+			signIn := func(password string) int {
+				return sendAs(h, "", http.MethodPost, "/v1/tokens/authentication", `{"email":"alice@example.com","password":"`+password+`"}`).Code
+			}
+			if code := signIn("pa55word"); code != http.StatusUnauthorized {
+				t.Errorf("old password: got status %d; want %d", code, http.StatusUnauthorized)
+			}
+			if code := signIn("correct horse battery"); code != http.StatusCreated {
+				t.Errorf("new password: got status %d; want %d", code, http.StatusCreated)
+			}
+		})
+	}
+}
+
+// requestEmailChange asks through h for the email of the user signed in
+// with token to change to email, returning the confirmation token mailed
+// there.
+func requestEmailChange(t *testing.T, app *application, h http.Handler, token, email string) string {
+	t.Helper()
+
+	if rr := sendAs(h, token, http.MethodPost, "/v1/me/email", `{"email":"`+email+`"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+	app.wg.Wait()
+	for _, mail := range app.mailer.(*stubMailer).Sent() {
+		if mail.Recipient == email && mail.Template == "token_email_change.tmpl" {
+			plaintext, _ := mail.Data["emailChangeToken"].(string)
+			return plaintext
+		}
+	}
+	t.Fatalf("no confirmation token was mailed to %s", email)
+	return ""
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com")
+	session := newTestToken(t, app, user, false)
+
+	confirm := requestEmailChange(t, app, h, session, "alice@example.org")
+	rr := sendAs(h, session, http.MethodPut, "/v1/me/email/confirm", `{"token":"`+confirm+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	got, err := app.models.Users.GetByEmail("alice@example.org")
+	if err != nil || got.ID != user.ID || got.PendingEmail != "" {
+		t.Errorf("got %+v, %v; want the user under the new address with none pending", got, err)
+	}
+}
+
+func TestConfirmEmailChangeTaken(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com")
+	session := newTestToken(t, app, user, false)
+
+	confirm := requestEmailChange(t, app, h, session, "shared@example.com")
+	// Someone else signs up with the address before it's confirmed.
+	insertTestUser(t, app, "shared@example.com")
+
+	rr := sendAs(h, session, http.MethodPut, "/v1/me/email/confirm", `{"token":"`+confirm+`"}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["email"] == "" {
+		t.Errorf("got fields %v; want only email", fields)
+	}
+	if got, err := app.models.Users.GetByEmail("alice@example.com"); err != nil || got.ID != user.ID {
+		t.Errorf("got %+v, %v; want the user to keep their address", got, err)
+	}
+}
+
+func TestConfirmEmailChangeExpired(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com")
+	session := newTestToken(t, app, user, false)
+
+	confirm := requestEmailChange(t, app, h, session, "alice@example.org")
+	_, err := app.models.Tokens.DB.Exec(`UPDATE tokens SET expiry = NOW() - INTERVAL '1 second' WHERE user_id = $1 AND scope = $2`, user.ID, data.ScopeEmailChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := sendAs(h, session, http.MethodPut, "/v1/me/email/confirm", `{"token":"`+confirm+`"}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["token"] == "" {
+		t.Errorf("got fields %v; want only token", fields)
+	}
+}
+
+// userRows counts the rows of userID in each table holding a user_id.
+func userRows(t *testing.T, app *application, userID int64) map[string]int {
+	t.Helper()
+
+	tables := []string{"tokens", "users_permissions", "idempotency_keys", "saved_searches", "enrichment_jobs",
+		"exports", "imports", "two_factor", "two_factor_recovery_codes"}
+	counts := make(map[string]int, len(tables))
+	for _, table := range tables {
+		var n int
+		if err := app.models.Tokens.DB.QueryRow(`SELECT count(*) FROM `+table+` WHERE user_id = $1`, userID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
+
+func TestDeleteMe(t *testing.T) {
+	app := newTestDBApplication(t)
+	app.config.export.dir = t.TempDir()
+	app.config.imports.spoolDir = t.TempDir()
+	h := app.routes()
+
+	user := insertTestUser(t, app, "alice@example.com", "musics:read")
+	session := newTestToken(t, app, user, false)
+	other := insertTestUser(t, app, "bob@example.com", "musics:read")
+	newTestToken(t, app, other, false)
+
+	if err := app.models.SavedSearches.Insert(&data.SavedSearch{UserID: user.ID, Name: "pop", Query: "genres=pop"}); err != nil {
+		t.Fatal(err)
+	}
+	export := &data.Export{UserID: user.ID, Format: "csv", Query: "genres=pop"}
+	if err := app.models.Exports.Insert(export); err != nil {
+		t.Fatal(err)
+	}
+	job := &data.Import{UserID: user.ID, Size: 10, Language: "en"}
+	if err := app.models.Imports.Insert(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.TwoFactor.Begin(user.ID, []byte("sealed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.models.TwoFactor.Enable(user.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{app.exportPath(export.ID, export.Format), app.importPath(job.ID)}
+	for _, name := range files {
+		if err := os.WriteFile(name, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherRows := userRows(t, app, other.ID)
+
+	if rr := sendAs(h, session, http.MethodDelete, "/v1/me", `{"password":"pa55word"}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+
+	for table, n := range userRows(t, app, user.ID) {
+		if n != 0 {
+			t.Errorf("got %d rows of the deleted user in %s; want 0", n, table)
+		}
+	}
+	if _, err := app.models.Users.GetByEmail(user.Email); !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("deleted user: got %v; want ErrRecordNotFound", err)
+	}
+	for _, name := range files {
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: got %v; want the file removed", name, err)
+		}
+	}
+
+	// Nobody else loses anything.
+	if got := userRows(t, app, other.ID); !reflect.DeepEqual(got, otherRows) {
+		t.Errorf("the other user's rows went from %v to %v", otherRows, got)
+	}
+}
+
+func TestDeleteMeLastAdmin(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	admin := insertTestUser(t, app, "admin@example.com", "admin")
+	session := newTestToken(t, app, admin, false)
+
+	rr := sendAs(h, session, http.MethodDelete, "/v1/me", `{"password":"pa55word"}`)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusConflict, rr.Body)
+	}
+	if code := readAPIError(t, rr).Code; code != codeLastHolder {
+		t.Errorf("got error code %q; want %q", code, codeLastHolder)
+	}
+	if code := authenticatedStatus(h, session); code != http.StatusOK {
+		t.Errorf("refused deletion: got status %d for the admin's session; want %d", code, http.StatusOK)
+	}
+
+	// With another admin around, the account can go.
+	insertTestUser(t, app, "admin2@example.com", "admin")
+	if rr := sendAs(h, session, http.MethodDelete, "/v1/me", `{"password":"pa55word"}`); rr.Code != http.StatusNoContent {
+		t.Errorf("with another admin: got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+}
+
+func TestProfileShape(t *testing.T) {
+	app := newTestApplication(t)
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return []string{"expiry"}, [][]driver.Value{{expiry}}, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	user := &data.User{ID: 7, CreatedAt: expiry.AddDate(-1, 0, 0), Name: "Alice", Email: "alice@example.com", Activated: true}
+	tests := []struct {
+		name        string
+		permissions data.Permissions
+		readOnly    bool
+		want        string
+	}{
+		{
+			"with permissions", data.Permissions{"admin", "musics:read"}, false,
+			`{"activated":true,"created_at":"2029-01-02T03:04:05Z","email":"alice@example.com","id":7,"name":"Alice",` +
+				`"permissions":["admin","musics:read"],"suspended":false,"token_expiry":"2030-01-02T03:04:05Z","token_read_only":false}`,
+		},
+		{
+			"without permissions", nil, true,
+			`{"activated":true,"created_at":"2029-01-02T03:04:05Z","email":"alice@example.com","id":7,"name":"Alice",` +
+				`"permissions":[],"suspended":false,"token_expiry":"2030-01-02T03:04:05Z","token_read_only":true}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/me", nil)
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, tt.permissions)
+			r = app.contextSetReadOnly(r, tt.readOnly)
+			r = app.contextSetAuthToken(r, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+			rr := serve(http.HandlerFunc(app.showMeHandler), r)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+			var body struct {
+				User json.RawMessage `json:"user"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			// Re-encoding through a map sorts the keys.
+			var fields map[string]interface{}
+			if err := json.Unmarshal(body.User, &fields); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfilePermissionsSorted(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com", "musics:write", "admin", "musics:export", "musics:read")
+	token := newTestToken(t, app, user, false)
+
+	want := []string{"admin", "musics:export", "musics:read", "musics:write"}
+	for i := 0; i < 3; i++ {
+		rr := sendAs(h, token, http.MethodGet, "/v1/me", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		var body struct {
+			User struct {
+				Permissions []string `json:"permissions"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(body.User.Permissions, want) {
+			t.Errorf("request %d: got permissions %v; want %v", i+1, body.User.Permissions, want)
+		}
+	}
+}
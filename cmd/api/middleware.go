@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
@@ -9,76 +11,321 @@ import (
 	"github.com/felixge/httpsnoop"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
+	"net"
 	"net/http"
+	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// maxRequestIDLength caps client-supplied X-Request-ID values; longer or
+// malformed ones are replaced with a generated id.
+const maxRequestIDLength = 128
+
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// negotiate rejects requests whose Accept header rules out every format we
+// can respond in with a 406. An explicit ?format= overrides the header.
+func (app *application) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "" && !acceptable(r) {
+			app.notAcceptableResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// assignRequestID tags every request with an id, reusing a well-formed
+// X-Request-ID from the client or generating one, and echoes it in the
+// response headers.
+func (app *application) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if len(id) > maxRequestIDLength || !requestIDRX.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// recoverPanic answers requests whose handler panicked with a 500. It runs
+// before authenticate, which fills in the permissions holder it adds, so
+// that admins still get the debug detail of the error.
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetPermissionsHolder(r)
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				app.serverErrorResponse(w, r, &panicError{value: err, stack: debug.Stack()})
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+var (
+	totalRateLimitExemptions = expvar.NewMap("total_rate_limit_exemptions")
+	// totalRateLimitRejections counts the requests the rate limiter turned
+	// away, by tier.
+	totalRateLimitRejections = expvar.NewMap("total_rate_limit_rejections")
+)
+
+// rateLimitTier is one set of token buckets of the rate limiter, a bucket
+// per client key.
+type rateLimitTier struct {
+	limit   rate.Limit
+	burst   int
+	mu      sync.Mutex
+	clients map[string]*rateLimitClient
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimitTier(rps float64, burst int) *rateLimitTier {
+	return &rateLimitTier{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*rateLimitClient),
+	}
+}
+
+// allow takes a token from the bucket of key, reporting otherwise how long
+// until one is available.
+func (t *rateLimitTier) allow(key string) (bool, time.Duration) {
+	return t.reserve(key, true)
+}
+
+// check is allow without taking the token.
+func (t *rateLimitTier) check(key string) (bool, time.Duration) {
+	return t.reserve(key, false)
+}
+
+func (t *rateLimitTier) reserve(key string, take bool) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, found := t.clients[key]
+	if !found {
+		c = &rateLimitClient{limiter: rate.NewLimiter(t.limit, t.burst)}
+		t.clients[key] = c
+	}
+	now := time.Now()
+	c.lastSeen = now
+
+	reservation := c.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// A zero burst never lets a request through.
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	if !take {
+		reservation.CancelAt(now)
+	}
+	return true, 0
+}
+
+// prune forgets the clients not seen for idle.
+func (t *rateLimitTier) prune(idle time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.clients {
+		if time.Since(c.lastSeen) > idle {
+			delete(t.clients, key)
+		}
 	}
+}
+
+// rateLimits are the tiers of the rate limiter, shared by rateLimit, which
+// runs before authenticate, and rateLimitUser, which runs after it.
+type rateLimits struct {
+	// anonymous limits the requests without a token per IP.
+	anonymous *rateLimitTier
+	// failedAuth limits, per IP, the requests whose token was rejected. An
+	// address that used up its allowance can't present tokens at all for a
+	// while, so guessing them can't hammer the database.
+	failedAuth *rateLimitTier
+	// users limits signed in users per user, so that users sharing an
+	// address don't use up each other's allowance.
+	users *rateLimitTier
+}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+func (app *application) newRateLimits() *rateLimits {
+	cfg := app.config.rateLimiter
+	limits := &rateLimits{
+		anonymous:  newRateLimitTier(cfg.rps, cfg.burst),
+		failedAuth: newRateLimitTier(cfg.rps, cfg.burst),
+		users:      newRateLimitTier(cfg.userRPS, cfg.userBurst),
+	}
 
 	// background, cleanup goroutine
 	go func() {
 		for {
 			time.Sleep(time.Minute)
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-				mu.Unlock()
-			}
+			limits.anonymous.prune(3 * time.Minute)
+			limits.failedAuth.prune(3 * time.Minute)
+			limits.users.prune(3 * time.Minute)
 		}
 	}()
 
+	return limits
+}
+
+// rateLimit applies the per-IP tiers before authenticate looks the token
+// up: requests without a token are limited per IP, and those with one are
+// turned away while their IP is over its allowance of failed
+// authentications. authenticate charges the failures with
+// rateLimitFailedAuth. Requests from an exempt network, or with a valid
+// X-Probe-Token, aren't limited; a probe token is held to the failed
+// authentication allowance like any other before it's looked up.
+func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.rateLimiter.enabled {
-			ip := realip.FromRequest(r)
+		if !app.config.rateLimiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if app.exemptNetwork(r) {
+			totalRateLimitExemptions.Add("cidr", 1)
+			next.ServeHTTP(w, app.contextSetRateLimitExempt(r))
+			return
+		}
 
-			mu.Lock()
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.rateLimiter.rps), app.config.rateLimiter.burst),
-				}
+		ip := realip.FromRequest(r)
+		probeToken := r.Header.Get("X-Probe-Token")
+		if r.Header.Get("Authorization") != "" || probeToken != "" {
+			if ok, retryAfter := app.limits.failedAuth.check(ip); !ok {
+				totalRateLimitRejections.Add("failed_auth", 1)
+				app.rateLimitExceededResponse(w, r, retryAfter)
+				return
 			}
+		}
 
-			clients[ip].lastSeen = time.Now()
+		if probeToken != "" {
+			if app.validProbeToken(r, probeToken) {
+				totalRateLimitExemptions.Add("probe_token", 1)
+				next.ServeHTTP(w, app.contextSetRateLimitExempt(r))
+				return
+			}
+			app.limits.failedAuth.allow(ip)
+		}
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+		if r.Header.Get("Authorization") == "" {
+			if ok, retryAfter := app.limits.anonymous.allow(ip); !ok {
+				totalRateLimitRejections.Add("anonymous", 1)
+				app.rateLimitExceededResponse(w, r, retryAfter)
 				return
 			}
-			mu.Unlock()
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// rateLimitFailedAuth charges a request whose token authenticate rejected to
+// the failed authentication allowance of its IP.
+func (app *application) rateLimitFailedAuth(r *http.Request) {
+	if !app.config.rateLimiter.enabled || app.contextGetRateLimitExempt(r) {
+		return
+	}
+	app.limits.failedAuth.allow(realip.FromRequest(r))
+}
+
+// rateLimitUser limits the requests of signed in users per user. It runs
+// after authenticate; anonymous requests were already limited by rateLimit.
+func (app *application) rateLimitUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.rateLimiter.enabled && !app.contextGetRateLimitExempt(r) {
+			if user := app.contextGetUser(r); !user.IsAnonymous() {
+				if ok, retryAfter := app.limits.users.allow(strconv.FormatInt(user.ID, 10)); !ok {
+					totalRateLimitRejections.Add("user", 1)
+					app.rateLimitExceededResponse(w, r, retryAfter)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// exemptNetwork reports whether r comes from one of the networks exempt from
+// rate limiting. It uses the connection's peer address rather than realip,
+// so forwarding headers can't be used to claim an exempt range.
+func (app *application) exemptNetwork(r *http.Request) bool {
+	if len(app.config.rateLimiter.exemptNetworks) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range app.config.rateLimiter.exemptNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validProbeToken reports whether token is an unexpired probe token, as
+// issued by createProbeTokenHandler.
+func (app *application) validProbeToken(r *http.Request, token string) bool {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return false
+	}
+
+	_, err := app.models.Users.GetForToken(data.ScopeProbe, token)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.PrintError(err, map[string]string{"request_id": app.requestID(r)})
+		}
+		return false
+	}
+	return true
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
+	// Tokens' last_used_at is only written once a minute per token, tracked
+	// here to spare a query on the other requests.
+	var mu sync.Mutex
+	touched := make(map[string]time.Time)
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			mu.Lock()
+			for token, at := range touched {
+				if time.Since(at) > time.Minute {
+					delete(touched, token)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
 
@@ -92,6 +339,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		headerParts := strings.Split(authorizationHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.rateLimitFailedAuth(r)
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
@@ -100,22 +348,55 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.rateLimitFailedAuth(r)
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, readOnly, err := app.models.Users.GetForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
+				app.rateLimitFailedAuth(r)
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
+		// Suspending a user deletes their tokens, but one may have been
+		// created as it happened.
+		if user.Suspended {
+			app.accountSuspendedResponse(w, r)
+			return
+		}
+
+		// Loading permissions up front means requirePermission, and error
+		// responses that depend on them, never need to query for them.
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		mu.Lock()
+		touch := time.Since(touched[token]) > time.Minute
+		if touch {
+			touched[token] = time.Now()
+		}
+		mu.Unlock()
+		if touch {
+			app.background(func() {
+				if err := app.models.Tokens.Touch(token); err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
 
 		r = app.contextSetUser(r, user)
+		r = app.contextSetPermissions(r, permissions)
+		r = app.contextSetAuthToken(r, token)
+		r = app.contextSetReadOnly(r, readOnly)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -144,16 +425,26 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	}
 }
 
+// requireWritableToken refuses read-only tokens on the routes where users
+// change their own account, which no permission guards. It goes inside
+// requireActivatedUser or requireAuthenticatedUser.
+func (app *application) requireWritableToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetReadOnly(r) {
+			app.readOnlyTokenResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
+		if app.contextGetReadOnly(r) && !validator.In(code, data.ReadOnlyPermissions...) {
+			app.readOnlyTokenResponse(w, r)
 			return
 		}
-
-		if !permissions.Include(code) {
+		if !app.contextGetPermissions(r).Include(code) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -163,6 +454,34 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// requireAnyPermission is requirePermission for routes open to the holders
+// of any one of codes. A read-only token only counts those of codes that are
+// read-only permissions.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions := app.contextGetPermissions(r)
+		readOnly := app.contextGetReadOnly(r)
+		allowed := false
+		for _, code := range codes {
+			if readOnly && !validator.In(code, data.ReadOnlyPermissions...) {
+				continue
+			}
+			allowed = true
+			if permissions.Include(code) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if !allowed {
+			app.readOnlyTokenResponse(w, r)
+			return
+		}
+		app.notPermittedResponse(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -180,12 +499,43 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponsesSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+// methodOverride lets clients behind proxies that only pass GET and POST reach
+// the other write routes: a POST carrying X-HTTP-Method-Override is routed, and
+// permission-checked, as the method named in the header.
+func (app *application) methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := r.Header.Get("X-HTTP-Method-Override")
+		if override == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
+		if r.Method != http.MethodPost {
+			app.badRequestResponse(w, r, errors.New("X-HTTP-Method-Override is only allowed on POST requests"))
+			return
+		}
+
+		switch method := strings.ToUpper(override); method {
+		case http.MethodPatch, http.MethodPut, http.MethodDelete:
+			r.Method = method
+		default:
+			app.badRequestResponse(w, r, fmt.Errorf("X-HTTP-Method-Override must be PATCH, PUT or DELETE, not %q", override))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+	totalResponseBytes              = expvar.NewInt("total_response_bytes")
+)
+
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
 
@@ -196,5 +546,7 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
 
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		totalResponseBytes.Add(metrics.Written)
 	})
 }
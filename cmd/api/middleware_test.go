@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// newRateLimitedApplication returns an application whose limiter allows
+// burst requests per bucket and practically never refills them.
+func newRateLimitedApplication(t *testing.T, burst int) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	enableRateLimit(app, burst)
+	return app
+}
+
+// enableRateLimit turns on app's limiter, allowing burst requests per bucket.
+func enableRateLimit(app *application, burst int) {
+	app.config.rateLimiter.enabled = true
+	app.config.rateLimiter.rps = 0.001
+	app.config.rateLimiter.burst = burst
+	app.config.rateLimiter.userRPS = 0.001
+	app.config.rateLimiter.userBurst = burst
+	app.limits = app.newRateLimits()
+}
+
+func requestFrom(ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/musics", nil)
+	r.RemoteAddr = ip + ":40000"
+	return r
+}
+
+func TestRateLimitAnonymousPerIP(t *testing.T) {
+	app := newRateLimitedApplication(t, 3)
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	for i := 0; i < 3; i++ {
+		if rr := serve(h, requestFrom("203.0.113.1")); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	rr := serve(h, requestFrom("203.0.113.1"))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	if rr := serve(h, requestFrom("203.0.113.2")); rr.Code != http.StatusOK {
+		t.Errorf("other IP: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitUsersFromSameIP(t *testing.T) {
+	app := newRateLimitedApplication(t, 3)
+	h := app.rateLimitUser(okHandler)
+
+	as := func(id int64) *http.Request {
+		return app.contextSetUser(requestFrom("203.0.113.1"), &data.User{ID: id, Activated: true})
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := serve(h, as(1)); rr.Code != http.StatusOK {
+			t.Fatalf("user 1 request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+	if rr := serve(h, as(1)); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("user 1: got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// User 2 shares the IP, not the bucket.
+	for i := 0; i < 3; i++ {
+		if rr := serve(h, as(2)); rr.Code != http.StatusOK {
+			t.Fatalf("user 2 request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	// Nor do anonymous requests from the IP count against either.
+	anon := app.rateLimit(app.authenticate(okHandler))
+	for i := 0; i < 3; i++ {
+		if rr := serve(anon, requestFrom("203.0.113.1")); rr.Code != http.StatusOK {
+			t.Fatalf("anonymous request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimitFailedAuthentication(t *testing.T) {
+	app := newRateLimitedApplication(t, 3)
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	badToken := func(ip string) *http.Request {
+		r := requestFrom(ip)
+		r.Header.Set("Authorization", "Bearer guess")
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := serve(h, badToken("203.0.113.1")); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Once the IP has used up its failures, tokens are refused before
+	// authenticate gets to look them up.
+	rr := serve(h, badToken("203.0.113.1"))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	if rr := serve(h, badToken("203.0.113.2")); rr.Code != http.StatusUnauthorized {
+		t.Errorf("other IP: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serve(h, requestFrom("203.0.113.1")); rr.Code != http.StatusOK {
+		t.Errorf("anonymous request: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	app := newRateLimitedApplication(t, 1)
+	app.config.rateLimiter.enabled = false
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	for i := 0; i < 5; i++ {
+		if rr := serve(h, requestFrom("203.0.113.1")); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRateLimitExemptNetwork(t *testing.T) {
+	app := newRateLimitedApplication(t, 1)
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.rateLimiter.exemptNetworks = []*net.IPNet{network}
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	for i := 0; i < 5; i++ {
+		if rr := serve(h, requestFrom("10.1.2.3")); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	// Claiming the exempt address in a forwarding header from outside the
+	// range is limited as usual.
+	spoofed := func() *http.Request {
+		r := requestFrom("203.0.113.1")
+		r.Header.Set("X-Forwarded-For", "10.1.2.3")
+		return r
+	}
+	if rr := serve(h, spoofed()); rr.Code != http.StatusOK {
+		t.Fatalf("spoofed request: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	if rr := serve(h, spoofed()); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed request: got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitBadProbeToken(t *testing.T) {
+	app := newRateLimitedApplication(t, 3)
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	// Anonymous requests have an allowance of their own, so this isn't
+	// the anonymous tier running out.
+	app.limits.anonymous = newRateLimitTier(0.001, 100)
+
+	probe := func() *http.Request {
+		r := requestFrom("203.0.113.1")
+		r.Header.Set("X-Probe-Token", "guess")
+		return r
+	}
+	for i := 0; i < 3; i++ {
+		if rr := serve(h, probe()); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	// The rejected tokens used up the failed authentication allowance, so
+	// the next one isn't looked up.
+	if rr := serve(h, probe()); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitProbeToken(t *testing.T) {
+	app := newTestDBApplication(t)
+	enableRateLimit(app, 1)
+	h := app.rateLimit(app.authenticate(app.rateLimitUser(okHandler)))
+
+	user := insertTestUser(t, app, "probe@example.com")
+	token, err := app.models.Tokens.New(user.ID, time.Hour, data.ScopeProbe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		r := requestFrom("203.0.113.1")
+		r.Header.Set("X-Probe-Token", token.Plaintext)
+		if rr := serve(h, r); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d; want %d", i+1, rr.Code, http.StatusOK)
+		}
+	}
+
+	// Only the requests sending the token are exempt.
+	if rr := serve(h, requestFrom("203.0.113.1")); rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	if rr := serve(h, requestFrom("203.0.113.1")); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestReadOnlyToken(t *testing.T) {
+	app := newTestApplication(t)
+
+	readOnly := func(method string) *http.Request {
+		r := httptest.NewRequest(method, "/", nil)
+		r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+		r = app.contextSetPermissions(r, data.Permissions{"musics:read", "musics:write"})
+		return app.contextSetReadOnly(r, true)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    int
+	}{
+		{"read permission", app.requirePermission("musics:read", okHandler), http.StatusOK},
+		{"write permission", app.requirePermission("musics:write", okHandler), http.StatusForbidden},
+		{"any of read and write", app.requireAnyPermission([]string{"musics:write", "musics:read"}, okHandler), http.StatusOK},
+		{"only write", app.requireAnyPermission([]string{"musics:write"}, okHandler), http.StatusForbidden},
+		{"account change", app.requireActivatedUser(app.requireWritableToken(okHandler)), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := serve(tt.handler, readOnly(http.MethodPost)); rr.Code != tt.want {
+				t.Errorf("got status %d; want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOnlyTokenRoutes(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+
+	user := insertTestUser(t, app, "reader@example.com", "musics:read", "musics:write")
+	token := newTestToken(t, app, user, true)
+
+	send := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Content-Type", "application/json")
+		return serve(h, r).Code
+	}
+
+	if code := send(http.MethodGet, "/v1/musics", ""); code != http.StatusOK {
+		t.Errorf("GET /v1/musics: got status %d; want %d", code, http.StatusOK)
+	}
+
+	forbidden := []struct{ method, path, body string }{
+		{http.MethodPost, "/v1/musics", `{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}`},
+		{http.MethodPatch, "/v1/me", `{"name":"Someone Else"}`},
+		{http.MethodPost, "/v1/me/email", `{"email":"new@example.com"}`},
+		{http.MethodPost, "/v1/me/searches", `{"name":"pop","query":"genres=pop"}`},
+		{http.MethodDelete, "/v1/me/searches/1", ""},
+		{http.MethodPost, "/v1/me/2fa/setup", `{"password":"pa55word"}`},
+		{http.MethodPost, "/v1/me/2fa/confirm", `{"password":"pa55word","code":"123456"}`},
+		{http.MethodPut, "/v1/me/password", `{"current_password":"pa55word","password":"newpa55word"}`},
+		{http.MethodDelete, "/v1/tokens/authentication/all", ""},
+	}
+	for _, req := range forbidden {
+		if code := send(req.method, req.path, req.body); code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d; want %d", req.method, req.path, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestRecoverPanicDebug(t *testing.T) {
+	app := newTestApplication(t)
+
+	// signedIn stands in for authenticate, which runs inside recoverPanic.
+	signedIn := func(permissions data.Permissions, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+			next.ServeHTTP(w, app.contextSetPermissions(r, permissions))
+		})
+	}
+	panics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	tests := []struct {
+		name        string
+		permissions data.Permissions
+		wantDebug   bool
+	}{
+		{"admin", data.Permissions{"admin"}, true},
+		{"other user", data.Permissions{"musics:read"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := app.recoverPanic(signedIn(tt.permissions, panics))
+			rr := serve(h, httptest.NewRequest(http.MethodGet, "/v1/musics", nil))
+			if rr.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+			}
+
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body.Error.Debug != nil; got != tt.wantDebug {
+				t.Fatalf("got debug detail %t; want %t", got, tt.wantDebug)
+			}
+			if tt.wantDebug && (body.Error.Debug.Error != "boom" || len(body.Error.Debug.Stack) == 0) {
+				t.Errorf("got debug detail %+v; want the panic and its stack", body.Error.Debug)
+			}
+		})
+	}
+}
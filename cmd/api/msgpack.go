@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/SPA-Final/musicdb/internal/msgpack"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// msgpackMediaType is the MessagePack media type, which clients opt in to
+// through Accept and, for bodies, Content-Type. The unofficial
+// application/x-msgpack is accepted too.
+const msgpackMediaType = "application/msgpack"
+
+// writeMsgPack writes data as MessagePack, with the field names of its JSON
+// encoding, so a client can switch between the two without remapping.
+func (app *application) writeMsgPack(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
+	res, err := msgpack.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", msgpackMediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+	w.WriteHeader(status)
+	w.Write(res)
+	return nil
+}
+
+// msgpackRequest reports whether the body of r is a MessagePack document.
+func msgpackRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && formatMediaTypes[mediaType] == formatMsgPack
+}
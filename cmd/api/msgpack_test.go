@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/msgpack"
+)
+
+func TestCreateMusicMsgPack(t *testing.T) {
+	input := map[string]interface{}{
+		"title":      "Rock & Roll ☃",
+		"artist":     "Band",
+		"duration":   180,
+		"genres":     []string{"rock", "pop"},
+		"popularity": 0.25,
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+	}{
+		{"msgpack both ways", msgpackMediaType, msgpackMediaType},
+		{"unofficial media type", "application/x-msgpack", "application/x-msgpack"},
+		{"msgpack in, JSON out", msgpackMediaType, "application/json"},
+		{"JSON in, msgpack out", "application/json", msgpackMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			var inserted []driver.Value
+			db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+				now := time.Now()
+				switch {
+				case strings.HasPrefix(query, "INSERT INTO musics"):
+					inserted = args
+					return []string{"id", "created_at", "updated_at", "version"}, [][]driver.Value{{int64(1), now, now, int64(1)}}, nil
+				case strings.HasPrefix(query, "INSERT INTO outbox"):
+					return []string{"created_at"}, [][]driver.Value{{now}}, nil
+				}
+				return nil, nil, nil
+			})
+			defer db.Close()
+			app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+			var body []byte
+			var err error
+			if tt.contentType == "application/json" {
+				body, err = json.Marshal(input)
+			} else {
+				body, err = msgpack.Marshal(input)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/musics", bytes.NewReader(body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Accept", tt.accept)
+			rr := serve(http.HandlerFunc(app.createMusicHandler), r)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("got status %d; want %d: %q", rr.Code, http.StatusCreated, rr.Body)
+			}
+
+			// title, duration, genres, popularity, isrc, artist
+			if len(inserted) != 6 || inserted[0] != input["title"] || inserted[2] != "{\"rock\",\"pop\"}" || inserted[5] != input["artist"] {
+				t.Errorf("got insert arguments %q", inserted)
+			}
+
+			res := rr.Body.Bytes()
+			if !strings.HasPrefix(tt.accept, "application/json") {
+				if got := rr.Header().Get("Content-Type"); got != msgpackMediaType {
+					t.Errorf("got Content-Type %q; want %q", got, msgpackMediaType)
+				}
+				if res, err = msgpack.ToJSON(res); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var env struct {
+				Music data.Music `json:"music"`
+			}
+			if err := json.Unmarshal(res, &env); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]interface{}{
+				"title": env.Music.Title, "artist": env.Music.Artist, "duration": int(env.Music.Duration),
+				"genres": []string(env.Music.Genres), "popularity": float64(env.Music.Popularity),
+			}
+			if !reflect.DeepEqual(got, input) {
+				t.Errorf("got %v; want %v", got, input)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/mbz"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// maxMusicBrainzCandidates caps the limit parameter of the candidates
+	// listing.
+	maxMusicBrainzCandidates = 25
+	// musicBrainzWait bounds a candidates search, including the time spent
+	// queued behind other searches for the rate limit.
+	musicBrainzWait = 15 * time.Second
+)
+
+// musicBrainzCandidate is a recording that may be the one record :id is of.
+type musicBrainzCandidate struct {
+	mbz.Recording
+	// ISRCMatch is set when the recording carries the record's ISRC.
+	ISRCMatch bool `json:"isrc_match"`
+	// DurationDifference is the recording's duration minus the record's,
+	// in seconds; it's absent when MusicBrainz doesn't know the duration.
+	DurationDifference *int `json:"duration_difference,omitempty"`
+}
+
+// listMusicBrainzCandidatesHandler searches MusicBrainz for the recordings
+// record :id may be linked to, by its ISRC if it has one and otherwise by
+// title and artist. Candidates are ordered by the MusicBrainz score.
+func (app *application) listMusicBrainzCandidatesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	limit := app.readInt(r.URL.Query(), "limit", 5, v)
+	v.Check(limit >= 1 && limit <= maxMusicBrainzCandidates, "limit", validator.MsgRange, 1, maxMusicBrainzCandidates)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	music, err := app.models.Musics.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), musicBrainzWait)
+	defer cancel()
+
+	recordings, err := app.musicbrainz.SearchRecordings(ctx, mbz.Query{
+		ISRC:   music.ISRC,
+		Title:  music.Title,
+		Artist: music.Artist,
+		Limit:  limit,
+	})
+	if err != nil {
+		var mbzErr *mbz.Error
+		switch {
+		case errors.As(err, &mbzErr):
+			app.upstreamFailedResponse(w, r, "musicbrainz", err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	candidates := make([]musicBrainzCandidate, len(recordings))
+	for i, recording := range recordings {
+		candidates[i] = musicBrainzCandidate{Recording: recording}
+		for _, isrc := range recording.ISRCs {
+			if music.ISRC != "" && data.NormalizeISRC(isrc) == music.ISRC {
+				candidates[i].ISRCMatch = true
+			}
+		}
+		if recording.Duration > 0 {
+			difference := recording.Duration - int(music.Duration)
+			candidates[i].DurationDifference = &difference
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"candidates": candidates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
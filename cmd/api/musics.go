@@ -1,22 +1,30 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/filterexpr"
 	"github.com/SPA-Final/musicdb/internal/validator"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 func (app *application) createMusicHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Title      string   `json:"title"`
+		Artist     string   `json:"artist"`
 		Duration   int16    `json:"duration"`
 		Genres     []string `json:"genres"`
 		Popularity float32  `json:"popularity"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input, jsonStrict)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -24,6 +32,7 @@ func (app *application) createMusicHandler(w http.ResponseWriter, r *http.Reques
 
 	ms := &data.Music{
 		Title:      input.Title,
+		Artist:     input.Artist,
 		Duration:   input.Duration,
 		Popularity: input.Popularity,
 		Genres:     input.Genres,
@@ -36,16 +45,26 @@ func (app *application) createMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Musics.Insert(ms)
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		if err := app.models.Musics.InsertTx(tx, ms); err != nil {
+			return err
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicCreated, ms))
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.constraintErrorResponse(w, r, err)
 		return
 	}
 
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", ms.Id))
+	headers.Set("Location", fmt.Sprintf("/v%d/musics/%d", app.contextGetAPIVersion(r), ms.Id))
+
+	env := envelope{"music": ms}
+	if app.config.legacy.createEnvelope {
+		env["musics"] = ms
+	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"musics": ms}, headers)
+	err = app.writeEnvelope(w, r, http.StatusCreated, env, "music", headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -54,7 +73,14 @@ func (app *application) createMusicHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) showMusicHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	fields := app.readMusicFields(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
@@ -69,7 +95,86 @@ func (app *application) showMusicHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"music": music}, nil)
+	if app.notModified(w, r, etag(music.Id, music.Version), music.UpdatedAt) {
+		return
+	}
+
+	payload, err := selectFields(music, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"music": payload}, "music", nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) upsertMusicHandler(w http.ResponseWriter, r *http.Request) {
+	isrc := app.readISRCParam(r)
+
+	v := validator.New()
+	if data.ValidateISRC(v, isrc); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var input struct {
+		Title      string   `json:"title"`
+		Artist     string   `json:"artist"`
+		Duration   int16    `json:"duration"`
+		Genres     []string `json:"genres"`
+		Popularity float32  `json:"popularity"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	music := &data.Music{
+		ISRC:       isrc,
+		Title:      input.Title,
+		Artist:     input.Artist,
+		Duration:   input.Duration,
+		Popularity: input.Popularity,
+		Genres:     input.Genres,
+	}
+
+	if data.ValidateMovie(v, music); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var created bool
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		var err error
+		created, err = app.models.Musics.UpsertByISRCTx(tx, music)
+		if err != nil {
+			return err
+		}
+
+		event := data.EventMusicUpdated
+		if created {
+			event = data.EventMusicCreated
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(event, music))
+	})
+	if err != nil {
+		app.constraintErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	headers := make(http.Header)
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/v%d/musics/%d", app.contextGetAPIVersion(r), music.Id))
+	}
+
+	err = app.writeEnvelope(w, r, status, envelope{"music": music}, "music", headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -78,7 +183,7 @@ func (app *application) showMusicHandler(w http.ResponseWriter, r *http.Request)
 func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
@@ -93,22 +198,43 @@ func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if !app.ifMatch(r, music.Id, music.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	var input struct {
 		Title      *string  `json:"title"`
-		Duration   *int16   `json:"Duration"`
+		Artist     *string  `json:"artist"`
+		Duration   *int16   `json:"duration"`
 		Genres     []string `json:"genres"`
 		Popularity *float32 `json:"popularity"`
+		// MusicBrainzID links the record to a MusicBrainz recording; ""
+		// removes the link.
+		MusicBrainzID *string `json:"musicbrainz_id"`
 	}
 
-	err = app.readJSON(w, r, &input)
+	err = app.readJSON(w, r, &input, jsonStrict)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
+	// An update that supplies no fields would still bump the version.
+	if input.Title == nil && input.Artist == nil && input.Duration == nil && input.Genres == nil && input.Popularity == nil &&
+		input.MusicBrainzID == nil {
+		app.failedValidationResponse(w, r, map[string]validator.Message{
+			"body": {ID: validator.MsgNoUpdatableFields, Args: []interface{}{"title, artist, duration, genres, popularity, musicbrainz_id"}},
+		})
+		return
+	}
+
 	if input.Title != nil {
 		music.Title = *input.Title
 	}
+	if input.Artist != nil {
+		music.Artist = *input.Artist
+	}
 	if input.Duration != nil {
 		music.Duration = *input.Duration
 	}
@@ -118,20 +244,127 @@ func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Reques
 	if input.Popularity != nil {
 		music.Popularity = *input.Popularity
 	}
+	if input.MusicBrainzID != nil {
+		music.MusicBrainzID = data.NormalizeMusicBrainzID(*input.MusicBrainzID)
+	}
 
 	v := validator.New()
+	if music.MusicBrainzID != "" {
+		data.ValidateMusicBrainzID(v, music.MusicBrainzID)
+	}
 	if data.ValidateMovie(v, music); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Musics.Update(music)
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		if err := app.models.Musics.UpdateTx(tx, music); err != nil {
+			return err
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, music))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.constraintErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(music.Id, music.Version))
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"music": music}, "music", headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// replaceMusicHandler replaces every mutable field of music :id with those of
+// the body. Unlike updateMusicHandler, fields the body leaves out are reset.
+func (app *application) replaceMusicHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"music": music}, nil)
+	music, err := app.models.Musics.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, music.Id, music.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		ISRC       string   `json:"isrc"`
+		Title      string   `json:"title"`
+		Artist     string   `json:"artist"`
+		Duration   int16    `json:"duration"`
+		Genres     []string `json:"genres"`
+		Popularity float32  `json:"popularity"`
+		// MusicBrainzID is replaced like the other fields, so omitting it
+		// removes the link.
+		MusicBrainzID string `json:"musicbrainz_id"`
+	}
+
+	err = app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	music.ISRC = data.NormalizeISRC(input.ISRC)
+	music.Title = input.Title
+	music.Artist = input.Artist
+	music.Duration = input.Duration
+	music.Genres = input.Genres
+	music.Popularity = input.Popularity
+	music.MusicBrainzID = data.NormalizeMusicBrainzID(input.MusicBrainzID)
+
+	v := validator.New()
+	if music.ISRC != "" {
+		data.ValidateISRC(v, music.ISRC)
+	}
+	if music.MusicBrainzID != "" {
+		data.ValidateMusicBrainzID(v, music.MusicBrainzID)
+	}
+	if data.ValidateMovie(v, music); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		if err := app.models.Musics.UpdateTx(tx, music); err != nil {
+			return err
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, music))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.constraintErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(music.Id, music.Version))
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"music": music}, "music", headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -140,10 +373,26 @@ func (app *application) updateMusicHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) deleteMusicHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	err = app.models.Musics.Delete(id)
+
+	v := validator.New()
+	quiet := app.readBool(r.URL.Query(), "quiet", r.Header.Get("Prefer") == "return=minimal", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var music *data.Music
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		var err error
+		music, err = app.models.Musics.DeleteTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicDeleted, music))
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -154,40 +403,474 @@ func (app *application) deleteMusicHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "music successfully deleted"}, nil)
+	if quiet {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"message": "music successfully deleted", "music": music}, "music", nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+func (app *application) deleteMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+	}
+
+	v := validator.New()
+	input.IDs = app.readIDs(r.URL.Query(), "ids", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.IDs == nil && r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input, jsonStrict)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateIDs(v, input.IDs, 500); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var deleted, missing []int64
+	err := app.saveMusicChange(func(tx *sql.Tx) error {
+		var err error
+		deleted, missing, err = app.models.Musics.DeleteManyTx(tx, input.IDs)
+		if err != nil {
+			return err
+		}
+		// Only the ids are left to report of records deleted in bulk.
+		for _, id := range deleted {
+			e := &data.OutboxEvent{Event: data.EventMusicDeleted, MusicID: id, Payload: envelope{"id": id}}
+			if err := app.models.Outbox.InsertTx(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deleted": deleted, "missing": missing}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxRetagRecords caps how many records a single retag may touch.
+const maxRetagRecords = 10_000
+
+func (app *application) retagMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		AddGenres    []string `json:"add_genres"`
+		RemoveGenres []string `json:"remove_genres"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	filter := app.readMusicFilter(r.URL.Query(), v)
+	v.Check(len(input.AddGenres) != 0 || len(input.RemoveGenres) != 0, "body", validator.MsgRequiredOneOf, "add_genres, remove_genres")
+	v.Check(len(input.AddGenres) <= 5, "add_genres", validator.MsgMaxGenres, 5)
+	v.Check(validator.Unique(input.AddGenres), "add_genres", validator.MsgDuplicateValues)
+	v.Check(validator.Unique(input.RemoveGenres), "remove_genres", validator.MsgDuplicateValues)
+	for _, genre := range input.RemoveGenres {
+		v.Check(!validator.In(genre, input.AddGenres...), "remove_genres", validator.MsgOverlap, "add_genres")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.AddGenres == nil {
+		input.AddGenres = []string{}
+	}
+	if input.RemoveGenres == nil {
+		input.RemoveGenres = []string{}
+	}
+
+	var changed []*data.Music
+	var overflowing []int64
+	err = app.saveMusicChange(func(tx *sql.Tx) error {
+		var err error
+		changed, overflowing, err = app.models.Musics.RetagTx(tx, filter, input.AddGenres, input.RemoveGenres, maxRetagRecords)
+		if err != nil {
+			return err
+		}
+		for _, music := range changed {
+			if err := app.models.Outbox.InsertTx(tx, musicEvent(data.EventMusicUpdated, music)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyRecords):
+			v.AddError("filter", validator.MsgTooManyMatches, maxRetagRecords)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.constraintErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(overflowing) > 0 {
+		v.AddError("add_genres", validator.MsgGenreOverflow, 5, formatIDs(overflowing, 50))
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"changed_records": len(changed)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// formatIDs joins ids with commas, listing at most max of them.
+func formatIDs(ids []int64, max int) string {
+	parts := make([]string, 0, max+1)
+	for i, id := range ids {
+		if i == max {
+			parts = append(parts, fmt.Sprintf("… (+%d)", len(ids)-max))
+			break
+		}
+		parts = append(parts, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readMusicFilter reads the query parameters that select records for the
+// list and retag endpoints, so that both interpret them the same way.
+func (app *application) readMusicFilter(qs url.Values, v *validator.Validator) data.MusicFilter {
+	filter := data.MusicFilter{
+		Title:          app.readString(qs, "title", ""),
+		SearchMode:     app.readString(qs, "search_mode", data.SearchFullText),
+		FuzzyThreshold: app.config.search.fuzzyThreshold,
+		TitleExact:     app.readString(qs, "title_exact", ""),
+		Query:          app.readString(qs, "q", ""),
+		Genres:         app.readCSV(qs, "genres", []string{}),
+		GenresAny:      app.readCSV(qs, "genres_any", []string{}),
+		ExcludeGenres:  app.readCSV(qs, "exclude_genres", []string{}),
+		DurationMin:    app.readOptionalInt(qs, "duration_min", v),
+		DurationMax:    app.readOptionalInt(qs, "duration_max", v),
+		PopularityMin:  app.readOptionalFloat(qs, "popularity_min", v),
+		PopularityMax:  app.readOptionalFloat(qs, "popularity_max", v),
+		CreatedAfter:   app.readTime(qs, "created_after", v),
+		CreatedBefore:  app.readTime(qs, "created_before", v),
+	}
+	if s := qs.Get("filter"); s != "" {
+		expr, err := data.ParseMusicExpr(s)
+		var exprErr *filterexpr.Error
+		switch {
+		case errors.As(err, &exprErr):
+			v.AddError("filter", validator.MsgInvalidExpression, exprErr.Pos, exprErr.Msg)
+		default:
+			filter.Expr = expr
+		}
+	}
+	data.ValidateMusicFilter(v, filter)
+	return filter
+}
+
 func (app *application) listMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("saved_search") != "" {
+		if r = app.applySavedSearch(w, r); r == nil {
+			return
+		}
+	}
+
+	if r.URL.Query().Get("ids") != "" {
+		app.listMusicsByIDs(w, r)
+		return
+	}
+
 	var input struct {
-		Title  string
-		Genres []string
+		data.MusicFilter
 		data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
 
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	fields := app.readMusicFields(r, v)
+	input.MusicFilter = app.readMusicFilter(qs, v)
+	if app.readBool(qs, "highlight", false, v) {
+		input.Highlight = &data.Highlight{Start: app.config.search.highlightStart, Stop: app.config.search.highlightStop}
+	}
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "title", "duration", "popularity", "-id", "-title", "-duration", "-popularity"}
+	input.Filters.SkipCount = !app.readBool(qs, "include_count", true, v)
+	input.Filters.MaxOffset = app.config.pagination.maxOffset
+	input.Filters.MaxPageSize = app.maxPageSize(r)
+	// Fuzzy matches are only useful best first, so that's their default order.
+	defaultSort := "id"
+	if input.SearchMode == data.SearchFuzzy && input.Title != "" {
+		defaultSort = "relevance"
+	}
+	input.Filters.Sort = unversionedField(app.contextGetAPIVersion(r), app.readString(qs, "sort", defaultSort))
+	input.Filters.SortSafeList = musicSortSafeList
+	v.Check(input.Searches() || strings.TrimPrefix(input.Filters.Sort, "-") != "relevance", "sort", validator.MsgRelevanceNeedsTitle)
+
+	format := responseFormat(r)
+	v.Check(validator.In(format, formatJSON, formatCSV, formatNDJSON, formatXML, formatJSONAPI, formatMsgPack), "format", validator.MsgOneOf, "json, csv, ndjson, xml, jsonapi, msgpack")
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	musics, metadata, err := app.models.Musics.GetAll(input.Title, input.Genres, input.Filters)
+	addVary(w.Header(), "Accept")
+	switch format {
+	case formatCSV:
+		app.exportMusicsCSV(w, r, input.MusicFilter, input.Filters)
+		return
+	case formatNDJSON:
+		app.exportMusicsNDJSON(w, r, input.MusicFilter, input.Filters, fields)
+		return
+	}
+
+	musics, metadata, err := app.models.Musics.GetAll(input.MusicFilter, input.Filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	payload, err := selectFields(musics, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	if !input.Filters.SkipCount {
+		headers.Set("X-Total-Count", strconv.Itoa(metadata.TotalRecords))
+	}
+	app.setPageURLs(r, &metadata)
+
+	// Added straight to w so that a successor-version Link survives.
+	if links := paginationLinks(r, metadata); links != "" {
+		w.Header().Add("Link", links)
+	}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"musics": payload, "metadata": metadata}, "musics", headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// musicSortSafeList holds the sort values the music listing accepts, by their
+// v1 names.
+var musicSortSafeList = data.MusicSortSafeList
+
+// suggestMusicsHandler completes the title prefix in ?q= for type-ahead
+// search. It answers with a bare list, without the listing metadata.
+func (app *application) suggestMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	prefix := strings.TrimSpace(r.URL.Query().Get("q"))
+	v.Check(prefix != "", "q", validator.MsgRequired)
+	v.Check(utf8.RuneCountInString(prefix) >= 2, "q", validator.MsgMinChars, 2)
+	v.Check(len(prefix) <= 500, "q", validator.MsgMaxBytes, 500)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Musics.Suggest(prefix, 10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"suggestions": suggestions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// countMusicsHandler returns how many records match the list endpoint's filter
+// parameters. Parameters that only shape a page are rejected.
+func (app *application) countMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filter := app.readMusicFilter(qs, v)
+	for _, key := range []string{"page", "page_size", "sort", "fields"} {
+		_, ok := qs[key]
+		v.Check(!ok, key, validator.MsgNotSupported)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	count, err := app.models.Musics.Count(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"count": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// recentMusicsHandler lists the records created in the last days days, newest
+// first. The listing is cheap to serve slightly stale, so shared caches may
+// keep it for a minute.
+func (app *application) recentMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	fields := app.readMusicFields(r, v)
+	days := app.readInt(qs, "days", 7, v)
+	limit := app.readInt(qs, "limit", 20, v)
+	v.Check(days >= 1 && days <= 90, "days", validator.MsgRange, 1, 90)
+	v.Check(limit >= 1 && limit <= 100, "limit", validator.MsgRange, 1, 100)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -days).UTC().Truncate(time.Second)
+	filter := data.MusicFilter{CreatedAfter: &since}
+	filters := data.Filters{
+		Page:         1,
+		PageSize:     limit,
+		Sort:         "-created_at",
+		SortSafeList: []string{"-created_at"},
+		SkipCount:    true,
+	}
+
+	musics, _, err := app.models.Musics.GetAll(filter, filters)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	payload, err := selectFields(musics, fields)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"musics": musics, "metadata": metadata}, nil)
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=60")
+
+	metadata := envelope{"days": days, "since": since, "limit": limit}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"musics": payload, "metadata": metadata}, "musics", headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxRandomMusics caps the count parameter of randomMusicsHandler.
+const maxRandomMusics = 50
+
+// randomMusicsHandler returns count (1 by default) distinct random records
+// matching the same filter parameters as the list endpoint. Passing seed
+// makes the selection repeatable.
+func (app *application) randomMusicsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	fields := app.readMusicFields(r, v)
+	filter := app.readMusicFilter(qs, v)
+	count := app.readInt(qs, "count", 1, v)
+	v.Check(count >= 1 && count <= maxRandomMusics, "count", validator.MsgRange, 1, maxRandomMusics)
+	var seed *int64
+	if s := app.readOptionalInt(qs, "seed", v); s != nil {
+		seed = new(int64)
+		*seed = int64(*s)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	musics, err := app.models.Musics.GetRandom(filter, count, seed)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	payload, err := selectFields(musics, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"musics": payload}, "musics", nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMusicsByIDs(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	fields := app.readMusicFields(r, v)
+	ids := app.readIDs(r.URL.Query(), "ids", v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if data.ValidateIDs(v, ids, 200); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	musics, err := app.models.Musics.GetMany(ids)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	payload, err := selectFields(musics, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	metadata := envelope{"requested_records": len(ids), "found_records": len(musics)}
+
+	err = app.writeEnvelope(w, r, http.StatusOK, envelope{"musics": payload, "metadata": metadata}, "musics", nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
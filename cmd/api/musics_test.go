@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertTestMusic adds a record with every optional field filled in.
+func insertTestMusic(t *testing.T, app *application) *data.Music {
+	t.Helper()
+
+	music := &data.Music{
+		ISRC:       "USS1Z9900001",
+		Title:      "Song",
+		Artist:     "Band",
+		Duration:   180,
+		Genres:     []string{"pop"},
+		Popularity: 0.5,
+	}
+	if err := app.models.Musics.Insert(music); err != nil {
+		t.Fatal(err)
+	}
+	music.MusicBrainzID = "5b11f4ce-a62d-471e-81fc-a69a8278c7da"
+	if err := app.models.Musics.Update(music); err != nil {
+		t.Fatal(err)
+	}
+	return music
+}
+
+// sendAs sends a request with a JSON body to h, authenticated with token
+// unless it's empty.
+func sendAs(h http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return serve(h, r)
+}
+
+// musicPath returns the path of music under /v1.
+func musicPath(music *data.Music) string {
+	return "/v1/musics/" + strconv.FormatInt(music.Id, 10)
+}
+
+func TestReplaceAndUpdateOmittedFields(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+
+	user := insertTestUser(t, app, "editor@example.com", "musics:read", "musics:write")
+	token := newTestToken(t, app, user, false)
+
+	// fields are those of a record the two verbs treat differently.
+	type fields struct {
+		Title, ISRC, Artist, MusicBrainzID string
+		Duration                           int16
+		Popularity                         float32
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   fields
+	}{
+		{
+			"PATCH keeps omitted fields",
+			http.MethodPatch,
+			`{"title":"Patched"}`,
+			fields{Title: "Patched", ISRC: "USS1Z9900001", Artist: "Band", MusicBrainzID: "5b11f4ce-a62d-471e-81fc-a69a8278c7da", Duration: 180, Popularity: 0.5},
+		},
+		{
+			"PUT resets omitted fields",
+			http.MethodPut,
+			`{"title":"Replaced","duration":200,"genres":["rock"],"popularity":0.4}`,
+			fields{Title: "Replaced", Duration: 200, Popularity: 0.4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			music := insertTestMusic(t, app)
+			rr := sendAs(h, token, tt.method, musicPath(music), tt.body)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			saved, err := app.models.Musics.Get(music.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fields{saved.Title, saved.ISRC, saved.Artist, saved.MusicBrainzID, saved.Duration, saved.Popularity}
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			if saved.Version != music.Version+1 {
+				t.Errorf("got version %d; want %d", saved.Version, music.Version+1)
+			}
+		})
+	}
+}
+
+func TestReplaceRequiresEveryField(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+
+	user := insertTestUser(t, app, "editor@example.com", "musics:read", "musics:write")
+	token := newTestToken(t, app, user, false)
+	music := insertTestMusic(t, app)
+
+	rr := sendAs(h, token, http.MethodPut, musicPath(music), `{"title":"Replaced"}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestShowMusicETag(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+
+	music := insertTestMusic(t, app)
+	current := etag(music.Id, music.Version)
+	stale := etag(music.Id, music.Version-1)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{"no header", "", http.StatusOK},
+		{"matching", current, http.StatusNotModified},
+		{"not matching", stale, http.StatusOK},
+		{"list containing it", stale + ", " + current, http.StatusNotModified},
+		{"list without it", stale + `, W/"0-1"`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, musicPath(music), nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			rr := serve(h, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.want)
+			}
+			if got := rr.Header().Get("ETag"); got != current {
+				t.Errorf("got ETag %q; want %q", got, current)
+			}
+			if tt.want == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("got body %q on a 304", rr.Body)
+			}
+		})
+	}
+
+	// An update bumps the version, so the tag the client holds stops
+	// matching.
+	if err := app.models.Musics.Update(music); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, musicPath(music), nil)
+	r.Header.Set("If-None-Match", current)
+	rr := serve(h, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("after update: got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("ETag"); got == current {
+		t.Errorf("after update: ETag still %q", got)
+	}
+}
+
+func TestShowMusicModifiedInSameSecond(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	music := insertTestMusic(t, app)
+
+	rr := serve(h, httptest.NewRequest(http.MethodGet, musicPath(music), nil))
+	lastModified := rr.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatal("missing Last-Modified header")
+	}
+
+	conditional := func() int {
+		r := httptest.NewRequest(http.MethodGet, musicPath(music), nil)
+		r.Header.Set("If-Modified-Since", lastModified)
+		return serve(h, r).Code
+	}
+	if code := conditional(); code != http.StatusNotModified {
+		t.Fatalf("unchanged: got status %d; want %d", code, http.StatusNotModified)
+	}
+
+	// Updated within the second Last-Modified names, the record must still
+	// count as modified since.
+	if err := app.models.Musics.Update(music); err != nil {
+		t.Fatal(err)
+	}
+	if code := conditional(); code != http.StatusOK {
+		t.Errorf("updated: got status %d; want %d", code, http.StatusOK)
+	}
+}
+
+// stubMusicRow is the row of musicColumns for a record with id 1 at version
+// 1.
+func stubMusicRow() (columns []string, row []driver.Value) {
+	now := time.Now()
+	columns = []string{"id", "isrc", "title", "artist", "duration", "genres", "popularity", "created_at", "updated_at", "version",
+		"enrichment_source", "enriched_at", "musicbrainz_id"}
+	row = []driver.Value{int64(1), "", "Song", "Band", int64(180), []byte("{pop}"), 0.5, now, now, int64(1), "", nil, ""}
+	return columns, row
+}
+
+// stubMusic is the stubMusicRow row with the named columns set to other
+// values, so that stubs name only the columns they care about.
+func stubMusic(set map[string]driver.Value) []driver.Value {
+	columns, row := stubMusicRow()
+	for name, value := range set {
+		i := 0
+		for i < len(columns) && columns[i] != name {
+			i++
+		}
+		if i == len(columns) {
+			panic("stubMusic: no column " + name)
+		}
+		row[i] = value
+	}
+	return row
+}
+
+// stubListColumns are the columns of a music listing: the window count, the
+// search rank and headline, then those of stubMusicRow.
+func stubListColumns() []string {
+	columns, _ := stubMusicRow()
+	return append([]string{"total", "rank", "headline"}, columns...)
+}
+
+// stubListRow is the listing row of music, a row of stubMusicRow columns,
+// with total as the window count and no rank or headline.
+func stubListRow(total int64, music []driver.Value) []driver.Value {
+	return append([]driver.Value{total, nil, nil}, music...)
+}
+
+func TestUpdateMusicEditConflict(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The record is found, but has moved on by the time it's saved: the
+	// UPDATE matches no row at the version read.
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "UPDATE musics") {
+			return []string{"version", "updated_at"}, nil, nil
+		}
+		columns, row := stubMusicRow()
+		return columns, [][]driver.Value{row}, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"PATCH", http.MethodPatch, app.updateMusicHandler, `{"title":"Edited"}`},
+		{"PUT", http.MethodPut, app.replaceMusicHandler, `{"title":"Edited","duration":180,"genres":["pop"],"popularity":0.5}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/musics/1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+
+			rr := serve(tt.handler, withIDParam(r, "1"))
+			if rr.Code != http.StatusConflict {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusConflict, rr.Body)
+			}
+
+			var body map[string]map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			apiErr, ok := body["error"]
+			if !ok || len(body) != 1 {
+				t.Fatalf("got body %s; want only an error object", rr.Body)
+			}
+			if apiErr["code"] != codeEditConflict {
+				t.Errorf("got code %v; want %q", apiErr["code"], codeEditConflict)
+			}
+			if message, _ := apiErr["message"].(string); !strings.Contains(message, "re-fetch") {
+				t.Errorf("got message %q; want it to tell the client to re-fetch", message)
+			}
+		})
+	}
+}
+
+func TestMusicIDParam(t *testing.T) {
+	app := newTestApplication(t)
+
+	// No record exists, so well-formed ids are looked up and not found.
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		columns, _ := stubMusicRow()
+		return columns, nil, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	handlers := []struct {
+		method  string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{http.MethodGet, app.showMusicHandler, ""},
+		{http.MethodPatch, app.updateMusicHandler, `{"title":"Edited"}`},
+		{http.MethodDelete, app.deleteMusicHandler, ""},
+	}
+	ids := []struct {
+		name        string
+		id          string
+		want        int
+		wantMessage string
+	}{
+		{"non-numeric", "abc", http.StatusBadRequest, errInvalidIDParam.Error()},
+		{"negative", "-3", http.StatusBadRequest, errInvalidIDParam.Error()},
+		{"zero", "0", http.StatusBadRequest, errInvalidIDParam.Error()},
+		{"overflow", "9223372036854775808", http.StatusBadRequest, errIDParamOutOfRange.Error()},
+		{"no such record", "99", http.StatusNotFound, ""},
+	}
+
+	for _, h := range handlers {
+		for _, tt := range ids {
+			t.Run(h.method+" "+tt.name, func(t *testing.T) {
+				r := httptest.NewRequest(h.method, "/v1/musics/"+tt.id, strings.NewReader(h.body))
+				if h.body != "" {
+					r.Header.Set("Content-Type", "application/json")
+				}
+
+				rr := serve(h.handler, withIDParam(r, tt.id))
+				if rr.Code != tt.want {
+					t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+				}
+				if tt.wantMessage == "" {
+					return
+				}
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Error.Message != tt.wantMessage {
+					t.Errorf("got message %q; want %q", body.Error.Message, tt.wantMessage)
+				}
+			})
+		}
+	}
+}
+
+// openMusicStubDB returns a database on which every music write succeeds and
+// reads find the record of stubMusicRow.
+func openMusicStubDB() *sql.DB {
+	return openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		now := time.Now()
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO musics"):
+			return []string{"id", "created_at", "updated_at", "version"}, [][]driver.Value{{int64(1), now, now, int64(1)}}, nil
+		case strings.HasPrefix(query, "INSERT INTO outbox"):
+			return []string{"created_at"}, [][]driver.Value{{now}}, nil
+		case strings.HasPrefix(query, "UPDATE musics"):
+			return []string{"version", "updated_at"}, [][]driver.Value{{int64(2), now}}, nil
+		}
+		columns, row := stubMusicRow()
+		return columns, [][]driver.Value{row}, nil
+	})
+}
+
+func TestMusicResponseShape(t *testing.T) {
+	const body = `{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}`
+
+	tests := []struct {
+		name         string
+		legacy       bool
+		method       string
+		handler      func(app *application) http.HandlerFunc
+		body         string
+		wantStatus   int
+		wantKeys     []string
+		wantLocation string
+	}{
+		{"create", false, http.MethodPost, func(app *application) http.HandlerFunc { return app.createMusicHandler }, body,
+			http.StatusCreated, []string{"music"}, "/v1/musics/1"},
+		{"create with legacy key", true, http.MethodPost, func(app *application) http.HandlerFunc { return app.createMusicHandler }, body,
+			http.StatusCreated, []string{"music", "musics"}, "/v1/musics/1"},
+		{"show", true, http.MethodGet, func(app *application) http.HandlerFunc { return app.showMusicHandler }, "",
+			http.StatusOK, []string{"music"}, ""},
+		{"update", true, http.MethodPatch, func(app *application) http.HandlerFunc { return app.updateMusicHandler }, `{"title":"Edited"}`,
+			http.StatusOK, []string{"music"}, ""},
+		{"replace", true, http.MethodPut, func(app *application) http.HandlerFunc { return app.replaceMusicHandler }, body,
+			http.StatusOK, []string{"music"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.legacy.createEnvelope = tt.legacy
+			db := openMusicStubDB()
+			defer db.Close()
+			app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+			r := httptest.NewRequest(tt.method, "/v1/musics/1", strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+
+			rr := serve(tt.handler(app), withIDParam(r, "1"))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if got := rr.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("got Location %q; want %q", got, tt.wantLocation)
+			}
+
+			var env map[string]map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &env); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for key, music := range env {
+				keys = append(keys, key)
+				if music["id"] != 1.0 {
+					t.Errorf("%q: got id %v; want 1", key, music["id"])
+				}
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("got envelope keys %v; want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	app := newTestApplication(t)
+
+	columns, row := stubMusicRow()
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT count(*) FROM"):
+			return []string{"count"}, [][]driver.Value{{int64(3)}}, nil
+		case strings.Contains(query, "AS rank"):
+			return stubListColumns(), [][]driver.Value{stubListRow(3, row)}, nil
+		}
+		return columns, [][]driver.Value{row}, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+	// The transport asks for gzip on GET only; compare identity encodings.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		name  string
+		path  string
+		total string
+	}{
+		{"list", "/v1/musics", "3"},
+		{"filtered list", "/v1/musics?title=song", "3"},
+		{"uncounted list", "/v1/musics?include_count=false", ""},
+		{"show", "/v1/musics/1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get, err := client.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			get.Body.Close()
+			head, err := client.Head(srv.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(head.Body)
+			head.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if get.StatusCode != http.StatusOK || head.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d for GET and %d for HEAD; want %d", get.StatusCode, head.StatusCode, http.StatusOK)
+			}
+			if len(body) != 0 {
+				t.Errorf("got HEAD body %q; want none", body)
+			}
+			if get.Header.Get("Content-Length") == "" {
+				t.Error("got no Content-Length")
+			}
+			if got := get.Header.Get("X-Total-Count"); got != tt.total {
+				t.Errorf("got X-Total-Count %q; want %q", got, tt.total)
+			}
+			for _, name := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified", "X-Total-Count", "Link"} {
+				if got, want := head.Header.Get(name), get.Header.Get(name); got != want {
+					t.Errorf("got HEAD %s %q; want %q as for GET", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListMusicsFilterValidation(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name    string
+		query   string
+		wantKey string
+	}{
+		{"empty genres_any element", "genres_any=rock,,pop", "genres_any"},
+		{"trailing genres_any comma", "genres_any=rock,", "genres_any"},
+		{"excluded genre also included", "genres=rock,metal&exclude_genres=metal", "exclude_genres"},
+		{"excluded genre also in genres_any", "genres_any=pop,rap&exclude_genres=rap", "exclude_genres"},
+		{"title_exact with title", "title=run&title_exact=run", "title_exact"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(http.HandlerFunc(app.listMusicsHandler), httptest.NewRequest(http.MethodGet, "/v1/musics?"+tt.query, nil))
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := body.Error.Fields[tt.wantKey]; !ok || len(body.Error.Fields) != 1 {
+				t.Errorf("got fields %v; want only %s", body.Error.Fields, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMusicListingsQueryTimeout(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Every query outlives the timeout, so each listing runs out of time.
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil, context.DeadlineExceeded
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, 10*time.Millisecond)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+	}{
+		{"list", app.listMusicsHandler, "/v1/musics"},
+		{"count", app.countMusicsHandler, "/v1/musics/count"},
+		{"recent", app.recentMusicsHandler, "/v1/musics/recent"},
+		{"random", app.randomMusicsHandler, "/v1/musics/random"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(tt.handler, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want %d; body %s", rr.Code, http.StatusServiceUnavailable, rr.Body)
+			}
+			if got := rr.Header().Get("Retry-After"); got != "5" {
+				t.Errorf("Retry-After = %q, want %q", got, "5")
+			}
+		})
+	}
+}
+
+func TestListMusicsSkipCount(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The catalogue holds five records; the stub answers a listing with the
+	// rows its LIMIT and OFFSET select.
+	const records = 5
+	var queries []string
+	var limit int64
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		queries = append(queries, query)
+		if !strings.Contains(query, "AS rank") {
+			t.Errorf("unexpected query %q", query)
+			return nil, nil, nil
+		}
+		offset := args[len(args)-1].(int64)
+		limit = args[len(args)-2].(int64)
+		var rows [][]driver.Value
+		for id := offset + 1; id <= offset+limit && id <= records; id++ {
+			rows = append(rows, stubListRow(0, stubMusic(map[string]driver.Value{"id": id})))
+		}
+		return stubListColumns(), rows, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	tests := []struct {
+		name     string
+		query    string
+		pageSize int64
+		wantIDs  []int64
+		hasMore  bool
+	}{
+		{"first page", "page=1", 2, []int64{1, 2}, true},
+		{"page ending the listing", "page=3", 2, []int64{5}, false},
+		{"page exactly at the end", "page=1", 5, []int64{1, 2, 3, 4, 5}, false},
+		{"page past the end", "page=4", 2, []int64{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries = nil
+			target := fmt.Sprintf("/v1/musics?genres=pop&include_count=false&%s&page_size=%d", tt.query, tt.pageSize)
+			rr := serve(http.HandlerFunc(app.listMusicsHandler), httptest.NewRequest(http.MethodGet, target, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			if len(queries) != 1 {
+				t.Fatalf("got %d queries; want only the page", len(queries))
+			}
+			if strings.Contains(queries[0], "OVER()") {
+				t.Errorf("got a counting query without a count: %s", queries[0])
+			}
+			// One row more than the page tells whether another follows.
+			if limit != tt.pageSize+1 {
+				t.Errorf("got LIMIT %d; want %d", limit, tt.pageSize+1)
+			}
+			if rr.Header().Get("X-Total-Count") != "" {
+				t.Errorf("got X-Total-Count %q; want none", rr.Header().Get("X-Total-Count"))
+			}
+
+			var body struct {
+				Musics []struct {
+					ID int64 `json:"id"`
+				} `json:"musics"`
+				Metadata map[string]interface{} `json:"metadata"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			ids := []int64{}
+			for _, m := range body.Musics {
+				ids = append(ids, m.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("got ids %v; want %v", ids, tt.wantIDs)
+			}
+
+			md := body.Metadata
+			if md["has_more"] != tt.hasMore || md["count"] != data.CountSkipped {
+				t.Errorf("got has_more %v, count %v; want %t, %q", md["has_more"], md["count"], tt.hasMore, data.CountSkipped)
+			}
+			for _, key := range []string{"total_records", "last_page"} {
+				if _, ok := md[key]; ok {
+					t.Errorf("got %s %v in uncounted metadata", key, md[key])
+				}
+			}
+			if next := md["next_page_url"]; (next != nil) != tt.hasMore {
+				t.Errorf("got next_page_url %v with has_more %t", next, tt.hasMore)
+			}
+		})
+	}
+
+	// Counted, the same listing does use the window function.
+	queries = nil
+	serve(http.HandlerFunc(app.listMusicsHandler), httptest.NewRequest(http.MethodGet, "/v1/musics?genres=pop", nil))
+	if len(queries) == 0 || !strings.Contains(queries[0], "count(*) OVER()") {
+		t.Errorf("got queries %q; want a counted page", queries)
+	}
+}
+
+func TestSuggestMusics(t *testing.T) {
+	app := newTestApplication(t)
+
+	// The stub answers the LIKE the way Postgres would for a pattern without
+	// escapes: titles starting with the pattern's lower-cased prefix, up to
+	// LIMIT of them.
+	titles := []string{"Other Song", "Sonata", "Song 0", "Song 1", "Song 2", "Song 3", "Song 4", "Song 5", "Song 6", "Song 7", "Song 8", "Song 9", "Song 10", "Song 11"}
+	var pattern string
+	var limit int64
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		pattern = args[0].(string)
+		limit = args[1].(int64)
+		var rows [][]driver.Value
+		for i, title := range titles {
+			if int64(len(rows)) < limit && strings.HasPrefix(strings.ToLower(title), strings.TrimSuffix(pattern, "%")) {
+				rows = append(rows, []driver.Value{int64(i + 1), title, "Band"})
+			}
+		}
+		return []string{"id", "title", "artist"}, rows, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	tests := []struct {
+		name        string
+		q           string
+		wantPattern string
+		wantTitles  []string
+	}{
+		{"prefix", "Ot", "ot%", []string{"Other Song"}},
+		{"prefix ignoring case", "SONA", "sona%", []string{"Sonata"}},
+		{"surrounding spaces", "  son  ", "son%", []string{"Sonata", "Song 0", "Song 1", "Song 2", "Song 3", "Song 4", "Song 5", "Song 6", "Song 7", "Song 8"}},
+		{"wildcards", "5_%", `5\_\%%`, []string{}},
+		{"two runes", "éa", "éa%", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/v1/musics/suggest?q=" + url.QueryEscape(tt.q)
+			rr := serve(http.HandlerFunc(app.suggestMusicsHandler), httptest.NewRequest(http.MethodGet, target, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+			if pattern != tt.wantPattern {
+				t.Errorf("got pattern %q; want %q", pattern, tt.wantPattern)
+			}
+			// However many titles match, no more than ten come back.
+			if limit != 10 {
+				t.Errorf("got LIMIT %d; want 10", limit)
+			}
+
+			var body struct {
+				Suggestions []data.Suggestion `json:"suggestions"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, s := range body.Suggestions {
+				got = append(got, s.Title)
+			}
+			if body.Suggestions == nil || !reflect.DeepEqual(got, tt.wantTitles) {
+				t.Errorf("got %s; want titles %q", rr.Body, tt.wantTitles)
+			}
+		})
+	}
+
+	refused := []struct {
+		name string
+		q    string
+	}{
+		{"missing", ""},
+		{"only spaces", "   "},
+		{"one rune", "s"},
+		{"one rune after trimming", " s "},
+		{"one two-byte rune", "é"},
+		{"too long", strings.Repeat("s", 501)},
+	}
+	for _, tt := range refused {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern = ""
+			target := "/v1/musics/suggest?q=" + url.QueryEscape(tt.q)
+			rr := serve(http.HandlerFunc(app.suggestMusicsHandler), httptest.NewRequest(http.MethodGet, target, nil))
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+			if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["q"] == "" {
+				t.Errorf("got fields %v; want only q", fields)
+			}
+			if pattern != "" {
+				t.Errorf("got a query for pattern %q", pattern)
+			}
+		})
+	}
+}
+
+func TestRandomMusics(t *testing.T) {
+	app := newTestApplication(t)
+
+	// Three records are rock; the stub answers the pick with the first
+	// offsets it's asked for.
+	columns, _ := stubMusicRow()
+	var countArgs []driver.Value
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SELECT count(*) FROM") {
+			countArgs = args
+			total := int64(0)
+			if len(args) == 1 && strings.Contains(fmt.Sprint(args[0]), "rock") {
+				total = 3
+			}
+			return []string{"count"}, [][]driver.Value{{total}}, nil
+		}
+		rows := [][]driver.Value{
+			stubMusic(map[string]driver.Value{"id": int64(1)}),
+			stubMusic(map[string]driver.Value{"id": int64(2)}),
+		}
+		return columns, rows, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	rr := serve(http.HandlerFunc(app.randomMusicsHandler), httptest.NewRequest(http.MethodGet, "/v1/musics/random?genres=rock&count=2", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if len(countArgs) != 1 || !strings.Contains(fmt.Sprint(countArgs[0]), "rock") {
+		t.Errorf("counted with args %v; want the genres filter", countArgs)
+	}
+	var body struct {
+		Musics []struct {
+			ID int64 `json:"id"`
+		} `json:"musics"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Musics) != 2 {
+		t.Errorf("got %s; want two records", rr.Body)
+	}
+
+	// Nothing to pick from is a 404, not an empty list.
+	rr = serve(http.HandlerFunc(app.randomMusicsHandler), httptest.NewRequest(http.MethodGet, "/v1/musics/random?genres=jazz", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("no matches: got status %d; want %d: %s", rr.Code, http.StatusNotFound, rr.Body)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// routeDoc describes a route for the OpenAPI document. Body and the values
+// of Response are samples whose types the schemas are derived from, so a
+// zero value of the right type is all that's needed.
+type routeDoc struct {
+	Summary string
+	// Auth is "authenticated" or "activated" for routes needing a user, a
+	// permission code for routes needing that permission, and empty for
+	// public routes.
+	Auth  string
+	Query []queryParam
+	Body  interface{}
+	// Status is the success status, 200 when zero.
+	Status   int
+	Response envelope
+	// Key names the primary payload of a Response written with
+	// writeEnvelope, which v2 sends without the envelope.
+	Key string
+	// ContentType is the success media type when it isn't JSON.
+	ContentType string
+}
+
+// queryParam describes a query string parameter and the values it accepts.
+type queryParam struct {
+	Name        string
+	Description string
+	Schema      map[string]interface{}
+}
+
+// registeredRoute is a route as routes() wired it up.
+type registeredRoute struct {
+	Method  string
+	Path    string
+	Version int
+	Doc     routeDoc
+}
+
+// handle registers handler on router and records the route for the OpenAPI
+// document.
+func (app *application) handle(router *httprouter.Router, method, path string, handler http.HandlerFunc, doc routeDoc) {
+	router.HandlerFunc(method, path, handler)
+	app.registeredRoutes = append(app.registeredRoutes, registeredRoute{Method: method, Path: path, Version: apiV1, Doc: doc})
+}
+
+// musicQuery documents the filter, sort and pagination parameters of the
+// music listing.
+func (app *application) musicQuery() []queryParam {
+	maxPageSize := app.config.pagination.maxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = data.DefaultMaxPageSize
+	}
+
+	return []queryParam{
+		{"title", "Full-text or, with search_mode=fuzzy, trigram search on the title", map[string]interface{}{"type": "string"}},
+		{"search_mode", "How title is matched", map[string]interface{}{"type": "string", "enum": []string{data.SearchFullText, data.SearchFuzzy}, "default": data.SearchFullText}},
+		{"title_exact", "Exact title, ignoring case and accents; not combinable with title", map[string]interface{}{"type": "string"}},
+		{"q", "Full-text search across title, artist and genres; not combinable with title", map[string]interface{}{"type": "string"}},
+		{"genres", "Comma separated genres a record must all have", map[string]interface{}{"type": "string"}},
+		{"genres_any", "Comma separated genres a record must have at least one of", map[string]interface{}{"type": "string"}},
+		{"exclude_genres", "Comma separated genres a record must have none of", map[string]interface{}{"type": "string"}},
+		{"filter", "Boolean filter expression, e.g. duration > 180 AND NOT genre = 'pop'", map[string]interface{}{"type": "string", "maxLength": 1000}},
+		{"page", "Page number", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10_000_000, "default": 1}},
+		{"page_size", "Records per page", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxPageSize, "default": 20}},
+		{"sort", "Sort key, descending with a leading -; relevance needs a title or q search", map[string]interface{}{"type": "string", "enum": musicSortSafeList, "default": "id"}},
+		{"include_count", "Whether to count the matching records", map[string]interface{}{"type": "boolean", "default": true}},
+		{"fields", "Comma separated fields to return", map[string]interface{}{"type": "string"}},
+		{"highlight", "Whether to return title_highlighted for searches", map[string]interface{}{"type": "boolean", "default": false}},
+		{"ids", "Comma separated ids to fetch instead of filtering", map[string]interface{}{"type": "string"}},
+		{"saved_search", "Id of a saved search of the caller to apply", map[string]interface{}{"type": "integer", "minimum": 1}},
+		{"format", "Response format, overriding Accept", map[string]interface{}{"type": "string", "enum": []string{formatJSON, formatCSV, formatNDJSON, formatXML, formatJSONAPI, formatMsgPack}}},
+	}
+}
+
+var (
+	routeParamRX  = regexp.MustCompile(`:([A-Za-z_]+)`)
+	operationIDRX = regexp.MustCompile(`[^A-Za-z0-9]+`)
+)
+
+// openapiHandler serves an OpenAPI 3 description of every registered route.
+func (app *application) openapiHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, app.openapiDocument(r), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) openapiDocument(r *http.Request) envelope {
+	schemas := newSchemaSet()
+	paths := map[string]map[string]interface{}{}
+
+	for _, route := range app.registeredRoutes {
+		path := routeParamRX.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = app.openapiOperation(route, schemas)
+	}
+
+	return envelope{
+		"openapi": "3.0.3",
+		"info": envelope{
+			"title":   "musicdb API",
+			"version": apiDocVersion(),
+		},
+		"servers": []envelope{{"url": app.baseURL(r)}},
+		"paths":   paths,
+		"components": envelope{
+			"schemas": schemas.components,
+			"securitySchemes": envelope{
+				"bearerAuth": envelope{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// apiDocVersion is the build version, or "dev" for builds without one.
+func apiDocVersion() string {
+	if version == "" {
+		return "dev"
+	}
+	return version
+}
+
+func (app *application) openapiOperation(route registeredRoute, schemas *schemaSet) envelope {
+	doc := route.Doc
+	op := envelope{
+		"summary":     doc.Summary,
+		"operationId": strings.ToLower(route.Method) + "_" + strings.Trim(operationIDRX.ReplaceAllString(route.Path, "_"), "_"),
+	}
+
+	var params []envelope
+	for _, match := range routeParamRX.FindAllStringSubmatch(route.Path, -1) {
+		schema := envelope{"type": "string"}
+		if match[1] == "id" {
+			schema = envelope{"type": "integer", "format": "int64", "minimum": 1}
+		}
+		params = append(params, envelope{"name": match[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, q := range doc.Query {
+		schema := q.Schema
+		if q.Name == "sort" && route.Version == apiV2 {
+			schema = versionedSortSchema(schema)
+		}
+		params = append(params, envelope{"name": q.Name, "in": "query", "description": q.Description, "schema": schema})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+
+	if doc.Body != nil {
+		op["requestBody"] = envelope{
+			"required": true,
+			"content":  envelope{"application/json": envelope{"schema": schemas.valueSchema(doc.Body, route.Version)}},
+		}
+	}
+
+	switch doc.Auth {
+	case "":
+	case "authenticated", "activated":
+		op["security"] = []envelope{{"bearerAuth": []string{}}}
+		op["description"] = fmt.Sprintf("Needs an %s user.", doc.Auth)
+	default:
+		op["security"] = []envelope{{"bearerAuth": []string{}}}
+		op["description"] = fmt.Sprintf("Needs the %s permission.", doc.Auth)
+		op["x-permission"] = doc.Auth
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := envelope{"description": http.StatusText(status)}
+	switch {
+	case doc.ContentType != "":
+		success["content"] = envelope{doc.ContentType: envelope{}}
+	case route.Method == http.MethodHead:
+	case doc.Response != nil:
+		success["content"] = envelope{"application/json": envelope{"schema": schemas.responseSchema(doc, route.Version)}}
+	}
+
+	op["responses"] = envelope{
+		fmt.Sprint(status): success,
+		"default": envelope{
+			"description": "Error",
+			"content":     envelope{"application/json": envelope{"schema": schemas.valueSchema(envelope{"error": apiError{}}, apiV1)}},
+		},
+	}
+	return op
+}
+
+// versionedSortSchema renames the sort values in schema to their v2 names.
+func versionedSortSchema(schema map[string]interface{}) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(schema))
+	for k, v := range schema {
+		renamed[k] = v
+	}
+	values := make([]string, len(musicSortSafeList))
+	for i, value := range musicSortSafeList {
+		name := strings.TrimPrefix(value, "-")
+		values[i] = strings.TrimSuffix(value, name) + musicFields(apiV2, []string{name})[0]
+	}
+	renamed["enum"] = values
+	return renamed
+}
+
+// schemaSet derives JSON schemas from Go types, collecting those of named
+// structs as components.
+type schemaSet struct {
+	components map[string]interface{}
+}
+
+func newSchemaSet() *schemaSet {
+	return &schemaSet{components: map[string]interface{}{}}
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	musicType = reflect.TypeOf(data.Music{})
+)
+
+// readOnlyFields lists the JSON keys the server fills in, which clients
+// don't send.
+var readOnlyFields = map[reflect.Type][]string{
+	musicType: {"id", "created_at", "updated_at", "version", "rank", "title_highlighted"},
+}
+
+// responseSchema is the schema of doc.Response as the given API version
+// sends it: without the envelope on v2 when doc.Key is set.
+func (s *schemaSet) responseSchema(doc routeDoc, version int) interface{} {
+	if doc.Key == "" || version == apiV1 {
+		return s.valueSchema(doc.Response, version)
+	}
+	if metadata, ok := doc.Response["metadata"]; ok {
+		return s.valueSchema(envelope{"items": doc.Response[doc.Key], "metadata": metadata}, version)
+	}
+	return s.valueSchema(doc.Response[doc.Key], version)
+}
+
+// valueSchema is the schema of sample, where envelopes stand for objects
+// with the given keys.
+func (s *schemaSet) valueSchema(sample interface{}, version int) interface{} {
+	if env, ok := sample.(envelope); ok {
+		properties := make(map[string]interface{}, len(env))
+		for key, value := range env {
+			properties[key] = s.valueSchema(value, version)
+		}
+		return envelope{"type": "object", "properties": properties}
+	}
+	return s.typeSchema(reflect.TypeOf(sample), version)
+}
+
+func (s *schemaSet) typeSchema(t reflect.Type, version int) interface{} {
+	if t == nil {
+		return envelope{}
+	}
+	if t == timeType {
+		return envelope{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return withKeyword(s.typeSchema(t.Elem(), version), "nullable", true)
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.objectSchema(t, version)
+		}
+		name := t.Name()
+		if t == musicType && version == apiV2 {
+			name += "V2"
+		}
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = envelope{}
+			s.components[name] = s.objectSchema(t, version)
+		}
+		return envelope{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return envelope{"type": "string", "format": "byte"}
+		}
+		return envelope{"type": "array", "items": s.typeSchema(t.Elem(), version)}
+	case reflect.Map:
+		return envelope{"type": "object", "additionalProperties": s.typeSchema(t.Elem(), version)}
+	case reflect.Bool:
+		return envelope{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return envelope{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return envelope{"type": "integer", "format": "int32"}
+	case reflect.Float32:
+		return envelope{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return envelope{"type": "number", "format": "double"}
+	case reflect.String:
+		return envelope{"type": "string"}
+	}
+	return envelope{}
+}
+
+// withKeyword returns schema with key set to value. A $ref can't carry other
+// keywords, so it's wrapped in an allOf.
+func withKeyword(schema interface{}, key string, value interface{}) interface{} {
+	inline, ok := schema.(envelope)
+	if !ok || inline["$ref"] != nil {
+		return envelope{"allOf": []interface{}{schema}, key: value}
+	}
+	copied := make(envelope, len(inline)+1)
+	for k, v := range inline {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// objectSchema lists the JSON keys of struct type t as properties, those of
+// embedded structs included. Renames for data.Music under later API versions
+// are applied.
+func (s *schemaSet) objectSchema(t reflect.Type, version int) envelope {
+	properties := map[string]interface{}{}
+	readOnly := map[string]bool{}
+	for _, name := range readOnlyFields[t] {
+		readOnly[name] = true
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" && field.Anonymous {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, schema := range s.objectSchema(embedded, version)["properties"].(map[string]interface{}) {
+					properties[key] = schema
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := s.typeSchema(field.Type, version)
+		if readOnly[name] {
+			schema = withKeyword(schema, "readOnly", true)
+		}
+		if t == musicType {
+			name = musicFields(version, []string{name})[0]
+		}
+		properties[name] = schema
+	}
+	return envelope{"type": "object", "properties": properties}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// openapiParameter is a parameter of an operation in the OpenAPI document.
+type openapiParameter struct {
+	Name   string                 `json:"name"`
+	In     string                 `json:"in"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// openapiOperation is an operation in the OpenAPI document.
+type openapiOperation struct {
+	OperationID string             `json:"operationId"`
+	Parameters  []openapiParameter `json:"parameters"`
+	Permission  string             `json:"x-permission"`
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.pagination.maxPageSize = 250
+	h := app.routes()
+
+	rr := serve(h, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	var doc struct {
+		OpenAPI string                                 `json:"openapi"`
+		Paths   map[string]map[string]openapiOperation `json:"paths"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("got openapi %q; want 3.0.3", doc.OpenAPI)
+	}
+
+	// Every route routes() registered is described, and nothing else.
+	operationIDs := map[string]bool{}
+	for _, route := range app.registeredRoutes {
+		path := routeParamRX.ReplaceAllString(route.Path, "{$1}")
+		op, ok := doc.Paths[path][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%s %s is missing from the document", route.Method, path)
+			continue
+		}
+		if operationIDs[op.OperationID] {
+			t.Errorf("%s %s has the operationId %q of another operation", route.Method, path, op.OperationID)
+		}
+		operationIDs[op.OperationID] = true
+
+		if route.Doc.Auth != "" && route.Doc.Auth != "authenticated" && route.Doc.Auth != "activated" && op.Permission != route.Doc.Auth {
+			t.Errorf("%s %s has x-permission %q; want %q", route.Method, path, op.Permission, route.Doc.Auth)
+		}
+		for _, match := range routeParamRX.FindAllStringSubmatch(route.Path, -1) {
+			if !hasParameter(op.Parameters, match[1], "path") {
+				t.Errorf("%s %s doesn't describe its %s parameter", route.Method, path, match[1])
+			}
+		}
+		for _, q := range route.Doc.Query {
+			if !hasParameter(op.Parameters, q.Name, "query") {
+				t.Errorf("%s %s doesn't describe its %s query parameter", route.Method, path, q.Name)
+			}
+		}
+	}
+	operations := 0
+	for _, methods := range doc.Paths {
+		operations += len(methods)
+	}
+	if operations != len(app.registeredRoutes) {
+		t.Errorf("the document has %d operations; want the %d registered routes", operations, len(app.registeredRoutes))
+	}
+
+	// The listing documents the limits its validation enforces.
+	for _, version := range []string{"v1", "v2"} {
+		list := doc.Paths["/"+version+"/musics"]["get"]
+		params := map[string]map[string]interface{}{}
+		for _, p := range list.Parameters {
+			params[p.Name] = p.Schema
+		}
+
+		want := map[string]map[string]interface{}{
+			"page":      {"type": "integer", "minimum": 1.0, "maximum": 10_000_000.0, "default": 1.0},
+			"page_size": {"type": "integer", "minimum": 1.0, "maximum": 250.0, "default": 20.0},
+			"filter":    {"type": "string", "maxLength": 1000.0},
+		}
+		for name, constraints := range want {
+			for key, value := range constraints {
+				if got := params[name][key]; got != value {
+					t.Errorf("%s list %s has %s %v; want %v", version, name, key, got, value)
+				}
+			}
+		}
+
+		sorts, _ := params["sort"]["enum"].([]interface{})
+		if len(sorts) != len(musicSortSafeList) {
+			t.Fatalf("%s list sort has %d values; want %d", version, len(sorts), len(musicSortSafeList))
+		}
+		wantDuration := map[string]string{"v1": "-duration", "v2": "-duration_seconds"}[version]
+		found := false
+		for _, s := range sorts {
+			found = found || s == wantDuration
+		}
+		if !found {
+			t.Errorf("%s list sort values %v don't include %q", version, sorts, wantDuration)
+		}
+	}
+}
+
+func hasParameter(params []openapiParameter, name, in string) bool {
+	for _, p := range params {
+		if p.Name == name && p.In == in {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// outboxBatchSize is how many events a dispatch pass publishes at most.
+	outboxBatchSize = 100
+	// outboxPollInterval is how often the dispatcher looks for events when
+	// it isn't woken, which picks up those written by other instances or
+	// left behind by a crash.
+	outboxPollInterval = time.Second
+	// outboxRetention is how long published events are kept.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// outboxOldestUnsent is the creation time, in Unix nanoseconds, of the
+// oldest event the dispatcher saw unpublished after its last pass, zero
+// when there was none.
+var outboxOldestUnsent int64
+
+// outboxLag is the age in seconds of the oldest event still unpublished, as
+// of the last dispatch pass.
+func outboxLag() interface{} {
+	oldest := atomic.LoadInt64(&outboxOldestUnsent)
+	if oldest == 0 {
+		return 0.0
+	}
+	return time.Since(time.Unix(0, oldest)).Seconds()
+}
+
+// saveMusicChange runs write in a transaction, in which it makes a change to
+// the music records and records the events describing it in the outbox, and
+// wakes the dispatcher once it's committed. The events are published even if
+// the process dies right after the commit, by whichever dispatcher runs next.
+func (app *application) saveMusicChange(write func(tx *sql.Tx) error) error {
+	if err := app.models.Transact(write); err != nil {
+		return err
+	}
+	app.wakeOutbox()
+	return nil
+}
+
+// musicEvent is the outbox event for a change to m, carrying the record as
+// it is now. It's encoded when inserted, so m may be modified after that.
+func musicEvent(event string, m *data.Music) *data.OutboxEvent {
+	return &data.OutboxEvent{Event: event, MusicID: m.Id, Version: m.Version, Payload: m}
+}
+
+// wakeOutbox has the dispatcher run a pass without waiting for its next poll.
+func (app *application) wakeOutbox() {
+	select {
+	case app.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchOutbox publishes the events in the outbox until the server shuts
+// down, and purges the old published ones every hour. Events are marked sent
+// only once their batch is published, so those of a pass cut short are
+// published again, under the same sequence, by the next one.
+func (app *application) dispatchOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	purged := time.Now()
+	for {
+		app.drainOutbox()
+
+		if time.Since(purged) >= time.Hour {
+			purged = time.Now()
+			n, err := app.models.Outbox.PurgeSent(purged.Add(-outboxRetention))
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else {
+				app.logger.PrintInfo("purged published outbox events", map[string]string{
+					"count": strconv.FormatInt(n, 10),
+				})
+			}
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-app.outboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainOutbox publishes batches until the outbox is empty, another
+// dispatcher holds it or publishing fails, then records the lag left.
+func (app *application) drainOutbox() {
+	for {
+		n, err := app.models.Outbox.Dispatch(outboxBatchSize, app.publishMusicEvents)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			break
+		}
+		if n < outboxBatchSize {
+			break
+		}
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+
+	oldest, err := app.models.Outbox.OldestUnsent()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	var nanos int64
+	if !oldest.IsZero() {
+		nanos = oldest.UnixNano()
+	}
+	atomic.StoreInt64(&outboxOldestUnsent, nanos)
+}
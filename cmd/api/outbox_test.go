@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBulkChangesDispatched checks that imported, retagged and renamed
+// records reach the event hub through the outbox, in the order they were
+// written.
+func TestBulkChangesDispatched(t *testing.T) {
+	app := newTestDBApplication(t)
+
+	_, sub := app.events.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	if code, env := postImport(t, app, "", importCSV(3, "")); code != http.StatusOK {
+		t.Fatalf("import: got status %d; want %d: %v", code, http.StatusOK, env)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/musics/retag?title_exact=Song+0", strings.NewReader(`{"add_genres":["jazz"]}`))
+	if rr := serve(http.HandlerFunc(app.retagMusicsHandler), r); rr.Code != http.StatusOK {
+		t.Fatalf("retag: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodPatch, "/v1/genres/rename", strings.NewReader(`{"from":"rock","to":"metal"}`))
+	if rr := serve(http.HandlerFunc(app.renameGenreHandler), r); rr.Code != http.StatusOK {
+		t.Fatalf("rename: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		app.dispatchOutbox()
+		close(done)
+	}()
+
+	want := []string{
+		data.EventMusicCreated, data.EventMusicCreated, data.EventMusicCreated,
+		data.EventMusicUpdated,
+		data.EventMusicUpdated, data.EventMusicUpdated, data.EventMusicUpdated,
+	}
+	var got []events.Event
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case e := <-sub.C:
+			got = append(got, e)
+		case <-timeout:
+			t.Fatalf("got %d events; want %d", len(got), len(want))
+		}
+	}
+
+	for i, e := range got {
+		if e.Type != want[i] {
+			t.Errorf("event %d is %q; want %q", i, e.Type, want[i])
+		}
+		if i > 0 && e.Sequence <= got[i-1].Sequence {
+			t.Errorf("event %d has sequence %d after %d", i, e.Sequence, got[i-1].Sequence)
+		}
+	}
+	// The retag bumped the first record to version 2 and the rename to 3.
+	if e := got[3]; e.MusicID != got[0].MusicID || e.Version != 2 {
+		t.Errorf("retag event is for music %d version %d; want %d version 2", e.MusicID, e.Version, got[0].MusicID)
+	}
+
+	close(app.shutdown)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatcher still running after shutdown")
+	}
+}
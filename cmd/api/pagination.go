@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPageSize returns the largest page_size r may list with. Callers holding
+// musics:bulk-read get the bulk limit; everyone else, including anonymous
+// callers, the default one.
+func (app *application) maxPageSize(r *http.Request) int {
+	if app.contextGetPermissions(r).Include("musics:bulk-read") {
+		return app.config.pagination.bulkMaxPageSize
+	}
+	return app.config.pagination.maxPageSize
+}
+
+// pageURL returns the URL of r with its page parameter set to page. Every
+// other query parameter is kept as sent.
+func pageURL(r *http.Request, page int) string {
+	qs := r.URL.Query()
+	qs.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + qs.Encode()
+}
+
+// baseURL returns the scheme and host clients reached the API under. Behind a
+// trusted proxy these come from X-Forwarded-Proto and X-Forwarded-Host.
+func (app *application) baseURL(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if app.config.trustProxy {
+		forwarded := func(header string) string {
+			return strings.TrimSpace(strings.Split(r.Header.Get(header), ",")[0])
+		}
+		if proto := strings.ToLower(forwarded("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := forwarded("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+	}
+
+	return scheme + "://" + host
+}
+
+// setPageURLs fills in the absolute next and previous page URLs of metadata.
+func (app *application) setPageURLs(r *http.Request, metadata *data.Metadata) {
+	if metadata.CurrentPage == 0 {
+		return
+	}
+
+	if metadata.HasNext() {
+		next := app.baseURL(r) + pageURL(r, metadata.CurrentPage+1)
+		metadata.NextPageURL = &next
+	}
+	if metadata.CurrentPage > metadata.FirstPage {
+		prev := app.baseURL(r) + pageURL(r, metadata.CurrentPage-1)
+		metadata.PrevPageURL = &prev
+	}
+}
+
+// paginationLinks builds an RFC 5988 Link header value pointing at the first,
+// previous, next and last pages around metadata. prev is left out on the first
+// page and next on the last; last is unknown when the count was skipped.
+func paginationLinks(r *http.Request, metadata data.Metadata) string {
+	if metadata.CurrentPage == 0 {
+		return ""
+	}
+
+	var links []string
+	link := func(page int, rel string) {
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, pageURL(r, page), rel))
+	}
+
+	link(metadata.FirstPage, "first")
+	if metadata.CurrentPage > metadata.FirstPage {
+		link(metadata.CurrentPage-1, "prev")
+	}
+	if metadata.HasNext() {
+		link(metadata.CurrentPage+1, "next")
+	}
+	if metadata.HasMore == nil {
+		link(metadata.LastPage, "last")
+	}
+
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// pageMetadata is the metadata of page of a listing with lastPage pages.
+func pageMetadata(page, lastPage int) data.Metadata {
+	return data.Metadata{CurrentPage: page, PageSize: 10, FirstPage: 1, LastPage: lastPage, TotalRecords: lastPage * 10, Count: data.CountExact}
+}
+
+func TestPaginationLinks(t *testing.T) {
+	hasMore := true
+
+	tests := []struct {
+		name     string
+		target   string
+		metadata data.Metadata
+		want     string
+	}{
+		{
+			"first page",
+			"/v1/musics?page=1&page_size=10&sort=-title",
+			pageMetadata(1, 3),
+			`</v1/musics?page=1&page_size=10&sort=-title>; rel="first", ` +
+				`</v1/musics?page=2&page_size=10&sort=-title>; rel="next", ` +
+				`</v1/musics?page=3&page_size=10&sort=-title>; rel="last"`,
+		},
+		{
+			"middle page",
+			"/v1/musics?genres=rock,pop&page=2&page_size=10",
+			pageMetadata(2, 3),
+			`</v1/musics?genres=rock%2Cpop&page=1&page_size=10>; rel="first", ` +
+				`</v1/musics?genres=rock%2Cpop&page=1&page_size=10>; rel="prev", ` +
+				`</v1/musics?genres=rock%2Cpop&page=3&page_size=10>; rel="next", ` +
+				`</v1/musics?genres=rock%2Cpop&page=3&page_size=10>; rel="last"`,
+		},
+		{
+			"last page",
+			"/v1/musics?page=3",
+			pageMetadata(3, 3),
+			`</v1/musics?page=1>; rel="first", </v1/musics?page=2>; rel="prev", </v1/musics?page=3>; rel="last"`,
+		},
+		{
+			"only page",
+			"/v1/musics",
+			pageMetadata(1, 1),
+			`</v1/musics?page=1>; rel="first", </v1/musics?page=1>; rel="last"`,
+		},
+		{
+			"encoded title",
+			"/v1/musics?title=rock%20%26%20roll%3F&page=2",
+			pageMetadata(2, 3),
+			`</v1/musics?page=1&title=rock+%26+roll%3F>; rel="first", ` +
+				`</v1/musics?page=1&title=rock+%26+roll%3F>; rel="prev", ` +
+				`</v1/musics?page=3&title=rock+%26+roll%3F>; rel="next", ` +
+				`</v1/musics?page=3&title=rock+%26+roll%3F>; rel="last"`,
+		},
+		{
+			"uncounted",
+			"/v1/musics?include_count=false&page=2",
+			data.Metadata{CurrentPage: 2, PageSize: 10, FirstPage: 1, HasMore: &hasMore, Count: data.CountSkipped},
+			`</v1/musics?include_count=false&page=1>; rel="first", ` +
+				`</v1/musics?include_count=false&page=1>; rel="prev", ` +
+				`</v1/musics?include_count=false&page=3>; rel="next"`,
+		},
+		{"empty listing", "/v1/musics?title=none", data.Metadata{Count: data.CountExact}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if got := paginationLinks(r, tt.metadata); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMusicsLinkHeader(t *testing.T) {
+	h := newListTestApplication(t).routes()
+
+	rr := serve(h, httptest.NewRequest(http.MethodGet, "/v1/musics?title=song&page_size=1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	want := `</v1/musics?page=1&page_size=1&title=song>; rel="first", ` +
+		`</v1/musics?page=2&page_size=1&title=song>; rel="next", ` +
+		`</v1/musics?page=2&page_size=1&title=song>; rel="last"`
+	if got := rr.Header().Get("Link"); got != want {
+		t.Errorf("got Link\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSetPageURLs(t *testing.T) {
+	const target = "/v1/musics?genres=rock,pop&sort=-popularity&page_size=10&title=a%26b&page=2"
+	// PAGE stands for the page number of each URL.
+	const query = "genres=rock%2Cpop&page=PAGE&page_size=10&sort=-popularity&title=a%26b"
+
+	tests := []struct {
+		name       string
+		trustProxy bool
+		tls        bool
+		headers    map[string]string
+		metadata   data.Metadata
+		wantNext   string
+		wantPrev   string
+	}{
+		{"middle page", false, false, nil, pageMetadata(2, 3),
+			"http://example.com/v1/musics?" + query, "http://example.com/v1/musics?" + query},
+		{"first page", false, false, nil, pageMetadata(1, 3), "http://example.com/v1/musics?" + query, ""},
+		{"last page", false, false, nil, pageMetadata(3, 3), "", "http://example.com/v1/musics?" + query},
+		{"empty listing", false, false, nil, data.Metadata{Count: data.CountExact}, "", ""},
+		{"TLS", false, true, nil, pageMetadata(2, 3),
+			"https://example.com/v1/musics?" + query, "https://example.com/v1/musics?" + query},
+		{"untrusted proxy headers", false, false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example.org"}, pageMetadata(2, 3),
+			"http://example.com/v1/musics?" + query, "http://example.com/v1/musics?" + query},
+		{"trusted proxy headers", true, false, map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "api.example.org, proxy"}, pageMetadata(2, 3),
+			"https://api.example.org/v1/musics?" + query, "https://api.example.org/v1/musics?" + query},
+		{"trusted proxy with bad scheme", true, false, map[string]string{"X-Forwarded-Proto": "ftp"}, pageMetadata(2, 3),
+			"http://example.com/v1/musics?" + query, "http://example.com/v1/musics?" + query},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.trustProxy = tt.trustProxy
+
+			target := target
+			if tt.tls {
+				target = "https://example.com" + target
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			metadata := tt.metadata
+			app.setPageURLs(r, &metadata)
+
+			check := func(rel string, got *string, want string, page int) {
+				t.Helper()
+				if want == "" {
+					if got != nil {
+						t.Errorf("got %s URL %q; want none", rel, *got)
+					}
+					return
+				}
+				if want = strings.Replace(want, "PAGE", strconv.Itoa(page), 1); got == nil || *got != want {
+					t.Errorf("got %s URL %v; want %q", rel, got, want)
+				}
+			}
+			check("next", metadata.NextPageURL, tt.wantNext, metadata.CurrentPage+1)
+			check("prev", metadata.PrevPageURL, tt.wantPrev, metadata.CurrentPage-1)
+		})
+	}
+}
+
+func TestListMusicsMaxPageSize(t *testing.T) {
+	app := newListTestApplication(t)
+	defaultMax, bulkMax := app.config.pagination.maxPageSize, app.config.pagination.bulkMaxPageSize
+
+	tests := []struct {
+		name        string
+		permissions data.Permissions
+		pageSize    int
+		want        int
+	}{
+		{"anonymous at the default cap", nil, defaultMax, http.StatusOK},
+		{"anonymous above the default cap", nil, defaultMax + 100, http.StatusUnprocessableEntity},
+		{"reader above the default cap", data.Permissions{"musics:read"}, defaultMax + 100, http.StatusUnprocessableEntity},
+		{"bulk reader above the default cap", data.Permissions{"musics:bulk-read"}, defaultMax + 100, http.StatusOK},
+		{"bulk reader at the bulk cap", data.Permissions{"musics:bulk-read"}, bulkMax, http.StatusOK},
+		{"bulk reader above the bulk cap", data.Permissions{"musics:bulk-read"}, bulkMax + 1, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/musics?title=song&page_size="+strconv.Itoa(tt.pageSize), nil)
+			if tt.permissions != nil {
+				r = app.contextSetUser(r, &data.User{ID: 1, Activated: true})
+				r = app.contextSetPermissions(r, tt.permissions)
+			} else {
+				r = app.contextSetUser(r, data.AnonymousUser)
+			}
+
+			rr := serve(http.HandlerFunc(app.listMusicsHandler), r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if rr.Code == http.StatusUnprocessableEntity {
+				if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["page_size"] == "" {
+					t.Errorf("got fields %v; want only page_size", fields)
+				}
+				return
+			}
+			var body struct {
+				Metadata data.Metadata `json:"metadata"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Metadata.PageSize != tt.pageSize {
+				t.Errorf("got page_size %d; want %d", body.Metadata.PageSize, tt.pageSize)
+			}
+		})
+	}
+}
+
+func TestListMusicsPageBounds(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.pagination.maxOffset = 1000
+
+	// 45 records match, so at 20 a page the listing ends at page 3.
+	var offset int64
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SELECT count(*) FROM") {
+			return []string{"count"}, [][]driver.Value{{int64(45)}}, nil
+		}
+		offset = args[len(args)-1].(int64)
+		return stubListColumns(), nil, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	list := func(page int) *httptest.ResponseRecorder {
+		target := "/v1/musics?genres=pop&page_size=20&page=" + strconv.Itoa(page)
+		return serve(http.HandlerFunc(app.listMusicsHandler), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	// A page past the last is empty, but still says where the listing ends.
+	for _, page := range []int{4, 51} {
+		rr := list(page)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("page %d: got status %d; want %d: %s", page, rr.Code, http.StatusOK, rr.Body)
+		}
+		var body struct {
+			Musics   []json.RawMessage `json:"musics"`
+			Metadata data.Metadata     `json:"metadata"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Musics == nil || len(body.Musics) != 0 {
+			t.Errorf("page %d: got musics %v; want an empty list", page, body.Musics)
+		}
+		md := body.Metadata
+		if md.CurrentPage != page || md.PageSize != 20 || md.FirstPage != 1 || md.LastPage != 3 || md.TotalRecords != 45 || md.Count != data.CountExact {
+			t.Errorf("page %d: got metadata %+v", page, md)
+		}
+		if md.NextPageURL != nil {
+			t.Errorf("page %d: got next page %s; want none", page, *md.NextPageURL)
+		}
+		if got := rr.Header().Get("X-Total-Count"); got != "45" {
+			t.Errorf("page %d: got X-Total-Count %q; want 45", page, got)
+		}
+	}
+	// Page 51 starts right at the ceiling.
+	if offset != 1000 {
+		t.Errorf("got OFFSET %d for the last page allowed; want 1000", offset)
+	}
+
+	rr := list(52)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("page past the ceiling: got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if fields := readAPIError(t, rr).Fields; len(fields) != 1 || !strings.Contains(fields["page"], "51") {
+		t.Errorf("got fields %v; want only page, naming page 51 as the last", fields)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"strings"
+)
+
+// showUserPermissionsHandler lists the permissions of user :id.
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+	app.writePermissions(w, r, user.ID)
+}
+
+// grantUserPermissionsHandler grants user :id the permissions listed in the
+// body. Granting one the user already holds changes nothing.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+	codes, ok := app.readPermissionCodes(w, r)
+	if !ok {
+		return
+	}
+
+	if err := app.models.Permissions.AddForUser(user.ID, codes...); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writePermissions(w, r, user.ID)
+}
+
+// revokeUserPermissionsHandler revokes the permissions listed in the body
+// from user :id, unless that would take a protected permission from its
+// last holder.
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+	codes, ok := app.readPermissionCodes(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Transact(func(tx *sql.Tx) error {
+		for _, code := range protectedPermissions {
+			if !validator.In(code, codes...) || !permissions.Include(code) {
+				continue
+			}
+			others, err := app.models.Permissions.CountOtherHoldersTx(tx, code, user.ID)
+			if err != nil {
+				return err
+			}
+			if others == 0 {
+				return errLastHolder{code}
+			}
+		}
+		return app.models.Permissions.RemoveForUserTx(tx, user.ID, codes...)
+	})
+	if err != nil {
+		var lastHolder errLastHolder
+		switch {
+		case errors.As(err, &lastHolder):
+			app.lastHolderRevokeResponse(w, r, lastHolder.code)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.writePermissions(w, r, user.ID)
+}
+
+// readPermissionCodes reads the permission codes of a grant or revocation
+// body, each of which must be one in the permissions table, answering the
+// request itself when they aren't valid.
+func (app *application) readPermissionCodes(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+	v.Check(len(input.Permissions) != 0, "permissions", validator.MsgRequired)
+	v.Check(validator.Unique(input.Permissions), "permissions", validator.MsgDuplicateValues)
+	for _, code := range input.Permissions {
+		v.Check(validator.In(code, known...), "permissions", validator.MsgOneOf, strings.Join(known, ", "))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return input.Permissions, true
+}
+
+// writePermissions answers with the full permission set of userID.
+func (app *application) writePermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// permissionsPath returns the path of the permissions of user id.
+func permissionsPath(id int64) string {
+	return fmt.Sprintf("/v1/users/%d/permissions", id)
+}
+
+// readPermissions decodes the permission codes in the body of rr.
+func readPermissions(t *testing.T, rr *httptest.ResponseRecorder) []string {
+	t.Helper()
+
+	var body struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Permissions
+}
+
+func TestGrantPermissions(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	admin := newTestToken(t, app, insertTestUser(t, app, "admin@example.com", "admin"), false)
+	user := insertTestUser(t, app, "alice@example.com", "musics:write")
+	path := permissionsPath(user.ID)
+
+	// Granting twice is the same as granting once, and the codes come back
+	// sorted.
+	for i := 0; i < 2; i++ {
+		rr := sendAs(h, admin, http.MethodPut, path, `{"permissions":["musics:read","musics:export"]}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("grant %d: got status %d; want %d: %s", i+1, rr.Code, http.StatusOK, rr.Body)
+		}
+		want := []string{"musics:export", "musics:read", "musics:write"}
+		if got := readPermissions(t, rr); !reflect.DeepEqual(got, want) {
+			t.Errorf("grant %d: got %v; want %v", i+1, got, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"unknown code", admin, path, `{"permissions":["musics:read","musics:delete"]}`, http.StatusUnprocessableEntity},
+		{"repeated code", admin, path, `{"permissions":["musics:read","musics:read"]}`, http.StatusUnprocessableEntity},
+		{"no codes", admin, path, `{"permissions":[]}`, http.StatusUnprocessableEntity},
+		{"unknown user", admin, permissionsPath(user.ID + 1000), `{"permissions":["musics:read"]}`, http.StatusNotFound},
+		{"non-admin caller", newTestToken(t, app, user, false), path, `{"permissions":["admin"]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := sendAs(h, tt.token, http.MethodPut, tt.path, tt.body)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if rr.Code == http.StatusUnprocessableEntity {
+				if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["permissions"] == "" {
+					t.Errorf("got fields %v; want only permissions", fields)
+				}
+			}
+		})
+	}
+
+	// None of the refused requests changed anything.
+	rr := sendAs(h, admin, http.MethodGet, path, "")
+	if got, want := readPermissions(t, rr), []string{"musics:export", "musics:read", "musics:write"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestRevokePermissions(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	admin := insertTestUser(t, app, "admin@example.com", "admin", "musics:read")
+	token := newTestToken(t, app, admin, false)
+	user := insertTestUser(t, app, "alice@example.com", "musics:read", "musics:write")
+
+	rr := sendAs(h, token, http.MethodDelete, permissionsPath(user.ID), `{"permissions":["musics:write","musics:export"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got, want := readPermissions(t, rr), []string{"musics:read"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	// The only admin can't be stripped of admin, not even by themselves.
+	rr = sendAs(h, token, http.MethodDelete, permissionsPath(admin.ID), `{"permissions":["admin"]}`)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("last admin: got status %d; want %d: %s", rr.Code, http.StatusConflict, rr.Body)
+	}
+	if code := readAPIError(t, rr).Code; code != codeLastHolderRevoke {
+		t.Errorf("last admin: got error code %q; want %q", code, codeLastHolderRevoke)
+	}
+
+	if rr := sendAs(h, token, http.MethodPut, permissionsPath(user.ID), `{"permissions":["admin"]}`); rr.Code != http.StatusOK {
+		t.Fatalf("grant admin: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	rr = sendAs(h, token, http.MethodDelete, permissionsPath(admin.ID), `{"permissions":["admin"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("with another admin: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got, want := readPermissions(t, rr), []string{"musics:read"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
@@ -2,30 +2,379 @@ package main
 
 import (
 	"expvar"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/graphql"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"time"
 )
 
 func (app *application) routes() http.Handler {
+	app.limits = app.newRateLimits()
+
 	router := httprouter.New()
 
+	// httprouter sets the Allow header for the matched path before calling
+	// the MethodNotAllowed and GlobalOPTIONS handlers.
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	router.GlobalOPTIONS = http.HandlerFunc(app.optionsHandler)
+
+	app.registeredRoutes = nil
+	app.graphql = app.newGraphQLSchema()
+
+	musicEnv := envelope{"music": data.Music{}}
+	musicsEnv := envelope{"musics": []data.Music{}, "metadata": data.Metadata{}}
+	musicBody := data.Music{}
+
+	app.handle(router, http.MethodGet, "/v1/healthcheck", app.healthcheckHandler, routeDoc{
+		Summary:  "Report whether the service is available",
+		Response: envelope{"status": "", "system_info": map[string]string{}},
+	})
+	app.handle(router, http.MethodGet, "/v1/openapi.json", app.openapiHandler, routeDoc{
+		Summary: "Describe the API as an OpenAPI 3 document",
+	})
+
+	app.handleVersioned(router, http.MethodGet, "/musics", app.listMusicsHandler, routeDoc{
+		Summary: "List musics", Query: app.musicQuery(), Response: musicsEnv, Key: "musics",
+	})
+	app.handleVersioned(router, http.MethodHead, "/musics", app.listMusicsHandler, routeDoc{
+		Summary: "Show the headers of a music listing", Query: app.musicQuery(),
+	})
+	app.handleVersioned(router, http.MethodGet, "/musics/:id", app.showMusicHandler, routeDoc{
+		Summary: "Show a music", Response: musicEnv, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodHead, "/musics/:id", app.showMusicHandler, routeDoc{
+		Summary: "Show the headers of a music",
+	})
+	app.handleVersioned(router, http.MethodPost, "/musics", app.requirePermission("musics:write", app.idempotent(app.createMusicHandler)), routeDoc{
+		Summary: "Create a music", Auth: "musics:write", Body: musicBody, Status: http.StatusCreated, Response: musicEnv, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodPut, "/musics/:id", app.requirePermission("musics:write", app.replaceMusicHandler), routeDoc{
+		Summary: "Replace a music", Auth: "musics:write", Body: musicBody, Response: musicEnv, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodPatch, "/musics/:id", app.requirePermission("musics:write", app.updateMusicHandler), routeDoc{
+		Summary: "Update some fields of a music", Auth: "musics:write", Body: musicBody, Response: musicEnv, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodDelete, "/musics/:id", app.requirePermission("musics:write", app.deleteMusicHandler), routeDoc{
+		Summary: "Delete a music", Auth: "musics:write", Response: envelope{"message": "", "music": data.Music{}}, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodPost, "/musics/:id/enrich", app.requirePermission("musics:write", app.enrichMusicHandler), routeDoc{
+		Summary: "Fill in a music's missing fields from Spotify", Auth: "musics:write",
+		Query:    []queryParam{{"overwrite", "Also replace the fields the music already has", map[string]interface{}{"type": "boolean", "default": false}}},
+		Response: envelope{"music": data.Music{}, "enriched_fields": []string{}}, Key: "music",
+	})
+	app.handleVersioned(router, http.MethodGet, "/musics/:id/musicbrainz-candidates", app.requireActivatedUser(app.listMusicBrainzCandidatesHandler), routeDoc{
+		Summary: "Search MusicBrainz for the recordings a music may be linked to", Auth: "activated",
+		Query:    []queryParam{{"limit", "How many candidates to return", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxMusicBrainzCandidates, "default": 5}}},
+		Response: envelope{"candidates": []musicBrainzCandidate{}},
+	})
+	app.handleVersioned(router, http.MethodDelete, "/musics", app.requirePermission("musics:write", app.deleteMusicsHandler), routeDoc{
+		Summary:  "Delete the musics listed in ?ids= or the body",
+		Auth:     "musics:write",
+		Query:    []queryParam{{"ids", "Comma separated ids to delete", map[string]interface{}{"type": "string"}}},
+		Response: envelope{"deleted": []int64{}, "missing": []int64{}},
+	})
+
+	app.handle(router, http.MethodGet, "/v1/genres", app.listGenresHandler, routeDoc{
+		Summary: "List the genres in use with their record counts",
+		Query: []queryParam{
+			{"q", "Genre name prefix", map[string]interface{}{"type": "string"}},
+			{"normalize", "Whether to merge genres differing only in case", map[string]interface{}{"type": "boolean", "default": false}},
+			{"sort", "Sort key", map[string]interface{}{"type": "string", "enum": []string{"name", "count", "-name", "-count"}, "default": "-count"}},
+		},
+		Response: envelope{"genres": []data.Genre{}, "metadata": data.Metadata{}},
+	})
+
+	app.handle(router, http.MethodGet, "/v1/ws", app.wsHandler, routeDoc{
+		Summary: "Open a WebSocket pushing music changes and the user's notifications",
+		Query:   []queryParam{{"token", "Authentication token, when it can't be sent in a header or the first message", map[string]interface{}{"type": "string"}}},
+		Status:  http.StatusSwitchingProtocols,
+	})
+
+	app.handle(router, http.MethodPost, "/v1/graphql", app.requireActivatedUser(app.graphqlHandler), routeDoc{
+		Summary: "Run a GraphQL query or mutation; mutations need musics:write", Auth: "activated",
+		Body:     envelope{"query": "", "operationName": "", "variables": map[string]interface{}{}},
+		Response: envelope{"data": map[string]interface{}{}, "errors": []graphql.Error{}},
+	})
+	app.handle(router, http.MethodGet, "/v1/graphql/schema", app.graphqlSchemaHandler, routeDoc{
+		Summary:     "Describe the GraphQL schema in the schema definition language",
+		ContentType: "text/plain",
+	})
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	app.handle(router, http.MethodGet, "/v1/me/searches", app.requireActivatedUser(app.listSavedSearchesHandler), routeDoc{
+		Summary: "List the caller's saved searches", Auth: "activated",
+		Response: envelope{"saved_searches": []data.SavedSearch{}, "metadata": data.Metadata{}},
+	})
+	app.handle(router, http.MethodPost, "/v1/me/searches", app.requireActivatedUser(app.requireWritableToken(app.createSavedSearchHandler)), routeDoc{
+		Summary: "Save a music search", Auth: "activated", Body: envelope{"name": "", "query": ""},
+		Status: http.StatusCreated, Response: envelope{"saved_search": data.SavedSearch{}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/me/searches/:id", app.requireActivatedUser(app.requireWritableToken(app.deleteSavedSearchHandler)), routeDoc{
+		Summary: "Delete a saved search", Auth: "activated", Response: envelope{"message": ""},
+	})
+	app.handle(router, http.MethodPatch, "/v1/genres/rename", app.requirePermission("musics:write", app.renameGenreHandler), routeDoc{
+		Summary: "Rename a genre on every music", Auth: "musics:write", Body: envelope{"from": "", "to": "", "dry_run": false},
+		Response: envelope{"from": "", "to": "", "dry_run": false, "records_affected": 0, "records_merged": 0},
+	})
 
-	router.HandlerFunc(http.MethodGet, "/v1/musics", app.listMusicsHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/musics/:id", app.showMusicHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/musics", app.requirePermission("musics:write", app.createMusicHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/musics/:id", app.requirePermission("musics:write", app.updateMusicHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/musics/:id", app.requirePermission("musics:write", app.deleteMusicHandler))
+	exportPerms := []string{"musics:export", "musics:write"}
+	exportEnv := envelope{"export": data.Export{}}
+	app.handle(router, http.MethodGet, "/v1/exports", app.requireAnyPermission(exportPerms, app.listExportsHandler), routeDoc{
+		Summary: "List the caller's exports; musics:write also allows it", Auth: "musics:export",
+		Response: envelope{"exports": []data.Export{}, "metadata": data.Metadata{}},
+	})
+	app.handle(router, http.MethodPost, "/v1/exports", app.requireAnyPermission(exportPerms, app.createExportHandler), routeDoc{
+		Summary: "Start exporting the musics matching a listing query to a csv or ndjson file; musics:write also allows it", Auth: "musics:export",
+		Body: envelope{"query": "", "format": ""}, Status: http.StatusAccepted, Response: exportEnv,
+	})
+	app.handle(router, http.MethodGet, "/v1/exports/:id", app.requireAnyPermission(exportPerms, app.showExportHandler), routeDoc{
+		Summary: "Show the progress of an export; musics:write also allows it", Auth: "musics:export", Response: exportEnv,
+	})
+	app.handle(router, http.MethodGet, "/v1/exports/:id/download", app.requireAnyPermission(exportPerms, app.downloadExportHandler), routeDoc{
+		Summary: "Download the file of a completed export, in byte ranges if asked; musics:write also allows it", Auth: "musics:export",
+		ContentType: "application/octet-stream",
+	})
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activate", app.activateUserHandler)
+	importEnv := envelope{"import": data.Import{}}
+	app.handle(router, http.MethodPost, "/v1/imports", app.requirePermission("musics:write", app.createImportHandler), routeDoc{
+		Summary: "Start importing musics from a CSV body too large for /musics/import", Auth: "musics:write",
+		Status: http.StatusAccepted, Response: importEnv,
+	})
+	app.handle(router, http.MethodGet, "/v1/imports/:id", app.requirePermission("musics:write", app.showImportHandler), routeDoc{
+		Summary: "Show the progress of an import and a page of the rows it rejected", Auth: "musics:write",
+		Response: envelope{"import": data.Import{}, "errors": []data.ImportError{}, "metadata": data.Metadata{}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/imports/:id", app.requirePermission("musics:write", app.cancelImportHandler), routeDoc{
+		Summary: "Cancel an import that hasn't finished", Auth: "musics:write", Response: importEnv,
+	})
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	webhookEnv := envelope{"webhook": data.Webhook{}}
+	webhookBody := envelope{"url": "", "secret": "", "events": []string{}, "active": false}
+	app.handle(router, http.MethodGet, "/v1/webhooks", app.requirePermission("admin", app.listWebhooksHandler), routeDoc{
+		Summary: "List webhooks", Auth: "admin", Response: envelope{"webhooks": []data.Webhook{}, "metadata": data.Metadata{}},
+	})
+	app.handle(router, http.MethodPost, "/v1/webhooks", app.requirePermission("admin", app.createWebhookHandler), routeDoc{
+		Summary: "Create a webhook", Auth: "admin", Body: webhookBody, Status: http.StatusCreated, Response: webhookEnv,
+	})
+	app.handle(router, http.MethodGet, "/v1/webhooks/:id", app.requirePermission("admin", app.showWebhookHandler), routeDoc{
+		Summary: "Show a webhook", Auth: "admin", Response: webhookEnv,
+	})
+	app.handle(router, http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("admin", app.updateWebhookHandler), routeDoc{
+		Summary: "Update a webhook", Auth: "admin", Body: webhookBody, Response: webhookEnv,
+	})
+	app.handle(router, http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("admin", app.deleteWebhookHandler), routeDoc{
+		Summary: "Delete a webhook", Auth: "admin", Response: envelope{"message": ""},
+	})
+	app.handle(router, http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("admin", app.listWebhookDeliveriesHandler), routeDoc{
+		Summary: "List the delivery attempts of a webhook", Auth: "admin",
+		Response: envelope{"deliveries": []data.WebhookDelivery{}, "metadata": data.Metadata{}},
+	})
 
-	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
+	app.handle(router, http.MethodPost, "/v1/users", app.registerUserHandler, routeDoc{
+		Summary: "Register a user", Body: envelope{"name": "", "email": "", "password": ""},
+		Status: http.StatusAccepted, Response: envelope{"user": data.User{}},
+	})
+	app.handle(router, http.MethodGet, "/v1/users", app.requirePermission("admin", app.listUsersHandler), routeDoc{
+		Summary: "List users", Auth: "admin",
+		Query: []queryParam{
+			{"email", "Part of the email address, in any case", map[string]interface{}{"type": "string"}},
+			{"activated", "Only activated, or only unactivated, users", map[string]interface{}{"type": "boolean"}},
+			{"created_after", "Registered at or after this time", map[string]interface{}{"type": "string", "format": "date-time"}},
+			{"created_before", "Registered before this time", map[string]interface{}{"type": "string", "format": "date-time"}},
+			{"sort", "Sort key, descending with a leading -", map[string]interface{}{"type": "string", "enum": userSortSafeList, "default": "created_at"}},
+		},
+		Response: envelope{"users": []data.User{}, "metadata": data.Metadata{}},
+	})
+	app.handle(router, http.MethodGet, "/v1/users/:id", app.requirePermission("admin", app.showUserHandler), routeDoc{
+		Summary: "Show a user with their permissions", Auth: "admin", Response: envelope{"user": userDetail{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodPost, "/v1/users/:id/deactivate", app.requirePermission("admin", app.deactivateUserHandler), routeDoc{
+		Summary: "Suspend a user, ending their sessions", Auth: "admin", Body: envelope{"reason": ""},
+		Response: envelope{"user": userDetail{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodPost, "/v1/users/:id/activate", app.requirePermission("admin", app.reactivateUserHandler), routeDoc{
+		Summary: "Lift the suspension of a user", Auth: "admin", Body: envelope{"reason": ""},
+		Response: envelope{"user": userDetail{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodPost, "/v1/users/:id/probe-token", app.requirePermission("admin", app.createProbeTokenHandler), routeDoc{
+		Summary: "Issue a user a token exempting requests that send it in X-Probe-Token from rate limiting", Auth: "admin",
+		Status: http.StatusCreated, Response: envelope{"probe_token": data.Token{}},
+	})
+	app.handle(router, http.MethodGet, "/v1/users/:id/permissions", app.requirePermission("admin", app.showUserPermissionsHandler), routeDoc{
+		Summary: "List the permissions of a user", Auth: "admin", Response: envelope{"permissions": []string{}},
+	})
+	app.handle(router, http.MethodPut, "/v1/users/:id/permissions", app.requirePermission("admin", app.grantUserPermissionsHandler), routeDoc{
+		Summary: "Grant permissions to a user", Auth: "admin", Body: envelope{"permissions": []string{}},
+		Response: envelope{"permissions": []string{}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/users/:id/permissions", app.requirePermission("admin", app.revokeUserPermissionsHandler), routeDoc{
+		Summary: "Revoke permissions from a user", Auth: "admin", Body: envelope{"permissions": []string{}},
+		Response: envelope{"permissions": []string{}},
+	})
+
+	app.handle(router, http.MethodGet, "/v1/me", app.requireActivatedUser(app.showMeHandler), routeDoc{
+		Summary: "Show the caller's profile and permissions", Auth: "activated",
+		Response: envelope{"user": profile{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodPatch, "/v1/me", app.requireActivatedUser(app.requireWritableToken(app.updateMeHandler)), routeDoc{
+		Summary: "Update the caller's profile", Auth: "activated", Body: envelope{"name": ""},
+		Response: envelope{"user": profile{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/me", app.requireAuthenticatedUser(app.requireWritableToken(app.deleteMeHandler)), routeDoc{
+		Summary: "Delete the caller's account and everything belonging to it", Auth: "authenticated",
+		Body: envelope{"password": ""}, Status: http.StatusNoContent,
+	})
+	app.handle(router, http.MethodPost, "/v1/me/email", app.requireActivatedUser(app.requireWritableToken(app.requestEmailChangeHandler)), routeDoc{
+		Summary: "Ask to change the caller's email, mailing a confirmation token to the new address", Auth: "activated",
+		Body: envelope{"email": ""}, Status: http.StatusAccepted, Response: envelope{"user": profile{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodPut, "/v1/me/email/confirm", app.requireActivatedUser(app.requireWritableToken(app.confirmEmailChangeHandler)), routeDoc{
+		Summary: "Confirm an email change with the token mailed to the new address", Auth: "activated",
+		Body: envelope{"token": ""}, Response: envelope{"user": profile{User: &data.User{}}},
+	})
+	app.handle(router, http.MethodGet, "/v1/me/tokens", app.requireActivatedUser(app.listSessionsHandler), routeDoc{
+		Summary: "List the caller's sessions", Auth: "activated", Response: envelope{"sessions": []data.Session{}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/me/tokens/:id", app.requireActivatedUser(app.requireWritableToken(app.deleteSessionHandler)), routeDoc{
+		Summary: "End one of the caller's sessions", Auth: "activated", Status: http.StatusNoContent,
+	})
+	app.handle(router, http.MethodPost, "/v1/me/2fa/setup", app.requireActivatedUser(app.requireWritableToken(app.setupTwoFactorHandler)), routeDoc{
+		Summary: "Start setting up two-factor authentication, with a new TOTP secret", Auth: "activated",
+		Body: envelope{"password": ""}, Response: envelope{"secret": "", "otpauth_uri": ""},
+	})
+	app.handle(router, http.MethodPost, "/v1/me/2fa/confirm", app.requireActivatedUser(app.requireWritableToken(app.confirmTwoFactorHandler)), routeDoc{
+		Summary: "Enable two-factor authentication with a code from the new secret", Auth: "activated",
+		Body: envelope{"password": "", "code": ""}, Response: envelope{"recovery_codes": []string{}},
+	})
+	app.handle(router, http.MethodPut, "/v1/me/password", app.requireAuthenticatedUser(app.requireWritableToken(app.updateMyPasswordHandler)), routeDoc{
+		Summary: "Change the caller's password", Auth: "authenticated",
+		Body:     envelope{"current_password": "", "password": "", "keep_current_session": false},
+		Response: envelope{"message": ""},
+	})
+
+	app.handle(router, http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler, routeDoc{
+		Summary: "Create an authentication token", Body: envelope{"email": "", "password": "", "totp_code": "", "scope": ""},
+		Status: http.StatusCreated, Response: envelope{"authentication_token": data.Token{}, "refresh_token": data.Token{}},
+	})
+	app.handle(router, http.MethodDelete, "/v1/tokens/authentication", app.requireActivatedUser(app.deleteAuthenticationTokenHandler), routeDoc{
+		Summary: "Sign out, revoking the authentication token of the request", Auth: "activated", Status: http.StatusNoContent,
+	})
+	app.handle(router, http.MethodDelete, "/v1/tokens/authentication/all", app.requireActivatedUser(app.requireWritableToken(app.deleteAllAuthenticationTokensHandler)), routeDoc{
+		Summary: "Sign out everywhere, revoking all of the caller's tokens", Auth: "activated", Status: http.StatusNoContent,
+	})
+	app.handle(router, http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler, routeDoc{
+		Summary: "Exchange a refresh token for new authentication and refresh tokens", Body: envelope{"refresh_token": ""},
+		Status: http.StatusCreated, Response: envelope{"authentication_token": data.Token{}, "refresh_token": data.Token{}},
+	})
+	app.handle(router, http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler, routeDoc{
+		Summary: "Mail a password reset token", Body: envelope{"email": ""},
+		Status: http.StatusAccepted, Response: envelope{"message": ""},
+	})
+
+	app.handle(router, http.MethodGet, "/v1/metrics", expvar.Handler().ServeHTTP, routeDoc{
+		Summary: "Show the server's runtime metrics",
+	})
+
+	// httprouter won't register a static segment where a wildcard such as :id
+	// already lives, so fixed sub-paths of /v1/musics and /v1/users get a
+	// router of their own which hands everything it doesn't match over to the
+	// main one.
+	staticRouter := httprouter.New()
+	staticRouter.NotFound = router
+	staticRouter.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	staticRouter.GlobalOPTIONS = http.HandlerFunc(app.optionsHandler)
+
+	app.handle(staticRouter, http.MethodPut, "/v1/users/activate", app.activateUserHandler, routeDoc{
+		Summary: "Activate a user with the token they were mailed", Body: envelope{"token": ""},
+		Response: envelope{"user": data.User{}},
+	})
+	app.handle(staticRouter, http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler, routeDoc{
+		Summary: "Reset a password with the token mailed for it", Body: envelope{"password": "", "token": ""},
+		Response: envelope{"message": ""},
+	})
+
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/count", app.countMusicsHandler, routeDoc{
+		Summary: "Count the musics matching the listing filters", Query: app.musicQuery(), Response: envelope{"count": 0},
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/suggest", app.suggestMusicsHandler, routeDoc{
+		Summary:  "Suggest musics whose title starts with ?q=",
+		Query:    []queryParam{{"q", "Title prefix", map[string]interface{}{"type": "string", "minLength": 2}}},
+		Response: envelope{"suggestions": []data.Suggestion{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/recent", app.recentMusicsHandler, routeDoc{
+		Summary: "List recently added musics",
+		Query: []queryParam{
+			{"days", "How many days back to look", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 90, "default": 7}},
+			{"limit", "Most records to return", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100, "default": 20}},
+		},
+		Response: envelope{"musics": []data.Music{}, "metadata": envelope{"days": 0, "since": time.Time{}, "limit": 0}},
+		Key:      "musics",
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/feed.atom", app.musicsFeedHandler, routeDoc{
+		Summary:     "Subscribe to newly added musics as an Atom feed",
+		Query:       []queryParam{{"genres", "Comma separated genres entries must all have", map[string]interface{}{"type": "string"}}},
+		ContentType: "application/atom+xml",
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/events", app.musicEventsHandler, routeDoc{
+		Summary:     "Stream music changes as server-sent events",
+		Query:       []queryParam{{"last_event_id", "Resume after this event id, when Last-Event-ID can't be sent", map[string]interface{}{"type": "integer", "minimum": 0}}},
+		ContentType: "text/event-stream",
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/stats", app.requireAuthenticatedUser(app.showStatsHandler), routeDoc{
+		Summary: "Show catalogue statistics", Auth: "authenticated", Response: envelope{"stats": data.Stats{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/stats/duration-histogram", app.requireAuthenticatedUser(app.durationHistogramHandler), routeDoc{
+		Summary:  "Show a histogram of music durations",
+		Auth:     "authenticated",
+		Query:    []queryParam{{"bucket", "Bucket width in seconds", map[string]interface{}{"type": "integer", "minimum": 10, "maximum": 600, "default": 30}}},
+		Response: envelope{"bucket": 0, "buckets": []data.HistogramBucket{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/random", app.randomMusicsHandler, routeDoc{
+		Summary: "Pick random musics matching the listing filters",
+		Query: append(app.musicQuery(),
+			queryParam{"count", "How many records to pick", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxRandomMusics, "default": 1}},
+			queryParam{"seed", "Seed that makes the pick repeatable", map[string]interface{}{"type": "integer", "format": "int64"}},
+		),
+		Response: envelope{"musics": []data.Music{}},
+		Key:      "musics",
+	})
+	app.handleVersioned(staticRouter, http.MethodPut, "/musics/isrc/:isrc", app.requirePermission("musics:write", app.upsertMusicHandler), routeDoc{
+		Summary: "Create or replace the music with an ISRC", Auth: "musics:write", Body: musicBody, Response: musicEnv, Key: "music",
+	})
+	app.handleVersioned(staticRouter, http.MethodPost, "/musics/import", app.requirePermission("musics:write", app.importMusicsHandler), routeDoc{
+		Summary:  "Import musics from a CSV body",
+		Auth:     "musics:write",
+		Query:    []queryParam{{"dry_run", "Only validate the rows", map[string]interface{}{"type": "boolean", "default": false}}},
+		Response: envelope{"dry_run": false, "imported": 0, "rejected": 0, "errors": []importRowError{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodPost, "/musics/enrich", app.requirePermission("musics:write", app.enrichMusicsHandler), routeDoc{
+		Summary: "Start filling in the missing fields of the musics matching the listing filters", Auth: "musics:write",
+		Query: append(app.musicQuery(),
+			queryParam{"overwrite", "Also replace the fields the musics already have", map[string]interface{}{"type": "boolean", "default": false}},
+		),
+		Status: http.StatusAccepted, Response: envelope{"enrichment_job": data.EnrichmentJob{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodGet, "/musics/enrich/:id", app.requirePermission("musics:write", app.showEnrichmentJobHandler), routeDoc{
+		Summary: "Show the progress of a bulk enrichment", Auth: "musics:write",
+		Response: envelope{"enrichment_job": data.EnrichmentJob{}},
+	})
+	app.handleVersioned(staticRouter, http.MethodPost, "/musics/retag", app.requirePermission("musics:write", app.retagMusicsHandler), routeDoc{
+		Summary: "Add and remove genres on the musics matching the listing filters", Auth: "musics:write",
+		Query: app.musicQuery(), Body: envelope{"add_genres": []string{}, "remove_genres": []string{}},
+		Response: envelope{"changed_records": 0},
+	})
+
+	return app.metrics(app.compress(app.assignRequestID(app.recoverPanic(app.enableCORS(app.negotiate(app.rateLimit(app.authenticate(app.rateLimitUser(app.decompressRequest(app.methodOverride(staticRouter)))))))))))
+}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+// optionsHandler answers OPTIONS requests for any registered path. For CORS
+// preflight requests the allowed methods are mirrored into
+// Access-Control-Allow-Methods.
+func (app *application) optionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-HTTP-Method-Override")
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowHeader(t *testing.T) {
+	h := newTestApplication(t).routes()
+
+	const (
+		collection = "DELETE, GET, HEAD, OPTIONS, POST"
+		item       = "DELETE, GET, HEAD, OPTIONS, PATCH, PUT"
+	)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"options collection", http.MethodOptions, "/v1/musics", http.StatusNoContent, collection},
+		{"options item", http.MethodOptions, "/v1/musics/1", http.StatusNoContent, item},
+		{"options v2 item", http.MethodOptions, "/v2/musics/1", http.StatusNoContent, item},
+		{"options healthcheck", http.MethodOptions, "/v1/healthcheck", http.StatusNoContent, "GET, OPTIONS"},
+		{"post item", http.MethodPost, "/v1/musics/1", http.StatusMethodNotAllowed, item},
+		{"put collection", http.MethodPut, "/v1/musics", http.StatusMethodNotAllowed, collection},
+		{"delete healthcheck", http.MethodDelete, "/v1/healthcheck", http.StatusMethodNotAllowed, "GET, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(h, httptest.NewRequest(tt.method, tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q; want %q", got, tt.wantAllow)
+			}
+
+			if rr.Code == http.StatusNoContent {
+				if rr.Body.Len() != 0 {
+					t.Errorf("got body %q; want none", rr.Body)
+				}
+				return
+			}
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != codeMethodNotAllowed {
+				t.Errorf("got error code %q; want %q", body.Error.Code, codeMethodNotAllowed)
+			}
+		})
+	}
+}
+
+func TestPreflightAllowMethods(t *testing.T) {
+	h := newTestApplication(t).routes()
+
+	r := httptest.NewRequest(http.MethodOptions, "/v1/musics/1", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+
+	rr := serve(h, r)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusNoContent)
+	}
+	if got, want := rr.Header().Get("Access-Control-Allow-Methods"), rr.Header().Get("Allow"); got != want {
+		t.Errorf("got Access-Control-Allow-Methods %q; want the Allow list %q", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func (app *application) createSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	search := &data.SavedSearch{
+		Name:   strings.TrimSpace(input.Name),
+		Query:  data.NormalizeSavedSearchQuery(input.Query),
+		UserID: app.contextGetUser(r).ID,
+	}
+
+	v := validator.New()
+	if data.ValidateSavedSearch(v, search); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.SavedSearches.Insert(search)
+	if err != nil {
+		app.constraintErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"saved_search": search}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafeList: []string{"id", "name", "created_at", "-id", "-name", "-created_at"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	searches, metadata, err := app.models.SavedSearches.GetAllForUser(app.contextGetUser(r).ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"saved_searches": searches, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	err = app.models.SavedSearches.DeleteForUser(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "saved search successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// applySavedSearch resolves ?saved_search=<id> on a listing request: it
+// returns a copy of r whose query holds the saved parameters, overridden by
+// any the request sets itself. It writes the error response and returns nil
+// when the saved search can't be used.
+func (app *application) applySavedSearch(w http.ResponseWriter, r *http.Request) *http.Request {
+	qs := r.URL.Query()
+	id, err := strconv.ParseInt(qs.Get("saved_search"), 10, 64)
+	if err != nil || id < 1 {
+		v := validator.New()
+		v.AddError("saved_search", validator.MsgPositiveInteger)
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return nil
+	}
+
+	search, err := app.models.SavedSearches.GetForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	merged, err := url.ParseQuery(search.Query)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+	qs.Del("saved_search")
+	for key, values := range qs {
+		merged[key] = values
+	}
+
+	r2 := r.WithContext(r.Context())
+	u := *r.URL
+	u.RawQuery = merged.Encode()
+	r2.URL = &u
+	return r2
+}
@@ -11,14 +11,19 @@ import (
 	"time"
 )
 
+// serverWriteTimeout bounds how long a response may take to write, which
+// also caps the life of a streamed response.
+const serverWriteTimeout = 30 * time.Second
+
 func (app *application) serve() error {
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 	}
+	srv.RegisterOnShutdown(func() { close(app.shutdown) })
 
 	shutdownError := make(chan error)
 
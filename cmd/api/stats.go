@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsCache keeps the last computed catalogue statistics until they are
+// older than the configured TTL.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *data.Stats
+	expires time.Time
+}
+
+// catalogueStats returns the cached statistics, recomputing them once they
+// have expired. Concurrent callers wait for a single recomputation.
+func (app *application) catalogueStats() (*data.Stats, error) {
+	app.stats.mu.Lock()
+	defer app.stats.mu.Unlock()
+
+	if app.stats.stats != nil && time.Now().Before(app.stats.expires) {
+		return app.stats.stats, nil
+	}
+
+	stats, err := app.models.Musics.Stats()
+	if err != nil {
+		return nil, err
+	}
+	app.stats.stats = stats
+	app.stats.expires = time.Now().Add(app.config.statsTTL)
+	return stats, nil
+}
+
+func (app *application) showStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.catalogueStats()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// durationHistogramHandler returns how many records fall in each duration
+// bucket of ?bucket= seconds, narrowed by the list endpoint's filters.
+func (app *application) durationHistogramHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filter := app.readMusicFilter(qs, v)
+	width := app.readInt(qs, "bucket", 30, v)
+	v.Check(width >= 10 && width <= 600, "bucket", validator.MsgRange, 10, 600)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	buckets, err := app.models.Musics.DurationHistogram(filter, width)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQueryTimeout):
+			app.queryTimeoutResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"bucket": width, "buckets": buckets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+)
+
+// stubQuery answers a query sent to a stub database with the columns and
+// rows of its result.
+type stubQuery func(query string, args []driver.Value) (columns []string, rows [][]driver.Value, err error)
+
+// openStubDB returns a database whose queries are answered by answer, for
+// handler tests that need the models to see a particular result. Statements
+// other than queries, and transactions, succeed without doing anything.
+func openStubDB(answer stubQuery) *sql.DB {
+	return sql.OpenDB(stubConnector{answer})
+}
+
+type stubConnector struct{ answer stubQuery }
+
+func (c stubConnector) Connect(context.Context) (driver.Conn, error) { return stubConn(c), nil }
+func (c stubConnector) Driver() driver.Driver                        { return stubDriver{} }
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) { return nil, driver.ErrSkip }
+
+type stubConn struct{ answer stubQuery }
+
+func (c stubConn) Prepare(query string) (driver.Stmt, error) { return stubStmt{c.answer, query}, nil }
+func (c stubConn) Close() error                              { return nil }
+func (c stubConn) Begin() (driver.Tx, error)                 { return stubTx{}, nil }
+
+// BeginTx accepts any isolation level and read-only transactions too.
+func (c stubConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	answer stubQuery
+	query  string
+}
+
+func (s stubStmt) Close() error  { return nil }
+func (s stubStmt) NumInput() int { return -1 }
+
+func (s stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, rows, err := s.answer(strings.TrimSpace(s.query), args)
+	if err != nil {
+		return nil, err
+	}
+	return &stubRows{columns: columns, rows: rows}, nil
+}
+
+type stubRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
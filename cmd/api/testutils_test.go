@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"github.com/SPA-Final/musicdb/internal/jsonlog"
+	"github.com/SPA-Final/musicdb/internal/testdb"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns the configuration the API starts with when given no
+// flags.
+func newTestConfig(t *testing.T) config {
+	t.Helper()
+
+	var cfg config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(fs, &cfg)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestApplication returns an application with the default configuration
+// and no database; tests using it must not reach the models.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	return &application{
+		config:     cfg,
+		logger:     jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:     data.NewModels(nil, cfg.db.queryTimeout),
+		mailer:     &stubMailer{},
+		events:     events.NewHub(recentEvents),
+		shutdown:   make(chan struct{}),
+		outboxWake: make(chan struct{}, 1),
+	}
+}
+
+// newTestDBApplication is newTestApplication with models backed by a
+// migrated test database, skipping t when there is none.
+func newTestDBApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(testdb.Open(t), app.config.db.queryTimeout)
+	t.Cleanup(func() { app.models.Close() })
+	return app
+}
+
+// insertTestUser adds an activated user with password "pa55word" and the
+// given permissions.
+func insertTestUser(t *testing.T, app *application, email string, permissions ...string) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) > 0 {
+		if err := app.models.Permissions.AddForUser(user.ID, permissions...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+// newTestToken issues user an authentication token and returns its
+// plaintext.
+func newTestToken(t *testing.T, app *application, user *data.User, readOnly bool) string {
+	t.Helper()
+
+	auth, _, err := app.models.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth.Plaintext
+}
+
+// serve sends r to h and returns the recorded response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+// withIDParam returns r with id as its :id route parameter, for handlers
+// called without the router.
+func withIDParam(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: id}})
+	return r.WithContext(ctx)
+}
+
+// readAPIError decodes the error envelope of rr.
+func readAPIError(t *testing.T, rr *httptest.ResponseRecorder) apiError {
+	t.Helper()
+
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", rr.Body, err)
+	}
+	return body.Error
+}
+
+// sentMail is an email stubMailer was asked to send.
+type sentMail struct {
+	Recipient string
+	Template  string
+	Data      map[string]interface{}
+}
+
+// stubMailer records the emails sent through it instead of sending them.
+type stubMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *stubMailer) Send(recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, _ := data.(map[string]interface{})
+	m.sent = append(m.sent, sentMail{Recipient: recipient, Template: templateFile, Data: d})
+	return nil
+}
+
+// Sent returns the emails sent so far.
+func (m *stubMailer) Sent() []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]sentMail(nil), m.sent...)
+}
@@ -4,17 +4,27 @@ import (
 	"errors"
 	"github.com/SPA-Final/musicdb/internal/data"
 	"github.com/SPA-Final/musicdb/internal/validator"
+	"github.com/tomasen/realip"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// tokenScopeReadOnly is the scope of a token creation request asking for a
+// read-only token.
+const tokenScopeReadOnly = "read-only"
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		TOTPCode string `json:"totp_code"`
+		// Scope is "read-only" to restrict the tokens to the user's
+		// read-only permissions.
+		Scope string `json:"scope"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input, jsonStrict)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -23,6 +33,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	v.Check(validator.In(input.Scope, "", tokenScopeReadOnly), "scope", validator.MsgOneOf, tokenScopeReadOnly)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -48,15 +59,179 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+	if !app.checkSecondFactor(w, r, user, input.TOTPCode) {
+		return
+	}
+
+	userAgent, ip := tokenClient(r)
+	readOnly := input.Scope == tokenScopeReadOnly
+	token, refresh, err := app.models.Tokens.NewPair(user.ID, app.config.tokens.authTTL, app.config.tokens.refreshTTL, userAgent, ip, readOnly)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new authentication
+// and refresh token. Each refresh token works once: presenting one that was
+// already exchanged revokes every token descended from the same sign-in,
+// since either the client or whoever copied the token is not who they seem.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	userAgent, ip := tokenClient(r)
+	token, refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.tokens.authTTL, app.config.tokens.refreshTTL, userAgent, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.PrintInfo("revoked token family after refresh token reuse", map[string]string{
+				"request_id": app.requestID(r),
+			})
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refresh}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// createPasswordResetTokenHandler mails a password reset token to the user
+// with the email in the body. It answers 202 whether or not there is such a
+// user, and looks the user up in the background, so neither the response
+// nor its timing tells who has an account.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		d := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+		if err := app.mailer.Send(user.Email, "token_password_reset.tmpl", d); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler signs the caller out by deleting the
+// token the request was made with.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteByPlaintextForUser(data.ScopeAuthentication, app.contextGetAuthToken(r), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAllAuthenticationTokensHandler signs the caller out everywhere.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.Tokens.DeleteSessions(app.contextGetUser(r).ID, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createProbeTokenHandler issues user :id, typically the service account of
+// a health probe or metrics scraper, a token that exempts the requests
+// sending it in X-Probe-Token from rate limiting. It doesn't authenticate
+// them.
+func (app *application) createProbeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, app.config.tokens.probeTTL, data.ScopeProbe)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"probe_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxUserAgentBytes bounds the User-Agent recorded for a session.
+const maxUserAgentBytes = 512
+
+// tokenClient returns the User-Agent and IP address of the client r comes
+// from, as recorded with the tokens issued to it.
+func tokenClient(r *http.Request) (string, string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentBytes {
+		userAgent = userAgent[:maxUserAgentBytes]
+	}
+	return strings.ToValidUTF8(userAgent, ""), realip.FromRequest(r)
+}
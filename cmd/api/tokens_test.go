@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokenPair is the body of a successful sign-in or refresh.
+type tokenPair struct {
+	Authentication struct {
+		Token    string `json:"token"`
+		ReadOnly bool   `json:"read_only"`
+	} `json:"authentication_token"`
+	Refresh struct {
+		Token    string `json:"token"`
+		ReadOnly bool   `json:"read_only"`
+	} `json:"refresh_token"`
+}
+
+// postRefresh exchanges refreshToken through h, returning the response and
+// the new tokens when there are any.
+func postRefresh(t *testing.T, h http.Handler, refreshToken string) (*httptest.ResponseRecorder, tokenPair) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+	rr := serve(h, r)
+	var pair tokenPair
+	if rr.Code == http.StatusCreated {
+		if err := json.Unmarshal(rr.Body.Bytes(), &pair); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, pair
+}
+
+// authenticatedStatus returns the status of GET /v1/me sent through h with
+// token.
+func authenticatedStatus(h http.Handler, token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/v1/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return serve(h, r).Code
+}
+
+func TestRefreshToken(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "refresh@example.com")
+
+	auth, refresh, err := app.models.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr, pair := postRefresh(t, h, refresh.Plaintext)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	if pair.Authentication.ReadOnly || pair.Refresh.ReadOnly {
+		t.Errorf("got read-only tokens from a full refresh token: %s", rr.Body)
+	}
+	if code := authenticatedStatus(h, pair.Authentication.Token); code != http.StatusOK {
+		t.Errorf("new authentication token: got status %d; want %d", code, http.StatusOK)
+	}
+
+	// The exchanged refresh token is refused, and its reuse signs out
+	// everything issued from the same sign-in.
+	if rr, _ := postRefresh(t, h, refresh.Plaintext); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+	for _, token := range []string{auth.Plaintext, pair.Authentication.Token} {
+		if code := authenticatedStatus(h, token); code != http.StatusUnauthorized {
+			t.Errorf("authentication token after reuse: got status %d; want %d", code, http.StatusUnauthorized)
+		}
+	}
+	if rr, _ := postRefresh(t, h, pair.Refresh.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token after reuse: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshTokenExpired(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "expired@example.com")
+
+	_, refresh, err := app.models.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.models.Tokens.DB.Exec(`UPDATE tokens SET expiry = NOW() - INTERVAL '1 second' WHERE hash = $1`, refresh.Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr, _ := postRefresh(t, h, refresh.Plaintext); rr.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshTokenReadOnly(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "reader@example.com", "musics:read", "musics:write")
+
+	_, refresh, err := app.models.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr, pair := postRefresh(t, h, refresh.Plaintext)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	if !pair.Authentication.ReadOnly || !pair.Refresh.ReadOnly {
+		t.Errorf("got %s; want both tokens read-only", rr.Body)
+	}
+
+	// The new token is as restricted as the one it replaced.
+	r := httptest.NewRequest(http.MethodPost, "/v1/musics", strings.NewReader(`{"title":"Song","artist":"Band","duration":180,"genres":["pop"],"popularity":0.5}`))
+	r.Header.Set("Authorization", "Bearer "+pair.Authentication.Token)
+	if rr := serve(h, r); rr.Code != http.StatusForbidden {
+		t.Errorf("POST /v1/musics: got status %d; want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestRevokedTokensRefused(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "revoke@example.com")
+	laptop := newTestToken(t, app, user, false)
+	phone := newTestToken(t, app, user, false)
+	tablet := newTestToken(t, app, user, false)
+
+	// Signing out ends only the session of the request.
+	if rr := sendAs(h, laptop, http.MethodDelete, "/v1/tokens/authentication", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("sign out: got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+	if code := authenticatedStatus(h, laptop); code != http.StatusUnauthorized {
+		t.Errorf("signed out session: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	for _, token := range []string{phone, tablet} {
+		if code := authenticatedStatus(h, token); code != http.StatusOK {
+			t.Errorf("other session: got status %d; want %d", code, http.StatusOK)
+		}
+	}
+
+	// Signing out everywhere ends them all.
+	if rr := sendAs(h, phone, http.MethodDelete, "/v1/tokens/authentication/all", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("sign out everywhere: got status %d; want %d: %s", rr.Code, http.StatusNoContent, rr.Body)
+	}
+	for _, token := range []string{phone, tablet} {
+		if code := authenticatedStatus(h, token); code != http.StatusUnauthorized {
+			t.Errorf("session after signing out everywhere: got status %d; want %d", code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestCreatePasswordResetToken(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	mail := app.mailer.(*stubMailer)
+	user := insertTestUser(t, app, "alice@example.com")
+	session := newTestToken(t, app, user, false)
+
+	// An unknown address is answered the same, and nothing is mailed.
+	if rr := sendAs(h, "", http.MethodPost, "/v1/tokens/password-reset", `{"email":"nobody@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("unknown email: got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+	app.wg.Wait()
+	if sent := mail.Sent(); len(sent) != 0 {
+		t.Fatalf("unknown email: got mail %+v; want none", sent)
+	}
+
+	if rr := sendAs(h, "", http.MethodPost, "/v1/tokens/password-reset", `{"email":"alice@example.com"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("known email: got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+	app.wg.Wait()
+	sent := mail.Sent()
+	if len(sent) != 1 || sent[0].Recipient != user.Email || sent[0].Template != "token_password_reset.tmpl" {
+		t.Fatalf("known email: got mail %+v; want the reset token mailed to %s", sent, user.Email)
+	}
+	token, _ := sent[0].Data["passwordResetToken"].(string)
+
+	// The mailed token resets the password, and the reset uses it up along
+	// with the user's sessions.
+	body := `{"password":"correct horse battery","token":"` + token + `"}`
+	if rr := sendAs(h, "", http.MethodPut, "/v1/users/password", body); rr.Code != http.StatusOK {
+		t.Fatalf("reset: got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var left int
+	err := app.models.Tokens.DB.QueryRow(`SELECT count(*) FROM tokens WHERE user_id = $1 AND scope IN ($2, $3)`,
+		user.ID, data.ScopePasswordReset, data.ScopeAuthentication).Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("got %d reset and authentication tokens left; want 0", left)
+	}
+	if code := authenticatedStatus(h, session); code != http.StatusUnauthorized {
+		t.Errorf("session after reset: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/totp"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/http"
+	"time"
+)
+
+// totpIssuer names the service in authenticator apps.
+const totpIssuer = "musicdb"
+
+// setupTwoFactorHandler starts setting up two-factor authentication for the
+// caller, answering with a new TOTP secret to add to an authenticator app.
+// It stays pending, and signing in is unchanged, until a code from it is
+// confirmed. Starting again replaces a pending secret. Like confirming, it
+// takes the caller's current password, so a stolen token can't be used to
+// lock them out.
+func (app *application) setupTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Password != "", "password", validator.MsgRequired); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.config.totp.key == nil {
+		app.twoFactorUnavailableResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	sealed, err := totp.Seal(app.config.totp.key, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Begin(user.ID, sealed)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.twoFactorEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"secret": totp.Encode(secret), "otpauth_uri": totp.URI(totpIssuer, user.Email, secret)}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTwoFactorHandler enables the caller's pending two-factor
+// authentication given a current code from it, answering with the recovery
+// codes, which are shown this once. It takes the caller's current password.
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Password != "", "password", validator.MsgRequired)
+	v.Check(input.Code != "", "code", validator.MsgRequired)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.config.totp.key == nil {
+		app.twoFactorUnavailableResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.twoFactorNotPendingResponse(w, r)
+		return
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	case tf.Enabled:
+		app.twoFactorEnabledResponse(w, r)
+		return
+	}
+
+	secret, err := totp.Open(app.config.totp.key, tf.Secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	step, ok := totp.Validate(secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", validator.MsgInvalidTOTP)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.TwoFactor.Enable(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.twoFactorEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkPassword reports whether password is user's, answering the request
+// itself when it isn't.
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// checkSecondFactor checks the second factor of user signing in, a code
+// from their authenticator app or one of their recovery codes, if they have
+// two-factor authentication enabled, answering the request itself when it
+// doesn't pass. TOTP codes are accepted from the step either side of the
+// current one, and each, like each recovery code, only once.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User, code string) bool {
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return true
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return false
+	case !tf.Enabled:
+		return true
+	}
+
+	if code == "" {
+		app.totpRequiredResponse(w, r)
+		return false
+	}
+
+	var ok bool
+	if isTOTPCode(code) {
+		if app.config.totp.key == nil {
+			app.serverErrorResponse(w, r, errors.New("two-factor authentication is enabled for a user but no TOTP key is configured"))
+			return false
+		}
+		secret, err := totp.Open(app.config.totp.key, tf.Secret)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		var step int64
+		if step, ok = totp.Validate(secret, code, time.Now()); ok {
+			ok, err = app.models.TwoFactor.UseStep(user.ID, step)
+		}
+	} else {
+		ok, err = app.models.TwoFactor.UseRecoveryCode(user.ID, code)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !ok {
+		app.invalidTOTPCodeResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// isTOTPCode reports whether code looks like a TOTP code rather than a
+// recovery code.
+func isTOTPCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
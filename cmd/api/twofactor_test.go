@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTwoFactorRequiresPassword(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.totp.key = bytes.Repeat([]byte{1}, 32)
+
+	user := &data.User{ID: 1, Email: "alice@example.com", Activated: true}
+	if err := user.Password.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    int
+	}{
+		{"setup without password", app.setupTwoFactorHandler, `{}`, http.StatusUnprocessableEntity},
+		{"setup with wrong password", app.setupTwoFactorHandler, `{"password":"guessed"}`, http.StatusUnauthorized},
+		{"confirm without password", app.confirmTwoFactorHandler, `{"code":"123456"}`, http.StatusUnprocessableEntity},
+		{"confirm with wrong password", app.confirmTwoFactorHandler, `{"password":"guessed","code":"123456"}`, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/me/2fa/setup", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r = app.contextSetUser(r, user)
+			if rr := serve(tt.handler, r); rr.Code != tt.want {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+		})
+	}
+}
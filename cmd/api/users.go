@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"github.com/SPA-Final/musicdb/internal/data"
 	"github.com/SPA-Final/musicdb/internal/validator"
@@ -15,7 +17,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Password string `json:"password"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input, jsonStrict)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -23,7 +25,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	user := &data.User{
 		Name:      input.Name,
-		Email:     input.Email,
+		Email:     data.NormalizeEmail(input.Email),
 		Activated: false,
 	}
 
@@ -34,7 +36,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validator.New()
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+	if app.checkPasswordBreach(r, v, input.Password); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -43,7 +46,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
+			v.AddError("email", validator.MsgDuplicateEmail)
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -69,7 +72,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 	})
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -80,7 +83,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		TokenPlaintext string `json:"token"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input, jsonStrict)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -96,7 +99,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", validator.MsgInvalidActivationToken)
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -123,8 +126,295 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// updateUserPasswordHandler sets a new password for the user a password
+// reset token was mailed to. The user's password reset tokens are deleted
+// and their sessions all ended, signing them out everywhere, in the
+// transaction saving the password.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateNewPassword(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if app.checkPasswordBreach(r, v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", validator.MsgInvalidPasswordResetToken)
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Transact(func(tx *sql.Tx) error {
+		if err := app.models.Users.UpdateTx(tx, user); err != nil {
+			return err
+		}
+		if err := app.models.Tokens.DeleteAllForUserTx(tx, data.ScopePasswordReset, user.ID); err != nil {
+			return err
+		}
+		return app.invalidateSessionsTx(tx, user.ID, nil, "", "password_reset")
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// userDetail is a user record as an admin sees it, with the codes of its
+// permissions, sorted.
+type userDetail struct {
+	*data.User
+	Permissions []string `json:"permissions"`
+}
+
+var userSortSafeList = []string{"created_at", "email", "name", "-created_at", "-email", "-name"}
+
+// listUsersHandler lists the users, for support staff looking one up.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filter := data.UserFilter{
+		Email:         app.readString(qs, "email", ""),
+		CreatedAfter:  app.readTime(qs, "created_after", v),
+		CreatedBefore: app.readTime(qs, "created_before", v),
+	}
+	if qs.Get("activated") != "" {
+		activated := app.readBool(qs, "activated", false, v)
+		filter.Activated = &activated
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "created_at"),
+		SortSafeList: userSortSafeList,
+	}
+	data.ValidateUserFilter(v, filter)
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler shows user :id with its permissions.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+	app.writeUser(w, r, user)
+}
+
+// readUser looks up user :id, answering the request itself when it can't.
+func (app *application) readUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// deactivateUserHandler suspends user :id, ending all their sessions and
+// deleting their other tokens, with an optional reason that goes in the
+// audit log. The last active holder of a protected permission can't be
+// suspended. Suspending a suspended user changes nothing.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setSuspended(w, r, true)
+}
+
+// reactivateUserHandler lifts the suspension of user :id. Their sessions
+// aren't restored; they sign in again.
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setSuspended(w, r, false)
+}
+
+func (app *application) setSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input, jsonStrict)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	if v.Check(len(input.Reason) <= 500, "reason", validator.MsgMaxBytes, 500); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if user.Suspended == suspended {
+		app.writeUser(w, r, user)
+		return
+	}
+
+	action := data.AuditUserReactivated
+	if suspended {
+		action = data.AuditUserSuspended
+	}
+	actorID := app.contextGetUser(r).ID
+
+	err := app.models.Transact(func(tx *sql.Tx) error {
+		if suspended {
+			permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				return err
+			}
+			for _, code := range protectedPermissions {
+				if !permissions.Include(code) {
+					continue
+				}
+				others, err := app.models.Permissions.CountOtherHoldersTx(tx, code, user.ID)
+				if err != nil {
+					return err
+				}
+				if others == 0 {
+					return errLastHolder{code}
+				}
+			}
+			if err := app.models.Tokens.DeleteEveryScopeForUserTx(tx, user.ID); err != nil {
+				return err
+			}
+		}
+
+		user.Suspended = suspended
+		if err := app.models.Users.UpdateTx(tx, user); err != nil {
+			return err
+		}
+		return app.models.Audit.InsertTx(tx, &data.AuditEntry{
+			UserID:  user.ID,
+			ActorID: &actorID,
+			Action:  action,
+			Reason:  input.Reason,
+		})
+	})
+	if err != nil {
+		var lastHolder errLastHolder
+		switch {
+		case errors.As(err, &lastHolder):
+			app.lastHolderSuspendResponse(w, r, lastHolder.code)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUser(w, r, user)
+}
+
+// writeUser answers with user and its permissions, as GET /v1/users/:id
+// shows them.
+func (app *application) writeUser(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": userDetail{user, permissions}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// pwnedWait bounds the breach data lookup of a new password.
+const pwnedWait = 5 * time.Second
+
+// checkPasswordBreach adds a validation error to v when the new password,
+// not already rejected, is found in the breach data. The check is skipped
+// when it's turned off, and when the lookup fails, so that the breach data
+// being unreachable doesn't stop users from setting passwords.
+func (app *application) checkPasswordBreach(r *http.Request, v *validator.Validator, password string) {
+	if app.pwned == nil {
+		return
+	}
+	if _, rejected := v.Errors["password"]; rejected {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), pwnedWait)
+	defer cancel()
+
+	breached, err := app.pwned.Breached(ctx, password)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"request_id": app.requestID(r)})
+		return
+	}
+	v.Check(!breached, "password", validator.MsgBreachedPassword)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// userPasswordHash is the hash the stub database holds for every user.
+const userPasswordHash = "$2a$12$R9h/cIPz0gi.URNNX3kh2OPST9/PgBkqquzi.Ss7KIUgO2t0jWMUW"
+
+func TestUserResponsesOmitPasswordHash(t *testing.T) {
+	app := newTestApplication(t)
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		now := time.Now()
+		switch {
+		case strings.HasPrefix(query, "SELECT p.code"):
+			return []string{"code"}, [][]driver.Value{{"admin"}, {"musics:read"}}, nil
+		case strings.HasPrefix(query, "SELECT count(*) OVER()"):
+			return []string{"count", "id", "created_at", "name", "email", "activated", "pending_email", "suspended", "version"},
+				[][]driver.Value{{int64(1), int64(1), now, "Alice", "alice@example.com", true, "", false, int64(1)}}, nil
+		}
+		return []string{"id", "created_at", "name", "email", "password_hash", "activated", "pending_email", "suspended", "version"},
+			[][]driver.Value{{int64(1), now, "Alice", "alice@example.com", []byte(userPasswordHash), true, "", false, int64(1)}}, nil
+	})
+	defer db.Close()
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+	}{
+		{"list", app.listUsersHandler, "/v1/users"},
+		{"show", app.showUserHandler, "/v1/users/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(tt.handler, withIDParam(httptest.NewRequest(http.MethodGet, tt.path, nil), "1"))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+
+			var v interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+			var walk func(v interface{})
+			walk = func(v interface{}) {
+				switch v := v.(type) {
+				case map[string]interface{}:
+					for key, value := range v {
+						if k := strings.ToLower(key); strings.Contains(k, "password") || strings.Contains(k, "hash") {
+							t.Errorf("got key %q in %s", key, rr.Body)
+						}
+						walk(value)
+					}
+				case []interface{}:
+					for _, value := range v {
+						walk(value)
+					}
+				}
+			}
+			walk(v)
+
+			if strings.Contains(rr.Body.String(), userPasswordHash) {
+				t.Errorf("got the password hash in %s", rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), "alice@example.com") {
+				t.Errorf("got no user in %s", rr.Body)
+			}
+		})
+	}
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com")
+	laptop := newTestToken(t, app, user, false)
+	phone := newTestToken(t, app, user, false)
+
+	reset, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"password":"correct horse battery","token":"` + reset.Plaintext + `"}`
+	if rr := sendAs(h, "", http.MethodPut, "/v1/users/password", body); rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	for _, token := range []string{laptop, phone} {
+		if code := authenticatedStatus(h, token); code != http.StatusUnauthorized {
+			t.Errorf("session after reset: got status %d; want %d", code, http.StatusUnauthorized)
+		}
+	}
+	if rr := sendAs(h, "", http.MethodPut, "/v1/users/password", body); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("used reset token: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestPasswordResetInvalidToken(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+	user := insertTestUser(t, app, "alice@example.com")
+
+	expired, err := app.models.Tokens.New(user.ID, -time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An authentication token isn't a reset token either.
+	auth := newTestToken(t, app, user, false)
+
+	for name, token := range map[string]string{"bogus": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "expired": expired.Plaintext, "wrong scope": auth} {
+		t.Run(name, func(t *testing.T) {
+			rr := sendAs(h, "", http.MethodPut, "/v1/users/password", `{"password":"correct horse battery","token":"`+token+`"}`)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+			if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["token"] == "" {
+				t.Errorf("got fields %v; want only token", fields)
+			}
+		})
+	}
+
+	// The password is unchanged.
+	if rr := sendAs(h, "", http.MethodPost, "/v1/tokens/authentication", `{"email":"alice@example.com","password":"pa55word"}`); rr.Code != http.StatusCreated {
+		t.Errorf("sign in with the old password: got status %d; want %d", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestRegisterUserEmailCase(t *testing.T) {
+	app := newTestDBApplication(t)
+	h := app.routes()
+
+	rr := sendAs(h, "", http.MethodPost, "/v1/users", `{"name":"Alice","email":"Alice@Example.COM","password":"correct horse battery"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+	}
+	app.wg.Wait()
+	var body struct {
+		User struct {
+			Email string `json:"email"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.User.Email != "alice@example.com" {
+		t.Errorf("got email %q; want it lower-cased", body.User.Email)
+	}
+
+	for _, email := range []string{"alice@example.com", "ALICE@example.com"} {
+		rr := sendAs(h, "", http.MethodPost, "/v1/tokens/authentication", `{"email":"`+email+`","password":"correct horse battery"}`)
+		if rr.Code != http.StatusCreated {
+			t.Errorf("sign in as %s: got status %d; want %d: %s", email, rr.Code, http.StatusCreated, rr.Body)
+		}
+	}
+
+	rr = sendAs(h, "", http.MethodPost, "/v1/users", `{"name":"Alice Again","email":"aLiCe@example.com","password":"correct horse battery"}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("same address in another case: got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if fields := readAPIError(t, rr).Fields; len(fields) != 1 || fields["email"] == "" {
+		t.Errorf("got fields %v; want only email", fields)
+	}
+}
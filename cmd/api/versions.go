@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	apiV1 = 1
+	apiV2 = 2
+)
+
+// musicRenames maps the JSON keys of data.Music to the names a later API
+// version exposes them under. Keys that aren't listed keep their v1 name.
+var musicRenames = map[int]map[string]string{
+	apiV2: {"duration": "duration_seconds"},
+}
+
+// handleVersioned registers handler for path, which omits the version prefix,
+// under both /v1 and /v2, and records both for the OpenAPI document.
+func (app *application) handleVersioned(router *httprouter.Router, method, path string, handler http.HandlerFunc, doc routeDoc) {
+	for _, version := range []int{apiV1, apiV2} {
+		versioned := fmt.Sprintf("/v%d%s", version, path)
+		router.HandlerFunc(method, versioned, app.apiVersion(version, handler))
+		app.registeredRoutes = append(app.registeredRoutes, registeredRoute{Method: method, Path: versioned, Version: version, Doc: doc})
+	}
+}
+
+// apiVersion stores the API version a request is served under in its context.
+// Requests under /v1 may opt into a later version with an Accept-Version
+// header; requests that stay on v1 get the configured deprecation headers.
+func (app *application) apiVersion(version int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Version")
+
+		if requested := r.Header.Get("Accept-Version"); requested != "" && version == apiV1 {
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(requested), "v"))
+			if err != nil || n < apiV1 || n > apiV2 {
+				app.badRequestResponse(w, r, fmt.Errorf("unsupported API version %q", requested))
+				return
+			}
+			version = n
+		}
+
+		if version == apiV1 {
+			app.setDeprecationHeaders(w, r)
+		}
+
+		next(w, app.contextSetAPIVersion(r, version))
+	}
+}
+
+func (app *application) setDeprecationHeaders(w http.ResponseWriter, r *http.Request) {
+	if !app.config.versions.v1Deprecation.IsZero() {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", app.config.versions.v1Deprecation.Unix()))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, "/v2"+strings.TrimPrefix(r.URL.Path, "/v1")))
+	}
+	if !app.config.versions.v1Sunset.IsZero() {
+		w.Header().Set("Sunset", app.config.versions.v1Sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// musicFields returns the JSON keys of data.Music as the given API version
+// names them.
+func musicFields(version int, fields []string) []string {
+	renamed := make([]string, len(fields))
+	for i, field := range fields {
+		if name, ok := musicRenames[version][field]; ok {
+			field = name
+		}
+		renamed[i] = field
+	}
+	return renamed
+}
+
+// unversionedField maps a data.Music JSON key as named by the given API
+// version back to its v1 name. A leading "-", as used by sort values, is kept.
+func unversionedField(version int, field string) string {
+	name := strings.TrimPrefix(field, "-")
+	for original, renamed := range musicRenames[version] {
+		if renamed == name {
+			return strings.TrimSuffix(field, name) + original
+		}
+	}
+	return field
+}
+
+// versionedPayload renames the keys of payload, a music object or a slice of
+// them, to the names the request's API version uses. v1 payloads are returned
+// untouched.
+func (app *application) versionedPayload(r *http.Request, payload interface{}) (interface{}, error) {
+	renames, ok := musicRenames[app.contextGetAPIVersion(r)]
+	if !ok {
+		return payload, nil
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	rename := func(object map[string]json.RawMessage) {
+		for from, to := range renames {
+			if raw, ok := object[from]; ok {
+				delete(object, from)
+				object[to] = raw
+			}
+		}
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(payload))
+	switch value.Kind() {
+	case reflect.Slice:
+		var objects []map[string]json.RawMessage
+		if err := json.Unmarshal(js, &objects); err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			rename(object)
+		}
+		return objects, nil
+	case reflect.Struct, reflect.Map:
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(js, &object); err != nil {
+			return nil, err
+		}
+		rename(object)
+		return object, nil
+	}
+	return nil, errors.New("versionedPayload: payload must be an object or a slice of objects")
+}
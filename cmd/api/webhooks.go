@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookAttempts is how many times an event is sent before giving up.
+	webhookAttempts = 3
+	// webhookBackoff is the wait before the second attempt; it doubles for
+	// each one after that.
+	webhookBackoff = time.Second
+)
+
+// webhookClient sends deliveries. Redirects aren't followed, so a receiver
+// can't bounce signed payloads elsewhere.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookPayload is the body of every delivery.
+type webhookPayload struct {
+	ID         string      `json:"id"`
+	Sequence   int64       `json:"sequence,omitempty"`
+	Event      string      `json:"event"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Music      interface{} `json:"music"`
+}
+
+// publishMusicEvents publishes a batch of outbox events to the event hub and
+// starts their deliveries to the webhooks subscribed to them. The delivery
+// id of an event is its sequence, so a receiver sees the same id when an
+// event is redelivered. A failure to look up the webhooks fails the batch,
+// which the dispatcher then publishes again.
+func (app *application) publishMusicEvents(batch []*data.OutboxEvent) error {
+	subscribers := make(map[string][]*data.Webhook)
+	for _, e := range batch {
+		if _, ok := subscribers[e.Event]; ok {
+			continue
+		}
+		webhooks, err := app.models.Webhooks.GetActiveForEvent(e.Event)
+		if err != nil {
+			return err
+		}
+		subscribers[e.Event] = webhooks
+	}
+
+	for _, e := range batch {
+		occurredAt := e.CreatedAt.UTC()
+		app.events.Publish(events.Event{
+			Type:       e.Event,
+			MusicID:    e.MusicID,
+			Version:    e.Version,
+			Sequence:   e.Sequence,
+			OccurredAt: occurredAt,
+		})
+
+		webhooks := subscribers[e.Event]
+		if len(webhooks) == 0 {
+			continue
+		}
+
+		payload := webhookPayload{
+			ID:         strconv.FormatInt(e.Sequence, 10),
+			Sequence:   e.Sequence,
+			Event:      e.Event,
+			OccurredAt: occurredAt,
+			Music:      e.Payload,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"sequence": payload.ID})
+			continue
+		}
+		for _, webhook := range webhooks {
+			webhook := webhook
+			app.background(func() {
+				app.deliverWebhook(webhook, payload, body)
+			})
+		}
+	}
+	return nil
+}
+
+// deliverWebhook posts body to webhook, retrying failed attempts with
+// exponential backoff. Every attempt is recorded in the delivery log. The
+// retries still due when the server shuts down are given up.
+func (app *application) deliverWebhook(webhook *data.Webhook, payload webhookPayload, body []byte) {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		delivery := &data.WebhookDelivery{WebhookID: webhook.ID, Event: payload.Event, Attempt: attempt}
+
+		start := time.Now()
+		status, err := postWebhook(webhook.URL, payload, signature, body)
+		delivery.DurationMS = int(time.Since(start).Milliseconds())
+		if status != 0 {
+			delivery.StatusCode = &status
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		delivery.Succeeded = err == nil
+
+		if err := app.models.Webhooks.InsertDelivery(delivery); err != nil {
+			app.logger.PrintError(err, map[string]string{"webhook_id": fmt.Sprint(webhook.ID)})
+		}
+		if delivery.Succeeded || attempt == webhookAttempts {
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-app.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// postWebhook makes a single delivery attempt. Any status outside 2xx counts
+// as a failure.
+func postWebhook(url string, payload webhookPayload, signature string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "musicdb-webhooks")
+	req.Header.Set("X-Musicdb-Event", payload.Event)
+	req.Header.Set("X-Musicdb-Delivery", payload.ID)
+	req.Header.Set("X-Musicdb-Signature", signature)
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    strings.TrimSpace(input.URL),
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: input.Active == nil || *input.Active,
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafeList: []string{"id", "url", "created_at", "-id", "-url", "-created_at"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhooks, metadata, err := app.models.Webhooks.GetAll(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readWebhook loads the webhook named by the :id route parameter, writing
+// the error response itself when that fails.
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return webhook, true
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input, jsonStrict)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL == nil && input.Secret == nil && input.Events == nil && input.Active == nil {
+		app.failedValidationResponse(w, r, map[string]validator.Message{
+			"body": {ID: validator.MsgNoUpdatableFields, Args: []interface{}{"url, secret, events, active"}},
+		})
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = strings.TrimSpace(*input.URL)
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-id",
+		SortSafeList: []string{"-id"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(webhook.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
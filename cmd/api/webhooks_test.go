@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookTestApplication returns an application whose delivery log is
+// kept in memory, as the argument lists of its inserts.
+func webhookTestApplication(t *testing.T) (*application, func() [][]driver.Value) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var deliveries [][]driver.Value
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if !strings.HasPrefix(query, "INSERT INTO webhook_deliveries") {
+			t.Errorf("unexpected query %q", query)
+			return nil, nil, nil
+		}
+		mu.Lock()
+		deliveries = append(deliveries, args)
+		id := int64(len(deliveries))
+		mu.Unlock()
+		return []string{"id", "created_at"}, [][]driver.Value{{id, time.Now()}}, nil
+	})
+	t.Cleanup(func() { db.Close() })
+
+	app := newTestApplication(t)
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+	return app, func() [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		return deliveries
+	}
+}
+
+func newTestWebhookPayload(t *testing.T) (webhookPayload, []byte) {
+	t.Helper()
+
+	payload := webhookPayload{ID: "42", Sequence: 42, Event: data.EventMusicCreated, OccurredAt: time.Now().UTC(), Music: envelope{"id": 1}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, body
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	app, deliveries := webhookTestApplication(t)
+	payload, body := newTestWebhookPayload(t)
+	const secret = "a webhook secret of some length"
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	wantSignature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	// The receiver fails twice, then accepts the delivery.
+	var received []time.Time
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		if string(got) != string(body) {
+			t.Errorf("got body %s; want %s", got, body)
+		}
+		if sig := r.Header.Get("X-Musicdb-Signature"); sig != wantSignature {
+			t.Errorf("got signature %q; want %q", sig, wantSignature)
+		}
+		if event := r.Header.Get("X-Musicdb-Event"); event != payload.Event {
+			t.Errorf("got event %q; want %q", event, payload.Event)
+		}
+		if id := r.Header.Get("X-Musicdb-Delivery"); id != payload.ID {
+			t.Errorf("got delivery id %q; want %q", id, payload.ID)
+		}
+
+		received = append(received, time.Now())
+		if len(received) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	webhook := &data.Webhook{ID: 5, URL: receiver.URL, Secret: secret, Events: []string{payload.Event}, Active: true}
+	app.deliverWebhook(webhook, payload, body)
+
+	if len(received) != webhookAttempts {
+		t.Fatalf("receiver got %d attempts; want %d", len(received), webhookAttempts)
+	}
+	// Each wait is twice the one before.
+	for i, wait := range []time.Duration{webhookBackoff, 2 * webhookBackoff} {
+		if gap := received[i+1].Sub(received[i]); gap < wait {
+			t.Errorf("attempt %d came %v after the one before; want at least %v", i+2, gap, wait)
+		}
+	}
+
+	// webhook_id, event, attempt, status_code, error, succeeded, duration_ms
+	rows := deliveries()
+	if len(rows) != 3 {
+		t.Fatalf("got %d delivery log rows; want 3", len(rows))
+	}
+	want := []struct {
+		status    int64
+		succeeded bool
+	}{
+		{http.StatusInternalServerError, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusNoContent, true},
+	}
+	for i, row := range rows {
+		if row[0] != int64(5) || row[1] != payload.Event || row[2] != int64(i+1) {
+			t.Errorf("row %d is for webhook %v, event %v, attempt %v; want 5, %s, %d", i, row[0], row[1], row[2], payload.Event, i+1)
+		}
+		if row[3] != want[i].status || row[5] != want[i].succeeded {
+			t.Errorf("row %d has status %v, succeeded %v; want %d, %t", i, row[3], row[5], want[i].status, want[i].succeeded)
+		}
+		if failed := row[4] != ""; failed == want[i].succeeded {
+			t.Errorf("row %d has error %q", i, row[4])
+		}
+	}
+}
+
+func TestDeliverWebhookShutdown(t *testing.T) {
+	app, deliveries := webhookTestApplication(t)
+	payload, body := newTestWebhookPayload(t)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	// Shutting down gives up the retry rather than waiting for it.
+	close(app.shutdown)
+	start := time.Now()
+	app.deliverWebhook(&data.Webhook{ID: 5, URL: receiver.URL, Secret: "secret"}, payload, body)
+	if elapsed := time.Since(start); elapsed >= webhookBackoff {
+		t.Errorf("delivery took %v after shutdown; want less than the %v backoff", elapsed, webhookBackoff)
+	}
+	if rows := deliveries(); len(rows) != 1 {
+		t.Errorf("got %d delivery log rows; want 1", len(rows))
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"github.com/SPA-Final/musicdb/internal/websocket"
+	"net/http"
+	"time"
+)
+
+const (
+	// wsAuthWait is how long a client that didn't authenticate with the
+	// handshake has to send its token.
+	wsAuthWait = 10 * time.Second
+	// wsWriteWait bounds every write to a socket.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may go without answering a ping;
+	// pings go out a little more often than that.
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsCloseWait is how long to wait for the client's reply to our close
+	// frame before dropping the connection.
+	wsCloseWait = time.Second
+	// wsSendBuffer is how many events a connection may fall behind by; the
+	// oldest queued event is dropped to make room for a new one.
+	wsSendBuffer = 32
+	// wsReadLimit caps the messages clients send, which is only ever the
+	// token.
+	wsReadLimit = 4096
+)
+
+// wsHandler upgrades to a WebSocket that pushes music changes and the
+// user's own notifications. The client authenticates with the usual bearer
+// token, sent either in the Authorization header or ?token= of the
+// handshake, or as {"token": "..."} in its first message.
+func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	if token := r.URL.Query().Get("token"); user.IsAnonymous() && token != "" {
+		var err error
+		user, err = app.userForToken(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, websocket.ErrBadHandshake):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The server doesn't track hijacked connections, so graceful shutdown
+	// waits for them here instead.
+	app.wg.Add(1)
+	defer app.wg.Done()
+	defer conn.Close()
+
+	conn.ReadLimit = wsReadLimit
+
+	if user.IsAnonymous() {
+		user, err = app.wsAuthenticate(conn)
+		if err != nil {
+			return
+		}
+	}
+
+	app.serveSocket(conn, user)
+}
+
+// userForToken returns the user an authentication token belongs to, or
+// data.ErrRecordNotFound for a malformed, unknown or expired token.
+func (app *application) userForToken(token string) (*data.User, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, data.ErrRecordNotFound
+	}
+	return app.models.Users.GetForToken(data.ScopeAuthentication, token)
+}
+
+// wsAuthenticate reads the token from the first message on conn. When that
+// fails, the connection is closed with the reason.
+func (app *application) wsAuthenticate(conn *websocket.Conn) (*data.User, error) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthWait))
+	opcode, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	var input struct {
+		Token string `json:"token"`
+	}
+	if opcode != websocket.TextMessage || json.Unmarshal(message, &input) != nil || input.Token == "" {
+		err = errors.New(`expected {"token": "..."} as the first message`)
+		closeSocket(conn, websocket.ClosePolicyViolation, err.Error())
+		return nil, err
+	}
+
+	user, err := app.userForToken(input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			closeSocket(conn, websocket.ClosePolicyViolation, "invalid or missing authentication token")
+		default:
+			app.logger.PrintError(err, nil)
+			closeSocket(conn, websocket.CloseInternalError, "the server encountered a problem")
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// serveSocket pushes the events meant for user to conn until the client
+// goes away, falls too far behind or the server shuts down.
+func (app *application) serveSocket(conn *websocket.Conn, user *data.User) {
+	_, sub := app.events.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	send := make(chan events.Event, wsSendBuffer)
+	go func() {
+		defer close(send)
+		for e := range sub.C {
+			if !e.For(user.ID) {
+				continue
+			}
+			select {
+			case send <- e:
+			default:
+				// This is the only sender, so once the oldest event is
+				// dropped there's room.
+				select {
+				case <-send:
+				default:
+				}
+				send <- e
+			}
+		}
+	}()
+
+	// Client messages aren't used past authentication; reading them keeps
+	// pings, pongs and the closing handshake flowing.
+	readerDone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.PongHandler = func() {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	}
+	go func() {
+		defer close(readerDone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case e, ok := <-send:
+			if !ok {
+				closeSocket(conn, websocket.CloseGoingAway, "fell too far behind", readerDone)
+				return
+			}
+			message, err := json.Marshal(e)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-readerDone:
+			return
+		case <-app.shutdown:
+			closeSocket(conn, websocket.CloseGoingAway, "server shutting down", readerDone)
+			return
+		}
+	}
+}
+
+// closeSocket sends a close frame and, given the reader's done channel,
+// waits a moment for the client to answer it.
+func closeSocket(conn *websocket.Conn, code int, reason string, readerDone ...chan struct{}) {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := conn.WriteClose(code, reason); err != nil {
+		return
+	}
+	for _, done := range readerDone {
+		select {
+		case <-done:
+		case <-time.After(wsCloseWait):
+		}
+	}
+}
+
+// notifyUser sends a notification to the WebSocket clients of user userID.
+func (app *application) notifyUser(userID int64, event, message string) {
+	app.events.Publish(events.Event{UserID: userID, Type: event, Message: message, OccurredAt: time.Now().UTC()})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+	"github.com/SPA-Final/musicdb/internal/events"
+	"github.com/SPA-Final/musicdb/internal/websocket"
+)
+
+// wsTestToken is the one authentication token the stub database knows, for
+// user 7.
+const wsTestToken = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// wsClient is the client side of a WebSocket connection, enough of it to
+// drive the server in tests.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// newWSTestServer serves the routes of an application whose database only
+// knows wsTestToken.
+func newWSTestServer(t *testing.T) (*application, *httptest.Server) {
+	t.Helper()
+
+	app := newTestApplication(t)
+	hash := sha256.Sum256([]byte(wsTestToken))
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		columns := []string{"id", "created_at", "name", "email", "password_hash", "activated", "pending_email", "suspended", "version", "read_only"}
+		if !strings.Contains(query, "FROM users u") || string(args[0].([]byte)) != string(hash[:]) {
+			return columns, nil, nil
+		}
+		return columns, [][]driver.Value{{int64(7), time.Now(), "Seven", "seven@example.com", []byte("hash"), true, "", false, int64(1), false}}, nil
+	})
+	t.Cleanup(func() { db.Close() })
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+
+	srv := httptest.NewServer(app.routes())
+	t.Cleanup(srv.Close)
+	return app, srv
+}
+
+// dialWS opens a WebSocket to path on srv. It returns the handshake
+// response, with a client only when the server switched protocols.
+func dialWS(t *testing.T, srv *httptest.Server, path string) (*wsClient, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, res
+	}
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if got, want := res.Header.Get("Sec-WebSocket-Accept"), base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Fatalf("got Sec-WebSocket-Accept %q; want %q", got, want)
+	}
+
+	c := &wsClient{t: t, conn: conn, br: br}
+	t.Cleanup(func() { conn.Close() })
+	return c, res
+}
+
+// write sends data in a single masked frame.
+func (c *wsClient) write(opcode int, data []byte) {
+	c.t.Helper()
+
+	header := []byte{0x80 | byte(opcode), 0x80 | byte(len(data))}
+	if len(data) > 125 {
+		c.t.Fatalf("frame of %d bytes is too long for the test client", len(data))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(data))
+	for i := range data {
+		masked[i] = data[i] ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(header, mask...), masked...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next frame from the server, which are never masked or
+// fragmented.
+func (c *wsClient) read() (int, []byte) {
+	c.t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		c.t.Fatalf("got frame header %x; want a final, unmasked frame", header)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return int(header[0] & 0x0f), payload
+}
+
+// readEvent reads the next frame as an event.
+func (c *wsClient) readEvent() events.Event {
+	c.t.Helper()
+
+	opcode, payload := c.read()
+	if opcode != websocket.TextMessage {
+		c.t.Fatalf("got opcode %d (%q); want a text message", opcode, payload)
+	}
+	var e events.Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		c.t.Fatal(err)
+	}
+	return e
+}
+
+// readClose reads the next frame as a close frame.
+func (c *wsClient) readClose() (int, string) {
+	c.t.Helper()
+
+	opcode, payload := c.read()
+	if opcode != websocket.CloseMessage || len(payload) < 2 {
+		c.t.Fatalf("got opcode %d (%q); want a close frame", opcode, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+// waitSubscribed waits for the server to subscribe n sockets to app's events.
+func waitSubscribed(t *testing.T, app *application, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); app.events.Subscribers() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d subscribers; want %d", app.events.Subscribers(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		// first is sent as the first message when set.
+		first string
+	}{
+		{"token in query", "/v1/ws?token=" + wsTestToken, ""},
+		{"token in first message", "/v1/ws", `{"token":"` + wsTestToken + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, srv := newWSTestServer(t)
+			c, _ := dialWS(t, srv, tt.path)
+			if tt.first != "" {
+				c.write(websocket.TextMessage, []byte(tt.first))
+			}
+			waitSubscribed(t, app, 1)
+
+			app.events.Publish(events.Event{Type: "music.updated", MusicID: 3, Version: 2})
+			app.notifyUser(8, "notification", "for someone else")
+			app.notifyUser(7, "notification", "for you")
+
+			if e := c.readEvent(); e.Type != "music.updated" || e.MusicID != 3 || e.Version != 2 {
+				t.Errorf("got %+v; want the music.updated event", e)
+			}
+			if e := c.readEvent(); e.Type != "notification" || e.Message != "for you" {
+				t.Errorf("got %+v; want the notification of user 7", e)
+			}
+
+			// Pings are answered, and the closing handshake is completed.
+			c.write(websocket.PingMessage, []byte("hi"))
+			if opcode, payload := c.read(); opcode != websocket.PongMessage || string(payload) != "hi" {
+				t.Errorf("got opcode %d (%q); want a pong echoing the ping", opcode, payload)
+			}
+			c.write(websocket.CloseMessage, []byte{0x03, 0xe8})
+			if code, _ := c.readClose(); code != websocket.CloseNormal {
+				t.Errorf("got close code %d; want %d", code, websocket.CloseNormal)
+			}
+		})
+	}
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      string
+		wantReason string
+	}{
+		{"not JSON", "hello", `expected {"token": "..."} as the first message`},
+		{"no token", `{"tok":"x"}`, `expected {"token": "..."} as the first message`},
+		{"unknown token", `{"token":"ZYXWVUTSRQPONMLKJIHGFEDCBA"}`, "invalid or missing authentication token"},
+		{"malformed token", `{"token":"short"}`, "invalid or missing authentication token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newWSTestServer(t)
+			c, _ := dialWS(t, srv, "/v1/ws")
+			c.write(websocket.TextMessage, []byte(tt.first))
+
+			code, reason := c.readClose()
+			if code != websocket.ClosePolicyViolation || reason != tt.wantReason {
+				t.Errorf("got close %d %q; want %d %q", code, reason, websocket.ClosePolicyViolation, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestWebSocketRejectedHandshake(t *testing.T) {
+	_, srv := newWSTestServer(t)
+
+	_, res := dialWS(t, srv, "/v1/ws?token=ZYXWVUTSRQPONMLKJIHGFEDCBA")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for an unknown token; want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	res, err := http.Get(srv.URL + "/v1/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d without an upgrade; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	app, srv := newWSTestServer(t)
+	c, _ := dialWS(t, srv, "/v1/ws?token="+wsTestToken)
+	waitSubscribed(t, app, 1)
+
+	close(app.shutdown)
+	code, reason := c.readClose()
+	if code != websocket.CloseGoingAway || reason != "server shutting down" {
+		t.Errorf("got close %d %q; want %d %q", code, reason, websocket.CloseGoingAway, "server shutting down")
+	}
+	c.write(websocket.CloseMessage, nil)
+	app.wg.Wait()
+}
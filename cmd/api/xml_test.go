@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// xmlMusic is a Music as a client decodes it from an XML response.
+type xmlMusic struct {
+	ID            int64     `xml:"id"`
+	ISRC          string    `xml:"isrc"`
+	Title         string    `xml:"title"`
+	Artist        string    `xml:"artist"`
+	Duration      int16     `xml:"duration"`
+	Popularity    float32   `xml:"popularity"`
+	Genres        []string  `xml:"genres>genre"`
+	CreatedAt     time.Time `xml:"created_at"`
+	UpdatedAt     time.Time `xml:"updated_at"`
+	Version       int32     `xml:"version"`
+	MusicBrainzID string    `xml:"musicbrainz_id"`
+}
+
+func (x xmlMusic) music() data.Music {
+	return data.Music{
+		Id: x.ID, ISRC: x.ISRC, Title: x.Title, Artist: x.Artist, Duration: x.Duration, Popularity: x.Popularity,
+		Genres: x.Genres, CreatedAt: x.CreatedAt, UpdatedAt: x.UpdatedAt, Version: x.Version, MusicBrainzID: x.MusicBrainzID,
+	}
+}
+
+// xmlValue is an element that may be marked nil.
+type xmlValue struct {
+	Nil   bool   `xml:"nil,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (v xmlValue) ptr() *string {
+	if v.Nil {
+		return nil
+	}
+	return &v.Value
+}
+
+// getBoth serves r as JSON and as XML, decoding each response into its
+// destination, and returns the status of the XML one.
+func getBoth(t *testing.T, h http.Handler, r func() *http.Request, jsonDst, xmlDst interface{}) int {
+	t.Helper()
+
+	jr := r()
+	jr.Header.Set("Accept", "application/json")
+	jrr := serve(h, jr)
+	if err := json.Unmarshal(jrr.Body.Bytes(), jsonDst); err != nil {
+		t.Fatalf("decoding JSON: %v: %s", err, jrr.Body)
+	}
+
+	xr := r()
+	xr.Header.Set("Accept", "application/xml")
+	xrr := serve(h, xr)
+	if got := xrr.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/xml") {
+		t.Fatalf("got Content-Type %q; want application/xml", got)
+	}
+	if err := xml.Unmarshal(xrr.Body.Bytes(), xmlDst); err != nil {
+		t.Fatalf("decoding XML: %v: %s", err, xrr.Body)
+	}
+	if xrr.Code != jrr.Code {
+		t.Fatalf("got status %d for XML; want %d as for JSON", xrr.Code, jrr.Code)
+	}
+	return xrr.Code
+}
+
+// newListTestApplication returns an application whose database holds two
+// records, which every listing returns, and finds the first of them by id.
+func newListTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	columns, _ := stubMusicRow()
+	at := time.Date(2021, 6, 1, 12, 0, 30, 500000000, time.UTC)
+	rows := [][]driver.Value{
+		stubMusic(map[string]driver.Value{
+			"isrc": "USS1Z9900001", "title": "Rock & <Roll>", "genres": []byte("{rock,pop}"), "popularity": 0.75,
+			"created_at": at, "updated_at": at, "version": int64(3), "musicbrainz_id": "5b11f4ce-a62d-471e-81fc-a69a8278c7da",
+		}),
+		stubMusic(map[string]driver.Value{
+			"id": int64(2), "title": "Ballad", "artist": "Singer", "duration": int64(240), "genres": []byte("{}"), "popularity": 0.0,
+			"created_at": at, "updated_at": at.Add(time.Hour),
+		}),
+	}
+	db := openStubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "AS rank") {
+			var list [][]driver.Value
+			for _, row := range rows {
+				list = append(list, stubListRow(int64(len(rows)), row))
+			}
+			return stubListColumns(), list, nil
+		}
+		return columns, rows[:1], nil
+	})
+	t.Cleanup(func() { db.Close() })
+	app.models = data.NewModels(db, app.config.db.queryTimeout)
+	return app
+}
+
+func TestXMLRoundTripShow(t *testing.T) {
+	h := newListTestApplication(t).routes()
+
+	var fromJSON struct {
+		Music data.Music `json:"music"`
+	}
+	var fromXML struct {
+		Music xmlMusic `xml:"music"`
+	}
+	status := getBoth(t, h, func() *http.Request { return httptest.NewRequest(http.MethodGet, "/v1/musics/1", nil) }, &fromJSON, &fromXML)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", status, http.StatusOK)
+	}
+
+	if got := fromXML.Music.music(); !reflect.DeepEqual(got, fromJSON.Music) {
+		t.Errorf("got %+v from XML; want %+v as from JSON", got, fromJSON.Music)
+	}
+	if fromXML.Music.Title != "Rock & <Roll>" {
+		t.Errorf("got title %q; want it unescaped", fromXML.Music.Title)
+	}
+}
+
+func TestXMLRoundTripList(t *testing.T) {
+	h := newListTestApplication(t).routes()
+
+	var fromJSON struct {
+		Musics   []data.Music  `json:"musics"`
+		Metadata data.Metadata `json:"metadata"`
+	}
+	var fromXML struct {
+		Musics   []xmlMusic `xml:"musics>music"`
+		Metadata struct {
+			CurrentPage  int      `xml:"current_page"`
+			PageSize     int      `xml:"page_size"`
+			FirstPage    int      `xml:"first_page"`
+			LastPage     int      `xml:"last_page"`
+			TotalRecords int      `xml:"total_records"`
+			Count        string   `xml:"count"`
+			NextPageURL  xmlValue `xml:"next_page_url"`
+			PrevPageURL  xmlValue `xml:"prev_page_url"`
+		} `xml:"metadata"`
+	}
+	status := getBoth(t, h, func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/v1/musics?title=song&page_size=1", nil)
+	}, &fromJSON, &fromXML)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", status, http.StatusOK)
+	}
+
+	var got []data.Music
+	for _, music := range fromXML.Musics {
+		got = append(got, music.music())
+	}
+	if len(got) != 2 || !reflect.DeepEqual(got, fromJSON.Musics) {
+		t.Errorf("got musics %+v from XML; want %+v as from JSON", got, fromJSON.Musics)
+	}
+
+	meta := fromXML.Metadata
+	gotMeta := data.Metadata{
+		CurrentPage: meta.CurrentPage, PageSize: meta.PageSize, FirstPage: meta.FirstPage, LastPage: meta.LastPage,
+		TotalRecords: meta.TotalRecords, Count: meta.Count, NextPageURL: meta.NextPageURL.ptr(), PrevPageURL: meta.PrevPageURL.ptr(),
+	}
+	if !reflect.DeepEqual(gotMeta, fromJSON.Metadata) {
+		t.Errorf("got metadata %+v from XML; want %+v as from JSON", gotMeta, fromJSON.Metadata)
+	}
+	if gotMeta.NextPageURL == nil || gotMeta.PrevPageURL != nil {
+		t.Errorf("got next %v and prev %v; want only a next page", gotMeta.NextPageURL, gotMeta.PrevPageURL)
+	}
+}
+
+func TestXMLRoundTripValidationError(t *testing.T) {
+	app := newListTestApplication(t)
+	h := http.HandlerFunc(app.createMusicHandler)
+
+	var fromJSON struct {
+		Error apiError `json:"error"`
+	}
+	var fromXML struct {
+		Error struct {
+			Code    string `xml:"code"`
+			Message string `xml:"message"`
+			Fields  struct {
+				Fields []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"fields"`
+		} `xml:"error"`
+	}
+	status := getBoth(t, h, func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/v1/musics", strings.NewReader(`{"title":"","artist":"Band","duration":-1,"genres":["pop"],"popularity":0.5}`))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}, &fromJSON, &fromXML)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+	if len(fromJSON.Error.Fields) != 2 {
+		t.Errorf("got fields %v; want title and duration", fromJSON.Error.Fields)
+	}
+
+	got := apiError{Code: fromXML.Error.Code, Message: fromXML.Error.Message}
+	for _, field := range fromXML.Error.Fields.Fields {
+		if got.Fields == nil {
+			got.Fields = make(map[string]string)
+		}
+		got.Fields[field.XMLName.Local] = field.Value
+	}
+	fromJSON.Error.RequestID = ""
+	if !reflect.DeepEqual(got, fromJSON.Error) {
+		t.Errorf("got error %+v from XML; want %+v as from JSON", got, fromJSON.Error)
+	}
+}
@@ -0,0 +1,43 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Audited actions on user accounts.
+const (
+	AuditSessionsInvalidated = "sessions.invalidated"
+	AuditUserSuspended       = "user.suspended"
+	AuditUserReactivated     = "user.reactivated"
+)
+
+// AuditEntry records an action taken on the account of UserID. ActorID is
+// the user who took it, nil when it was the system or the user themself
+// without a session, as with a password reset.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	ActorID   *int64    `json:"actor_id"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// InsertTx records e in tx, so that it's kept only if the action it
+// describes is.
+func (m AuditModel) InsertTx(tx *sql.Tx, e *AuditEntry) error {
+	q := `INSERT INTO audit_log (user_id, actor_id, action, reason)
+		  VALUES ($1, $2, $3, $4)
+		  RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return tx.QueryRowContext(ctx, q, e.UserID, e.ActorID, e.Action, e.Reason).Scan(&e.ID, &e.CreatedAt)
+}
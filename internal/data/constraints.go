@@ -0,0 +1,57 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+// Classes of constraint violation, as named by PostgreSQL.
+const (
+	UniqueViolation     = "unique_violation"
+	ForeignKeyViolation = "foreign_key_violation"
+	CheckViolation      = "check_violation"
+)
+
+// ConstraintError reports a write the database rejected because it violated
+// the named constraint.
+type ConstraintError struct {
+	Class      string
+	Constraint string
+	err        error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s on constraint %q", e.Class, e.Constraint)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+// translateError turns unique, foreign key and check violations into a
+// *ConstraintError and returns any other error unchanged. Matching on the
+// SQLSTATE rather than the message text keeps it independent of the server's
+// lc_messages setting.
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code {
+	case "23505", "23503", "23514":
+		return &ConstraintError{Class: pqErr.Code.Name(), Constraint: pqErr.Constraint, err: err}
+	default:
+		return err
+	}
+}
+
+// isConstraint reports whether err is a violation of the named constraint.
+func isConstraint(err error, constraint string) bool {
+	var constraintErr *ConstraintError
+	return errors.As(err, &constraintErr) && constraintErr.Constraint == constraint
+}
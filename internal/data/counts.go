@@ -0,0 +1,57 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// totalCountMaxAge is how long an unfiltered total count is reused before it
+// is counted again.
+const totalCountMaxAge = 30 * time.Second
+
+// totalCountCache remembers the number of rows in musics so that unfiltered
+// listings don't have to count the whole table on every page. Inserts and
+// deletes through MusicsModel invalidate it; changes made elsewhere show up
+// within totalCountMaxAge. A nil cache counts every time.
+type totalCountCache struct {
+	mu        sync.Mutex
+	total     int
+	countedAt time.Time
+}
+
+func newTotalCountCache() *totalCountCache {
+	return &totalCountCache{}
+}
+
+// get returns the cached total, calling count to refresh it when it is
+// missing or stale. Callers arriving during a refresh wait for its result.
+func (c *totalCountCache) get(count func() (int, error)) (int, error) {
+	if c == nil {
+		return count()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.countedAt.IsZero() && time.Since(c.countedAt) < totalCountMaxAge {
+		return c.total, nil
+	}
+
+	total, err := count()
+	if err != nil {
+		return 0, err
+	}
+	c.total, c.countedAt = total, time.Now()
+	return total, nil
+}
+
+// invalidate makes the next get count again.
+func (c *totalCountCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.countedAt = time.Time{}
+	c.mu.Unlock()
+}
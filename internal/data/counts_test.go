@@ -0,0 +1,109 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTotalCountCacheConcurrent(t *testing.T) {
+	c := newTotalCountCache()
+	var rows int64
+	count := func() (int, error) { return int(atomic.LoadInt64(&rows)), nil }
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n := atomic.AddInt64(&rows, 1)
+				c.invalidate()
+				// A writer sees its own insert, however the reads
+				// interleave with it.
+				total, err := c.get(count)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if int64(total) < n {
+					t.Errorf("got total %d after inserting row %d", total, n)
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if _, err := c.get(count); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total, err := c.get(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != int(rows) {
+		t.Errorf("got total %d; want %d", total, rows)
+	}
+}
+
+func TestTotalCountConcurrentWrites(t *testing.T) {
+	m := newTestModels(t)
+	filters := Filters{Page: 1, PageSize: 5, Sort: "id", SortSafeList: []string{"id"}}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				mv := &Music{Title: "Song", Duration: 180, Genres: []string{"pop"}}
+				if err := m.Musics.Insert(mv); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%2 == 1 {
+					if _, err := m.Musics.Delete(mv.Id); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, _, err := m.Musics.GetAll(MusicFilter{}, filters); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every write invalidated the cache, so the listing after them reports
+	// what's in the table.
+	_, metadata, err := m.Musics.GetAll(MusicFilter{}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Count != CountApproximate {
+		t.Errorf("got count %q; want %q", metadata.Count, CountApproximate)
+	}
+	if want := 4 * 5; metadata.TotalRecords != want {
+		t.Errorf("got total %d; want %d", metadata.TotalRecords, want)
+	}
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The states of an EnrichmentJob, Export or Import. A job is running until it
+// has been through all its records; one cut short by a shutdown or failure
+// stays unfinished. Exports and imports are pending until their worker
+// starts; exports are expired once their file has been swept, and imports
+// may be cancelled by their user.
+const (
+	JobPending     = "pending"
+	JobRunning     = "running"
+	JobCompleted   = "completed"
+	JobFailed      = "failed"
+	JobInterrupted = "interrupted"
+	JobExpired     = "expired"
+	JobCancelled   = "cancelled"
+)
+
+// EnrichmentJob is a background enrichment of the records matched by a
+// listing query.
+type EnrichmentJob struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	// Query is the GET /musics query string selecting the records.
+	Query     string    `json:"query"`
+	Overwrite bool      `json:"overwrite"`
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Enriched  int       `json:"enriched"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    int64     `json:"-"`
+}
+
+type EnrichmentJobModel struct {
+	DB *sql.DB
+}
+
+func (m EnrichmentJobModel) Insert(job *EnrichmentJob) error {
+	q := `INSERT INTO enrichment_jobs (user_id, query, overwrite, total)
+		  VALUES ($1, $2, $3, $4)
+		  RETURNING id, status, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{job.UserID, job.Query, job.Overwrite, job.Total}
+	return m.DB.QueryRowContext(ctx, q, args...).Scan(&job.ID, &job.Status, &job.CreatedAt, &job.UpdatedAt)
+}
+
+// Get returns job id. Jobs can be read by anyone allowed to start one, so
+// that several editors can follow a bulk run.
+func (m EnrichmentJobModel) Get(id int64) (*EnrichmentJob, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	q := `SELECT id, status, query, overwrite, total, processed, enriched, skipped, failed, error,
+		         created_at, updated_at, user_id
+		  FROM enrichment_jobs
+		  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var job EnrichmentJob
+	err := m.DB.QueryRowContext(ctx, q, id).Scan(
+		&job.ID, &job.Status, &job.Query, &job.Overwrite, &job.Total, &job.Processed, &job.Enriched,
+		&job.Skipped, &job.Failed, &job.Error, &job.CreatedAt, &job.UpdatedAt, &job.UserID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// UpdateProgress saves the counts and status of job.
+func (m EnrichmentJobModel) UpdateProgress(job *EnrichmentJob) error {
+	q := `UPDATE enrichment_jobs
+		  SET status = $2, processed = $3, enriched = $4, skipped = $5, failed = $6, error = $7, updated_at = NOW()
+		  WHERE id = $1
+		  RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{job.ID, job.Status, job.Processed, job.Enriched, job.Skipped, job.Failed, job.Error}
+	err := m.DB.QueryRowContext(ctx, q, args...).Scan(&job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// InterruptRunning marks the jobs still running as interrupted. It's called
+// at startup, when no job of this process can be running yet, so those
+// were left behind by an earlier one.
+func (m EnrichmentJobModel) InterruptRunning() (int64, error) {
+	q := `UPDATE enrichment_jobs
+		  SET status = $1, updated_at = NOW()
+		  WHERE status = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, JobInterrupted, JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Export is a background export of the records matched by a listing query
+// to a file, downloadable until it expires.
+type Export struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	// Format is csv or ndjson.
+	Format string `json:"format"`
+	// Query is the GET /musics query string selecting the records.
+	Query       string     `json:"query"`
+	Total       int        `json:"total"`
+	RowsWritten int        `json:"rows_written"`
+	Size        int64      `json:"size"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	UserID      int64      `json:"-"`
+}
+
+const exportColumns = `id, status, format, query, total, rows_written, size, error,
+	created_at, updated_at, completed_at, expires_at, user_id`
+
+func scanExport(s scanner, leading ...interface{}) (*Export, error) {
+	var e Export
+	dest := append(leading,
+		&e.ID, &e.Status, &e.Format, &e.Query, &e.Total, &e.RowsWritten, &e.Size, &e.Error,
+		&e.CreatedAt, &e.UpdatedAt, &e.CompletedAt, &e.ExpiresAt, &e.UserID,
+	)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+type ExportModel struct {
+	DB *sql.DB
+}
+
+func (m ExportModel) Insert(e *Export) error {
+	q := `INSERT INTO exports (user_id, query, format, total)
+		  VALUES ($1, $2, $3, $4)
+		  RETURNING id, status, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{e.UserID, e.Query, e.Format, e.Total}
+	return m.DB.QueryRowContext(ctx, q, args...).Scan(&e.ID, &e.Status, &e.CreatedAt, &e.UpdatedAt)
+}
+
+// GetForUser returns export id if it belongs to userID. Exports are only
+// visible to the user who asked for them.
+func (m ExportModel) GetForUser(id, userID int64) (*Export, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	q := `SELECT ` + exportColumns + `
+		  FROM exports
+		  WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	e, err := scanExport(m.DB.QueryRowContext(ctx, q, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// GetAllForUser lists the exports of userID.
+func (m ExportModel) GetAllForUser(userID int64, filters Filters) ([]*Export, Metadata, error) {
+	q := fmt.Sprintf(`SELECT count(*) OVER(), `+exportColumns+`
+		  FROM exports
+		  WHERE user_id = $1
+		  ORDER BY %s %s, id ASC
+		  LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	exports := []*Export{}
+	for rows.Next() {
+		e, err := scanExport(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		exports = append(exports, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return exports, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// UpdateProgress saves the counts, status and times of e.
+func (m ExportModel) UpdateProgress(e *Export) error {
+	q := `UPDATE exports
+		  SET status = $2, rows_written = $3, size = $4, error = $5, completed_at = $6, expires_at = $7, updated_at = NOW()
+		  WHERE id = $1
+		  RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{e.ID, e.Status, e.RowsWritten, e.Size, e.Error, e.CompletedAt, e.ExpiresAt}
+	err := m.DB.QueryRowContext(ctx, q, args...).Scan(&e.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// InterruptUnfinished marks the exports still pending or running as
+// interrupted, due to be swept straight away. Like
+// EnrichmentJobModel.InterruptRunning it's called at startup.
+func (m ExportModel) InterruptUnfinished() (int64, error) {
+	q := `UPDATE exports
+		  SET status = $1, expires_at = NOW(), updated_at = NOW()
+		  WHERE status IN ($2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, JobInterrupted, JobPending, JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Sweep returns the exports whose files are due to be removed and marks
+// them swept. Completed exports become expired; failed and interrupted ones
+// keep their status.
+func (m ExportModel) Sweep() ([]*Export, error) {
+	q := `UPDATE exports
+		  SET swept_at = NOW(), status = CASE WHEN status = $1 THEN $2 ELSE status END, updated_at = NOW()
+		  WHERE expires_at <= NOW() AND swept_at IS NULL
+		  RETURNING ` + exportColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, JobCompleted, JobExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []*Export
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+// DeleteAllForUserTx deletes the exports of userID in tx, returning them so
+// their files can be removed once tx commits.
+func (m ExportModel) DeleteAllForUserTx(tx *sql.Tx, userID int64) ([]*Export, error) {
+	q := `DELETE FROM exports
+		  WHERE user_id = $1
+		  RETURNING ` + exportColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []*Export
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
@@ -11,19 +11,53 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+	// SkipCount leaves out the total count, which costs a scan of every
+	// matching record; the metadata then only reports whether there's a next
+	// page.
+	SkipCount bool
+	// MaxOffset, when positive, is the largest row offset a page may start
+	// at. Deep offsets make PostgreSQL walk every skipped row.
+	MaxOffset int
+	// MaxPageSize is the largest page_size the caller may ask for. Zero means
+	// DefaultMaxPageSize.
+	MaxPageSize int
 }
 
+// DefaultMaxPageSize caps page_size when Filters.MaxPageSize is unset.
+const DefaultMaxPageSize = 100
+
+// Count modes reported in Metadata.Count.
+const (
+	CountExact       = "exact"
+	CountApproximate = "approximate"
+	CountSkipped     = "skipped"
+)
+
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	HasMore      *bool  `json:"has_more,omitempty"`
+	Count        string `json:"count"`
+	// NextPageURL and PrevPageURL are filled in by the handler, which knows
+	// the request URL. They are null at the ends of the listing.
+	NextPageURL *string `json:"next_page_url"`
+	PrevPageURL *string `json:"prev_page_url"`
+}
+
+// HasNext reports whether a page follows the current one.
+func (m Metadata) HasNext() bool {
+	if m.HasMore != nil {
+		return *m.HasMore
+	}
+	return m.CurrentPage < m.LastPage
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 	if totalRecords == 0 {
-		return Metadata{}
+		return Metadata{Count: CountExact}
 	}
 
 	return Metadata{
@@ -32,15 +66,34 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		FirstPage:    1,
 		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
 		TotalRecords: totalRecords,
+		Count:        CountExact,
+	}
+}
+
+// uncountedMetadata is calculateMetadata for a page fetched with SkipCount.
+func uncountedMetadata(hasMore bool, page, pageSize int) Metadata {
+	return Metadata{
+		CurrentPage: page,
+		PageSize:    pageSize,
+		FirstPage:   1,
+		HasMore:     &hasMore,
+		Count:       CountSkipped,
 	}
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+	v.Check(f.Page > 0, "page", validator.MsgGreaterThanZero)
+	v.Check(f.Page <= 10_000_000, "page", validator.MsgMaxPage)
+	v.Check(f.PageSize > 0, "page_size", validator.MsgGreaterThanZero)
+	maxPageSize := f.MaxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = DefaultMaxPageSize
+	}
+	v.Check(f.PageSize <= maxPageSize, "page_size", validator.MsgMaxValue, maxPageSize)
+	if f.MaxOffset > 0 && f.PageSize > 0 {
+		v.Check(f.Page <= f.maxPage(), "page", validator.MsgPageCeiling, f.maxPage())
+	}
+	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", validator.MsgInvalidSort)
 }
 
 func (f Filters) sortColumn() string {
@@ -59,10 +112,26 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// limit is the number of rows to fetch for a page. Without a total count one
+// extra row tells whether another page follows.
 func (f Filters) limit() int {
+	if f.SkipCount {
+		return f.PageSize + 1
+	}
 	return f.PageSize
 }
 
+// maxPage is the last page MaxOffset allows at the current page size.
+func (f Filters) maxPage() int {
+	return f.MaxOffset/f.PageSize + 1
+}
+
+// offset is the row offset of the page, capped at MaxOffset in case the
+// filters weren't validated.
 func (f Filters) offset() int {
-	return (f.Page - 1) * f.PageSize
+	offset := (f.Page - 1) * f.PageSize
+	if f.MaxOffset > 0 && offset > f.MaxOffset {
+		return f.MaxOffset
+	}
+	return offset
 }
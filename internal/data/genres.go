@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// genreListMaxAge is how long GetAll reuses a genre listing. Unnesting every
+// record's genres is a full table scan, and the set of genres changes slowly.
+const genreListMaxAge = 30 * time.Second
+
+// Genre is a genre tag together with the number of records carrying it.
+type Genre struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// GenreFilter selects the genres GenresModel.GetAll lists.
+type GenreFilter struct {
+	// Prefix keeps the genres starting with it, ignoring case.
+	Prefix string
+	// Normalize folds genres differing only by case into their lower-case
+	// form. Otherwise they are listed separately.
+	Normalize bool
+}
+
+type GenresModel struct {
+	DB    *sql.DB
+	cache *genreListCache
+}
+
+// GetAll lists the genres in use, as found in the genres arrays of musics.
+func (m GenresModel) GetAll(filter GenreFilter, filters Filters) ([]Genre, Metadata, error) {
+	key := fmt.Sprintf("%q/%t/%s/%d/%d", filter.Prefix, filter.Normalize, filters.Sort, filters.Page, filters.PageSize)
+	if entry, ok := m.cache.get(key); ok {
+		return entry.genres, entry.metadata, nil
+	}
+
+	name := "genre"
+	if filter.Normalize {
+		name = "lower(genre)"
+	}
+
+	var args []interface{}
+	where := "true"
+	if filter.Prefix != "" {
+		where = "lower(genre) LIKE " + placeholder(&args, likePrefix(filter.Prefix))
+	}
+
+	q := fmt.Sprintf(`SELECT count(*) OVER(), name, count
+		  FROM (
+		      SELECT %s AS name, count(*) AS count
+		      FROM musics, unnest(genres) AS genre
+		      WHERE %s
+		      GROUP BY 1
+		  ) g
+		  ORDER BY %s %s, name ASC
+		  LIMIT %s OFFSET %s`, name, where, filters.sortColumn(), filters.sortDirection(),
+		placeholder(&args, filters.limit()), placeholder(&args, filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	genres := []Genre{}
+	for rows.Next() {
+		var g Genre
+		if err := rows.Scan(&totalRecords, &g.Name, &g.Count); err != nil {
+			return nil, Metadata{}, err
+		}
+		genres = append(genres, g)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	m.cache.put(key, genreListEntry{genres: genres, metadata: metadata})
+	return genres, metadata, nil
+}
+
+// likePrefix returns a LIKE pattern matching strings that start with the
+// lower-cased prefix, with LIKE's wildcards in prefix escaped.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(prefix)) + "%"
+}
+
+type genreListEntry struct {
+	genres   []Genre
+	metadata Metadata
+	expires  time.Time
+}
+
+// genreListCache keeps recent genre listings keyed by their parameters. A nil
+// cache keeps nothing.
+type genreListCache struct {
+	mu      sync.Mutex
+	entries map[string]genreListEntry
+}
+
+func newGenreListCache() *genreListCache {
+	return &genreListCache{entries: make(map[string]genreListEntry)}
+}
+
+func (c *genreListCache) get(key string) (genreListEntry, bool) {
+	if c == nil {
+		return genreListEntry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return genreListEntry{}, false
+	}
+	return entry, true
+}
+
+// put stores entry under key, dropping expired entries so that the cache
+// only ever holds the listings of the last genreListMaxAge.
+func (c *genreListCache) put(key string, entry genreListEntry) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	entry.expires = now.Add(genreListMaxAge)
+	c.entries[key] = entry
+}
@@ -0,0 +1,133 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key. Status is zero while the original request is still being
+// processed.
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int64
+	RequestHash []byte
+	Status      int
+	Headers     map[string][]string
+	Body        []byte
+	Expiry      time.Time
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// Insert claims record.Key for record.UserID. It reports false, without
+// error, when a live record already holds the key, which makes it safe for
+// concurrent first-time requests: exactly one of them gets the claim. An
+// expired record holding the key is replaced.
+func (m IdempotencyModel) Insert(record *IdempotencyRecord) (bool, error) {
+	q := `INSERT INTO idempotency_keys (key, user_id, request_hash, expiry)
+		  VALUES ($1, $2, $3, $4)
+		  ON CONFLICT (key, user_id) DO UPDATE
+		  SET request_hash = EXCLUDED.request_hash, status = NULL, headers = NULL, body = NULL, expiry = EXCLUDED.expiry
+		  WHERE idempotency_keys.expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, record.Key, record.UserID, record.RequestHash, record.Expiry)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+func (m IdempotencyModel) Get(key string, userID int64) (*IdempotencyRecord, error) {
+	q := `SELECT key, user_id, request_hash, coalesce(status, 0), coalesce(headers, '{}'), coalesce(body, ''), expiry
+		  FROM idempotency_keys
+		  WHERE key = $1 AND user_id = $2 AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var record IdempotencyRecord
+	var headers []byte
+	err := m.DB.QueryRowContext(ctx, q, key, userID).Scan(
+		&record.Key,
+		&record.UserID,
+		&record.RequestHash,
+		&record.Status,
+		&headers,
+		&record.Body,
+		&record.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(headers, &record.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Complete stores the response produced for a previously claimed key.
+func (m IdempotencyModel) Complete(record *IdempotencyRecord) error {
+	headers, err := json.Marshal(record.Headers)
+	if err != nil {
+		return err
+	}
+
+	q := `UPDATE idempotency_keys
+		  SET status = $3, headers = $4, body = $5
+		  WHERE key = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, q, record.Key, record.UserID, record.Status, headers, record.Body)
+	return err
+}
+
+// Delete releases a claim whose request failed, so that a retry can run it.
+func (m IdempotencyModel) Delete(key string, userID int64) error {
+	q := `DELETE FROM idempotency_keys
+		  WHERE key = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, q, key, userID)
+	return err
+}
+
+func (m IdempotencyModel) PurgeExpired() (int64, error) {
+	q := `DELETE FROM idempotency_keys
+		  WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+// ErrJobCancelled is returned when saving the progress of a job its user
+// has cancelled.
+var ErrJobCancelled = errors.New("job cancelled")
+
+// Import is a background import of an uploaded CSV file. LastLine is the
+// checkpoint: the rows up to it have been saved, together with the counts,
+// so a worker picking the import up again carries on from the next one.
+type Import struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+	// Size is that of the uploaded file, in bytes.
+	Size int64 `json:"size"`
+	// Total is the number of rows in the file, known once the worker has
+	// started.
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Imported  int       `json:"imported"`
+	Rejected  int       `json:"rejected"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	LastLine  int       `json:"-"`
+	// Language is the one the row errors are written in, that of the
+	// upload request.
+	Language string `json:"-"`
+	UserID   int64  `json:"-"`
+}
+
+// ImportError reports why a row of an import was rejected. Lines count from
+// 1 at the header row.
+type ImportError struct {
+	Line   int               `json:"line"`
+	Fields map[string]string `json:"fields"`
+}
+
+const importColumns = `id, status, size, total, processed, imported, rejected, error,
+	created_at, updated_at, last_line, language, user_id`
+
+func scanImport(s scanner) (*Import, error) {
+	var job Import
+	err := s.Scan(
+		&job.ID, &job.Status, &job.Size, &job.Total, &job.Processed, &job.Imported, &job.Rejected, &job.Error,
+		&job.CreatedAt, &job.UpdatedAt, &job.LastLine, &job.Language, &job.UserID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+type ImportModel struct {
+	DB *sql.DB
+}
+
+func (m ImportModel) Insert(job *Import) error {
+	q := `INSERT INTO imports (user_id, size, language)
+		  VALUES ($1, $2, $3)
+		  RETURNING id, status, last_line, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{job.UserID, job.Size, job.Language}
+	return m.DB.QueryRowContext(ctx, q, args...).Scan(&job.ID, &job.Status, &job.LastLine, &job.CreatedAt, &job.UpdatedAt)
+}
+
+// GetForUser returns import id if it belongs to userID.
+func (m ImportModel) GetForUser(id, userID int64) (*Import, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	q := `SELECT ` + importColumns + `
+		  FROM imports
+		  WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	job, err := scanImport(m.DB.QueryRowContext(ctx, q, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// GetUnfinished returns the imports still pending or running, in the order
+// they were created. It's called at startup to pick up the imports an
+// earlier process didn't finish.
+func (m ImportModel) GetUnfinished() ([]*Import, error) {
+	q := `SELECT ` + importColumns + `
+		  FROM imports
+		  WHERE status IN ($1, $2)
+		  ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, JobPending, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Import
+	for rows.Next() {
+		job, err := scanImport(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Start marks job running, returning ErrJobCancelled if it has been
+// cancelled or has finished since it was read.
+func (m ImportModel) Start(job *Import) error {
+	q := `UPDATE imports
+		  SET status = $2, updated_at = NOW()
+		  WHERE id = $1 AND status IN ($2, $3)
+		  RETURNING status, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, q, job.ID, JobRunning, JobPending).Scan(&job.Status, &job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrJobCancelled
+	}
+	return err
+}
+
+// CheckpointTx records in tx the rows rejected since the last checkpoint and
+// saves the counts and LastLine of job, returning ErrJobCancelled if the
+// import isn't running any more. Run in the transaction inserting the rows
+// accepted since the last checkpoint, it saves either all of them and the
+// new checkpoint or, on a crash, neither.
+func (m ImportModel) CheckpointTx(tx *sql.Tx, job *Import, rejected []ImportError) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if len(rejected) > 0 {
+		lines := make([]int64, len(rejected))
+		fields := make([]string, len(rejected))
+		for i, e := range rejected {
+			js, err := json.Marshal(e.Fields)
+			if err != nil {
+				return err
+			}
+			lines[i] = int64(e.Line)
+			fields[i] = string(js)
+		}
+
+		q := `INSERT INTO import_errors (import_id, line, fields)
+			  SELECT $1, line, fields
+			  FROM unnest($2::integer[], $3::jsonb[]) AS e (line, fields)
+			  ON CONFLICT DO NOTHING`
+
+		if _, err := tx.ExecContext(ctx, q, job.ID, pq.Array(lines), pq.Array(fields)); err != nil {
+			return err
+		}
+	}
+
+	q := `UPDATE imports
+		  SET total = $2, processed = $3, imported = $4, rejected = $5, last_line = $6, updated_at = NOW()
+		  WHERE id = $1 AND status = $7
+		  RETURNING updated_at`
+
+	args := []interface{}{job.ID, job.Total, job.Processed, job.Imported, job.Rejected, job.LastLine, JobRunning}
+	err := tx.QueryRowContext(ctx, q, args...).Scan(&job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrJobCancelled
+	}
+	return err
+}
+
+// Finish saves the final status of job, returning ErrJobCancelled if it was
+// cancelled in the meantime.
+func (m ImportModel) Finish(job *Import) error {
+	q := `UPDATE imports
+		  SET status = $2, error = $3, updated_at = NOW()
+		  WHERE id = $1 AND status = $4
+		  RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, q, job.ID, job.Status, job.Error, JobRunning).Scan(&job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrJobCancelled
+	}
+	return err
+}
+
+// Cancel cancels job if it's still pending or running, returning
+// ErrEditConflict if it has finished. The rows imported by a running job
+// before it notices are kept.
+func (m ImportModel) Cancel(job *Import) error {
+	q := `UPDATE imports
+		  SET status = $2, updated_at = NOW()
+		  WHERE id = $1 AND status IN ($3, $4)
+		  RETURNING status, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, q, job.ID, JobCancelled, JobPending, JobRunning).Scan(&job.Status, &job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrEditConflict
+	}
+	return err
+}
+
+// GetErrors lists the rejected rows of import importID by line.
+func (m ImportModel) GetErrors(importID int64, filters Filters) ([]*ImportError, Metadata, error) {
+	q := `SELECT count(*) OVER(), line, fields
+		  FROM import_errors
+		  WHERE import_id = $1
+		  ORDER BY line
+		  LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, importID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	rowErrors := []*ImportError{}
+	for rows.Next() {
+		var e ImportError
+		var fields []byte
+		if err := rows.Scan(&totalRecords, &e.Line, &fields); err != nil {
+			return nil, Metadata{}, err
+		}
+		if err := json.Unmarshal(fields, &e.Fields); err != nil {
+			return nil, Metadata{}, err
+		}
+		rowErrors = append(rowErrors, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return rowErrors, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// DeleteAllForUserTx deletes the imports of userID in tx, their rejected
+// rows going with them through the foreign key, returning the ids of those still pending or running so
+// their spooled files can be removed once tx commits. A worker running one
+// of them stops at its next checkpoint.
+func (m ImportModel) DeleteAllForUserTx(tx *sql.Tx, userID int64) ([]int64, error) {
+	q := `WITH deleted AS (
+			  DELETE FROM imports
+			  WHERE user_id = $1
+			  RETURNING id, status
+		  )
+		  SELECT id FROM deleted WHERE status IN ($2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, q, userID, JobPending, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -1,27 +1,121 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	ErrTooManyRecords = errors.New("too many records")
+	ErrQueryTimeout   = errors.New("query timed out")
 )
 
+// timeoutError returns ErrQueryTimeout in place of err if ctx ran out while
+// the query was running. The driver reports a cancelled statement as a
+// server error, so ctx is checked rather than err.
+func timeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+// querier is what the model methods that have a Tx variant need of the
+// *sql.DB or *sql.Tx they run against.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 type Models struct {
-	Musics      MusicsModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Musics        MusicsModel
+	Genres        GenresModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	Idempotency   IdempotencyModel
+	SavedSearches SavedSearchModel
+	Webhooks      WebhookModel
+	Enrichments   EnrichmentJobModel
+	Outbox        OutboxModel
+	Exports       ExportModel
+	Imports       ImportModel
+	Audit         AuditModel
+	TwoFactor     TwoFactorModel
+	db            *sql.DB
+	stmts         *statements
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models backed by db. queryTimeout bounds the listing
+// queries of MusicsModel.
+func NewModels(db *sql.DB, queryTimeout time.Duration) Models {
+	stmts := newStatements(db)
+
 	return Models{
-		Musics:      MusicsModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Musics:        MusicsModel{DB: db, QueryTimeout: queryTimeout, stmts: stmts, totals: newTotalCountCache()},
+		Genres:        GenresModel{DB: db, cache: newGenreListCache()},
+		Users:         UserModel{DB: db, stmts: stmts},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Idempotency:   IdempotencyModel{DB: db},
+		SavedSearches: SavedSearchModel{DB: db},
+		Webhooks:      WebhookModel{DB: db},
+		Enrichments:   EnrichmentJobModel{DB: db},
+		Outbox:        OutboxModel{DB: db},
+		Exports:       ExportModel{DB: db},
+		Imports:       ImportModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		TwoFactor:     TwoFactorModel{DB: db},
+		db:            db,
+		stmts:         stmts,
+	}
+}
+
+// Transact runs fn in a transaction, which is committed if fn returns nil
+// and rolled back otherwise. fn passes the transaction to the Tx variants
+// of the model methods. The whole transaction has 30 seconds, enough for a
+// batch insert.
+func (m Models) Transact(fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The Tx variants drop the cached total counts when they write, but a
+	// listing may have cached the count again before the commit.
+	m.Musics.totals.invalidate()
+	return nil
+}
+
+// Prepare prepares the statements of the hot queries. Until it's called
+// they run unprepared.
+func (m Models) Prepare() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	queries := []string{getMusicQuery, userForTokenQuery}
+	for _, sort := range MusicSortSafeList {
+		queries = append(queries, unfilteredMusicsQuery(sort))
+	}
+	return m.stmts.prepare(ctx, queries...)
+}
+
+func (m Models) Close() error {
+	return m.stmts.Close()
 }
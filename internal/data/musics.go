@@ -5,19 +5,37 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/SPA-Final/musicdb/internal/filterexpr"
 	"github.com/SPA-Final/musicdb/internal/validator"
 	"github.com/lib/pq"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Music struct {
-	Id         int64          `gorm:"primaryKey"`
+	Id         int64          `json:"id"`
+	ISRC       string         `json:"isrc,omitempty"`
 	Title      string         `json:"title"`
+	Artist     string         `json:"artist"`
 	Duration   int16          `json:"duration"`
 	Popularity float32        `json:"popularity"`
 	Genres     pq.StringArray `json:"genres"`
 	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
 	Version    int32          `json:"version"`
+	// MusicBrainzID is the MusicBrainz recording the record is linked to.
+	MusicBrainzID string `json:"musicbrainz_id,omitempty"`
+	// EnrichmentSource names the catalogue that last filled in fields of
+	// the record, at EnrichedAt.
+	EnrichmentSource string     `json:"enrichment_source,omitempty"`
+	EnrichedAt       *time.Time `json:"enriched_at,omitempty"`
+	Rank             *float32   `json:"rank,omitempty"`
+	// TitleHighlighted is the title with the words matching the search
+	// wrapped in markers, set when GetAll is asked to highlight.
+	TitleHighlighted *string `json:"title_highlighted,omitempty"`
 }
 
 func (m *Music) SanitizeGenres(genres []sql.NullString) {
@@ -30,52 +48,193 @@ func (m *Music) SanitizeGenres(genres []sql.NullString) {
 }
 
 func ValidateMovie(v *validator.Validator, movie *Music) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
-	v.Check(movie.Duration != 0, "duration", "must be provided")
-	v.Check(movie.Duration > 0, "duration", "must be a positive integer")
-	v.Check(movie.Popularity != 0, "popularity", "must be provided")
-	v.Check(movie.Popularity > 0, "popularity", "must be a positive number")
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(movie.Title != "", "title", validator.MsgRequired)
+	v.Check(len(movie.Title) <= 500, "title", validator.MsgMaxBytes, 500)
+	v.Check(len(movie.Artist) <= 500, "artist", validator.MsgMaxBytes, 500)
+	v.Check(movie.Duration != 0, "duration", validator.MsgRequired)
+	v.Check(movie.Duration > 0, "duration", validator.MsgPositiveInteger)
+	v.Check(movie.Popularity != 0, "popularity", validator.MsgRequired)
+	v.Check(movie.Popularity > 0, "popularity", validator.MsgPositiveNumber)
+	v.Check(movie.Genres != nil, "genres", validator.MsgRequired)
+	v.Check(len(movie.Genres) >= 1, "genres", validator.MsgMinGenres)
+	v.Check(len(movie.Genres) <= 5, "genres", validator.MsgMaxGenres, 5)
+	v.Check(validator.Unique(movie.Genres), "genres", validator.MsgDuplicateValues)
+}
+
+// NormalizeISRC strips the hyphens ISRCs are often printed with and upper-cases
+// the rest, so "us-s1z-99-00001" and "USS1Z9900001" name the same recording.
+func NormalizeISRC(isrc string) string {
+	return strings.ToUpper(strings.ReplaceAll(isrc, "-", ""))
+}
+
+func ValidateISRC(v *validator.Validator, isrc string) {
+	v.Check(isrc != "", "isrc", validator.MsgRequired)
+	v.Check(validator.Matches(isrc, validator.ISRCRX), "isrc", validator.MsgInvalidISRC)
+}
+
+// NormalizeMusicBrainzID lower-cases a MusicBrainz id, as MusicBrainz
+// prints them.
+func NormalizeMusicBrainzID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+func ValidateMusicBrainzID(v *validator.Validator, id string) {
+	v.Check(validator.Matches(id, validator.UUIDRX), "musicbrainz_id", validator.MsgInvalidUUID)
+}
+
+func ValidateIDs(v *validator.Validator, ids []int64, max int) {
+	v.Check(len(ids) != 0, "ids", validator.MsgRequired)
+	v.Check(len(ids) <= max, "ids", validator.MsgMaxIDs, max)
+	for _, id := range ids {
+		if id < 1 {
+			v.AddError("ids", validator.MsgPositiveIDs, id)
+			break
+		}
+	}
+}
+
+// musicColumns is the select list scanMusic expects, in order.
+const musicColumns = `id, coalesce(isrc, ''), title, artist, duration, genres, popularity, created_at, updated_at, version,
+	coalesce(enrichment_source, ''), enriched_at, coalesce(musicbrainz_id::text, '')`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMusic scans a row selected with musicColumns into a new Music. Any
+// columns selected ahead of musicColumns are scanned into leading.
+func scanMusic(s scanner, leading ...interface{}) (*Music, error) {
+	var music Music
+	var genres []sql.NullString
+
+	dest := append(leading,
+		&music.Id,
+		&music.ISRC,
+		&music.Title,
+		&music.Artist,
+		&music.Duration,
+		pq.Array(&genres),
+		&music.Popularity,
+		&music.CreatedAt,
+		&music.UpdatedAt,
+		&music.Version,
+		&music.EnrichmentSource,
+		&music.EnrichedAt,
+		&music.MusicBrainzID,
+	)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	music.SanitizeGenres(genres)
+	return &music, nil
 }
 
 type MusicsModel struct {
 	DB *sql.DB
+	// QueryTimeout bounds GetAll and Count, whose cost depends on the filter.
+	// Zero means the usual 3 seconds.
+	QueryTimeout time.Duration
+	stmts        *statements
+	totals       *totalCountCache
+}
+
+func (m MusicsModel) queryTimeout() time.Duration {
+	if m.QueryTimeout > 0 {
+		return m.QueryTimeout
+	}
+	return 3 * time.Second
 }
 
 func (m MusicsModel) Insert(mv *Music) error {
-	q := `INSERT INTO musics (title, duration, genres, popularity)
-		  VALUES ($1, $2, $3, $4)
-		  RETURNING id, created_at, version`
+	return m.insert(m.DB, mv)
+}
+
+// InsertTx is Insert run in tx.
+func (m MusicsModel) InsertTx(tx *sql.Tx, mv *Music) error {
+	return m.insert(tx, mv)
+}
+
+func (m MusicsModel) insert(db querier, mv *Music) error {
+	q := `INSERT INTO musics (title, duration, genres, popularity, isrc, artist)
+		  VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		  RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{mv.Title, mv.Duration, pq.Array(mv.Genres), mv.Popularity, mv.ISRC, mv.Artist}
+	err := translateError(db.QueryRowContext(context.Background(), q, args...).Scan(&mv.Id, &mv.CreatedAt, &mv.UpdatedAt, &mv.Version))
+	if err == nil {
+		m.totals.invalidate()
+	}
+	return err
+}
+
+// InsertBatch inserts ms in a single transaction: either all of them are
+// saved, with their ids and timestamps filled in, or none are.
+func (m MusicsModel) InsertBatch(ms []*Music) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	args := []interface{}{mv.Title, mv.Duration, pq.Array(mv.Genres), mv.Popularity}
-	return m.DB.QueryRow(q, args...).Scan(&mv.Id, &mv.CreatedAt, &mv.Version)
+	if err := m.insertBatch(ctx, tx, ms); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.totals.invalidate()
+	return nil
 }
 
+// InsertBatchTx is InsertBatch run in tx, so they are saved if tx commits.
+func (m MusicsModel) InsertBatchTx(tx *sql.Tx, ms []*Music) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := m.insertBatch(ctx, tx, ms)
+	if err == nil {
+		m.totals.invalidate()
+	}
+	return err
+}
+
+func (m MusicsModel) insertBatch(ctx context.Context, tx *sql.Tx, ms []*Music) error {
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO musics (title, duration, genres, popularity, isrc, artist)
+		  VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		  RETURNING id, created_at, updated_at, version`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, mv := range ms {
+		args := []interface{}{mv.Title, mv.Duration, pq.Array(mv.Genres), mv.Popularity, mv.ISRC, mv.Artist}
+		err := stmt.QueryRowContext(ctx, args...).Scan(&mv.Id, &mv.CreatedAt, &mv.UpdatedAt, &mv.Version)
+		if err != nil {
+			return translateError(err)
+		}
+	}
+	return nil
+}
+
+// getMusicQuery is the query of Get; it's one of the prepared statements.
+const getMusicQuery = `SELECT ` + musicColumns + `
+		  FROM musics
+		  WHERE id = $1`
+
 func (m MusicsModel) Get(id int64) (*Music, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	q := `SELECT *
-		  FROM musics
-		  WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	var ms Music
-	var genres []sql.NullString
-	err := m.DB.QueryRow(q, id).Scan(
-		&ms.Id,
-		&ms.Title,
-		&ms.Duration,
-		pq.Array(&genres),
-		&ms.Popularity,
-		&ms.CreatedAt,
-		&ms.Version,
-	)
-	ms.SanitizeGenres(genres)
+	ms, err := scanMusic(m.stmts.QueryRowContext(ctx, getMusicQuery, id))
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -85,52 +244,336 @@ func (m MusicsModel) Get(id int64) (*Music, error) {
 		}
 	}
 
-	return &ms, nil
+	return ms, nil
 }
 
-func (m MusicsModel) GetAll(title string, genres []string, filters Filters) ([]*Music, Metadata, error) {
-	q := fmt.Sprintf(`SELECT count(*) OVER(), *
+// GetMany returns the records matching ids in the order the ids were given.
+// Ids without a matching record, and repeated ids, are skipped.
+func (m MusicsModel) GetMany(ids []int64) ([]*Music, error) {
+	q := `SELECT ` + musicColumns + `
 		  FROM musics
-		  WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		  AND (genres @> $2 OR $2 = '{}')
-		  ORDER BY %s %s, id ASC
-	      LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		  WHERE id = ANY($1)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-	rows, err := m.DB.QueryContext(ctx, q, args...)
+	rows, err := m.DB.QueryContext(ctx, q, pq.Array(ids))
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int64]*Music, len(ids))
+	for rows.Next() {
+		music, err := scanMusic(rows)
+		if err != nil {
+			return nil, err
+		}
+		byID[music.Id] = music
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	musics := make([]*Music, 0, len(byID))
+	for _, id := range ids {
+		if music, ok := byID[id]; ok {
+			musics = append(musics, music)
+			delete(byID, id)
+		}
+	}
+
+	return musics, nil
+}
+
+// Title search modes. SearchFullText matches words of the title;
+// SearchFuzzy matches by trigram similarity, which tolerates typos.
+const (
+	SearchFullText = "fulltext"
+	SearchFuzzy    = "fuzzy"
+)
+
+// MusicFilter selects the records GetAll lists and Retag changes. Empty
+// fields and nil bounds don't narrow the selection.
+type MusicFilter struct {
+	Title      string
+	SearchMode string
+	// FuzzyThreshold is the minimum similarity for SearchFuzzy. The trigram
+	// index only finds titles above pg_trgm.similarity_threshold (0.3 by
+	// default), so it can tighten but not loosen that.
+	FuzzyThreshold float64
+	// TitleExact matches the whole title, ignoring case and accents only.
+	TitleExact string
+	// Query is a full-text search over both title and artist, with title
+	// matches ranked higher.
+	Query string
+	// Expr is a parsed filter= expression, ANDed with the other fields.
+	Expr *filterexpr.Expr
+	// Highlight, when set, makes GetAll mark the words of the title or q
+	// search in each title. The other methods ignore it.
+	Highlight *Highlight
+
+	Genres        []string
+	GenresAny     []string
+	ExcludeGenres []string
+	DurationMin   *int
+	DurationMax   *int
+	PopularityMin *float64
+	PopularityMax *float64
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+func ValidateMusicFilter(v *validator.Validator, f MusicFilter) {
+	v.Check(validator.In(f.SearchMode, SearchFullText, SearchFuzzy), "search_mode", validator.MsgOneOf, SearchFullText+", "+SearchFuzzy)
+	v.Check(f.Title == "" || f.TitleExact == "", "title_exact", validator.MsgExclusive, "title")
+	v.Check(f.Title == "" || f.Query == "", "q", validator.MsgExclusive, "title")
+	v.Check(!validator.In("", f.GenresAny...), "genres_any", validator.MsgEmptyValues)
+	for _, genre := range f.ExcludeGenres {
+		v.Check(!validator.In(genre, f.Genres...), "exclude_genres", validator.MsgOverlap, "genres")
+		v.Check(!validator.In(genre, f.GenresAny...), "exclude_genres", validator.MsgOverlap, "genres_any")
+	}
+
+	// duration is an integer column, which larger bounds would overflow.
+	if f.DurationMin != nil {
+		v.Check(*f.DurationMin >= 0, "duration_min", validator.MsgNotNegative)
+		v.Check(*f.DurationMin <= math.MaxInt32, "duration_min", validator.MsgMaxValue, math.MaxInt32)
+	}
+	if f.DurationMax != nil {
+		v.Check(*f.DurationMax >= 0, "duration_max", validator.MsgNotNegative)
+		v.Check(*f.DurationMax <= math.MaxInt32, "duration_max", validator.MsgMaxValue, math.MaxInt32)
+	}
+	if f.DurationMin != nil && f.DurationMax != nil {
+		v.Check(*f.DurationMin <= *f.DurationMax, "duration_max", validator.MsgMinValue, "duration_min")
+	}
+
+	if f.PopularityMin != nil {
+		v.Check(*f.PopularityMin >= 0 && *f.PopularityMin <= 100, "popularity_min", validator.MsgRange, 0, 100)
+	}
+	if f.PopularityMax != nil {
+		v.Check(*f.PopularityMax >= 0 && *f.PopularityMax <= 100, "popularity_max", validator.MsgRange, 0, 100)
+	}
+	if f.PopularityMin != nil && f.PopularityMax != nil {
+		v.Check(*f.PopularityMin <= *f.PopularityMax, "popularity_max", validator.MsgMinValue, "popularity_min")
+	}
+
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(!f.CreatedBefore.Before(*f.CreatedAfter), "created_before", validator.MsgMinValue, "created_after")
+	}
+}
+
+// MusicSortSafeList holds the sort values music listings accept.
+var MusicSortSafeList = []string{"id", "title", "duration", "popularity", "created_at", "relevance", "-id", "-title", "-duration", "-popularity", "-created_at", "-relevance"}
+
+// musicExprFields are the fields filter= expressions may refer to.
+var musicExprFields = map[string]filterexpr.Field{
+	"id":         {Column: "id", Kind: filterexpr.BigInteger},
+	"isrc":       {Column: "isrc", Kind: filterexpr.Text},
+	"title":      {Column: "title", Kind: filterexpr.Text},
+	"artist":     {Column: "artist", Kind: filterexpr.Text},
+	"duration":   {Column: "duration", Kind: filterexpr.Integer},
+	"popularity": {Column: "popularity", Kind: filterexpr.Float},
+	"genre":      {Column: "genres", Kind: filterexpr.Tags},
+	"created_at": {Column: "created_at", Kind: filterexpr.Time},
+	"updated_at": {Column: "updated_at", Kind: filterexpr.Time},
+}
+
+// ParseMusicExpr parses a filter= expression over the fields of Music.
+// Errors are *filterexpr.Error.
+func ParseMusicExpr(s string) (*filterexpr.Expr, error) {
+	node, err := filterexpr.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return filterexpr.Compile(node, musicExprFields)
+}
+
+// where returns the WHERE clause for f, appending the values it refers to
+// to args so that placeholders are numbered after any already there. Title
+// searches compare normalize_text() forms, lower-cased and stripped of
+// accents, the same way the search columns and indexes are built.
+func (f MusicFilter) where(args *[]interface{}) string {
+	clauses := []string{"true"}
+	if f.Title != "" {
+		switch f.SearchMode {
+		case SearchFuzzy:
+			title := placeholder(args, f.Title)
+			clauses = append(clauses, "normalize_text(title) % normalize_text("+title+") AND similarity(normalize_text(title), normalize_text("+title+")) >= "+placeholder(args, f.FuzzyThreshold))
+		default:
+			clauses = append(clauses, "search_vector @@ plainto_tsquery('simple', normalize_text("+placeholder(args, f.Title)+"))")
+		}
+	}
+	if f.Query != "" {
+		clauses = append(clauses, "search_document @@ plainto_tsquery('simple', normalize_text("+placeholder(args, f.Query)+"))")
+	}
+	if f.TitleExact != "" {
+		clauses = append(clauses, "normalize_text(title) = normalize_text("+placeholder(args, f.TitleExact)+")")
+	}
+	if f.Expr != nil {
+		clauses = append(clauses, f.Expr.SQL(func(v interface{}) string { return placeholder(args, v) }))
+	}
+	if len(f.Genres) > 0 {
+		clauses = append(clauses, "genres @> "+placeholder(args, pq.Array(f.Genres)))
+	}
+	if len(f.GenresAny) > 0 {
+		clauses = append(clauses, "genres && "+placeholder(args, pq.Array(f.GenresAny)))
+	}
+	if len(f.ExcludeGenres) > 0 {
+		clauses = append(clauses, "NOT genres && "+placeholder(args, pq.Array(f.ExcludeGenres)))
+	}
+	if f.DurationMin != nil {
+		clauses = append(clauses, "duration >= "+placeholder(args, *f.DurationMin))
+	}
+	if f.DurationMax != nil {
+		clauses = append(clauses, "duration <= "+placeholder(args, *f.DurationMax))
+	}
+	if f.PopularityMin != nil {
+		clauses = append(clauses, "popularity >= "+placeholder(args, *f.PopularityMin))
+	}
+	if f.PopularityMax != nil {
+		clauses = append(clauses, "popularity <= "+placeholder(args, *f.PopularityMax))
+	}
+	if f.CreatedAfter != nil {
+		clauses = append(clauses, "created_at >= "+placeholder(args, *f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		clauses = append(clauses, "created_at < "+placeholder(args, *f.CreatedBefore))
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+// Highlight holds the markers put around matched words. They are passed to
+// ts_headline, so they must not contain double quotes or commas.
+type Highlight struct {
+	Start string
+	Stop  string
+}
+
+// headline returns an expression for the highlighted title, or NULL when f
+// doesn't ask for highlighting or has no full-text search to highlight. The
+// search is normalized as in where, and the simple_unaccent configuration
+// folds the title's words the same way, so that the words an accent- or
+// case-insensitive search matched are the ones highlighted.
+func (f MusicFilter) headline(args *[]interface{}) string {
+	search := f.Query
+	if search == "" {
+		search = f.Title
+	}
+	if f.Highlight == nil || search == "" {
+		return "NULL::text"
+	}
+
+	options := fmt.Sprintf(`StartSel="%s", StopSel="%s", HighlightAll=true`, f.Highlight.Start, f.Highlight.Stop)
+	return "ts_headline('simple_unaccent', title, plainto_tsquery('simple', normalize_text(" + placeholder(args, search) + ")), " + placeholder(args, options) + ")"
+}
+
+// Searches reports whether f has a title or q search to rank records by.
+func (f MusicFilter) Searches() bool {
+	return f.Title != "" || f.Query != ""
+}
+
+// rank returns an expression for how well a record matches the title or q
+// search of f, or NULL when there is none.
+func (f MusicFilter) rank(args *[]interface{}) string {
+	switch {
+	case f.Query != "":
+		return "ts_rank(search_document, plainto_tsquery('simple', normalize_text(" + placeholder(args, f.Query) + ")))"
+	case f.Title == "":
+		return "NULL::real"
+	case f.SearchMode == SearchFuzzy:
+		return "similarity(normalize_text(title), normalize_text(" + placeholder(args, f.Title) + "))"
+	default:
+		return "ts_rank(search_vector, plainto_tsquery('simple', normalize_text(" + placeholder(args, f.Title) + ")))"
+	}
+}
+
+// placeholder appends value to args and returns its placeholder.
+func placeholder(args *[]interface{}, value interface{}) string {
+	*args = append(*args, value)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// GetAll lists the records matching filter. When filter has a title or q search,
+// each record carries its rank against it (ts_rank, or the trigram similarity
+// in fuzzy mode) and the "relevance" sort puts the best matches first
+// ("-relevance" reverses that).
+func (m MusicsModel) GetAll(filter MusicFilter, filters Filters) ([]*Music, Metadata, error) {
+	var args []interface{}
+	where := filter.where(&args)
+
+	rank := filter.rank(&args)
+	headline := filter.headline(&args)
+
+	orderBy := musicOrder(filters)
+
+	// An unfiltered listing takes its total from the count cache rather
+	// than counting the whole table for every page.
+	cachedTotal := where == "true" && !filters.SkipCount
+	total := "count(*) OVER()"
+	if filters.SkipCount || cachedTotal {
+		total = "0"
+	}
+
+	q := musicsQuery(total, rank, headline, where, orderBy,
+		placeholder(&args, filters.limit()), placeholder(&args, filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.stmts.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, Metadata{}, timeoutError(ctx, err)
 	}
 	defer rows.Close()
 
 	totalRecords := 0
 	musics := []*Music{}
 	for rows.Next() {
-		var music Music
-		var gnrs []sql.NullString
-		err := rows.Scan(
-			&totalRecords,
-			&music.Id,
-			&music.Title,
-			&music.Duration,
-			pq.Array(&gnrs),
-			&music.Popularity,
-			&music.CreatedAt,
-			&music.Version,
-		)
+		var rank sql.NullFloat64
+		var headline sql.NullString
+		music, err := scanMusic(rows, &totalRecords, &rank, &headline)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, timeoutError(ctx, err)
 		}
-
-		music.SanitizeGenres(gnrs)
-		musics = append(musics, &music)
+		if rank.Valid {
+			r := float32(rank.Float64)
+			music.Rank = &r
+		}
+		if headline.Valid {
+			music.TitleHighlighted = &headline.String
+		}
+		musics = append(musics, music)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, timeoutError(ctx, err)
+	}
+
+	if filters.SkipCount {
+		hasMore := len(musics) > filters.PageSize
+		if hasMore {
+			musics = musics[:filters.PageSize]
+		}
+		return musics, uncountedMetadata(hasMore, filters.Page, filters.PageSize), nil
+	}
+
+	if cachedTotal {
+		totalRecords, err = m.totals.get(func() (int, error) { return m.Count(filter) })
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+		metadata.Count = CountApproximate
+		return musics, metadata, nil
+	}
+
+	// A page past the end has no rows to carry the window count, so count
+	// separately to still report where the listing ends.
+	if len(musics) == 0 && filters.Page > 1 {
+		totalRecords, err = m.Count(filter)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
 	}
 
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
@@ -138,17 +581,300 @@ func (m MusicsModel) GetAll(title string, genres []string, filters Filters) ([]*
 	return musics, metadata, nil
 }
 
+// musicsQuery returns the query of a GetAll page.
+func musicsQuery(total, rank, headline, where, orderBy, limit, offset string) string {
+	return fmt.Sprintf(`SELECT %s, %s AS rank, %s, `+musicColumns+`
+		  FROM musics
+		  WHERE %s
+		  ORDER BY %s, id ASC
+		  LIMIT %s OFFSET %s`, total, rank, headline, where, orderBy, limit, offset)
+}
+
+// unfilteredMusicsQuery is the query GetAll runs for a page of the whole
+// catalogue in the order of sort, which gets a prepared statement.
+func unfilteredMusicsQuery(sort string) string {
+	var args []interface{}
+	filter := MusicFilter{}
+	filters := Filters{Sort: sort, SortSafeList: MusicSortSafeList}
+	return musicsQuery("0", filter.rank(&args), filter.headline(&args), filter.where(&args), musicOrder(filters), "$1", "$2")
+}
+
+// musicOrder returns the ORDER BY list for filters, without the id
+// tie-breaker. Relevance sorts need the rank column selected.
+func musicOrder(filters Filters) string {
+	if filters.sortColumn() == "relevance" {
+		if filters.sortDirection() == "DESC" {
+			return "rank ASC"
+		}
+		return "rank DESC"
+	}
+	return filters.sortColumn() + " " + filters.sortDirection()
+}
+
+// StreamAll calls fn with every record matching filter, in the order of
+// filters.Sort; the page fields of filters are ignored. Rows are read as
+// fn consumes them, so memory use doesn't grow with the result. An error
+// from fn stops the iteration and is returned. The query runs for as long
+// as ctx allows it, with no timeout of its own, since a large result may
+// take as long to write out as the response is given; cancelling ctx, such
+// as when the client of a streamed response goes away, stops it.
+func (m MusicsModel) StreamAll(ctx context.Context, filter MusicFilter, filters Filters, fn func(*Music) error) error {
+	var args []interface{}
+	where := filter.where(&args)
+	rank := filter.rank(&args)
+
+	q := fmt.Sprintf(`SELECT %s AS rank, `+musicColumns+`
+		  FROM musics
+		  WHERE %s
+		  ORDER BY %s, id ASC`, rank, where, musicOrder(filters))
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rank sql.NullFloat64
+		music, err := scanMusic(rows, &rank)
+		if err != nil {
+			return timeoutError(ctx, err)
+		}
+		if err := fn(music); err != nil {
+			return err
+		}
+	}
+	return timeoutError(ctx, rows.Err())
+}
+
+// GetAfter returns up to limit records matching filter with an id above
+// afterID, in id order. Jobs reading more records than a single query may
+// take the time for page through them with it.
+func (m MusicsModel) GetAfter(filter MusicFilter, afterID int64, limit int) ([]*Music, error) {
+	var args []interface{}
+	where := filter.where(&args)
+
+	q := fmt.Sprintf(`SELECT `+musicColumns+`
+		  FROM musics
+		  WHERE %s AND id > %s
+		  ORDER BY id
+		  LIMIT %s`, where, placeholder(&args, afterID), placeholder(&args, limit))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	musics := []*Music{}
+	for rows.Next() {
+		music, err := scanMusic(rows)
+		if err != nil {
+			return nil, timeoutError(ctx, err)
+		}
+		musics = append(musics, music)
+	}
+	return musics, timeoutError(ctx, rows.Err())
+}
+
+// Suggestion is a title completion returned by Suggest.
+type Suggestion struct {
+	Id     int64  `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+}
+
+// Suggest returns up to limit records whose title starts with prefix, ignoring
+// case. The lower(title) text_pattern_ops index serves the LIKE.
+func (m MusicsModel) Suggest(prefix string, limit int) ([]Suggestion, error) {
+	q := `SELECT id, title, artist
+		  FROM musics
+		  WHERE lower(title) LIKE $1
+		  ORDER BY lower(title), id
+		  LIMIT $2`
+
+	pattern := likePrefix(prefix)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.Id, &s.Title, &s.Artist); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+// Count returns the number of records matching filter.
+func (m MusicsModel) Count(filter MusicFilter) (int, error) {
+	var args []interface{}
+	q := "SELECT count(*) FROM musics WHERE " + filter.where(&args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout())
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, q, args...).Scan(&count)
+	return count, timeoutError(ctx, err)
+}
+
+// GetRandom returns up to n distinct records matching filter, picked at
+// random. Rather than sorting the matches by random(), it counts them and
+// fetches the records at n random offsets into the id order, in a snapshot so
+// the offsets stay valid. It returns ErrRecordNotFound when nothing matches.
+//
+// A non-nil seed makes the pick reproducible: the same seed over the same
+// matching records returns the same records in the same order. The offsets are
+// drawn in Go, so seeding never touches the connection's random() state.
+func (m MusicsModel) GetRandom(filter MusicFilter, n int, seed *int64) ([]*Music, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var args []interface{}
+	where := filter.where(&args)
+
+	var total int
+	err = tx.QueryRowContext(ctx, "SELECT count(*) FROM musics WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	if total == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	source := time.Now().UnixNano()
+	if seed != nil {
+		source = *seed
+	}
+	offsets := randomOffsets(total, n, source)
+
+	q := fmt.Sprintf(`SELECT m.*
+		  FROM unnest(%s::bigint[]) AS o(n)
+		  CROSS JOIN LATERAL (
+		      SELECT `+musicColumns+`
+		      FROM musics
+		      WHERE %s
+		      ORDER BY id
+		      OFFSET o.n LIMIT 1
+		  ) m`, placeholder(&args, pq.Array(offsets)), where)
+
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	musics := []*Music{}
+	for rows.Next() {
+		music, err := scanMusic(rows)
+		if err != nil {
+			return nil, timeoutError(ctx, err)
+		}
+		musics = append(musics, music)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+
+	return musics, nil
+}
+
+// randomOffsets returns min(n, total) distinct offsets into total records, in
+// the order drawn from source.
+func randomOffsets(total, n int, source int64) []int64 {
+	if n > total {
+		n = total
+	}
+	random := rand.New(rand.NewSource(source))
+	picked := make(map[int]bool, n)
+	offsets := make([]int64, 0, n)
+	for len(offsets) < n {
+		offset := random.Intn(total)
+		if !picked[offset] {
+			picked[offset] = true
+			offsets = append(offsets, int64(offset))
+		}
+	}
+	return offsets
+}
+
+// UpsertByISRC inserts ms, or updates the existing record carrying the same
+// ISRC, in a single statement. It reports whether a new record was created.
+func (m MusicsModel) UpsertByISRC(ms *Music) (bool, error) {
+	return m.upsertByISRC(m.DB, ms)
+}
+
+// UpsertByISRCTx is UpsertByISRC run in tx.
+func (m MusicsModel) UpsertByISRCTx(tx *sql.Tx, ms *Music) (bool, error) {
+	return m.upsertByISRC(tx, ms)
+}
+
+func (m MusicsModel) upsertByISRC(db querier, ms *Music) (bool, error) {
+	q := `INSERT INTO musics (isrc, title, duration, genres, popularity, artist)
+		  VALUES ($1, $2, $3, $4, $5, $6)
+		  ON CONFLICT (isrc) DO UPDATE
+		  SET title = EXCLUDED.title, duration = EXCLUDED.duration, genres = EXCLUDED.genres,
+		      popularity = EXCLUDED.popularity, artist = EXCLUDED.artist, version = musics.version + 1,
+		      updated_at = GREATEST(date_trunc('second', NOW()), musics.updated_at + interval '1 second')
+		  RETURNING id, created_at, updated_at, version, xmax = 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var created bool
+	args := []interface{}{ms.ISRC, ms.Title, ms.Duration, pq.Array(ms.Genres), ms.Popularity, ms.Artist}
+	err := db.QueryRowContext(ctx, q, args...).Scan(&ms.Id, &ms.CreatedAt, &ms.UpdatedAt, &ms.Version, &created)
+	if err == nil && created {
+		m.totals.invalidate()
+	}
+	return created, translateError(err)
+}
+
+// Update saves ms if it is still at ms.Version. updated_at only has second
+// precision, so each update moves it at least one second past the previous
+// value; that way two edits landing in the same second still produce
+// distinct Last-Modified values.
 func (m MusicsModel) Update(ms *Music) error {
+	return m.update(m.DB, ms)
+}
+
+// UpdateTx is Update run in tx.
+func (m MusicsModel) UpdateTx(tx *sql.Tx, ms *Music) error {
+	return m.update(tx, ms)
+}
+
+func (m MusicsModel) update(db querier, ms *Music) error {
 	q := `UPDATE musics
-		  SET title = $2, duration = $3, popularity = $4, genres = $5, version = version + 1
+		  SET title = $2, duration = $3, popularity = $4, genres = $5, isrc = NULLIF($7, ''), artist = $8, version = version + 1,
+		      updated_at = GREATEST(date_trunc('second', NOW()), updated_at + interval '1 second'),
+		      musicbrainz_id = NULLIF($9, '')::uuid
 		  WHERE id = $1 AND version = $6
-		  RETURNING version`
+		  RETURNING version, updated_at`
 
 	args := []interface{}{
-		ms.Id, ms.Title, ms.Duration, ms.Popularity, pq.Array(ms.Genres), ms.Version,
+		ms.Id, ms.Title, ms.Duration, ms.Popularity, pq.Array(ms.Genres), ms.Version, ms.ISRC, ms.Artist, ms.MusicBrainzID,
 	}
 
-	err := m.DB.QueryRow(q, args...).Scan(&ms.Version)
+	err := translateError(db.QueryRowContext(context.Background(), q, args...).Scan(&ms.Version, &ms.UpdatedAt))
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -160,25 +886,310 @@ func (m MusicsModel) Update(ms *Music) error {
 	return nil
 }
 
-func (m MusicsModel) Delete(id int64) error {
+// Enrich saves ms like Update, recording that source filled in its fields.
+func (m MusicsModel) Enrich(ms *Music, source string) error {
+	return m.enrich(m.DB, ms, source)
+}
+
+// EnrichTx is Enrich run in tx.
+func (m MusicsModel) EnrichTx(tx *sql.Tx, ms *Music, source string) error {
+	return m.enrich(tx, ms, source)
+}
+
+func (m MusicsModel) enrich(db querier, ms *Music, source string) error {
+	q := `UPDATE musics
+		  SET title = $2, duration = $3, popularity = $4, genres = $5, isrc = NULLIF($7, ''), artist = $8, version = version + 1,
+		      updated_at = GREATEST(date_trunc('second', NOW()), updated_at + interval '1 second'),
+		      enrichment_source = $9, enriched_at = NOW()
+		  WHERE id = $1 AND version = $6
+		  RETURNING version, updated_at, enriched_at`
+
+	args := []interface{}{
+		ms.Id, ms.Title, ms.Duration, ms.Popularity, pq.Array(ms.Genres), ms.Version, ms.ISRC, ms.Artist, source,
+	}
+
+	err := translateError(db.QueryRowContext(context.Background(), q, args...).Scan(&ms.Version, &ms.UpdatedAt, &ms.EnrichedAt))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	ms.EnrichmentSource = source
+	return nil
+}
+
+// RenameGenre replaces the genre from with to on every record carrying it,
+// bumping their versions. A record that already has to keeps a single copy, so
+// a rename can shrink a record's genres but never grow them past the cap. It
+// returns how many records were affected and how many of those were merged
+// that way; with dryRun set nothing is written.
+func (m MusicsModel) RenameGenre(from, to string, dryRun bool) (int, int, error) {
+	if !dryRun {
+		renamed, merged, err := m.renameGenre(m.DB, from, to)
+		return len(renamed), merged, err
+	}
+
+	q := `SELECT count(*), count(*) FILTER (WHERE $2 = ANY(genres))
+		  FROM musics
+		  WHERE $1 = ANY(genres)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var affected, merged int
+	err := m.DB.QueryRowContext(ctx, q, from, to).Scan(&affected, &merged)
+	return affected, merged, translateError(err)
+}
+
+// RenameGenreTx is RenameGenre run in tx, returning the renamed records as
+// they are now rather than counting them.
+func (m MusicsModel) RenameGenreTx(tx *sql.Tx, from, to string) ([]*Music, int, error) {
+	return m.renameGenre(tx, from, to)
+}
+
+func (m MusicsModel) renameGenre(db querier, from, to string) ([]*Music, int, error) {
+	q := `UPDATE musics
+		  SET genres = ARRAY(
+		          SELECT g FROM unnest(array_replace(musics.genres, $1::text, $2::text)) WITH ORDINALITY AS u(g, pos)
+		          GROUP BY g ORDER BY min(pos)),
+		      version = musics.version + 1,
+		      updated_at = GREATEST(date_trunc('second', NOW()), musics.updated_at + interval '1 second')
+		  FROM (SELECT id AS old_id, $2 = ANY(genres) AS merged FROM musics WHERE $1 = ANY(genres)) old
+		  WHERE musics.id = old.old_id
+		  RETURNING old.merged, ` + musicColumns
+
+	// This touches every matching row, so allow it more time than the
+	// single-record queries.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, q, from, to)
+	if err != nil {
+		return nil, 0, translateError(err)
+	}
+	defer rows.Close()
+
+	renamed := []*Music{}
+	merged := 0
+	for rows.Next() {
+		var wasMerged bool
+		music, err := scanMusic(rows, &wasMerged)
+		if err != nil {
+			return nil, 0, err
+		}
+		renamed = append(renamed, music)
+		if wasMerged {
+			merged++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, translateError(err)
+	}
+	return renamed, merged, nil
+}
+
+// retaggedGenres returns an expression for the genres column with the add
+// parameter appended and the remove parameter taken out, without duplicates
+// and otherwise in the original order.
+func retaggedGenres(add, remove string) string {
+	return `ARRAY(
+			  SELECT g FROM unnest(genres || ` + add + `::text[]) WITH ORDINALITY AS u(g, pos)
+			  WHERE g <> ALL(` + remove + `::text[])
+			  GROUP BY g ORDER BY min(pos))`
+}
+
+const retagBatchSize = 1000
+
+// Retag adds and removes genres on every record matching filter, in one
+// transaction. Nothing is written when more
+// than limit records match (ErrTooManyRecords) or when the change would leave
+// any record with more than 5 genres; the ids of such records are returned. On
+// success it returns how many records actually changed.
+func (m MusicsModel) Retag(filter MusicFilter, add, remove []string, limit int) (int, []int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	changed, overflowing, err := m.retag(ctx, tx, filter, add, remove, limit)
+	if err != nil || len(overflowing) > 0 {
+		return 0, overflowing, err
+	}
+	return len(changed), nil, tx.Commit()
+}
+
+// RetagTx is Retag run in tx, returning the changed records as they are now
+// rather than counting them.
+func (m MusicsModel) RetagTx(tx *sql.Tx, filter MusicFilter, add, remove []string, limit int) ([]*Music, []int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return m.retag(ctx, tx, filter, add, remove, limit)
+}
+
+func (m MusicsModel) retag(ctx context.Context, tx *sql.Tx, filter MusicFilter, add, remove []string, limit int) ([]*Music, []int64, error) {
+	var args []interface{}
+	where := filter.where(&args)
+	q := `SELECT id, cardinality(` + retaggedGenres(placeholder(&args, pq.Array(add)), placeholder(&args, pq.Array(remove))) + `) > 5
+		  FROM musics
+		  WHERE ` + where + `
+		  ORDER BY id
+		  LIMIT ` + placeholder(&args, limit+1) + `
+		  FOR UPDATE`
+
+	rows, err := tx.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids, overflowing []int64
+	for rows.Next() {
+		var id int64
+		var overflow bool
+		if err := rows.Scan(&id, &overflow); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		if overflow {
+			overflowing = append(overflowing, id)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case len(ids) > limit:
+		return nil, nil, ErrTooManyRecords
+	case len(overflowing) > 0:
+		return nil, overflowing, nil
+	}
+
+	q = `UPDATE musics
+		 SET genres = ` + retaggedGenres("$2", "$3") + `, version = version + 1,
+		     updated_at = GREATEST(date_trunc('second', NOW()), updated_at + interval '1 second')
+		 WHERE id = ANY($1) AND genres <> ` + retaggedGenres("$2", "$3") + `
+		 RETURNING ` + musicColumns
+
+	changed := []*Music{}
+	for start := 0; start < len(ids); start += retagBatchSize {
+		end := start + retagBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		rows, err := tx.QueryContext(ctx, q, pq.Array(ids[start:end]), pq.Array(add), pq.Array(remove))
+		if err != nil {
+			return nil, nil, translateError(err)
+		}
+		for rows.Next() {
+			music, err := scanMusic(rows)
+			if err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			changed = append(changed, music)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, nil, translateError(err)
+		}
+	}
+
+	return changed, nil, nil
+}
+
+func (m MusicsModel) Delete(id int64) (*Music, error) {
+	return m.delete(m.DB, id)
+}
+
+// DeleteTx is Delete run in tx.
+func (m MusicsModel) DeleteTx(tx *sql.Tx, id int64) (*Music, error) {
+	return m.delete(tx, id)
+}
+
+func (m MusicsModel) delete(db querier, id int64) (*Music, error) {
 	if id < 1 {
-		return ErrRecordNotFound
+		return nil, ErrRecordNotFound
 	}
 
 	q := `DELETE FROM musics
-		  WHERE id = $1`
-	result, err := m.DB.Exec(q, id)
+		  WHERE id = $1
+		  RETURNING ` + musicColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ms, err := scanMusic(db.QueryRowContext(ctx, q, id))
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	m.totals.invalidate()
+	return ms, nil
+}
+
+func (m MusicsModel) DeleteMany(ids []int64) ([]int64, []int64, error) {
+	return m.deleteMany(m.DB, ids)
+}
+
+// DeleteManyTx is DeleteMany run in tx.
+func (m MusicsModel) DeleteManyTx(tx *sql.Tx, ids []int64) ([]int64, []int64, error) {
+	return m.deleteMany(tx, ids)
+}
+
+func (m MusicsModel) deleteMany(db querier, ids []int64) ([]int64, []int64, error) {
+	q := `DELETE FROM musics
+		  WHERE id = ANY($1)
+		  RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, q, pq.Array(ids))
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int64]bool)
+	deleted := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		seen[id] = true
+		deleted = append(deleted, id)
 	}
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(deleted) > 0 {
+		m.totals.invalidate()
 	}
 
-	return nil
+	missing := []int64{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			missing = append(missing, id)
+		}
+	}
+
+	return deleted, missing, nil
 }
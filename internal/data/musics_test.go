@@ -0,0 +1,778 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertTestMusics adds n records titled "Song 0" onwards.
+func insertTestMusics(t *testing.T, m Models, n int) []*Music {
+	t.Helper()
+
+	ms := make([]*Music, n)
+	for i := range ms {
+		ms[i] = &Music{Title: fmt.Sprintf("Song %d", i), Duration: 180, Genres: []string{"pop"}, Popularity: 0.5}
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestStreamAll(t *testing.T) {
+	m := newTestModels(t)
+	ms := insertTestMusics(t, m, 5)
+
+	filters := Filters{Sort: "id", SortSafeList: []string{"id"}}
+	var ids []int64
+	err := m.Musics.StreamAll(context.Background(), MusicFilter{}, filters, func(mv *Music) error {
+		ids = append(ids, mv.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(ms) {
+		t.Fatalf("got %d records; want %d", len(ids), len(ms))
+	}
+	for i := range ms {
+		if ids[i] != ms[i].Id {
+			t.Errorf("record %d: got id %d; want %d", i, ids[i], ms[i].Id)
+		}
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = m.Musics.StreamAll(context.Background(), MusicFilter{}, filters, func(mv *Music) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls; want %v after 1", err, calls, stop)
+	}
+}
+
+func TestStreamAllCancelled(t *testing.T) {
+	m := newTestModels(t)
+	insertTestMusics(t, m, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	filters := Filters{Sort: "id", SortSafeList: []string{"id"}}
+	err := m.Musics.StreamAll(ctx, MusicFilter{}, filters, func(mv *Music) error {
+		t.Error("called after the context was cancelled")
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v; want %v", err, context.Canceled)
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func TestDurationFilterSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   MusicFilter
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{"none", MusicFilter{}, "true", nil},
+		{"min only", MusicFilter{DurationMin: intPtr(120)}, "true AND duration >= $1", []interface{}{120}},
+		{"max only", MusicFilter{DurationMax: intPtr(240)}, "true AND duration <= $1", []interface{}{240}},
+		{"both", MusicFilter{DurationMin: intPtr(120), DurationMax: intPtr(240)}, "true AND duration >= $1 AND duration <= $2", []interface{}{120, 240}},
+		{
+			"after other filters",
+			MusicFilter{TitleExact: "Song", DurationMin: intPtr(120)},
+			"true AND normalize_text(title) = normalize_text($1) AND duration >= $2",
+			[]interface{}{"Song", 120},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []interface{}
+			if got := tt.filter.where(&args); got != tt.wantSQL {
+				t.Errorf("got %q; want %q", got, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("got args %v; want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestValidateDurationFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  MusicFilter
+		wantKey string
+		wantID  string
+	}{
+		{"in range", MusicFilter{DurationMin: intPtr(0), DurationMax: intPtr(math.MaxInt32)}, "", ""},
+		{"negative min", MusicFilter{DurationMin: intPtr(-1)}, "duration_min", validator.MsgNotNegative},
+		{"negative max", MusicFilter{DurationMax: intPtr(-1)}, "duration_max", validator.MsgNotNegative},
+		{"min past integer", MusicFilter{DurationMin: intPtr(math.MaxInt32 + 1)}, "duration_min", validator.MsgMaxValue},
+		{"max past integer", MusicFilter{DurationMax: intPtr(math.MaxInt32 + 1)}, "duration_max", validator.MsgMaxValue},
+		{"min above max", MusicFilter{DurationMin: intPtr(240), DurationMax: intPtr(120)}, "duration_max", validator.MsgMinValue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.filter
+			f.SearchMode = SearchFullText
+			v := validator.New()
+			ValidateMusicFilter(v, f)
+			if tt.wantKey == "" {
+				if !v.Valid() {
+					t.Fatalf("got errors %v; want none", v.Errors)
+				}
+				return
+			}
+			if got := v.Errors[tt.wantKey].ID; got != tt.wantID {
+				t.Errorf("got %s error %q; want %q", tt.wantKey, got, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestGetAllDurationBounds(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Short", Duration: 119, Genres: []string{"pop"}},
+		{Title: "Two minutes", Duration: 120, Genres: []string{"pop"}},
+		{Title: "Three minutes", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Four minutes", Duration: 240, Genres: []string{"pop"}},
+		{Title: "Long", Duration: 241, Genres: []string{"pop"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   []int64
+	}{
+		{"between", MusicFilter{DurationMin: intPtr(120), DurationMax: intPtr(240)}, []int64{ms[1].Id, ms[2].Id, ms[3].Id}},
+		{"min only", MusicFilter{DurationMin: intPtr(240)}, []int64{ms[3].Id, ms[4].Id}},
+		{"max only", MusicFilter{DurationMax: intPtr(120)}, []int64{ms[0].Id, ms[1].Id}},
+		{"single value", MusicFilter{DurationMin: intPtr(180), DurationMax: intPtr(180)}, []int64{ms[2].Id}},
+	}
+
+	filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, metadata, err := m.Musics.GetAll(tt.filter, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, mv := range got {
+				ids = append(ids, mv.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got ids %v; want %v", ids, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGetAllHighlightAccents(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Beyoncé Live", Artist: "Beyoncé", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Uber Alles", Artist: "Band", Duration: 180, Genres: []string{"rock"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	highlight := &Highlight{Start: "[", Stop: "]"}
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   string
+	}{
+		{"unaccented title search", MusicFilter{Title: "beyonce", SearchMode: SearchFullText, Highlight: highlight}, "[Beyoncé] Live"},
+		{"accented title search", MusicFilter{Title: "ÜBER", SearchMode: SearchFullText, Highlight: highlight}, "[Uber] Alles"},
+		{"unaccented q search", MusicFilter{Query: "BEYONCE live", Highlight: highlight}, "[Beyoncé] [Live]"},
+	}
+
+	filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := m.Musics.GetAll(tt.filter, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d records; want 1", len(got))
+			}
+			if got[0].TitleHighlighted == nil || *got[0].TitleHighlighted != tt.want {
+				t.Errorf("got highlighted title %v; want %q", got[0].TitleHighlighted, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomOffsets(t *testing.T) {
+	for _, total := range []int{1, 5, 1000} {
+		for _, n := range []int{1, 5, 10} {
+			first := randomOffsets(total, n, 42)
+			if again := randomOffsets(total, n, 42); !reflect.DeepEqual(first, again) {
+				t.Errorf("total %d, n %d: seed 42 drew %v, then %v", total, n, first, again)
+			}
+
+			want := n
+			if want > total {
+				want = total
+			}
+			if len(first) != want {
+				t.Errorf("total %d, n %d: got %d offsets; want %d", total, n, len(first), want)
+			}
+			seen := make(map[int64]bool)
+			for _, offset := range first {
+				if offset < 0 || offset >= int64(total) || seen[offset] {
+					t.Errorf("total %d, n %d: got offsets %v; want distinct offsets in [0, %d)", total, n, first, total)
+					break
+				}
+				seen[offset] = true
+			}
+		}
+	}
+
+	// Different seeds may draw the same offsets, but hardly ever do over a
+	// large table.
+	same := 0
+	for seed := int64(1); seed <= 100; seed++ {
+		if reflect.DeepEqual(randomOffsets(1000, 5, seed), randomOffsets(1000, 5, seed+1)) {
+			same++
+		}
+	}
+	if same > 1 {
+		t.Errorf("%d of 100 pairs of adjacent seeds drew the same offsets", same)
+	}
+}
+
+func TestGetRandomSeed(t *testing.T) {
+	m := newTestModels(t)
+	insertTestMusics(t, m, 50)
+
+	ids := func(seed int64) []int64 {
+		t.Helper()
+		musics, err := m.Musics.GetRandom(MusicFilter{}, 5, &seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, music := range musics {
+			ids = append(ids, music.Id)
+		}
+		return ids
+	}
+
+	first := ids(7)
+	if len(first) != 5 {
+		t.Fatalf("got %d records; want 5", len(first))
+	}
+	for i := 0; i < 3; i++ {
+		if again := ids(7); !reflect.DeepEqual(first, again) {
+			t.Fatalf("seed 7 returned %v, then %v", first, again)
+		}
+	}
+
+	differ := false
+	for seed := int64(8); seed < 18 && !differ; seed++ {
+		differ = !reflect.DeepEqual(first, ids(seed))
+	}
+	if !differ {
+		t.Errorf("seeds 8 to 17 all returned the records of seed 7: %v", first)
+	}
+}
+
+func TestGetRandomFilter(t *testing.T) {
+	m := newTestModels(t)
+	insertTestMusics(t, m, 20)
+	rock := []*Music{
+		{Title: "Rock 0", Duration: 180, Genres: []string{"rock"}},
+		{Title: "Rock 1", Duration: 180, Genres: []string{"rock", "pop"}},
+		{Title: "Rock 2", Duration: 180, Genres: []string{"rock"}},
+	}
+	if err := m.Musics.InsertBatch(rock); err != nil {
+		t.Fatal(err)
+	}
+	isRock := map[int64]bool{rock[0].Id: true, rock[1].Id: true, rock[2].Id: true}
+
+	for seed := int64(1); seed <= 10; seed++ {
+		// Picks come from the matches only.
+		musics, err := m.Musics.GetRandom(MusicFilter{Genres: []string{"rock"}}, 2, &seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(musics) != 2 || musics[0].Id == musics[1].Id {
+			t.Fatalf("seed %d: got %v; want two distinct records", seed, musics)
+		}
+		for _, music := range musics {
+			if !isRock[music.Id] {
+				t.Errorf("seed %d: got %q, which doesn't match the filter", seed, music.Title)
+			}
+		}
+
+		// Asking for more than match returns each match once.
+		musics, err = m.Musics.GetRandom(MusicFilter{Genres: []string{"rock"}}, 5, &seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, music := range musics {
+			ids = append(ids, music.Id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if want := []int64{rock[0].Id, rock[1].Id, rock[2].Id}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("seed %d: got ids %v; want %v", seed, ids, want)
+		}
+	}
+
+	_, err := m.Musics.GetRandom(MusicFilter{Genres: []string{"jazz"}}, 1, nil)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("no matches: got %v; want ErrRecordNotFound", err)
+	}
+}
+
+// getAllIDs returns the ids GetAll lists for filter, in id order, with the
+// metadata.
+func getAllIDs(t *testing.T, m Models, filter MusicFilter) ([]int64, Metadata) {
+	t.Helper()
+
+	filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: MusicSortSafeList}
+	got, metadata, err := m.Musics.GetAll(filter, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	for _, mv := range got {
+		ids = append(ids, mv.Id)
+	}
+	return ids, metadata
+}
+
+func TestValidateSearchMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		valid bool
+	}{
+		{SearchFullText, true},
+		{SearchFuzzy, true},
+		{"", false},
+		{"FUZZY", false},
+		{"trigram", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			v := validator.New()
+			ValidateMusicFilter(v, MusicFilter{Title: "song", SearchMode: tt.mode})
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (errors %v)", v.Valid(), tt.valid, v.Errors)
+			}
+			if !tt.valid && v.Errors["search_mode"].ID != validator.MsgOneOf {
+				t.Errorf("got errors %v; want search_mode %s", v.Errors, validator.MsgOneOf)
+			}
+		})
+	}
+}
+
+func TestFuzzyTitleSQL(t *testing.T) {
+	f := MusicFilter{Title: "Bohemian Rapsody", SearchMode: SearchFuzzy, FuzzyThreshold: 0.4}
+
+	var args []interface{}
+	wantWhere := "true AND normalize_text(title) % normalize_text($1) AND similarity(normalize_text(title), normalize_text($1)) >= $2"
+	if got := f.where(&args); got != wantWhere {
+		t.Errorf("got where %q; want %q", got, wantWhere)
+	}
+	if want := []interface{}{"Bohemian Rapsody", 0.4}; !reflect.DeepEqual(args, want) {
+		t.Errorf("got args %v; want %v", args, want)
+	}
+
+	args = nil
+	if got, want := f.rank(&args), "similarity(normalize_text(title), normalize_text($1))"; got != want {
+		t.Errorf("got rank %q; want %q", got, want)
+	}
+}
+
+func TestGetAllFuzzyTitle(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Bohemian Rhapsody", Duration: 355, Genres: []string{"rock"}},
+		{Title: "Bohemian Rhapsody (Live at Wembley)", Duration: 360, Genres: []string{"rock"}},
+		{Title: "Another One Bites the Dust", Duration: 215, Genres: []string{"rock"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   []int64
+	}{
+		{"typo in default mode", MusicFilter{Title: "Bohemian Rapsody", SearchMode: SearchFullText}, []int64{}},
+		{"typo in fuzzy mode", MusicFilter{Title: "Bohemian Rapsody", SearchMode: SearchFuzzy, FuzzyThreshold: 0.3}, []int64{ms[0].Id, ms[1].Id}},
+		{"threshold tightened", MusicFilter{Title: "Bohemian Rapsody", SearchMode: SearchFuzzy, FuzzyThreshold: 0.6}, []int64{ms[0].Id}},
+		{"unrelated title", MusicFilter{Title: "Yellow Submarine", SearchMode: SearchFuzzy, FuzzyThreshold: 0.3}, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, metadata := getAllIDs(t, m, tt.filter)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got ids %v; want %v", ids, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+
+	// By relevance, the closer title comes first whatever the id order.
+	filter := MusicFilter{Title: "Bohemian Rhapsody live at Wembley", SearchMode: SearchFuzzy, FuzzyThreshold: 0.3}
+	filters := Filters{Page: 1, PageSize: 10, Sort: "relevance", SortSafeList: MusicSortSafeList}
+	got, _, err := m.Musics.GetAll(filter, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Id != ms[1].Id || *got[0].Rank < *got[1].Rank {
+		t.Errorf("got %v by relevance; want %d first", got, ms[1].Id)
+	}
+}
+
+func TestGenresFilterSQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  MusicFilter
+		wantSQL string
+	}{
+		{"all", MusicFilter{Genres: []string{"rock", "indie"}}, "true AND genres @> $1"},
+		{"any", MusicFilter{GenresAny: []string{"rock", "indie"}}, "true AND genres && $1"},
+		{"both", MusicFilter{Genres: []string{"rock"}, GenresAny: []string{"indie", "pop"}}, "true AND genres @> $1 AND genres && $2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []interface{}
+			if got := tt.filter.where(&args); got != tt.wantSQL {
+				t.Errorf("got %q; want %q", got, tt.wantSQL)
+			}
+		})
+	}
+}
+
+func TestValidateGenresAny(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres []string
+		valid  bool
+	}{
+		{"one", []string{"rock"}, true},
+		{"several", []string{"rock", "pop"}, true},
+		{"empty element", []string{"rock", "", "pop"}, false},
+		{"trailing comma", []string{"rock", ""}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateMusicFilter(v, MusicFilter{SearchMode: SearchFullText, GenresAny: tt.genres})
+			if v.Valid() != tt.valid {
+				t.Fatalf("got valid %t; want %t (errors %v)", v.Valid(), tt.valid, v.Errors)
+			}
+			if !tt.valid && v.Errors["genres_any"].ID != validator.MsgEmptyValues {
+				t.Errorf("got errors %v; want genres_any %s", v.Errors, validator.MsgEmptyValues)
+			}
+		})
+	}
+}
+
+func TestGetAllGenresAllVsAny(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Rock only", Duration: 180, Genres: []string{"rock"}},
+		{Title: "Indie only", Duration: 180, Genres: []string{"indie"}},
+		{Title: "Indie rock", Duration: 180, Genres: []string{"rock", "indie"}},
+		{Title: "Pop", Duration: 180, Genres: []string{"pop"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   []int64
+	}{
+		{"all of rock and indie", MusicFilter{Genres: []string{"rock", "indie"}}, []int64{ms[2].Id}},
+		{"any of rock and indie", MusicFilter{GenresAny: []string{"rock", "indie"}}, []int64{ms[0].Id, ms[1].Id, ms[2].Id}},
+		{"any of one genre", MusicFilter{GenresAny: []string{"pop"}}, []int64{ms[3].Id}},
+		{"any of unknown genres", MusicFilter{GenresAny: []string{"jazz"}}, []int64{}},
+		{"rock and any of indie or pop", MusicFilter{Genres: []string{"rock"}, GenresAny: []string{"indie", "pop"}}, []int64{ms[2].Id}},
+		{"pop and any of rock", MusicFilter{Genres: []string{"pop"}, GenresAny: []string{"rock"}}, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, metadata := getAllIDs(t, m, tt.filter)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got ids %v; want %v", ids, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestValidateExcludeGenres(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  MusicFilter
+		wantErr bool
+	}{
+		{"alone", MusicFilter{ExcludeGenres: []string{"metal"}}, false},
+		{"with other genres", MusicFilter{Genres: []string{"rock"}, ExcludeGenres: []string{"metal"}}, false},
+		{"also in genres", MusicFilter{Genres: []string{"rock", "metal"}, ExcludeGenres: []string{"metal"}}, true},
+		{"also in genres_any", MusicFilter{GenresAny: []string{"pop", "rap"}, ExcludeGenres: []string{"metal", "rap"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.filter
+			f.SearchMode = SearchFullText
+			v := validator.New()
+			ValidateMusicFilter(v, f)
+			if got := v.Errors["exclude_genres"].ID; tt.wantErr != (got == validator.MsgOverlap) || len(v.Errors) > 1 {
+				t.Errorf("got errors %v; want an exclude_genres error: %t", v.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetAllExcludeGenres(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Heavy song", Duration: 180, Genres: []string{"metal"}},
+		{Title: "Rap song", Duration: 180, Genres: []string{"rap", "explicit"}},
+		{Title: "Rock song", Duration: 180, Genres: []string{"rock"}},
+		{Title: "Metal rock song", Duration: 180, Genres: []string{"rock", "metal"}},
+		{Title: "Pop tune", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Untagged song", Duration: 180, Genres: []string{}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   []int64
+	}{
+		{"alone", MusicFilter{ExcludeGenres: []string{"metal", "explicit"}}, []int64{ms[2].Id, ms[4].Id, ms[5].Id}},
+		{"with genres", MusicFilter{Genres: []string{"rock"}, ExcludeGenres: []string{"metal"}}, []int64{ms[2].Id}},
+		{"with genres_any", MusicFilter{GenresAny: []string{"rock", "rap"}, ExcludeGenres: []string{"explicit"}}, []int64{ms[2].Id, ms[3].Id}},
+		{"with title search", MusicFilter{Title: "song", SearchMode: SearchFullText, ExcludeGenres: []string{"metal"}}, []int64{ms[1].Id, ms[2].Id, ms[5].Id}},
+		{"unknown genre", MusicFilter{ExcludeGenres: []string{"jazz"}}, []int64{ms[0].Id, ms[1].Id, ms[2].Id, ms[3].Id, ms[4].Id, ms[5].Id}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, metadata := getAllIDs(t, m, tt.filter)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got ids %v; want %v", ids, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGetAllTitleExact(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "Run", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Running", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Run Away", Duration: 180, Genres: []string{"pop"}},
+		{Title: "RUN", Duration: 180, Genres: []string{"rock"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter MusicFilter
+		want   []int64
+	}{
+		{"exact", MusicFilter{TitleExact: "run"}, []int64{ms[0].Id, ms[3].Id}},
+		{"exact with genres", MusicFilter{TitleExact: "run", Genres: []string{"rock"}}, []int64{ms[3].Id}},
+		{"exact two words", MusicFilter{TitleExact: "run away"}, []int64{ms[2].Id}},
+		{"exact prefix", MusicFilter{TitleExact: "runn"}, []int64{}},
+		// The simple configuration doesn't stem, so full-text search
+		// doesn't find Running either, but it does match a title word.
+		{"full-text", MusicFilter{Title: "run", SearchMode: SearchFullText}, []int64{ms[0].Id, ms[2].Id, ms[3].Id}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, metadata := getAllIDs(t, m, tt.filter)
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got ids %v; want %v", ids, tt.want)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(tt.want))
+			}
+		})
+	}
+
+	// Paging and sorting work as for any other filter.
+	filters := Filters{Page: 2, PageSize: 1, Sort: "-id", SortSafeList: MusicSortSafeList}
+	got, metadata, err := m.Musics.GetAll(MusicFilter{TitleExact: "Run"}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id != ms[0].Id || metadata.TotalRecords != 2 || metadata.LastPage != 2 {
+		t.Errorf("got %v with %+v on page 2; want record %d of 2", got, metadata, ms[0].Id)
+	}
+}
+
+func TestCreatedAtOrderSQL(t *testing.T) {
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"created_at", "ORDER BY created_at ASC, id ASC"},
+		{"-created_at", "ORDER BY created_at DESC, id ASC"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			if q := unfilteredMusicsQuery(tt.sort); !strings.Contains(q, tt.want) {
+				t.Errorf("got query %q; want it to contain %q", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAllCreatedAtTies(t *testing.T) {
+	m := newTestModels(t)
+
+	// Each batch is inserted in one transaction, sharing its created_at.
+	older := insertTestMusics(t, m, 3)
+	time.Sleep(10 * time.Millisecond)
+	newer := insertTestMusics(t, m, 3)
+	if !older[0].CreatedAt.Equal(older[2].CreatedAt) || !newer[0].CreatedAt.After(older[0].CreatedAt) {
+		t.Fatalf("got created_at %v and %v; want two batches of ties", older[0].CreatedAt, newer[0].CreatedAt)
+	}
+
+	ids := func(ms ...[]*Music) []int64 {
+		var ids []int64
+		for _, batch := range ms {
+			for _, mv := range batch {
+				ids = append(ids, mv.Id)
+			}
+		}
+		return ids
+	}
+
+	tests := []struct {
+		sort string
+		want []int64
+	}{
+		{"created_at", ids(older, newer)},
+		// Ties stay in id order whichever way created_at goes.
+		{"-created_at", ids(newer, older)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			for _, pageSize := range []int{10, 2} {
+				var got []int64
+				for page := 1; page <= (len(tt.want)+pageSize-1)/pageSize; page++ {
+					filters := Filters{Page: page, PageSize: pageSize, Sort: tt.sort, SortSafeList: MusicSortSafeList}
+					ms, _, err := m.Musics.GetAll(MusicFilter{}, filters)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, ids(ms)...)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("page size %d: got ids %v; want %v", pageSize, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "song b", Duration: 180, Genres: []string{"pop"}},
+		{Title: "Song A", Duration: 180, Genres: []string{"pop"}},
+		{Title: "SONG B", Duration: 180, Genres: []string{"pop"}},
+		{Title: "A Song", Duration: 180, Genres: []string{"pop"}},
+		{Title: "100% Song", Duration: 180, Genres: []string{"pop"}},
+		{Title: "100 Songs", Duration: 180, Genres: []string{"pop"}},
+		{Title: "s_ng", Duration: 180, Genres: []string{"pop"}},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int
+		want   []int64
+	}{
+		// Matches ignore case and come in title order, then id order.
+		{"prefix", "SONG", 10, []int64{ms[1].Id, ms[0].Id, ms[2].Id}},
+		{"limit", "song", 2, []int64{ms[1].Id, ms[0].Id}},
+		{"only at the start", "ong", 10, []int64{}},
+		{"percent is literal", "100%", 10, []int64{ms[4].Id}},
+		{"underscore is literal", "s_", 10, []int64{ms[6].Id}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestions, err := m.Musics.Suggest(tt.prefix, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int64{}
+			for _, s := range suggestions {
+				got = append(got, s.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got ids %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+// outboxLock is the advisory lock a dispatch pass holds, so that the
+// dispatchers of several instances take turns rather than publishing the
+// same rows at once.
+const outboxLock = 361
+
+// OutboxEvent is a change to a music record, written in the transaction
+// making the change and published from there by a dispatcher.
+type OutboxEvent struct {
+	// Sequence numbers events in the order they are published. It's given
+	// to an event before its first delivery attempt and kept for every
+	// redelivery, so consumers can drop the events they've already seen.
+	Sequence int64
+	Event    string
+	MusicID  int64
+	// Version is the record's version after the change, zero when unknown.
+	Version int32
+	// Payload is encoded to JSON on insert; events read back carry the
+	// encoded json.RawMessage.
+	Payload   interface{}
+	CreatedAt time.Time
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// InsertTx records e in tx, to be published once tx commits.
+func (m OutboxModel) InsertTx(tx *sql.Tx, e *OutboxEvent) error {
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+
+	q := `INSERT INTO outbox (event, music_id, version, payload)
+		  VALUES ($1, $2, $3, $4)
+		  RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return tx.QueryRowContext(ctx, q, e.Event, e.MusicID, e.Version, string(payload)).Scan(&e.CreatedAt)
+}
+
+// Dispatch passes up to limit unsent events, in sequence order, to publish
+// and marks them sent if it returns nil. Events are sequenced in a
+// transaction of their own first, so one whose publication fails or is cut
+// short by a crash keeps its sequence when it's published again. It returns
+// the number of events published, which is zero when there were none or
+// another dispatcher holds the lock.
+func (m OutboxModel) Dispatch(limit int, publish func([]*OutboxEvent) error) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	locked, err := m.sequence(ctx)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxLock).Scan(&locked); err != nil || !locked {
+		return 0, err
+	}
+
+	q := `SELECT id, sequence, event, music_id, version, payload, created_at
+		  FROM outbox
+		  WHERE sent_at IS NULL AND sequence IS NOT NULL
+		  ORDER BY sequence
+		  LIMIT $1`
+
+	rows, err := tx.QueryContext(ctx, q, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var events []*OutboxEvent
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		var e OutboxEvent
+		if err := rows.Scan(&id, &e.Sequence, &e.Event, &e.MusicID, &e.Version, &payload, &e.CreatedAt); err != nil {
+			return 0, err
+		}
+		e.Payload = json.RawMessage(payload)
+		ids = append(ids, id)
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := publish(events); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE outbox SET sent_at = NOW() WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit()
+}
+
+// sequence numbers the events still missing a sequence in the order they
+// were written, reporting false when another dispatcher holds the lock.
+func (m OutboxModel) sequence(ctx context.Context) (bool, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxLock).Scan(&locked); err != nil || !locked {
+		return false, err
+	}
+
+	q := `WITH numbered AS (
+		      SELECT id, nextval('outbox_sequence') AS sequence
+		      FROM (SELECT id FROM outbox WHERE sequence IS NULL ORDER BY id) pending
+		  )
+		  UPDATE outbox
+		  SET sequence = numbered.sequence
+		  FROM numbered
+		  WHERE outbox.id = numbered.id`
+
+	if _, err := tx.ExecContext(ctx, q); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// OldestUnsent returns when the oldest event still to be published was
+// written, or the zero time when there is none.
+func (m OutboxModel) OldestUnsent() (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var oldest sql.NullTime
+	err := m.DB.QueryRowContext(ctx, `SELECT min(created_at) FROM outbox WHERE sent_at IS NULL`).Scan(&oldest)
+	return oldest.Time, err
+}
+
+// PurgeSent deletes the events published before cutoff.
+func (m OutboxModel) PurgeSent(cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestOutboxDispatchResumes(t *testing.T) {
+	m := newTestModels(t)
+
+	err := m.Transact(func(tx *sql.Tx) error {
+		for id := int64(1); id <= 6; id++ {
+			e := &OutboxEvent{Event: EventMusicCreated, MusicID: id, Version: 1, Payload: map[string]int64{"id": id}}
+			if err := m.Outbox.InsertTx(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first dispatcher is stopped halfway through publishing its batch.
+	errStopped := errors.New("dispatcher stopped")
+	var first []*OutboxEvent
+	n, err := m.Outbox.Dispatch(10, func(batch []*OutboxEvent) error {
+		first = append(first, batch[:3]...)
+		return errStopped
+	})
+	if !errors.Is(err, errStopped) || n != 0 {
+		t.Fatalf("first dispatch = %d, %v; want 0, %v", n, err, errStopped)
+	}
+
+	// The one restarted in its place publishes the whole batch again.
+	var second []*OutboxEvent
+	n, err = m.Outbox.Dispatch(10, func(batch []*OutboxEvent) error {
+		second = append(second, batch...)
+		return nil
+	})
+	if err != nil || n != 6 {
+		t.Fatalf("second dispatch = %d, %v; want 6, nil", n, err)
+	}
+
+	for i, e := range second {
+		if e.MusicID != int64(i+1) {
+			t.Errorf("event %d is for music %d; want %d", i, e.MusicID, i+1)
+		}
+		if i > 0 && e.Sequence <= second[i-1].Sequence {
+			t.Errorf("event %d has sequence %d after %d", i, e.Sequence, second[i-1].Sequence)
+		}
+	}
+	for i, e := range first {
+		if second[i].MusicID != e.MusicID || second[i].Sequence != e.Sequence {
+			t.Errorf("event for music %d was published with sequence %d, then with %d for music %d",
+				e.MusicID, e.Sequence, second[i].Sequence, second[i].MusicID)
+		}
+	}
+
+	n, err = m.Outbox.Dispatch(10, func(batch []*OutboxEvent) error {
+		t.Errorf("published %d events already sent", len(batch))
+		return nil
+	})
+	if err != nil || n != 0 {
+		t.Errorf("third dispatch = %d, %v; want 0, nil", n, err)
+	}
+
+	oldest, err := m.Outbox.OldestUnsent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oldest.IsZero() {
+		t.Errorf("oldest unsent event is from %v; want none", oldest)
+	}
+}
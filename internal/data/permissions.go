@@ -9,6 +9,10 @@ import (
 
 type Permissions []string
 
+// ReadOnlyPermissions are the permissions that never allow a change, the
+// only ones a read-only token can exercise.
+var ReadOnlyPermissions = []string{"musics:read", "musics:bulk-read"}
+
 func (p Permissions) Include(code string) bool {
 	for i := range p {
 		if code == p[i] {
@@ -27,7 +31,8 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		  FROM permissions p
 		  INNER JOIN users_permissions up ON up.permission_id = p.id
 		  INNER JOIN users u ON up.user_id = u.id
-		  WHERE u.id = $1`
+		  WHERE u.id = $1
+		  ORDER BY p.code`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -53,9 +58,36 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// GetAll returns the codes of every permission there is.
+func (m PermissionModel) GetAll() ([]string, error) {
+	q := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// AddForUser grants codes to userID. Codes the user already holds are left
+// as they are.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	q := `INSERT INTO users_permissions
-		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		  ON CONFLICT DO NOTHING`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -63,3 +95,51 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, q, userID, pq.Array(codes))
 	return err
 }
+
+// RemoveForUserTx revokes codes from userID in tx. Codes the user doesn't
+// hold are ignored.
+func (m PermissionModel) RemoveForUserTx(tx *sql.Tx, userID int64, codes ...string) error {
+	q := `DELETE FROM users_permissions up
+		  USING permissions p
+		  WHERE up.permission_id = p.id AND up.user_id = $1 AND p.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, q, userID, pq.Array(codes))
+	return err
+}
+
+// CountOtherHoldersTx counts the users other than userID holding permission
+// code who aren't suspended, locking them and their grants until tx ends so
+// that two holders can't each see the other and both give up the
+// permission.
+func (m PermissionModel) CountOtherHoldersTx(tx *sql.Tx, code string, userID int64) (int, error) {
+	q := `SELECT up.user_id
+		  FROM users_permissions up
+		  INNER JOIN permissions p ON up.permission_id = p.id
+		  INNER JOIN users u ON up.user_id = u.id
+		  WHERE p.code = $1 AND NOT u.suspended
+		  FOR UPDATE OF up, u`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := tx.QueryContext(ctx, q, code)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var holder int64
+		if err := rows.Scan(&holder); err != nil {
+			return 0, err
+		}
+		if holder != userID {
+			count++
+		}
+	}
+	return count, rows.Err()
+}
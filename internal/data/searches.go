@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SavedSearch is a named query string for GET /musics that a user keeps to
+// run again later.
+type SavedSearch struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+}
+
+// ValidateSavedSearch checks the shape of s. The parameters in the query are
+// only validated when the search runs, so that a saved search going stale
+// fails loudly rather than being rejected up front.
+func ValidateSavedSearch(v *validator.Validator, s *SavedSearch) {
+	v.Check(s.Name != "", "name", validator.MsgRequired)
+	v.Check(len(s.Name) <= 200, "name", validator.MsgMaxBytes, 200)
+	v.Check(s.Query != "", "query", validator.MsgRequired)
+	v.Check(len(s.Query) <= 2000, "query", validator.MsgMaxBytes, 2000)
+
+	qs, err := url.ParseQuery(s.Query)
+	v.Check(err == nil, "query", validator.MsgInvalidQuery)
+	_, nested := qs["saved_search"]
+	v.Check(!nested, "query", validator.MsgNotSupported)
+}
+
+// NormalizeSavedSearchQuery trims s and the "?" it may be copied with.
+func NormalizeSavedSearchQuery(s string) string {
+	return strings.TrimPrefix(strings.TrimSpace(s), "?")
+}
+
+type SavedSearchModel struct {
+	DB *sql.DB
+}
+
+func (m SavedSearchModel) Insert(s *SavedSearch) error {
+	q := `INSERT INTO saved_searches (user_id, name, query)
+		  VALUES ($1, $2, $3)
+		  RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return translateError(m.DB.QueryRowContext(ctx, q, s.UserID, s.Name, s.Query).Scan(&s.ID, &s.CreatedAt))
+}
+
+// GetForUser returns the saved search id if it belongs to userID.
+func (m SavedSearchModel) GetForUser(id, userID int64) (*SavedSearch, error) {
+	q := `SELECT id, name, query, created_at, user_id
+		  FROM saved_searches
+		  WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s SavedSearch
+	err := m.DB.QueryRowContext(ctx, q, id, userID).Scan(&s.ID, &s.Name, &s.Query, &s.CreatedAt, &s.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// GetAllForUser lists the saved searches of userID.
+func (m SavedSearchModel) GetAllForUser(userID int64, filters Filters) ([]*SavedSearch, Metadata, error) {
+	q := fmt.Sprintf(`SELECT count(*) OVER(), id, name, query, created_at, user_id
+		  FROM saved_searches
+		  WHERE user_id = $1
+		  ORDER BY %s %s, id ASC
+		  LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	searches := []*SavedSearch{}
+	for rows.Next() {
+		var s SavedSearch
+		if err := rows.Scan(&totalRecords, &s.ID, &s.Name, &s.Query, &s.CreatedAt, &s.UserID); err != nil {
+			return nil, Metadata{}, err
+		}
+		searches = append(searches, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return searches, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// DeleteForUser deletes the saved search id if it belongs to userID.
+func (m SavedSearchModel) DeleteForUser(id, userID int64) error {
+	q := `DELETE FROM saved_searches
+		  WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
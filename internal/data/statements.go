@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// statements holds the prepared statements of the hot queries: Get, the
+// unfiltered GetAll page of each sort in MusicSortSafeList, and the token
+// lookup of authenticate. They are prepared once, by Models.Prepare, and
+// the set never grows, so the dynamic queries built from filters can't
+// crowd them out; any other query runs unprepared. database/sql takes care
+// of preparing each statement on the connections it ends up running on,
+// dropping it from connections that are closed or recycled, and
+// re-preparing on a fresh connection after a drop.
+type statements struct {
+	db    *sql.DB
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStatements(db *sql.DB) *statements {
+	return &statements{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// prepare prepares queries, keeping those already prepared. On error the
+// statements prepared so far are kept.
+func (s *statements) prepare(ctx context.Context, queries ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, query := range queries {
+		if _, ok := s.stmts[query]; ok {
+			continue
+		}
+		stmt, err := s.db.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		s.stmts[query] = stmt
+	}
+	return nil
+}
+
+func (s *statements) get(query string) *sql.Stmt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stmts[query]
+}
+
+// QueryContext runs query through its prepared statement, or as a plain
+// query if it has none.
+func (s *statements) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := s.get(query); stmt != nil {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+func (s *statements) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if stmt := s.get(query); stmt != nil {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return s.db.QueryRowContext(ctx, query, args...)
+}
+
+func (s *statements) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for query, stmt := range s.stmts {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.stmts, query)
+	}
+	return firstErr
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"github.com/SPA-Final/musicdb/internal/testdb"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetAllSorts(t *testing.T) {
+	m := newTestModels(t)
+
+	ms := []*Music{
+		{Title: "charlie", Duration: 200, Genres: []string{"pop"}, Popularity: 0.2},
+		{Title: "alpha", Duration: 180, Genres: []string{"pop"}, Popularity: 0.9},
+		{Title: "bravo", Duration: 200, Genres: []string{"pop"}, Popularity: 0.5},
+		{Title: "delta", Duration: 120, Genres: []string{"pop"}, Popularity: 0.5},
+	}
+	if err := m.Musics.InsertBatch(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records were inserted in one transaction, so they share
+	// created_at, and have no rank without a search: both sorts fall back
+	// to the id tie-breaker.
+	keys := map[string]func(mv *Music) float64{
+		"id":         func(mv *Music) float64 { return 0 },
+		"duration":   func(mv *Music) float64 { return float64(mv.Duration) },
+		"popularity": func(mv *Music) float64 { return float64(mv.Popularity) },
+		"created_at": func(mv *Music) float64 { return 0 },
+		"relevance":  func(mv *Music) float64 { return 0 },
+	}
+
+	for _, sortValue := range MusicSortSafeList {
+		t.Run(sortValue, func(t *testing.T) {
+			if m.stmts.get(unfilteredMusicsQuery(sortValue)) == nil {
+				t.Fatal("no prepared statement")
+			}
+
+			filters := Filters{Page: 1, PageSize: 10, Sort: sortValue, SortSafeList: MusicSortSafeList}
+			got, metadata, err := m.Musics.GetAll(MusicFilter{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.TotalRecords != len(ms) {
+				t.Errorf("got total %d; want %d", metadata.TotalRecords, len(ms))
+			}
+
+			column := strings.TrimPrefix(sortValue, "-")
+			desc := strings.HasPrefix(sortValue, "-")
+			want := append([]*Music(nil), ms...)
+			sort.SliceStable(want, func(i, j int) bool {
+				a, b := want[i], want[j]
+				var less, greater bool
+				if column == "title" {
+					less, greater = a.Title < b.Title, a.Title > b.Title
+				} else {
+					ka, kb := keys[column](a), keys[column](b)
+					less, greater = ka < kb, ka > kb
+				}
+				if desc {
+					less, greater = greater, less
+				}
+				if less || greater {
+					return less
+				}
+				return a.Id < b.Id
+			})
+			if len(got) != len(want) {
+				t.Fatalf("got %d records; want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Id != want[i].Id {
+					t.Errorf("record %d: got id %d; want %d", i, got[i].Id, want[i].Id)
+				}
+			}
+		})
+	}
+}
+
+func TestPreparedStatementsReconnect(t *testing.T) {
+	db := testdb.Open(t)
+	m := NewModels(db, 5*time.Second)
+	t.Cleanup(func() { m.Close() })
+	if err := m.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := insertTestMusics(t, m, 1)
+
+	// With no idle connections kept, every query runs on a fresh
+	// connection the statements have to be prepared on again.
+	db.SetMaxIdleConns(0)
+	for i := 0; i < 3; i++ {
+		got, err := m.Musics.Get(ms[0].Id)
+		if err != nil {
+			t.Fatalf("query %d: %v", i+1, err)
+		}
+		if got.Title != ms[0].Title {
+			t.Errorf("query %d: got title %q; want %q", i+1, got.Title, ms[0].Title)
+		}
+	}
+}
+
+// BenchmarkGet compares Get run as a prepared statement with the same query
+// parsed and planned on every call.
+func BenchmarkGet(b *testing.B) {
+	db := testdb.Open(b)
+	prepared := NewModels(db, 5*time.Second)
+	b.Cleanup(func() { prepared.Close() })
+	if err := prepared.Prepare(); err != nil {
+		b.Fatal(err)
+	}
+
+	mv := &Music{Title: "Song", Duration: 180, Genres: []string{"pop"}, Popularity: 0.5}
+	if err := prepared.Musics.Insert(mv); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name   string
+		models Models
+	}{
+		{"unprepared", NewModels(db, 5*time.Second)},
+		{"prepared", prepared},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.models.Musics.Get(mv.Id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
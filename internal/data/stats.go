@@ -0,0 +1,107 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// GenreCount is the number of records tagged with a genre.
+type GenreCount struct {
+	Genre string `json:"genre"`
+	Count int    `json:"count"`
+}
+
+// Stats summarises the whole catalogue.
+type Stats struct {
+	TotalRecords      int          `json:"total_records"`
+	TotalDuration     int64        `json:"total_duration"`
+	AverageDuration   float64      `json:"average_duration"`
+	AveragePopularity float64      `json:"average_popularity"`
+	AddedLast7Days    int          `json:"added_last_7_days"`
+	AddedLast30Days   int          `json:"added_last_30_days"`
+	TopGenres         []GenreCount `json:"top_genres"`
+}
+
+// statsTopGenres caps the per-genre breakdown of Stats.
+const statsTopGenres = 20
+
+// Stats computes the catalogue statistics in a single query.
+func (m MusicsModel) Stats() (*Stats, error) {
+	q := `SELECT count(*), coalesce(sum(duration), 0), coalesce(avg(duration), 0), coalesce(avg(popularity), 0),
+		      count(*) FILTER (WHERE created_at > NOW() - interval '7 days'),
+		      count(*) FILTER (WHERE created_at > NOW() - interval '30 days'),
+		      (SELECT coalesce(json_agg(g), '[]')
+		       FROM (SELECT genre, count(*) AS count
+		             FROM musics, unnest(genres) AS genre
+		             GROUP BY genre
+		             ORDER BY count DESC, genre
+		             LIMIT $1) g)
+		  FROM musics`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stats Stats
+	var genres []byte
+	err := m.DB.QueryRowContext(ctx, q, statsTopGenres).Scan(
+		&stats.TotalRecords,
+		&stats.TotalDuration,
+		&stats.AverageDuration,
+		&stats.AveragePopularity,
+		&stats.AddedLast7Days,
+		&stats.AddedLast30Days,
+		&genres,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(genres, &stats.TopGenres); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// HistogramBucket counts the records whose duration lies in [Min, Max).
+type HistogramBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+// DurationHistogram counts the records matching filter per duration bucket of
+// width seconds. Every bucket between the shortest and the longest matching
+// record is returned, empty ones with a zero count.
+func (m MusicsModel) DurationHistogram(filter MusicFilter, width int) ([]HistogramBucket, error) {
+	args := []interface{}{width}
+	q := `WITH counts AS (
+		      SELECT duration / $1 AS bucket, count(*) AS count
+		      FROM musics
+		      WHERE ` + filter.where(&args) + `
+		      GROUP BY 1
+		  )
+		  SELECT s.bucket, coalesce(counts.count, 0)
+		  FROM generate_series((SELECT min(bucket) FROM counts), (SELECT max(bucket) FROM counts)) AS s(bucket)
+		  LEFT JOIN counts ON counts.bucket = s.bucket
+		  ORDER BY s.bucket`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	buckets := []HistogramBucket{}
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, timeoutError(ctx, err)
+		}
+		buckets = append(buckets, HistogramBucket{Min: bucket * width, Max: (bucket + 1) * width, Count: count})
+	}
+	return buckets, timeoutError(ctx, rows.Err())
+}
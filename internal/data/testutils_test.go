@@ -0,0 +1,34 @@
+package data
+
+import (
+	"github.com/SPA-Final/musicdb/internal/testdb"
+	"testing"
+	"time"
+)
+
+// newTestModels returns models backed by a migrated test database, with
+// their statements prepared, skipping t when there is none.
+func newTestModels(t *testing.T) Models {
+	t.Helper()
+
+	m := NewModels(testdb.Open(t), 5*time.Second)
+	t.Cleanup(func() { m.Close() })
+	if err := m.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// insertTestUser adds an activated user with password "pa55word".
+func insertTestUser(t *testing.T, m Models, email string) *User {
+	t.Helper()
+
+	user := &User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
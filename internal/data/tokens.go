@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"github.com/SPA-Final/musicdb/internal/validator"
 	"time"
 )
@@ -13,14 +14,49 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeProbe          = "probe"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	// ScopeRefreshRotated marks a refresh token that has been exchanged. It
+	// can't be used again; it's kept until it expires so that a second use
+	// is noticed.
+	ScopeRefreshRotated = "refresh-rotated"
 )
 
+// ErrTokenReused is returned when a refresh token is presented after it was
+// exchanged, a sign that it leaked; its family has then been revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// Family groups a refresh token with the tokens it was issued with and
+	// those later exchanged for it.
+	Family string `json:"-"`
+	// UserAgent and IP are those of the client the token was issued to.
+	UserAgent string `json:"-"`
+	IP        string `json:"-"`
+	// ReadOnly restricts an authentication token, and the refresh tokens of
+	// its family, to the ReadOnlyPermissions of its user.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// Session describes an authentication token of a user, without the token
+// itself.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	ReadOnly   bool       `json:"read_only"`
+	// Current is set on the session of the request listing them.
+	Current bool `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -30,27 +66,35 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		Scope:  scope,
 	}
 
-	randomBytes := make([]byte, 16)
-	_, err := rand.Read(randomBytes)
+	var err error
+	token.Plaintext, err = randomPlaintext()
 	if err != nil {
 		return nil, err
 	}
 
-	// example token: Y3QMGX3PJ3WLRL2YRTQGQ6KRHU
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-
 	hash := sha256.Sum256([]byte(token.Plaintext))
 	token.Hash = hash[:]
 	return token, nil
 }
 
+// randomPlaintext returns 16 random bytes in base32, such as
+// Y3QMGX3PJ3WLRL2YRTQGQ6KRHU.
+func randomPlaintext() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 type TokenModel struct {
 	DB *sql.DB
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", validator.MsgRequired)
+	v.Check(len(tokenPlaintext) == 26, "token", validator.MsgExactBytes, 26)
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -64,24 +108,306 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 }
 
 func (m TokenModel) Insert(token *Token) error {
-	q := `INSERT INTO tokens (hash, user_id, expiry, scope)
-		  VALUES ($1, $2, $3, $4)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, q querier, token *Token) error {
+	stmt := `INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip, read_only)
+		  VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.UserAgent, token.IP, token.ReadOnly}
+	_, err := q.ExecContext(ctx, stmt, args...)
+	return err
+}
+
+// NewPair issues userID an authentication token and a refresh token for it,
+// in a new family, recording the client they were issued to. readOnly
+// restricts them to the user's ReadOnlyPermissions.
+func (m TokenModel) NewPair(userID int64, authTTL, refreshTTL time.Duration, userAgent, ip string, readOnly bool) (*Token, *Token, error) {
+	family, err := randomPlaintext()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, q, args...)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	auth, refresh, err := newPairTx(ctx, tx, userID, family, authTTL, refreshTTL, userAgent, ip, readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth, refresh, tx.Commit()
+}
+
+func newPairTx(ctx context.Context, tx *sql.Tx, userID int64, family string, authTTL, refreshTTL time.Duration, userAgent, ip string, readOnly bool) (*Token, *Token, error) {
+	auth, err := generateToken(userID, authTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*Token{auth, refresh} {
+		token.Family, token.UserAgent, token.IP, token.ReadOnly = family, userAgent, ip, readOnly
+		if err := insertToken(ctx, tx, token); err != nil {
+			return nil, nil, err
+		}
+	}
+	return auth, refresh, nil
+}
+
+// Rotate exchanges the refresh token with plaintext for a new
+// authentication and refresh token in its family. The refresh token is
+// marked rotated, and presenting it again revokes the whole family and
+// returns ErrTokenReused. An unknown or expired token is ErrRecordNotFound.
+// The new tokens record the client they were issued to, and are read-only
+// if the refresh token was.
+func (m TokenModel) Rotate(tokenPlaintext string, authTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	q := `SELECT user_id, scope, family, read_only
+		  FROM tokens
+		  WHERE hash = $1 AND scope IN ($2, $3) AND expiry > NOW()
+		  FOR UPDATE`
+
+	var userID int64
+	var scope string
+	var family sql.NullString
+	var readOnly bool
+	err = tx.QueryRowContext(ctx, q, hash[:], ScopeRefresh, ScopeRefreshRotated).Scan(&userID, &scope, &family, &readOnly)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if scope == ScopeRefreshRotated {
+		if err := deleteFamily(ctx, tx, family.String); err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET scope = $2 WHERE hash = $1`, hash[:], ScopeRefreshRotated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auth, refresh, err := newPairTx(ctx, tx, userID, family.String, authTTL, refreshTTL, userAgent, ip, readOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth, refresh, tx.Commit()
+}
+
+// DeleteFamily deletes the tokens of family, revoking the session they
+// belong to.
+func (m TokenModel) DeleteFamily(family string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return deleteFamily(ctx, m.DB, family)
+}
+
+func deleteFamily(ctx context.Context, q querier, family string) error {
+	if family == "" {
+		return nil
+	}
+	_, err := q.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+	return err
+}
+
+// GetExpiry returns when the token in scope with plaintext expires.
+func (m TokenModel) GetExpiry(scope, tokenPlaintext string) (time.Time, error) {
+	q := `SELECT expiry
+		  FROM tokens
+		  WHERE hash = $1 AND scope = $2`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expiry time.Time
+	err := m.DB.QueryRowContext(ctx, q, hash[:], scope).Scan(&expiry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrRecordNotFound
+	}
+	return expiry, err
+}
+
+// DeleteByPlaintextForUser deletes the token of userID in scope with
+// plaintext. The refresh tokens of its family go with it, so the session it
+// belongs to can't be renewed either.
+func (m TokenModel) DeleteByPlaintextForUser(scope, tokenPlaintext string, userID int64) error {
+	q := `WITH deleted AS (
+			  DELETE FROM tokens
+			  WHERE hash = $1 AND scope = $2 AND user_id = $3
+			  RETURNING family
+		  )
+		  DELETE FROM tokens
+		  WHERE scope IN ($4, $5) AND family IN (SELECT family FROM deleted)`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, q, hash[:], scope, userID, ScopeRefresh, ScopeRefreshRotated)
+	return err
+}
+
+// DeleteSessions deletes the authentication and refresh tokens of userID,
+// ending its sessions, except for the authentication token with plaintext
+// keep and the refresh tokens of its family. An empty keep ends them all.
+func (m TokenModel) DeleteSessions(userID int64, keep string) error {
+	return deleteSessions(m.DB, userID, keep)
+}
+
+// DeleteSessionsTx is DeleteSessions in tx.
+func (m TokenModel) DeleteSessionsTx(tx *sql.Tx, userID int64, keep string) error {
+	return deleteSessions(tx, userID, keep)
+}
+
+func deleteSessions(db querier, userID int64, keep string) error {
+	q := `DELETE FROM tokens
+		  WHERE user_id = $1 AND scope IN ($3, $4, $5) AND hash <> $2
+		  AND NOT (scope <> $3 AND family IS NOT NULL AND family = COALESCE((SELECT family FROM tokens WHERE hash = $2), ''))`
+
+	hash := sha256.Sum256([]byte(keep))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, q, userID, hash[:], ScopeAuthentication, ScopeRefresh, ScopeRefreshRotated)
 	return err
 }
 
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	return deleteAllForUser(m.DB, scope, userID)
+}
+
+// DeleteAllForUserTx is DeleteAllForUser in tx.
+func (m TokenModel) DeleteAllForUserTx(tx *sql.Tx, scope string, userID int64) error {
+	return deleteAllForUser(tx, scope, userID)
+}
+
+// DeleteEveryScopeForUserTx deletes all the tokens of userID, whatever their
+// scope, in tx.
+func (m TokenModel) DeleteEveryScopeForUserTx(tx *sql.Tx, userID int64) error {
+	q := `DELETE FROM tokens
+		  WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, q, userID)
+	return err
+}
+
+func deleteAllForUser(db querier, scope string, userID int64) error {
 	q := `DELETE FROM tokens
 		  WHERE scope = $1 AND user_id = $2`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, q, scope, userID)
+	_, err := db.ExecContext(ctx, q, scope, userID)
+	return err
+}
+
+// GetSessions lists the unexpired authentication tokens of userID, newest
+// first, marking the one with plaintext current.
+func (m TokenModel) GetSessions(userID int64, current string) ([]*Session, error) {
+	q := `SELECT id, created_at, expiry, last_used_at, user_agent, ip, read_only, hash = $3
+		  FROM tokens
+		  WHERE user_id = $1 AND scope = $2 AND expiry > NOW()
+		  ORDER BY created_at DESC, id DESC`
+
+	hash := sha256.Sum256([]byte(current))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, userID, ScopeAuthentication, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.CreatedAt, &s.Expiry, &s.LastUsedAt, &s.UserAgent, &s.IP, &s.ReadOnly, &s.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession deletes authentication token id of userID, with the refresh
+// tokens of its family, returning ErrRecordNotFound if there's no such
+// token.
+func (m TokenModel) DeleteSession(userID, id int64) error {
+	q := `WITH deleted AS (
+			  DELETE FROM tokens
+			  WHERE id = $1 AND user_id = $2 AND scope = $3
+			  RETURNING family
+		  ), refresh AS (
+			  DELETE FROM tokens
+			  WHERE scope IN ($4, $5) AND family IN (SELECT family FROM deleted)
+		  )
+		  SELECT count(*) FROM deleted`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deleted int
+	err := m.DB.QueryRowContext(ctx, q, id, userID, ScopeAuthentication, ScopeRefresh, ScopeRefreshRotated).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Touch records that the token with plaintext was just used. The write is
+// skipped if it was already recorded less than a minute ago.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	q := `UPDATE tokens
+		  SET last_used_at = NOW()
+		  WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, q, hash[:])
 	return err
 }
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenRotate(t *testing.T) {
+	m := newTestModels(t)
+	user := insertTestUser(t, m, "rotate@example.com")
+
+	auth, refresh, err := m.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "first", "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAuth, newRefresh, err := m.Tokens.Rotate(refresh.Plaintext, time.Hour, 2*time.Hour, "second", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAuth.Family != refresh.Family || newRefresh.Family != refresh.Family {
+		t.Errorf("got families %q and %q; want %q", newAuth.Family, newRefresh.Family, refresh.Family)
+	}
+	if newAuth.UserAgent != "second" || newAuth.IP != "192.0.2.2" {
+		t.Errorf("got client %q, %q; want the one rotating", newAuth.UserAgent, newAuth.IP)
+	}
+	for _, plaintext := range []string{auth.Plaintext, newAuth.Plaintext} {
+		if _, err := m.Users.GetForToken(ScopeAuthentication, plaintext); err != nil {
+			t.Errorf("authentication token: got %v; want it to stay valid", err)
+		}
+	}
+
+	// The new refresh token rotates in turn.
+	latestAuth, latestRefresh, err := m.Tokens.Rotate(newRefresh.Plaintext, time.Hour, 2*time.Hour, "third", "192.0.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Presenting the first refresh token again revokes everything issued
+	// since the sign-in.
+	_, _, err = m.Tokens.Rotate(refresh.Plaintext, time.Hour, 2*time.Hour, "thief", "203.0.113.1")
+	if !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("reuse: got %v; want ErrTokenReused", err)
+	}
+	var left int
+	if err := m.Tokens.DB.QueryRow(`SELECT count(*) FROM tokens WHERE family = $1`, refresh.Family).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("got %d tokens left in the family; want 0", left)
+	}
+	for _, plaintext := range []string{auth.Plaintext, newAuth.Plaintext, latestAuth.Plaintext} {
+		if _, err := m.Users.GetForToken(ScopeAuthentication, plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("revoked authentication token: got %v; want ErrRecordNotFound", err)
+		}
+	}
+	if _, _, err := m.Tokens.Rotate(latestRefresh.Plaintext, time.Hour, 2*time.Hour, "third", "192.0.2.3"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoked refresh token: got %v; want ErrRecordNotFound", err)
+	}
+}
+
+func TestTokenRotateExpired(t *testing.T) {
+	m := newTestModels(t)
+	user := insertTestUser(t, m, "expired@example.com")
+
+	_, refresh, err := m.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Tokens.DB.Exec(`UPDATE tokens SET expiry = NOW() - INTERVAL '1 second' WHERE hash = $1`, refresh.Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.Tokens.Rotate(refresh.Plaintext, time.Hour, 2*time.Hour, "test", "192.0.2.1"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got %v; want ErrRecordNotFound", err)
+	}
+}
+
+func TestTokenRotateReadOnly(t *testing.T) {
+	m := newTestModels(t)
+	user := insertTestUser(t, m, "readonly@example.com")
+
+	_, refresh, err := m.Tokens.NewPair(user.ID, time.Hour, 2*time.Hour, "test", "192.0.2.1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, newRefresh, err := m.Tokens.Rotate(refresh.Plaintext, time.Hour, 2*time.Hour, "test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.ReadOnly || !newRefresh.ReadOnly {
+		t.Errorf("got read-only %t and %t; want both read-only", auth.ReadOnly, newRefresh.ReadOnly)
+	}
+
+	_, readOnly, err := m.Users.GetForAuthenticationToken(auth.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readOnly {
+		t.Error("the stored authentication token isn't read-only")
+	}
+}
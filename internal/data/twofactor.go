@@ -0,0 +1,194 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is how many recovery codes enabling two-factor
+// authentication issues.
+const RecoveryCodeCount = 10
+
+// ErrTwoFactorEnabled is returned when setting up two-factor authentication
+// for a user who already has it enabled.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+
+// TwoFactor is the two-factor authentication state of a user. Secret is the
+// TOTP secret as sealed with the server's key. Until Enabled is set it is
+// pending, waiting for the user to confirm a code from it.
+type TwoFactor struct {
+	UserID   int64
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the two-factor state of userID, ErrRecordNotFound if they
+// have never set it up.
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	q := `SELECT user_id, secret, enabled, last_step
+		  FROM two_factor
+		  WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+	err := m.DB.QueryRowContext(ctx, q, userID).Scan(&tf.UserID, &tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &tf, nil
+}
+
+// Begin stores the sealed secret as userID's pending one, replacing any
+// earlier pending secret. It returns ErrTwoFactorEnabled if two-factor
+// authentication is already enabled.
+func (m TwoFactorModel) Begin(userID int64, secret []byte) error {
+	q := `INSERT INTO two_factor (user_id, secret)
+		  VALUES ($1, $2)
+		  ON CONFLICT (user_id) DO UPDATE
+		  SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+		  WHERE NOT two_factor.enabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, userID, secret)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// Enable enables the pending two-factor authentication of userID, which
+// was confirmed with the code of step, and returns a fresh set of recovery
+// codes. Only their hashes are kept. It returns ErrTwoFactorEnabled if it
+// was enabled in the meantime.
+func (m TwoFactorModel) Enable(userID, step int64) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256([]byte(NormalizeRecoveryCode(code)))
+		codes[i], hashes[i] = code, hash[:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE two_factor
+		  SET enabled = true, last_step = $2
+		  WHERE user_id = $1 AND NOT enabled`
+
+	result, err := tx.ExecContext(ctx, q, userID, step)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM two_factor_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	q = `INSERT INTO two_factor_recovery_codes (user_id, hash)
+		 SELECT $1, unnest($2::bytea[])`
+	if _, err := tx.ExecContext(ctx, q, userID, pq.ByteaArray(hashes)); err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseStep records that userID signed in with the code of step, reporting
+// false if a code of that step or a later one has been used already, which
+// makes every code single use.
+func (m TwoFactorModel) UseStep(userID, step int64) (bool, error) {
+	q := `UPDATE two_factor
+		  SET last_step = $2
+		  WHERE user_id = $1 AND enabled AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// UseRecoveryCode consumes recovery code of userID, reporting false if it
+// isn't one of theirs or has been used already.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	hash := sha256.Sum256([]byte(NormalizeRecoveryCode(code)))
+
+	q := `DELETE FROM two_factor_recovery_codes
+		  WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, userID, hash[:])
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// NormalizeRecoveryCode lower-cases code and drops the hyphen and any
+// spaces, so it can be typed as it was shown or not.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// generateRecoveryCode returns ten random base32 characters, shown as two
+// groups of five.
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 7)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
@@ -0,0 +1,66 @@
+package data
+
+import "testing"
+
+func TestTwoFactorUseStep(t *testing.T) {
+	m := newTestModels(t)
+	user := insertTestUser(t, m, "totp@example.com")
+
+	if err := m.TwoFactor.Begin(user.ID, []byte("sealed")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := m.TwoFactor.UseStep(user.ID, 101); err != nil || ok {
+		t.Fatalf("pending: got %t, %v; want false, nil", ok, err)
+	}
+
+	if _, err := m.TwoFactor.Enable(user.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		step int64
+		want bool
+	}{
+		{"step confirmed with", 100, false},
+		{"next step", 101, true},
+		{"replayed step", 101, false},
+		{"earlier step", 100, false},
+		{"later step", 103, true},
+	}
+	for _, tt := range tests {
+		ok, err := m.TwoFactor.UseStep(user.ID, tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestTwoFactorUseRecoveryCode(t *testing.T) {
+	m := newTestModels(t)
+	user := insertTestUser(t, m, "recovery@example.com")
+
+	if err := m.TwoFactor.Begin(user.ID, []byte("sealed")); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := m.TwoFactor.Enable(user.ID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) == 0 {
+		t.Fatal("no recovery codes")
+	}
+
+	if ok, err := m.TwoFactor.UseRecoveryCode(user.ID, codes[0]); err != nil || !ok {
+		t.Fatalf("first use: got %t, %v; want true, nil", ok, err)
+	}
+	if ok, err := m.TwoFactor.UseRecoveryCode(user.ID, codes[0]); err != nil || ok {
+		t.Errorf("reuse: got %t, %v; want false, nil", ok, err)
+	}
+	if ok, err := m.TwoFactor.UseRecoveryCode(user.ID, "not-a-code"); err != nil || ok {
+		t.Errorf("unknown code: got %t, %v; want false, nil", ok, err)
+	}
+}
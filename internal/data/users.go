@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/SPA-Final/musicdb/internal/validator"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
@@ -22,29 +24,49 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// PendingEmail is the address the user asked to change to, until they
+	// confirm it with the token mailed there.
+	PendingEmail string `json:"pending_email,omitempty"`
+	// Suspended is set by an admin to lock the user out, whether or not
+	// they have activated their account.
+	Suspended bool `json:"suspended"`
+	Version   int  `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// NormalizeEmail lower-cases email, the form emails are stored and looked up
+// in, so "Alice@Example.com" and "alice@example.com" are the same user.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	v.Check(email != "", "email", validator.MsgRequired)
+	v.Check(validator.Matches(email, validator.EmailRX), "email", validator.MsgInvalidEmail)
 }
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(password != "", "password", validator.MsgRequired)
+	v.Check(len(password) >= 8, "password", validator.MsgMinBytes, 8)
+	v.Check(len(password) <= 72, "password", validator.MsgMaxBytes, 72)
+}
+
+// ValidateNewPassword is ValidatePasswordPlaintext for a password being set,
+// which mustn't be a common one either. Passwords given to sign in aren't
+// held to that, so that existing accounts keep working.
+func ValidateNewPassword(v *validator.Validator, password string) {
+	ValidatePasswordPlaintext(v, password)
+	v.Check(validator.NotCommonPassword(password), "password", validator.MsgCommonPassword)
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(user.Name != "", "name", validator.MsgRequired)
+	v.Check(len(user.Name) <= 500, "name", validator.MsgMaxBytes, 500)
 	ValidateEmail(v, user.Email)
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext)
 	}
 
 	if user.Password.hash == nil {
@@ -52,8 +74,44 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
+// UserFilter selects the users GetAll lists. Empty fields and nil bounds
+// don't narrow the selection.
+type UserFilter struct {
+	// Email matches the users whose address contains it, ignoring case.
+	Email         string
+	Activated     *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+func ValidateUserFilter(v *validator.Validator, f UserFilter) {
+	v.Check(len(f.Email) <= 500, "email", validator.MsgMaxBytes, 500)
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(!f.CreatedBefore.Before(*f.CreatedAfter), "created_before", validator.MsgMinValue, "created_after")
+	}
+}
+
+// where returns the SQL condition for f, appending its arguments to args.
+func (f UserFilter) where(args *[]interface{}) string {
+	clauses := []string{"true"}
+	if f.Email != "" {
+		clauses = append(clauses, "strpos(lower(email::text), lower("+placeholder(args, f.Email)+")) > 0")
+	}
+	if f.Activated != nil {
+		clauses = append(clauses, "activated = "+placeholder(args, *f.Activated))
+	}
+	if f.CreatedAfter != nil {
+		clauses = append(clauses, "created_at >= "+placeholder(args, *f.CreatedAfter))
+	}
+	if f.CreatedBefore != nil {
+		clauses = append(clauses, "created_at < "+placeholder(args, *f.CreatedBefore))
+	}
+	return strings.Join(clauses, " AND ")
+}
+
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	stmts *statements
 }
 
 func (m UserModel) Insert(user *User) error {
@@ -65,10 +123,10 @@ func (m UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, q, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := translateError(m.DB.QueryRowContext(ctx, q, args...).Scan(&user.ID, &user.CreatedAt, &user.Version))
 	if err != nil {
 		switch {
-		case err.Error() == `pq: повторяющееся значение ключа нарушает ограничение уникальности "users_email_key"`:
+		case isConstraint(err, "users_email_key"), isConstraint(err, "users_email_lower_key"):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -77,10 +135,94 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Get returns user id.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	q := `SELECT id, created_at, name, email, password_hash, activated, pending_email, suspended, version
+		  FROM users
+		  WHERE id = $1`
+
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, q, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.PendingEmail,
+		&user.Suspended,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAll lists the users matching filter. The password hashes are left out.
+func (m UserModel) GetAll(filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	var args []interface{}
+	where := filter.where(&args)
+
+	q := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, name, email, activated, pending_email, suspended, version
+		  FROM users
+		  WHERE %s
+		  ORDER BY %s %s, id ASC
+		  LIMIT %s OFFSET %s`, where, filters.sortColumn(), filters.sortDirection(),
+		placeholder(&args, filters.limit()), placeholder(&args, filters.offset()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.PendingEmail,
+			&user.Suspended,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
-	q := `SELECT id, created_at, name, email, password_hash, activated, version
+	q := `SELECT id, created_at, name, email, password_hash, activated, pending_email, suspended, version
 		  FROM users
-		  WHERE email = $1`
+		  WHERE lower(email::text) = lower($1)`
 
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -93,6 +235,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.PendingEmail,
+		&user.Suspended,
 		&user.Version,
 	)
 	if err != nil {
@@ -107,9 +251,24 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 func (m UserModel) Update(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return updateUser(ctx, m.DB, user)
+}
+
+// UpdateTx is Update in tx.
+func (m UserModel) UpdateTx(tx *sql.Tx, user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return updateUser(ctx, tx, user)
+}
+
+func updateUser(ctx context.Context, db querier, user *User) error {
 	q := `UPDATE users
-		  SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		  WHERE id = $5 AND version = $6
+		  SET name = $1, email = $2, password_hash = $3, activated = $4, pending_email = $5, suspended = $6, version = version + 1
+		  WHERE id = $7 AND version = $8
 		  RETURNING version`
 
 	args := []interface{}{
@@ -117,16 +276,16 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.PendingEmail,
+		user.Suspended,
 		user.ID,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, q, args...).Scan(&user.Version)
+	err := translateError(db.QueryRowContext(ctx, q, args...).Scan(&user.Version))
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isConstraint(err, "users_email_key"), isConstraint(err, "users_email_lower_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -138,9 +297,19 @@ func (m UserModel) Update(user *User) error {
 }
 
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	user, _, err := m.getForToken(tokenScope, tokenPlaintext)
+	return user, err
+}
 
-	q := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.version
+// GetForAuthenticationToken returns the user of an authentication token and
+// whether the token is read-only.
+func (m UserModel) GetForAuthenticationToken(tokenPlaintext string) (*User, bool, error) {
+	return m.getForToken(ScopeAuthentication, tokenPlaintext)
+}
+
+// userForTokenQuery looks up the user of a token; it's one of the prepared
+// statements.
+const userForTokenQuery = `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.pending_email, u.suspended, u.version, tokens.read_only
 		  FROM users u
 		  INNER JOIN tokens
 		  ON u.id = tokens.user_id
@@ -148,30 +317,37 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		  AND tokens.scope = $2
 		  AND tokens.expiry > $3`
 
+func (m UserModel) getForToken(tokenScope, tokenPlaintext string) (*User, bool, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
+	var readOnly bool
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, q, args...).Scan(
+	err := m.stmts.QueryRowContext(ctx, userForTokenQuery, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.PendingEmail,
+		&user.Suspended,
 		&user.Version,
+		&readOnly,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, false, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, false, err
 		}
 	}
 
-	return &user, nil
+	return &user, readOnly, nil
 }
 
 type password struct {
@@ -201,3 +377,33 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	}
 	return true, nil
 }
+
+// DeleteWithDependencies deletes user userID in tx, after the rows that
+// depend on it: tokens, permissions, idempotency keys, saved searches and
+// enrichment jobs. Exports and imports have files as well as rows, so their
+// models delete them, with ExportModel.DeleteAllForUserTx and
+// ImportModel.DeleteAllForUserTx, before this is called; the foreign keys
+// cascade to any that are left.
+func (m UserModel) DeleteWithDependencies(tx *sql.Tx, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, table := range []string{"tokens", "users_permissions", "idempotency_keys", "saved_searches", "enrichment_jobs"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonKeys returns every object key in the JSON document js, at any depth.
+func jsonKeys(t *testing.T, js []byte) []string {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal(js, &v); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				keys = append(keys, key)
+				walk(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		}
+	}
+	walk(v)
+	return keys
+}
+
+func TestUserJSONOmitsPassword(t *testing.T) {
+	user := &User{ID: 1, CreatedAt: time.Now(), Name: "Alice", Email: "alice@example.com", Activated: true}
+	if err := user.Password.Set("correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []interface{}{user, *user, []*User{user}, map[string]interface{}{"user": user}} {
+		js, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range jsonKeys(t, js) {
+			if k := strings.ToLower(key); strings.Contains(k, "password") || strings.Contains(k, "hash") {
+				t.Errorf("got key %q in %s", key, js)
+			}
+		}
+		if strings.Contains(string(js), string(user.Password.hash)) || strings.Contains(string(js), "correct horse") {
+			t.Errorf("got the password in %s", js)
+		}
+	}
+}
+
+func TestUserEmailIgnoresCase(t *testing.T) {
+	m := newTestModels(t)
+	// Insert stores the address as given; the handlers normalize it first.
+	user := insertTestUser(t, m, "Bob@Example.com")
+
+	for _, email := range []string{"bob@example.com", "BOB@EXAMPLE.COM", "Bob@Example.com"} {
+		got, err := m.Users.GetByEmail(email)
+		if err != nil {
+			t.Errorf("%s: got %v; want the user", email, err)
+			continue
+		}
+		if got.ID != user.ID {
+			t.Errorf("%s: got user %d; want %d", email, got.ID, user.ID)
+		}
+	}
+
+	other := &User{Name: "Other", Email: "bob@EXAMPLE.com"}
+	if err := other.Password.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Users.Insert(other); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("same address in another case: got %v; want ErrDuplicateEmail", err)
+	}
+}
@@ -0,0 +1,257 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/validator"
+	"github.com/lib/pq"
+	"net/url"
+	"time"
+)
+
+// Events a webhook can subscribe to.
+const (
+	EventMusicCreated = "music.created"
+	EventMusicUpdated = "music.updated"
+	EventMusicDeleted = "music.deleted"
+)
+
+// WebhookEvents lists every event a webhook can subscribe to.
+var WebhookEvents = []string{EventMusicCreated, EventMusicUpdated, EventMusicDeleted}
+
+// Webhook is an endpoint that is sent the events it subscribes to. The
+// secret signs the deliveries and is never shown again once set.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int32     `json:"version"`
+}
+
+// WebhookDelivery records one attempt at delivering an event to a webhook.
+type WebhookDelivery struct {
+	ID         int64     `json:"id"`
+	WebhookID  int64     `json:"webhook_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode *int      `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+	DurationMS int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func ValidateWebhook(v *validator.Validator, w *Webhook) {
+	v.Check(w.URL != "", "url", validator.MsgRequired)
+	v.Check(len(w.URL) <= 2000, "url", validator.MsgMaxBytes, 2000)
+	u, err := url.Parse(w.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", validator.MsgURL)
+
+	v.Check(len(w.Secret) >= 16, "secret", validator.MsgMinBytes, 16)
+	v.Check(len(w.Secret) <= 200, "secret", validator.MsgMaxBytes, 200)
+
+	v.Check(len(w.Events) != 0, "events", validator.MsgRequired)
+	v.Check(validator.Unique(w.Events), "events", validator.MsgDuplicateValues)
+	for _, event := range w.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", validator.MsgOneOf, "music.created, music.updated, music.deleted")
+	}
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+const webhookColumns = "id, url, secret, events, active, created_at, version"
+
+func scanWebhook(s interface{ Scan(...interface{}) error }, leading ...interface{}) (*Webhook, error) {
+	var w Webhook
+	dest := append(leading, &w.ID, &w.URL, &w.Secret, pq.Array(&w.Events), &w.Active, &w.CreatedAt, &w.Version)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (m WebhookModel) Insert(w *Webhook) error {
+	q := `INSERT INTO webhooks (url, secret, events, active)
+		  VALUES ($1, $2, $3, $4)
+		  RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, q, w.URL, w.Secret, pq.Array(w.Events), w.Active).Scan(&w.ID, &w.CreatedAt, &w.Version)
+}
+
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	q := `SELECT ` + webhookColumns + `
+		  FROM webhooks
+		  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w, err := scanWebhook(m.DB.QueryRowContext(ctx, q, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (m WebhookModel) GetAll(filters Filters) ([]*Webhook, Metadata, error) {
+	q := fmt.Sprintf(`SELECT count(*) OVER(), %s
+		  FROM webhooks
+		  ORDER BY %s %s, id ASC
+		  LIMIT $1 OFFSET $2`, webhookColumns, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return webhooks, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// GetActiveForEvent returns the active webhooks subscribed to event.
+func (m WebhookModel) GetActiveForEvent(event string) ([]*Webhook, error) {
+	q := `SELECT ` + webhookColumns + `
+		  FROM webhooks
+		  WHERE active AND $1 = ANY(events)
+		  ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (m WebhookModel) Update(w *Webhook) error {
+	q := `UPDATE webhooks
+		  SET url = $2, secret = $3, events = $4, active = $5, version = version + 1
+		  WHERE id = $1 AND version = $6
+		  RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, q, w.ID, w.URL, w.Secret, pq.Array(w.Events), w.Active, w.Version).Scan(&w.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m WebhookModel) Delete(id int64) error {
+	q := `DELETE FROM webhooks
+		  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, q, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m WebhookModel) InsertDelivery(d *WebhookDelivery) error {
+	q := `INSERT INTO webhook_deliveries (webhook_id, event, attempt, status_code, error, succeeded, duration_ms)
+		  VALUES ($1, $2, $3, $4, $5, $6, $7)
+		  RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{d.WebhookID, d.Event, d.Attempt, d.StatusCode, d.Error, d.Succeeded, d.DurationMS}
+	return m.DB.QueryRowContext(ctx, q, args...).Scan(&d.ID, &d.CreatedAt)
+}
+
+// GetDeliveries lists the delivery attempts of webhook id, newest first.
+func (m WebhookModel) GetDeliveries(id int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	q := `SELECT count(*) OVER(), id, webhook_id, event, attempt, status_code, error, succeeded, duration_ms, created_at
+		  FROM webhook_deliveries
+		  WHERE webhook_id = $1
+		  ORDER BY id DESC
+		  LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, q, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&totalRecords, &d.ID, &d.WebhookID, &d.Event, &d.Attempt, &d.StatusCode,
+			&d.Error, &d.Succeeded, &d.DurationMS, &d.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
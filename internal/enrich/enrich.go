@@ -0,0 +1,155 @@
+// Package enrich fills in the metadata music records are missing from
+// external catalogues. A Source looks a record up; Apply copies what it
+// found onto the record.
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/SPA-Final/musicdb/internal/data"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrNoMatch is returned by Source.Lookup when the catalogue has no track
+// for the query.
+var ErrNoMatch = errors.New("enrich: no matching track")
+
+// maxGenres is the most genres a record may carry, as ValidateMovie allows.
+const maxGenres = 5
+
+// Query identifies the track to look up. An ISRC, when known, names the
+// recording exactly; otherwise the title and artist are searched for.
+type Query struct {
+	ISRC   string
+	Title  string
+	Artist string
+}
+
+// QueryFor returns the query for record m.
+func QueryFor(m *data.Music) Query {
+	return Query{ISRC: m.ISRC, Title: m.Title, Artist: m.Artist}
+}
+
+// Track is what a catalogue knows about a recording. Zero values mean the
+// catalogue doesn't know.
+type Track struct {
+	ISRC   string
+	Title  string
+	Artist string
+	// Duration is in seconds, like data.Music.Duration.
+	Duration   int
+	Popularity float32
+	Genres     []string
+}
+
+// Source is a catalogue records can be enriched from.
+type Source interface {
+	// Name identifies the source, as recorded on enriched records.
+	Name() string
+	// Lookup returns the best matching track, ErrNoMatch when there is
+	// none, or an *UpstreamError or *RateLimitError when the catalogue
+	// can't be asked.
+	Lookup(ctx context.Context, q Query) (*Track, error)
+}
+
+// UpstreamError reports a catalogue request that failed.
+type UpstreamError struct {
+	Source string
+	// Status is the HTTP status the catalogue answered with, zero when it
+	// couldn't be reached.
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("enrich: %s answered %d: %v", e.Source, e.Status, e.Err)
+	}
+	return fmt.Sprintf("enrich: %s: %v", e.Source, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitError reports that the catalogue asked us to wait longer than a
+// lookup is willing to.
+type RateLimitError struct {
+	Source     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("enrich: %s is rate limiting requests, retry after %s", e.Source, e.RetryAfter)
+}
+
+// Apply copies the fields of t onto m and returns the JSON names of the
+// fields it changed. Fields m already has are kept unless overwrite is set;
+// fields t doesn't know are always kept. Values that wouldn't pass
+// ValidateMovie, such as a duration out of range, are skipped.
+func Apply(m *data.Music, t *Track, overwrite bool) []string {
+	var changed []string
+
+	if t.ISRC != "" && (m.ISRC == "" || overwrite) {
+		if isrc := data.NormalizeISRC(t.ISRC); isrc != m.ISRC {
+			m.ISRC = isrc
+			changed = append(changed, "isrc")
+		}
+	}
+	if t.Title != "" && len(t.Title) <= 500 && (m.Title == "" || overwrite) && t.Title != m.Title {
+		m.Title = t.Title
+		changed = append(changed, "title")
+	}
+	if t.Artist != "" && len(t.Artist) <= 500 && (m.Artist == "" || overwrite) && t.Artist != m.Artist {
+		m.Artist = t.Artist
+		changed = append(changed, "artist")
+	}
+	if t.Duration > 0 && t.Duration <= math.MaxInt16 && (m.Duration <= 0 || overwrite) && int16(t.Duration) != m.Duration {
+		m.Duration = int16(t.Duration)
+		changed = append(changed, "duration")
+	}
+	if t.Popularity > 0 && (m.Popularity <= 0 || overwrite) && t.Popularity != m.Popularity {
+		m.Popularity = t.Popularity
+		changed = append(changed, "popularity")
+	}
+	if genres := cleanGenres(t.Genres); len(genres) > 0 && (len(m.Genres) == 0 || overwrite) && !equal(genres, m.Genres) {
+		m.Genres = genres
+		changed = append(changed, "genres")
+	}
+
+	return changed
+}
+
+// cleanGenres trims genres and drops blanks and duplicates, keeping at most
+// maxGenres in the catalogue's order, which is roughly by relevance.
+func cleanGenres(genres []string) []string {
+	cleaned := make([]string, 0, maxGenres)
+	seen := make(map[string]bool, len(genres))
+	for _, genre := range genres {
+		genre = strings.TrimSpace(genre)
+		if genre == "" || len(genre) > 500 || seen[genre] {
+			continue
+		}
+		seen[genre] = true
+		cleaned = append(cleaned, genre)
+		if len(cleaned) == maxGenres {
+			break
+		}
+	}
+	return cleaned
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
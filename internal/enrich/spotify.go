@@ -0,0 +1,261 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spotifyName     = "spotify"
+	spotifyAuthURL  = "https://accounts.spotify.com/api/token"
+	spotifyAPIURL   = "https://api.spotify.com/v1"
+	spotifyAttempts = 3
+	// spotifyMaxWait is the longest Retry-After a lookup waits out; when
+	// Spotify asks for more, the lookup fails with a *RateLimitError.
+	spotifyMaxWait = 10 * time.Second
+	// spotifyTokenMargin is how long before its expiry a token is
+	// replaced, so that it doesn't lapse during a request.
+	spotifyTokenMargin = time.Minute
+)
+
+// Spotify looks tracks up with the Spotify Web API, authenticating with the
+// client credentials flow. Track popularity, on Spotify's 0 to 100 scale, is
+// used as it is; genres are those of the track's first artist, as Spotify
+// doesn't tag tracks. It is safe for concurrent use.
+type Spotify struct {
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewSpotify returns a Spotify source using the credentials of a registered
+// Spotify application.
+func NewSpotify(clientID, clientSecret string) *Spotify {
+	return &Spotify{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *Spotify) Name() string {
+	return spotifyName
+}
+
+type spotifyTrack struct {
+	Name       string  `json:"name"`
+	DurationMS int     `json:"duration_ms"`
+	Popularity float32 `json:"popularity"`
+	ExternalID struct {
+		ISRC string `json:"isrc"`
+	} `json:"external_ids"`
+	Artists []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"artists"`
+}
+
+func (s *Spotify) Lookup(ctx context.Context, q Query) (*Track, error) {
+	var search string
+	switch {
+	case q.ISRC != "":
+		search = "isrc:" + q.ISRC
+	case q.Title != "":
+		// Field filters take the rest of the word, so quotes in the
+		// values would end them early.
+		search = `track:"` + strings.ReplaceAll(q.Title, `"`, " ") + `"`
+		if q.Artist != "" {
+			search += ` artist:"` + strings.ReplaceAll(q.Artist, `"`, " ") + `"`
+		}
+	default:
+		return nil, ErrNoMatch
+	}
+
+	params := url.Values{"q": {search}, "type": {"track"}, "limit": {"1"}}
+	var result struct {
+		Tracks struct {
+			Items []spotifyTrack `json:"items"`
+		} `json:"tracks"`
+	}
+	if err := s.get(ctx, "/search?"+params.Encode(), &result); err != nil {
+		return nil, err
+	}
+	if len(result.Tracks.Items) == 0 {
+		return nil, ErrNoMatch
+	}
+	found := result.Tracks.Items[0]
+
+	track := &Track{
+		ISRC:       found.ExternalID.ISRC,
+		Title:      found.Name,
+		Duration:   int(math.Round(float64(found.DurationMS) / 1000)),
+		Popularity: found.Popularity,
+	}
+	if len(found.Artists) > 0 {
+		track.Artist = found.Artists[0].Name
+
+		var artist struct {
+			Genres []string `json:"genres"`
+		}
+		if err := s.get(ctx, "/artists/"+url.PathEscape(found.Artists[0].ID), &artist); err != nil {
+			return nil, err
+		}
+		track.Genres = artist.Genres
+	}
+	return track, nil
+}
+
+// get decodes the response to an API request for path into dst. Requests
+// answered with 429 are retried after the Retry-After delay, and a 401
+// gets a new token once.
+func (s *Spotify) get(ctx context.Context, path string, dst interface{}) error {
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		token, err := s.accessToken(ctx, false)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, spotifyAPIURL+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+
+		res, err := s.client.Do(req)
+		if err != nil {
+			return &UpstreamError{Source: spotifyName, Err: err}
+		}
+
+		switch {
+		case res.StatusCode == http.StatusOK:
+			defer res.Body.Close()
+			if err := json.NewDecoder(res.Body).Decode(dst); err != nil {
+				return &UpstreamError{Source: spotifyName, Status: res.StatusCode, Err: err}
+			}
+			return nil
+
+		case res.StatusCode == http.StatusUnauthorized && !refreshed:
+			drain(res)
+			refreshed = true
+			if _, err := s.accessToken(ctx, true); err != nil {
+				return err
+			}
+
+		case res.StatusCode == http.StatusTooManyRequests:
+			drain(res)
+			wait := retryAfter(res.Header.Get("Retry-After"))
+			if wait > spotifyMaxWait || attempt == spotifyAttempts {
+				return &RateLimitError{Source: spotifyName, RetryAfter: wait}
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+
+		default:
+			err := responseError(res)
+			return &UpstreamError{Source: spotifyName, Status: res.StatusCode, Err: err}
+		}
+	}
+}
+
+// accessToken returns a client credentials token, asking for a new one when
+// the cached token is about to expire or refresh is set.
+func (s *Spotify) accessToken(ctx context.Context, refresh bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !refresh && s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, spotifyAuthURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(s.clientID, s.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", &UpstreamError{Source: spotifyName, Err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", &UpstreamError{Source: spotifyName, Status: res.StatusCode, Err: fmt.Errorf("token request failed: %w", responseError(res))}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", &UpstreamError{Source: spotifyName, Status: res.StatusCode, Err: err}
+	}
+	if token.AccessToken == "" {
+		return "", &UpstreamError{Source: spotifyName, Status: res.StatusCode, Err: errors.New("token response has no access_token")}
+	}
+
+	s.token = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - spotifyTokenMargin)
+	return s.token, nil
+}
+
+// retryAfter parses a Retry-After header holding seconds or an HTTP date,
+// defaulting to one second.
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// responseError describes an unsuccessful response by the start of its body.
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	res.Body.Close()
+	if len(body) == 0 {
+		return errors.New(res.Status)
+	}
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+}
+
+// drain discards the rest of a response body so its connection can be
+// reused.
+func drain(res *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+}
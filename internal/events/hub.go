@@ -0,0 +1,136 @@
+// Package events fans catalogue change events and user notifications out to
+// in-process subscribers, such as the clients of the event stream. Events are numbered
+// in publication order and the most recent ones are kept, so a subscriber
+// that reconnects can pick up from the last event it saw.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a change to a music record or, when UserID is set, a
+// notification meant for that user alone.
+type Event struct {
+	ID      int64  `json:"-"`
+	UserID  int64  `json:"-"`
+	Type    string `json:"event"`
+	MusicID int64  `json:"id,omitempty"`
+	Version int32  `json:"version,omitempty"`
+	// Sequence is the outbox sequence of a change event, see
+	// data.OutboxEvent.
+	Sequence   int64     `json:"sequence,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// For reports whether e may be delivered to user userID; zero stands for
+// an anonymous subscriber, who only gets broadcast events.
+func (e Event) For(userID int64) bool {
+	return e.UserID == 0 || e.UserID == userID
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before it's cut off.
+const subscriberBuffer = 64
+
+// Hub delivers published events to every subscriber. A nil *Hub drops
+// everything published to it.
+type Hub struct {
+	mu     sync.Mutex
+	nextID int64
+	// recent is a ring of the last size events; head is the oldest once
+	// it's full.
+	recent []Event
+	head   int
+	size   int
+	subs   map[*Subscription]struct{}
+}
+
+// NewHub returns a hub that keeps the last size events for reconnecting
+// subscribers.
+func NewHub(size int) *Hub {
+	return &Hub{nextID: 1, size: size, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives events on C until it's closed, either by
+// Unsubscribe or by the hub when the subscriber falls too far behind. A
+// subscriber whose channel was closed by the hub can subscribe again from
+// the last event it received.
+type Subscription struct {
+	C   <-chan Event
+	c   chan Event
+	hub *Hub
+}
+
+// Publish numbers e, remembers it and sends it to every subscriber.
+// Subscribers whose buffers are full are dropped rather than waited for.
+func (h *Hub) Publish(e Event) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.ID = h.nextID
+	h.nextID++
+
+	switch {
+	case len(h.recent) < h.size:
+		h.recent = append(h.recent, e)
+	case h.size > 0:
+		h.recent[h.head] = e
+		h.head = (h.head + 1) % h.size
+	}
+
+	for sub := range h.subs {
+		select {
+		case sub.c <- e:
+		default:
+			delete(h.subs, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscribe registers a subscriber. The events after lastID that are still
+// remembered are returned, so nothing is missed between them and those sent
+// on the subscription. A lastID of zero asks for no backlog.
+func (h *Hub) Subscribe(lastID int64) ([]Event, *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []Event
+	if lastID > 0 {
+		for i := range h.recent {
+			if e := h.recent[(h.head+i)%len(h.recent)]; e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	c := make(chan Event, subscriberBuffer)
+	sub := &Subscription{C: c, c: c, hub: h}
+	h.subs[sub] = struct{}{}
+	return backlog, sub
+}
+
+// Unsubscribe stops deliveries to s and closes its channel. It's safe to
+// call more than once and after the hub dropped s.
+func (s *Subscription) Unsubscribe() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+// Subscribers returns the number of current subscribers.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
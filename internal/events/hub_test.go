@@ -0,0 +1,178 @@
+package events
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestHubFanOut(t *testing.T) {
+	const (
+		publishers  = 4
+		perProducer = subscriberBuffer / publishers
+		subscribers = 300
+	)
+	h := NewHub(16)
+
+	subs := make([]*Subscription, subscribers)
+	for i := range subs {
+		_, subs[i] = h.Subscribe(0)
+	}
+
+	// Subscribers read while the events are published and others come and
+	// go. No more events are published than fit in a buffer, so none of
+	// the readers can fall far enough behind to be dropped.
+	received := make([][]Event, subscribers)
+	var readers sync.WaitGroup
+	for i, sub := range subs {
+		readers.Add(1)
+		go func(i int, sub *Subscription) {
+			defer readers.Done()
+			for e := range sub.C {
+				received[i] = append(received[i], e)
+				if len(received[i]) == publishers*perProducer {
+					sub.Unsubscribe()
+				}
+			}
+		}(i, sub)
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for n := 1; n <= perProducer; n++ {
+				h.Publish(Event{Type: "music.updated", MusicID: int64(p + 1), Version: int32(n)})
+			}
+		}(p)
+	}
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				_, sub := h.Subscribe(int64(n))
+				sub.Unsubscribe()
+				sub.Unsubscribe()
+			}
+		}()
+	}
+	wg.Wait()
+	readers.Wait()
+
+	for i, events := range received {
+		if len(events) != publishers*perProducer {
+			t.Fatalf("subscriber %d got %d events; want %d", i, len(events), publishers*perProducer)
+		}
+		versions := make(map[int64]int32)
+		for j, e := range events {
+			if e.ID != int64(j+1) {
+				t.Fatalf("subscriber %d got event %d as number %d; events must arrive in order", i, e.ID, j+1)
+			}
+			// Each publisher's events arrive in the order it sent them.
+			if e.Version != versions[e.MusicID]+1 {
+				t.Fatalf("subscriber %d got version %d of %d after %d", i, e.Version, e.MusicID, versions[e.MusicID])
+			}
+			versions[e.MusicID] = e.Version
+		}
+	}
+	if n := h.Subscribers(); n != 0 {
+		t.Errorf("got %d subscribers left; want 0", n)
+	}
+}
+
+func TestHubBacklog(t *testing.T) {
+	h := NewHub(4)
+	for i := 0; i < 10; i++ {
+		h.Publish(Event{Type: "music.created", MusicID: int64(i + 1)})
+	}
+
+	// The ring has wrapped, keeping events 7 to 10.
+	tests := []struct {
+		lastID int64
+		want   []int64
+	}{
+		{0, nil},
+		{3, []int64{7, 8, 9, 10}},
+		{6, []int64{7, 8, 9, 10}},
+		{8, []int64{9, 10}},
+		{10, nil},
+	}
+	for _, tt := range tests {
+		backlog, sub := h.Subscribe(tt.lastID)
+		sub.Unsubscribe()
+
+		var got []int64
+		for _, e := range backlog {
+			got = append(got, e.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("backlog after %d is %v; want %v", tt.lastID, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("backlog after %d is %v; want %v", tt.lastID, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	h := NewHub(256)
+	_, slow := h.Subscribe(0)
+	_, fast := h.Subscribe(0)
+	defer fast.Unsubscribe()
+
+	var lastFast int64
+	for i := 0; i <= subscriberBuffer; i++ {
+		h.Publish(Event{Type: "music.updated"})
+		lastFast = (<-fast.C).ID
+	}
+
+	// The slow subscriber got a full buffer and was cut off at the next
+	// event; the fast one keeps going.
+	var lastSlow int64
+	n := 0
+	for e := range slow.C {
+		lastSlow = e.ID
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before it was dropped; want %d", n, subscriberBuffer)
+	}
+	if got := h.Subscribers(); got != 1 {
+		t.Errorf("got %d subscribers; want 1", got)
+	}
+	if lastFast != subscriberBuffer+1 {
+		t.Errorf("fast subscriber's last event is %d; want %d", lastFast, subscriberBuffer+1)
+	}
+
+	// It can pick up from the last event it received.
+	backlog, sub := h.Subscribe(lastSlow)
+	defer sub.Unsubscribe()
+	if len(backlog) != 1 || backlog[0].ID != subscriberBuffer+1 {
+		t.Errorf("got backlog %v; want event %d", backlog, subscriberBuffer+1)
+	}
+
+	// Unsubscribing after being dropped is harmless.
+	slow.Unsubscribe()
+}
+
+func TestNilHub(t *testing.T) {
+	var h *Hub
+	h.Publish(Event{Type: "music.created"})
+}
+
+func TestEventFor(t *testing.T) {
+	broadcast := Event{Type: "music.created"}
+	private := Event{Type: "export.completed", UserID: 7}
+
+	if !broadcast.For(0) || !broadcast.For(7) {
+		t.Error("a broadcast event must go to everyone")
+	}
+	if !private.For(7) || private.For(8) || private.For(0) {
+		t.Error("a user's notification must only go to that user")
+	}
+}
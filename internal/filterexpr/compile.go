@@ -0,0 +1,190 @@
+package filterexpr
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the type of a filterable field. It decides which operators the
+// field accepts and how its values are parsed.
+type Kind int
+
+const (
+	// Integer, BigInteger and Float fields accept every operator. Integer
+	// values must fit the 32 bits of a PostgreSQL integer, BigInteger ones
+	// the 64 bits of a bigint.
+	Integer Kind = iota
+	BigInteger
+	Float
+	// Text fields accept = and !=.
+	Text
+	// Time fields accept every operator; values are RFC 3339 timestamps or
+	// YYYY-MM-DD dates.
+	Time
+	// Tags fields are text arrays. = matches records carrying the value and
+	// != those that don't.
+	Tags
+)
+
+// Field describes a field expressions may refer to.
+type Field struct {
+	Column string
+	Kind   Kind
+}
+
+// Expr is a compiled expression: SQL text with its values held apart.
+type Expr struct {
+	parts  []string
+	values []interface{}
+}
+
+// SQL returns the expression as a boolean SQL expression. arg is called for
+// each value in order and returns the placeholder standing in for it.
+func (e *Expr) SQL(arg func(interface{}) string) string {
+	var b strings.Builder
+	for i, part := range e.parts {
+		b.WriteString(part)
+		if i < len(e.values) {
+			b.WriteString(arg(e.values[i]))
+		}
+	}
+	return b.String()
+}
+
+// Compile checks node against the allowed fields and compiles it. Errors are
+// *Error, positioned at the offending field or value.
+func Compile(node Node, fields map[string]Field) (*Expr, error) {
+	c := &compiler{fields: fields}
+	if err := c.compile(node); err != nil {
+		return nil, err
+	}
+	c.expr.parts = append(c.expr.parts, c.sql.String())
+	return &c.expr, nil
+}
+
+type compiler struct {
+	fields map[string]Field
+	sql    strings.Builder
+	expr   Expr
+}
+
+// value ends the SQL text written so far and records v as the next value.
+func (c *compiler) value(v interface{}) {
+	c.expr.parts = append(c.expr.parts, c.sql.String())
+	c.expr.values = append(c.expr.values, v)
+	c.sql.Reset()
+}
+
+func (c *compiler) compile(node Node) error {
+	switch n := node.(type) {
+	case Binary:
+		c.sql.WriteString("(")
+		if err := c.compile(n.Left); err != nil {
+			return err
+		}
+		c.sql.WriteString(" " + n.Op + " ")
+		if err := c.compile(n.Right); err != nil {
+			return err
+		}
+		c.sql.WriteString(")")
+		return nil
+
+	case Not:
+		c.sql.WriteString("NOT (")
+		if err := c.compile(n.X); err != nil {
+			return err
+		}
+		c.sql.WriteString(")")
+		return nil
+
+	case Comparison:
+		return c.comparison(n)
+	}
+	panic("filterexpr: unknown node type")
+}
+
+func (c *compiler) comparison(n Comparison) error {
+	field, ok := c.fields[n.Field]
+	if !ok {
+		return &Error{Pos: n.Pos, Msg: "unknown field " + strconv.Quote(n.Field) + ", expected one of " + c.fieldNames()}
+	}
+
+	if (field.Kind == Text || field.Kind == Tags) && n.Op != "=" && n.Op != "!=" {
+		return &Error{Pos: n.Pos, Msg: "field " + strconv.Quote(n.Field) + " only supports = and !="}
+	}
+
+	value, err := parseValue(field.Kind, n.Value)
+	if err != nil {
+		return &Error{Pos: n.ValuePos, Msg: err.Error()}
+	}
+
+	op := n.Op
+	if op == "!=" {
+		op = "<>"
+	}
+
+	switch field.Kind {
+	case Tags:
+		if op == "<>" {
+			c.sql.WriteString("NOT ")
+		}
+		c.sql.WriteString("(")
+		c.value(value)
+		c.sql.WriteString(" = ANY(" + field.Column + "))")
+	default:
+		c.sql.WriteString(field.Column + " " + op + " ")
+		c.value(value)
+	}
+	return nil
+}
+
+func (c *compiler) fieldNames() string {
+	names := make([]string, 0, len(c.fields))
+	for name := range c.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+type valueError string
+
+func (e valueError) Error() string {
+	return string(e)
+}
+
+func parseValue(kind Kind, s string) (interface{}, error) {
+	switch kind {
+	case Integer, BigInteger:
+		bits := 64
+		if kind == Integer {
+			bits = 32
+		}
+		i, err := strconv.ParseInt(s, 10, bits)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, valueError("integer " + s + " is out of range")
+		}
+		if err != nil {
+			return nil, valueError("expected an integer, got " + strconv.Quote(s))
+		}
+		return i, nil
+	case Float:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, valueError("expected a number, got " + strconv.Quote(s))
+		}
+		return f, nil
+	case Time:
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		if t, err := time.Parse("2006-01-02", s); err == nil {
+			return t, nil
+		}
+		return nil, valueError("expected a timestamp or a YYYY-MM-DD date, got " + strconv.Quote(s))
+	}
+	return s, nil
+}
@@ -0,0 +1,62 @@
+// Package filterexpr parses filter expressions such as
+//
+//	(genre = rock OR genre = indie) AND duration < 300
+//
+// and compiles them into parameterized SQL. An expression compares fields
+// with =, !=, <, <=, > and >=, and combines comparisons with AND, OR, NOT
+// and parentheses; AND binds tighter than OR. Values are bare words or
+// quoted strings. Only the fields the caller allows can be used, and values
+// never end up in the SQL text.
+package filterexpr
+
+import (
+	"fmt"
+)
+
+// Limits that keep a single expression from becoming an expensive query.
+const (
+	MaxLength      = 1000
+	MaxComparisons = 50
+	maxDepth       = 20
+)
+
+// Error is a parse or validation error at the 1-based character position
+// Pos of the expression.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("at character %d: %s", e.Pos, e.Msg)
+}
+
+// Node is an element of a parsed expression.
+type Node interface {
+	node()
+}
+
+// Binary combines two expressions with "AND" or "OR".
+type Binary struct {
+	Op          string
+	Left, Right Node
+}
+
+// Not negates an expression.
+type Not struct {
+	X Node
+}
+
+// Comparison compares a field with a literal value.
+type Comparison struct {
+	Field string
+	Op    string
+	Value string
+	// Pos and ValuePos locate the field and the value in the expression.
+	Pos      int
+	ValuePos int
+}
+
+func (Binary) node()     {}
+func (Not) node()        {}
+func (Comparison) node() {}
@@ -0,0 +1,196 @@
+package filterexpr
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFields = map[string]Field{
+	"id":         {Column: "id", Kind: BigInteger},
+	"duration":   {Column: "duration", Kind: Integer},
+	"popularity": {Column: "popularity", Kind: Float},
+	"title":      {Column: "title", Kind: Text},
+	"genre":      {Column: "genres", Kind: Tags},
+	"created_at": {Column: "created_at", Kind: Time},
+}
+
+// compile parses and compiles input, numbering placeholders from $1.
+func compile(input string) (string, []interface{}, error) {
+	node, err := Parse(input)
+	if err != nil {
+		return "", nil, err
+	}
+	expr, err := Compile(node, testFields)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var values []interface{}
+	sql := expr.SQL(func(v interface{}) string {
+		values = append(values, v)
+		return "$" + strconv.Itoa(len(values))
+	})
+	return sql, values, nil
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"duration < 300", "duration < $1"},
+		{"title != x", "title <> $1"},
+		{"genre = rock", "($1 = ANY(genres))"},
+		{"genre != rock", "NOT ($1 = ANY(genres))"},
+		// AND binds tighter than OR, and both associate to the left.
+		{"genre = a OR genre = b AND duration > 1", "(($1 = ANY(genres)) OR (($2 = ANY(genres)) AND duration > $3))"},
+		{"genre = a AND genre = b OR duration > 1", "((($1 = ANY(genres)) AND ($2 = ANY(genres))) OR duration > $3)"},
+		{"(genre = a OR genre = b) AND duration > 1", "((($1 = ANY(genres)) OR ($2 = ANY(genres))) AND duration > $3)"},
+		{"duration > 1 OR duration > 2 OR duration > 3", "((duration > $1 OR duration > $2) OR duration > $3)"},
+		{"NOT duration > 1 AND id = 2", "(NOT (duration > $1) AND id = $2)"},
+		{"not (duration > 1 or id = 2)", "NOT ((duration > $1 OR id = $2))"},
+		{"DURATION >= 1", "duration >= $1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, _, err := compile(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileValues(t *testing.T) {
+	_, values, err := compile(`id = 9000000000 AND duration = 300 AND popularity > 0.5 AND title = "Blue Monday" AND created_at >= 2024-01-02`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []interface{}{int64(9000000000), int64(300), 0.5, "Blue Monday", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if len(values) != len(want) {
+		t.Fatalf("got %d values; want %d", len(values), len(want))
+	}
+	for i := range want {
+		if tm, ok := want[i].(time.Time); ok {
+			if got, ok := values[i].(time.Time); !ok || !got.Equal(tm) {
+				t.Errorf("value %d: got %v; want %v", i, values[i], tm)
+			}
+			continue
+		}
+		if values[i] != want[i] {
+			t.Errorf("value %d: got %#v; want %#v", i, values[i], want[i])
+		}
+	}
+}
+
+func TestInjection(t *testing.T) {
+	inputs := []string{
+		`title = "x'; DROP TABLE musics; --"`,
+		`title = 'a" OR 1=1 --'`,
+		`title = "\") OR (true"`,
+		`genre = "rock')) OR true; --"`,
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			sql, values, err := compile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.ContainsAny(sql, `'";-`) || strings.Contains(strings.ToUpper(sql), "DROP") {
+				t.Errorf("value leaked into SQL %q", sql)
+			}
+			if len(values) != 1 {
+				t.Errorf("got %d values; want 1", len(values))
+			}
+		})
+	}
+
+	// Field names never reach the SQL unless they are allowed.
+	for _, input := range []string{`"title" = x`, `pg_sleep = 1`, `title; = x`} {
+		if _, _, err := compile(input); err == nil {
+			t.Errorf("%q compiled", input)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+		msg   string
+	}{
+		{"", 1, "expression is empty"},
+		{"   ", 1, "expression is empty"},
+		{"duration ! 3", 10, `expected "=" after "!"`},
+		{"title = @", 9, "unexpected character '@'"},
+		{`title = "open`, 9, "unterminated string"},
+		{"duration >", 11, "unexpected end of expression, expected a value"},
+		{"duration 3", 10, `unexpected "3", expected a comparison operator`},
+		{"= 3", 1, `unexpected "=", expected a field name`},
+		{"and = 3", 1, `unexpected "and", expected a field name`},
+		{"(duration > 3", 14, `unexpected end of expression, expected ")"`},
+		{"duration > 3)", 13, `unexpected ")", expected AND, OR or end of expression`},
+		{"duration > 3 duration < 4", 14, `unexpected "duration", expected AND, OR or end of expression`},
+		{"tempo > 3", 1, `unknown field "tempo", expected one of created_at, duration, genre, id, popularity, title`},
+		{"title < x", 1, `field "title" only supports = and !=`},
+		{"genre > x", 1, `field "genre" only supports = and !=`},
+		{"duration > fast", 12, `expected an integer, got "fast"`},
+		{"duration > 3000000000", 12, "integer 3000000000 is out of range"},
+		{"duration > -2147483649", 12, "integer -2147483649 is out of range"},
+		{"id = 99999999999999999999", 6, "integer 99999999999999999999 is out of range"},
+		{"popularity > high", 14, `expected a number, got "high"`},
+		{"created_at > yesterday", 14, `expected a timestamp or a YYYY-MM-DD date, got "yesterday"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, _, err := compile(tt.input)
+			var exprErr *Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("got error %v; want *Error", err)
+			}
+			if exprErr.Pos != tt.pos || exprErr.Msg != tt.msg {
+				t.Errorf("got %d %q; want %d %q", exprErr.Pos, exprErr.Msg, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestIntegerBounds(t *testing.T) {
+	for _, input := range []string{"duration = 2147483647", "duration = -2147483648", "id = 9223372036854775807"} {
+		if _, _, err := compile(input); err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	long := "title = " + strings.Repeat("x", MaxLength)
+	if _, err := Parse(long); err == nil || err.(*Error).Msg != "expression is too long" {
+		t.Errorf("long expression: got %v", err)
+	}
+
+	deep := strings.Repeat("(", maxDepth+1) + "duration > 1" + strings.Repeat(")", maxDepth+1)
+	if _, err := Parse(deep); err == nil || err.(*Error).Msg != "expression is nested too deeply" {
+		t.Errorf("deep expression: got %v", err)
+	}
+
+	many := strings.Repeat("duration > 1 OR ", MaxComparisons) + "duration > 1"
+	if _, err := Parse(many); err == nil || err.(*Error).Msg != "expression has too many comparisons" {
+		t.Errorf("many comparisons: got %v", err)
+	}
+
+	ok := strings.Repeat("duration > 1 OR ", MaxComparisons-1) + "duration > 1"
+	if _, err := Parse(ok); err != nil {
+		t.Errorf("%d comparisons: %v", MaxComparisons, err)
+	}
+}
@@ -0,0 +1,166 @@
+package filterexpr
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type parser struct {
+	tokens      []token
+	pos         int
+	depth       int
+	comparisons int
+}
+
+// Parse parses input into an expression tree. Errors are *Error.
+func Parse(input string) (Node, error) {
+	if utf8.RuneCountInString(input) > MaxLength {
+		return nil, &Error{Pos: MaxLength + 1, Msg: "expression is too long"}
+	}
+	if strings.TrimSpace(input) == "" {
+		return nil, &Error{Pos: 1, Msg: "expression is empty"}
+	}
+
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t, "AND, OR or end of expression")
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(t token, expected string) error {
+	if t.kind == tokenEOF {
+		return &Error{Pos: t.pos, Msg: "unexpected end of expression, expected " + expected}
+	}
+	return &Error{Pos: t.pos, Msg: "unexpected " + quote(t) + ", expected " + expected}
+}
+
+// or = and { "OR" and }
+func (p *parser) or() (Node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = Binary{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// and = unary { "AND" unary }
+func (p *parser) and() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("and") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = Binary{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// unary = "NOT" unary | "(" or ")" | comparison
+func (p *parser) unary() (Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, &Error{Pos: p.peek().pos, Msg: "expression is nested too deeply"}
+	}
+
+	t := p.peek()
+	switch {
+	case t.keyword("not"):
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{X: x}, nil
+
+	case t.kind == tokenLParen:
+		p.next()
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, p.unexpected(t, `")"`)
+		}
+		return x, nil
+	}
+
+	return p.comparison()
+}
+
+// comparison = field operator value
+func (p *parser) comparison() (Node, error) {
+	field := p.next()
+	if field.kind != tokenWord || isKeyword(field) {
+		return nil, p.unexpected(field, "a field name")
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, p.unexpected(op, "a comparison operator")
+	}
+
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, p.unexpected(value, "a value")
+	}
+
+	p.comparisons++
+	if p.comparisons > MaxComparisons {
+		return nil, &Error{Pos: field.pos, Msg: "expression has too many comparisons"}
+	}
+
+	return Comparison{
+		Field:    strings.ToLower(field.text),
+		Op:       op.text,
+		Value:    value.text,
+		Pos:      field.pos,
+		ValuePos: value.pos,
+	}, nil
+}
+
+func isKeyword(t token) bool {
+	return t.keyword("and") || t.keyword("or") || t.keyword("not")
+}
+
+func quote(t token) string {
+	if t.kind == tokenString {
+		return "string"
+	}
+	return `"` + t.text + `"`
+}
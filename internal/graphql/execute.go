@@ -0,0 +1,624 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// plannedField is a validated field of an operation, its arguments coerced
+// and merged with every other selection answering to the same key.
+type plannedField struct {
+	key  string
+	name string
+	// def is nil for __typename.
+	def      *Field
+	args     map[string]interface{}
+	children []*plannedField
+	loc      Location
+}
+
+func (f *plannedField) typ() Type {
+	if f.def == nil {
+		return &NonNull{Of: String}
+	}
+	return f.def.Type
+}
+
+// planner validates an operation against the schema and turns it into
+// planned fields. Errors are collected rather than returned, so that a
+// response lists them all.
+type planner struct {
+	schema    *Schema
+	types     map[string]Type
+	doc       *document
+	params    Params
+	varDefs   map[string]*variableDef
+	vars      map[string]interface{}
+	spreading map[string]bool
+	tooDeep   bool
+	errs      []*Error
+}
+
+func newPlanner(schema *Schema, doc *document, params Params) *planner {
+	return &planner{
+		schema:    schema,
+		types:     schema.types(),
+		doc:       doc,
+		params:    params,
+		varDefs:   make(map[string]*variableDef),
+		vars:      make(map[string]interface{}),
+		spreading: make(map[string]bool),
+	}
+}
+
+func (p *planner) errorf(loc Location, format string, args ...interface{}) {
+	p.errs = append(p.errs, newError(loc, format, args...))
+}
+
+// coerceVariables checks the variable definitions of op and coerces the
+// given values, or defaults, to their types.
+func (p *planner) coerceVariables(op *operation) {
+	for _, def := range op.variables {
+		if _, ok := p.varDefs[def.name]; ok {
+			p.errorf(def.loc, "there can be only one variable named $%s", def.name)
+			continue
+		}
+		p.varDefs[def.name] = def
+
+		t, err := p.typeFromRef(def.typ)
+		if err != nil {
+			p.errorf(def.loc, "variable $%s: %s", def.name, err)
+			continue
+		}
+
+		raw, given := p.params.Variables[def.name]
+		if !given && def.def != nil {
+			raw, _, err = p.valueFromAST(def.def)
+			given = err == nil
+		}
+		if !given {
+			if _, required := t.(*NonNull); required {
+				p.errorf(def.loc, "variable $%s of required type %s was not provided", def.name, t)
+			}
+			continue
+		}
+
+		v, err := coerce(t, raw)
+		if err != nil {
+			p.errorf(def.loc, "variable $%s got an invalid value: %s", def.name, err)
+			continue
+		}
+		p.vars[def.name] = v
+	}
+}
+
+// typeFromRef resolves a type written in a variable definition.
+func (p *planner) typeFromRef(ref *typeRef) (Type, error) {
+	var t Type
+	if ref.elem != nil {
+		elem, err := p.typeFromRef(ref.elem)
+		if err != nil {
+			return nil, err
+		}
+		t = &List{Of: elem}
+	} else {
+		named, ok := p.types[ref.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", ref.name)
+		}
+		if !isInputType(named) {
+			return nil, fmt.Errorf("%s is not an input type", ref.name)
+		}
+		t = named
+	}
+	if ref.nonNull {
+		t = &NonNull{Of: t}
+	}
+	return t, nil
+}
+
+// valueFromAST converts a document value to the form coerce takes, with
+// variables substituted. present is false for a variable that was defined
+// but given no value, which leaves the argument as if omitted.
+func (p *planner) valueFromAST(v value) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case variableValue:
+		if _, ok := p.varDefs[v.name]; !ok {
+			return nil, false, newError(v.loc, "variable $%s is not defined", v.name)
+		}
+		val, ok := p.vars[v.name]
+		return val, ok, nil
+	case intValue:
+		return json.Number(v), true, nil
+	case floatValue:
+		return json.Number(v), true, nil
+	case stringValue:
+		return string(v), true, nil
+	case boolValue:
+		return bool(v), true, nil
+	case nullValue:
+		return nil, true, nil
+	case enumValue:
+		return enumLiteral(v), true, nil
+	case listValue:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			val, _, err := p.valueFromAST(item)
+			if err != nil {
+				return nil, false, err
+			}
+			list = append(list, val)
+		}
+		return list, true, nil
+	case objectValue:
+		object := make(map[string]interface{}, len(v))
+		for _, f := range v {
+			if _, ok := object[f.name]; ok {
+				return nil, false, newError(f.loc, "there can be only one input field named %q", f.name)
+			}
+			val, present, err := p.valueFromAST(f.value)
+			if err != nil {
+				return nil, false, err
+			}
+			if present {
+				object[f.name] = val
+			}
+		}
+		return object, true, nil
+	}
+	return nil, false, fmt.Errorf("unexpected value %v", v)
+}
+
+// arguments coerces the arguments given to the field f defined by defs.
+func (p *planner) arguments(defs Args, f *field) map[string]interface{} {
+	given := make(map[string]*argument, len(f.arguments))
+	for _, arg := range f.arguments {
+		if _, ok := given[arg.name]; ok {
+			p.errorf(arg.loc, "there can be only one argument named %q", arg.name)
+			continue
+		}
+		if _, ok := defs[arg.name]; !ok {
+			p.errorf(arg.loc, "unknown argument %q on field %q", arg.name, f.name)
+			continue
+		}
+		given[arg.name] = arg
+	}
+
+	args := make(map[string]interface{}, len(defs))
+	for _, name := range sortedKeys(defs) {
+		def := defs[name]
+
+		var (
+			v       interface{}
+			present bool
+			err     error
+		)
+		if arg, ok := given[name]; ok {
+			if v, present, err = p.valueFromAST(arg.value); err != nil {
+				p.errs = append(p.errs, toError(err))
+				continue
+			}
+		}
+		if !present {
+			if def.Default == nil {
+				if _, required := def.Type.(*NonNull); required {
+					p.errorf(f.loc, "argument %q of type %s is required on field %q", name, def.Type, f.name)
+				}
+				continue
+			}
+			v = def.Default
+		}
+
+		c, err := coerce(def.Type, v)
+		if err != nil {
+			p.errorf(f.loc, "argument %q on field %q has an invalid value: %s", name, f.name, err)
+			continue
+		}
+		args[name] = c
+	}
+	return args
+}
+
+// included evaluates @include and @skip.
+func (p *planner) included(directives []*directive) bool {
+	include := true
+	for _, d := range directives {
+		if d.name != "include" && d.name != "skip" {
+			p.errorf(d.loc, "unknown directive @%s", d.name)
+			continue
+		}
+
+		field := &field{name: "@" + d.name, arguments: d.arguments, loc: d.loc}
+		args := p.arguments(Args{"if": {Type: &NonNull{Of: Boolean}}}, field)
+		cond, ok := args["if"].(bool)
+		if !ok {
+			continue
+		}
+		if d.name == "include" && !cond || d.name == "skip" && cond {
+			include = false
+		}
+	}
+	return include
+}
+
+func (p *planner) noDirectives(directives []*directive, where string) {
+	for _, d := range directives {
+		p.errorf(d.loc, "directive @%s is not supported on %s", d.name, where)
+	}
+}
+
+// collect gathers the fields selected on obj by response key, expanding
+// fragments, in the order they first appear.
+func (p *planner) collect(obj *Object, selections []selection, keys *[]string, groups map[string][]*field) {
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *field:
+			if !p.included(sel.directives) {
+				continue
+			}
+			key := sel.responseKey()
+			if _, ok := groups[key]; !ok {
+				*keys = append(*keys, key)
+			}
+			groups[key] = append(groups[key], sel)
+
+		case *fragmentSpread:
+			if !p.included(sel.directives) {
+				continue
+			}
+			frag, ok := p.doc.fragments[sel.name]
+			if !ok {
+				p.errorf(sel.loc, "unknown fragment %q", sel.name)
+				continue
+			}
+			if p.spreading[sel.name] {
+				p.errorf(sel.loc, "fragment %q spreads itself", sel.name)
+				continue
+			}
+			if !p.appliesTo(frag.typeCondition, obj, sel.loc) {
+				continue
+			}
+			p.noDirectives(frag.directives, "fragment definitions")
+
+			p.spreading[sel.name] = true
+			p.collect(obj, frag.selections, keys, groups)
+			delete(p.spreading, sel.name)
+
+		case *inlineFragment:
+			if !p.included(sel.directives) {
+				continue
+			}
+			if sel.typeCondition != "" && !p.appliesTo(sel.typeCondition, obj, sel.loc) {
+				continue
+			}
+			p.collect(obj, sel.selections, keys, groups)
+		}
+	}
+}
+
+// appliesTo checks that a fragment on typeCondition may be spread within a
+// selection on obj. Without interfaces or unions, that's only obj itself.
+func (p *planner) appliesTo(typeCondition string, obj *Object, loc Location) bool {
+	t, ok := p.types[typeCondition]
+	switch {
+	case !ok:
+		p.errorf(loc, "unknown type %q", typeCondition)
+		return false
+	case t != Type(obj):
+		p.errorf(loc, "fragment on %s cannot be spread within %s", typeCondition, obj.Name)
+		return false
+	}
+	return true
+}
+
+// plan validates selections on obj, at nesting level depth.
+func (p *planner) plan(obj *Object, selections []selection, depth int) []*plannedField {
+	if p.params.MaxDepth > 0 && depth > p.params.MaxDepth {
+		if !p.tooDeep {
+			p.tooDeep = true
+			p.errorf(selections[0].location(), "operation is nested deeper than the %d levels allowed", p.params.MaxDepth)
+		}
+		return nil
+	}
+
+	var keys []string
+	groups := make(map[string][]*field)
+	p.collect(obj, selections, &keys, groups)
+
+	var fields []*plannedField
+	for _, key := range keys {
+		nodes := groups[key]
+		first := nodes[0]
+
+		conflict := false
+		for _, n := range nodes[1:] {
+			if n.name != first.name {
+				p.errorf(n.loc, "fields %q conflict because %s and %s are different fields", key, first.name, n.name)
+				conflict = true
+			}
+		}
+		if conflict {
+			continue
+		}
+
+		if first.name == "__typename" {
+			if len(first.arguments) > 0 || len(first.selections) > 0 {
+				p.errorf(first.loc, "__typename takes no arguments or selections")
+				continue
+			}
+			fields = append(fields, &plannedField{key: key, name: first.name, loc: first.loc})
+			continue
+		}
+
+		def, ok := obj.Fields[first.name]
+		if !ok {
+			p.errorf(first.loc, "cannot query field %q on type %s", first.name, obj.Name)
+			continue
+		}
+
+		pf := &plannedField{key: key, name: first.name, def: def, args: p.arguments(def.Args, first), loc: first.loc}
+
+		var sub []selection
+		for _, n := range nodes {
+			sub = append(sub, n.selections...)
+		}
+		if child, ok := namedType(def.Type).(*Object); ok {
+			if len(sub) == 0 {
+				p.errorf(first.loc, "field %q of type %s must have a selection of subfields", first.name, def.Type)
+				continue
+			}
+			pf.children = p.plan(child, sub, depth+1)
+		} else if len(sub) > 0 {
+			p.errorf(first.loc, "field %q must not have a selection since type %s has no subfields", first.name, def.Type)
+			continue
+		}
+
+		fields = append(fields, pf)
+	}
+	return fields
+}
+
+// complexity sums the cost of fields and their selections.
+func complexity(fields []*plannedField) int {
+	total := 0
+	for _, f := range fields {
+		if f.def == nil {
+			continue
+		}
+		child := complexity(f.children)
+		if f.def.Cost != nil {
+			total += f.def.Cost(f.args, child)
+		} else {
+			total += 1 + child
+		}
+	}
+	return total
+}
+
+// path locates a value in the response.
+type path []interface{}
+
+func (p path) with(elem interface{}) path {
+	out := make(path, len(p), len(p)+1)
+	copy(out, p)
+	return append(out, elem)
+}
+
+// failure is the value of a field whose error has been reported. It turns
+// into null in the response, unless the field is non-null, in which case
+// the parent turns null instead.
+type failure struct{}
+
+type executor struct {
+	ctx    context.Context
+	params Params
+	errs   []*Error
+}
+
+func (e *executor) fieldError(err error, loc Location, at path) {
+	gqlErr := *toError(err)
+	gqlErr.Locations = []Location{loc}
+	gqlErr.Path = at
+	e.errs = append(e.errs, &gqlErr)
+}
+
+// executeFields resolves fields on each of sources. A source's result is
+// nil when a non-null field of it failed.
+func (e *executor) executeFields(obj *Object, fields []*plannedField, sources []interface{}, paths []path) []interface{} {
+	prepared := false
+	for _, f := range fields {
+		if f.def == nil || f.def.Prepare == nil {
+			continue
+		}
+		for _, source := range sources {
+			f.def.Prepare(ResolveParams{Context: e.ctx, Source: source, Args: f.args})
+		}
+		prepared = true
+	}
+	if prepared && e.params.Flush != nil {
+		e.params.Flush()
+	}
+
+	results := make([]orderedObject, len(sources))
+	nulled := make([]bool, len(sources))
+
+	for _, f := range fields {
+		values := make([]interface{}, len(sources))
+		fieldPaths := make([]path, len(sources))
+		for i, source := range sources {
+			fieldPaths[i] = paths[i].with(f.key)
+			if f.def == nil {
+				values[i] = obj.Name
+				continue
+			}
+
+			v, err := f.def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: f.args})
+			if err != nil {
+				e.fieldError(err, f.loc, fieldPaths[i])
+				values[i] = failure{}
+				continue
+			}
+			values[i] = v
+		}
+
+		_, nonNull := f.typ().(*NonNull)
+		for i, v := range e.complete(f.typ(), f, values, fieldPaths) {
+			if _, failed := v.(failure); failed {
+				if nonNull {
+					nulled[i] = true
+				}
+				v = nil
+			}
+			results[i] = append(results[i], objectEntry{key: f.key, value: v})
+		}
+	}
+
+	out := make([]interface{}, len(sources))
+	for i := range sources {
+		if !nulled[i] {
+			out[i] = results[i]
+		}
+	}
+	return out
+}
+
+// complete turns resolved values of type t into response values, running
+// the selections of objects. Each value is completed, nil or failure.
+func (e *executor) complete(t Type, f *plannedField, values []interface{}, paths []path) []interface{} {
+	if nn, ok := t.(*NonNull); ok {
+		out := e.complete(nn.Of, f, values, paths)
+		for i, v := range out {
+			if v == nil {
+				e.fieldError(fmt.Errorf("cannot return null for non-nullable field %q", f.name), f.loc, paths[i])
+				out[i] = failure{}
+			}
+		}
+		return out
+	}
+
+	out := make([]interface{}, len(values))
+	var (
+		pending []int
+		sources []interface{}
+		subs    []path
+	)
+	for i, v := range values {
+		if _, failed := v.(failure); failed {
+			out[i] = v
+			continue
+		}
+		if isNil(v) {
+			continue
+		}
+
+		switch t.(type) {
+		case *Scalar:
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+				v = rv.Elem().Interface()
+			}
+			if t == Type(ID) {
+				v = fmt.Sprint(v)
+			}
+			out[i] = v
+
+		case *Object:
+			pending = append(pending, i)
+			sources = append(sources, v)
+			subs = append(subs, paths[i])
+
+		case *List:
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				e.fieldError(fmt.Errorf("expected a list for field %q", f.name), f.loc, paths[i])
+				out[i] = failure{}
+				continue
+			}
+			out[i] = rv
+		}
+	}
+
+	switch t := t.(type) {
+	case *Object:
+		for k, result := range e.executeFields(t, f.children, sources, subs) {
+			if result == nil {
+				out[pending[k]] = failure{}
+			} else {
+				out[pending[k]] = result
+			}
+		}
+
+	case *List:
+		// The items of every list are completed together, so their lookups
+		// are batched together too.
+		var (
+			owners    []int
+			items     []interface{}
+			itemPaths []path
+		)
+		for i, v := range out {
+			rv, ok := v.(reflect.Value)
+			if !ok {
+				continue
+			}
+			for j := 0; j < rv.Len(); j++ {
+				owners = append(owners, i)
+				items = append(items, rv.Index(j).Interface())
+				itemPaths = append(itemPaths, paths[i].with(j))
+			}
+			out[i] = make([]interface{}, 0, rv.Len())
+		}
+
+		_, nonNullItems := t.Of.(*NonNull)
+		for k, item := range e.complete(t.Of, f, items, itemPaths) {
+			list, ok := out[owners[k]].([]interface{})
+			if !ok {
+				continue // already failed
+			}
+			if _, failed := item.(failure); failed {
+				if nonNullItems {
+					out[owners[k]] = failure{}
+					continue
+				}
+				item = nil
+			}
+			out[owners[k]] = append(list, item)
+		}
+	}
+
+	return out
+}
+
+// orderedObject is a response object, keeping its fields in selection
+// order.
+type orderedObject []objectEntry
+
+type objectEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(entry.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
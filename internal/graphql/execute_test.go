@@ -0,0 +1,381 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testArtist struct {
+	ID    int
+	Name  string
+	Songs []*testSong
+}
+
+type testSong struct {
+	Title    string
+	Length   *int
+	ArtistID int
+}
+
+// testSchema is a small catalogue of artists and their songs. lookups
+// counts the artist lookups songs make, and flushes the rounds of them
+// batched through Prepare.
+type testSchema struct {
+	*Schema
+	artists map[int]*testArtist
+	lookups int
+	flushes int
+	added   []map[string]interface{}
+}
+
+func newTestSchema() *testSchema {
+	length := 215
+	ts := &testSchema{artists: map[int]*testArtist{
+		1: {ID: 1, Name: "Kraftwerk", Songs: []*testSong{{Title: "Computer Love", Length: &length, ArtistID: 1}, {Title: "Neon Lights", ArtistID: 1}}},
+		2: {ID: 2, Name: "Can", Songs: []*testSong{{Title: "Vitamin C", ArtistID: 2}}},
+	}}
+
+	artist := &Object{Name: "Artist"}
+	song := &Object{Name: "Song", Fields: Fields{
+		"title": {Type: &NonNull{Of: String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*testSong).Title, nil
+		}},
+		"length": {Type: Int, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*testSong).Length, nil
+		}},
+		"artist": {
+			Type: &NonNull{Of: artist},
+			Prepare: func(p ResolveParams) {
+				ts.lookups++
+			},
+			Resolve: func(p ResolveParams) (interface{}, error) {
+				return ts.artists[p.Source.(*testSong).ArtistID], nil
+			},
+		},
+	}}
+	artist.Fields = Fields{
+		"id": {Type: &NonNull{Of: ID}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*testArtist).ID, nil
+		}},
+		"name": {Type: &NonNull{Of: String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*testArtist).Name, nil
+		}},
+		"songs": {
+			Type: &NonNull{Of: &List{Of: &NonNull{Of: song}}},
+			Args: Args{"limit": {Type: Int, Default: 10}},
+			Resolve: func(p ResolveParams) (interface{}, error) {
+				songs := p.Source.(*testArtist).Songs
+				if limit := p.Args["limit"].(int); limit < len(songs) {
+					songs = songs[:limit]
+				}
+				return songs, nil
+			},
+			Cost: func(args map[string]interface{}, childCost int) int {
+				return 1 + args["limit"].(int)*childCost
+			},
+		},
+	}
+
+	songInput := &InputObject{Name: "SongInput", Fields: Args{
+		"title":    {Type: &NonNull{Of: String}},
+		"artistId": {Type: &NonNull{Of: ID}},
+		"length":   {Type: Int, Default: 180},
+	}}
+
+	ts.Schema = &Schema{
+		Query: &Object{Name: "Query", Fields: Fields{
+			"artist": {
+				Type: artist,
+				Args: Args{"id": {Type: &NonNull{Of: ID}}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					var id int
+					fmt.Sscan(p.Args["id"].(string), &id)
+					if a, ok := ts.artists[id]; ok {
+						return a, nil
+					}
+					return nil, nil
+				},
+			},
+			"artists": {
+				Type: &NonNull{Of: &List{Of: &NonNull{Of: artist}}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					return []*testArtist{ts.artists[1], ts.artists[2]}, nil
+				},
+			},
+			"broken": {Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+				return nil, &Error{Message: "broken on purpose", Extensions: map[string]interface{}{"code": "BROKEN"}}
+			}},
+			"required": {Type: &NonNull{Of: String}, Resolve: func(p ResolveParams) (interface{}, error) {
+				return nil, errors.New("nothing to return")
+			}},
+		}},
+		Mutation: &Object{Name: "Mutation", Fields: Fields{
+			"addSong": {
+				Type: song,
+				Args: Args{"input": {Type: &NonNull{Of: songInput}}},
+				Resolve: func(p ResolveParams) (interface{}, error) {
+					input := p.Args["input"].(map[string]interface{})
+					ts.added = append(ts.added, input)
+
+					var artistID int
+					fmt.Sscan(input["artistId"].(string), &artistID)
+					length := input["length"].(int)
+					s := &testSong{Title: input["title"].(string), Length: &length, ArtistID: artistID}
+					if a, ok := ts.artists[artistID]; ok {
+						a.Songs = append(a.Songs, s)
+					}
+					return s, nil
+				},
+			},
+		}},
+	}
+	return ts
+}
+
+// execute runs params against ts and returns the response as JSON.
+func (ts *testSchema) execute(t *testing.T, params Params) string {
+	t.Helper()
+
+	params.Flush = func() { ts.flushes++ }
+	js, err := json.Marshal(Execute(ts.Schema, params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(js)
+}
+
+func TestExecuteNestedQuery(t *testing.T) {
+	ts := newTestSchema()
+
+	got := ts.execute(t, Params{Query: `{
+		artists {
+			name
+			songs(limit: 1) { title length artist { id } }
+		}
+	}`})
+	want := `{"data":{"artists":[` +
+		`{"name":"Kraftwerk","songs":[{"title":"Computer Love","length":215,"artist":{"id":"1"}}]},` +
+		`{"name":"Can","songs":[{"title":"Vitamin C","length":null,"artist":{"id":"2"}}]}]}}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	// The songs of both artists are completed together, so their artist
+	// lookups were prepared in a single round.
+	if ts.lookups != 2 || ts.flushes != 1 {
+		t.Errorf("got %d lookups in %d rounds; want 2 in 1", ts.lookups, ts.flushes)
+	}
+}
+
+func TestExecuteVariablesAndFragments(t *testing.T) {
+	ts := newTestSchema()
+
+	got := ts.execute(t, Params{
+		Query: `
+			query Artist($id: ID!, $withSongs: Boolean = true, $brief: Boolean!) {
+				first: artist(id: $id) { ...Named songs @include(if: $withSongs) { title } }
+				second: artist(id: 2) { __typename ... on Artist @skip(if: $brief) { id } }
+				missing: artist(id: "99") { name }
+			}
+			fragment Named on Artist { id name }`,
+		OperationName: "Artist",
+		Variables:     map[string]interface{}{"id": 1, "brief": true},
+	})
+	want := `{"data":{` +
+		`"first":{"id":"1","name":"Kraftwerk","songs":[{"title":"Computer Love"},{"title":"Neon Lights"}]},` +
+		`"second":{"__typename":"Artist"},` +
+		`"missing":null}}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestExecuteMutation(t *testing.T) {
+	ts := newTestSchema()
+
+	got := ts.execute(t, Params{
+		Query:     `mutation Add($input: SongInput!) { addSong(input: $input) { title length artist { name } } }`,
+		Variables: map[string]interface{}{"input": map[string]interface{}{"title": "Spoon", "artistId": "2"}},
+	})
+	want := `{"data":{"addSong":{"title":"Spoon","length":180,"artist":{"name":"Can"}}}}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+	if len(ts.added) != 1 || len(ts.artists[2].Songs) != 2 {
+		t.Errorf("got %d songs added and %d by Can; want 1 and 2", len(ts.added), len(ts.artists[2].Songs))
+	}
+}
+
+func TestExecuteMaxDepth(t *testing.T) {
+	ts := newTestSchema()
+	query := `{ artist(id: 1) { songs { artist { songs { title } } } } }`
+
+	// The query is five levels deep.
+	if got := ts.execute(t, Params{Query: query, MaxDepth: 5}); strings.Contains(got, "errors") {
+		t.Errorf("query within the limit got %s", got)
+	}
+
+	got := ts.execute(t, Params{Query: query, MaxDepth: 4})
+	want := `{"errors":[{"message":"operation is nested deeper than the 4 levels allowed","locations":[{"line":1,"column":44}]}]}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+	if ts.lookups != 2 {
+		t.Errorf("got %d artist lookups; the rejected query must not run", ts.lookups-2)
+	}
+}
+
+func TestExecuteMaxComplexity(t *testing.T) {
+	ts := newTestSchema()
+
+	// artist 1, songs 1 + 3×(title 1 + length 1) = 7, name 1: 9 in all.
+	query := `{ artist(id: 1) { songs(limit: 3) { title length } name } }`
+	if got := ts.execute(t, Params{Query: query, MaxComplexity: 9}); strings.Contains(got, "errors") {
+		t.Errorf("query within the limit got %s", got)
+	}
+
+	got := ts.execute(t, Params{Query: query, MaxComplexity: 8})
+	want := `{"errors":[{"message":"operation has a complexity of 9, over the limit of 8","locations":[{"line":1,"column":1}]}]}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	ts := newTestSchema()
+
+	// A failed nullable field is null; a failed non-null one nulls its
+	// parent, here the whole data.
+	got := ts.execute(t, Params{Query: `{ broken artists { name } }`})
+	want := `{"errors":[{"message":"broken on purpose","locations":[{"line":1,"column":3}],"path":["broken"],"extensions":{"code":"BROKEN"}}],` +
+		`"data":{"broken":null,"artists":[{"name":"Kraftwerk"},{"name":"Can"}]}}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	got = ts.execute(t, Params{Query: `{ artists { name } required }`})
+	want = `{"errors":[{"message":"nothing to return","locations":[{"line":1,"column":20}],"path":["required"]}],"data":null}`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestExecuteValidationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+		want   string
+	}{
+		{
+			"unknown field",
+			Params{Query: `{ artist(id: 1) { genre } }`},
+			`cannot query field "genre" on type Artist`,
+		},
+		{
+			"missing selection",
+			Params{Query: `{ artist(id: 1) }`},
+			`field "artist" of type Artist must have a selection of subfields`,
+		},
+		{
+			"selection on a scalar",
+			Params{Query: `{ artist(id: 1) { name { x } } }`},
+			`field "name" must not have a selection since type String! has no subfields`,
+		},
+		{
+			"missing argument",
+			Params{Query: `{ artist { name } }`},
+			`argument "id" of type ID! is required on field "artist"`,
+		},
+		{
+			"invalid argument",
+			Params{Query: `{ artist(id: 1.5) { name } }`},
+			`argument "id" on field "artist" has an invalid value: expected ID, found 1.5`,
+		},
+		{
+			"missing variable",
+			Params{Query: `query ($id: ID!) { artist(id: $id) { name } }`},
+			`variable $id of required type ID! was not provided`,
+		},
+		{
+			"undefined variable",
+			Params{Query: `{ artist(id: $id) { name } }`},
+			`variable $id is not defined`,
+		},
+		{
+			"invalid input object",
+			Params{Query: `mutation { addSong(input: {title: "x"}) { title } }`},
+			`argument "input" on field "addSong" has an invalid value: field "artistId" of type ID! is required`,
+		},
+		{
+			"conflicting aliases",
+			Params{Query: `{ a: artists { name } a: artist(id: 1) { name } }`},
+			`fields "a" conflict because artists and artist are different fields`,
+		},
+		{
+			"fragment cycle",
+			Params{Query: `{ artist(id: 1) { ...A } } fragment A on Artist { ...A }`},
+			`fragment "A" spreads itself`,
+		},
+		{
+			"fragment on another type",
+			Params{Query: `{ artist(id: 1) { ...S } } fragment S on Song { title }`},
+			`fragment on Song cannot be spread within Artist`,
+		},
+		{
+			"unknown directive",
+			Params{Query: `{ artists @cached { name } }`},
+			`unknown directive @cached`,
+		},
+		{
+			"several operations",
+			Params{Query: `query A { artists { name } } query B { artists { id } }`},
+			`operationName is required when the document has several operations`,
+		},
+		{
+			"unknown operation",
+			Params{Query: `query A { artists { name } }`, OperationName: "B"},
+			`unknown operation "B"`,
+		},
+		{
+			"subscription",
+			Params{Query: `subscription { artists { name } }`},
+			`subscriptions are not supported`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestSchema()
+			got := ts.execute(t, tt.params)
+
+			var result struct {
+				Errors []*Error
+				Data   *json.RawMessage
+			}
+			if err := json.Unmarshal([]byte(got), &result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Errors) != 1 || result.Errors[0].Message != tt.want || result.Data != nil {
+				t.Errorf("got %s; want only the error %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSDL(t *testing.T) {
+	sdl := newTestSchema().SDL()
+	for _, want := range []string{
+		"type Query {",
+		"artist(id: ID!): Artist",
+		"songs(limit: Int = 10): [Song!]!",
+		"input SongInput {",
+		"type Mutation {",
+	} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL lacks %q:\n%s", want, sdl)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package graphql executes GraphQL requests against a schema of resolver
+// functions. It covers queries and mutations, with variables, aliases,
+// fragments and the @include and @skip directives, but not subscriptions,
+// interfaces, unions, enums or introspection beyond __typename; Schema.SDL
+// describes a schema instead. Operations can be bounded in depth and in
+// complexity, and resolvers can batch their lookups through Field.Prepare.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Location is a 1-based line and column in a request document.
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Error is an error as it appears in a response. Resolvers may return one
+// to set its extensions; any other error is reported by its text.
+type Error struct {
+	Message    string                 `json:"message"`
+	Locations  []Location             `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(loc Location, format string, args ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, args...), Locations: []Location{loc}}
+}
+
+// Params is a request to execute.
+type Params struct {
+	Context       context.Context
+	Query         string
+	OperationName string
+	// Variables holds the variable values as decoded from JSON.
+	Variables map[string]interface{}
+	// MaxDepth caps the nesting of selections and MaxComplexity the summed
+	// cost of the selected fields. Zero means no limit.
+	MaxDepth      int
+	MaxComplexity int
+	// Flush, when set, is called after each round of Field.Prepare calls,
+	// to run the batched lookups.
+	Flush func()
+}
+
+// Result is the response to a request. Data is only encoded once
+// execution started, as the spec requires; a request rejected before that
+// has only errors.
+type Result struct {
+	Data     interface{}
+	Errors   []*Error
+	executed bool
+}
+
+func (r *Result) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if len(r.Errors) > 0 {
+		errs, err := json.Marshal(r.Errors)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(`"errors":`)
+		buf.Write(errs)
+	}
+	if r.executed {
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"data":`)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Execute parses, validates and runs the request in params.
+func Execute(schema *Schema, params Params) *Result {
+	if params.Context == nil {
+		params.Context = context.Background()
+	}
+
+	doc, err := parse(params.Query)
+	if err != nil {
+		return &Result{Errors: []*Error{toError(err)}}
+	}
+
+	op, err := selectOperation(doc, params.OperationName)
+	if err != nil {
+		return &Result{Errors: []*Error{toError(err)}}
+	}
+
+	var root *Object
+	switch op.kind {
+	case "query":
+		root = schema.Query
+	case "mutation":
+		root = schema.Mutation
+		if root == nil {
+			return &Result{Errors: []*Error{newError(op.loc, "the schema does not support mutations")}}
+		}
+	default:
+		return &Result{Errors: []*Error{newError(op.loc, "%ss are not supported", op.kind)}}
+	}
+
+	p := newPlanner(schema, doc, params)
+	p.coerceVariables(op)
+	p.noDirectives(op.directives, "operations")
+	var plan []*plannedField
+	if len(p.errs) == 0 {
+		plan = p.plan(root, op.selections, 1)
+	}
+	if len(p.errs) > 0 {
+		return &Result{Errors: p.errs}
+	}
+
+	if params.MaxComplexity > 0 {
+		if cost := complexity(plan); cost > params.MaxComplexity {
+			return &Result{Errors: []*Error{newError(op.loc, "operation has a complexity of %d, over the limit of %d", cost, params.MaxComplexity)}}
+		}
+	}
+
+	e := &executor{ctx: params.Context, params: params}
+	data := e.executeFields(root, plan, []interface{}{nil}, []path{nil})[0]
+	return &Result{Data: data, Errors: e.errs, executed: true}
+}
+
+// selectOperation picks the operation named name, or the only one.
+func selectOperation(doc *document, name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) != 1 {
+			return nil, &Error{Message: "operationName is required when the document has several operations"}
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: fmt.Sprintf("unknown operation %q", name)}
+}
+
+// toError converts err to an *Error, keeping one as it is.
+func toError(err error) *Error {
+	var gqlErr *Error
+	if errors.As(err, &gqlErr) {
+		return gqlErr
+	}
+	return &Error{Message: err.Error()}
+}
@@ -0,0 +1,320 @@
+package graphql
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of document"
+	case tokenName:
+		return "name"
+	case tokenInt:
+		return "integer"
+	case tokenFloat:
+		return "float"
+	case tokenString:
+		return "string"
+	}
+	return "punctuator"
+}
+
+// token is a lexical unit of a document. For strings, text is the decoded
+// value.
+type token struct {
+	kind tokenKind
+	text string
+	loc  Location
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return t.kind.String()
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return `"` + t.text + `"`
+}
+
+func isNameStart(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_'
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// lexer splits a document into tokens. Commas, white space and comments are
+// insignificant and skipped.
+type lexer struct {
+	src       []rune
+	pos       int
+	line      int
+	lineStart int
+}
+
+func lex(src string) ([]token, error) {
+	l := &lexer{src: []rune(src), line: 1}
+	var tokens []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) loc() Location {
+	return Location{Line: l.line, Column: l.pos - l.lineStart + 1}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return newError(l.loc(), "syntax error: "+format, args...)
+}
+
+func (l *lexer) peek(offset int) rune {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return utf8.RuneError
+}
+
+func (l *lexer) newline() {
+	l.line++
+	l.lineStart = l.pos
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		switch r := l.src[l.pos]; {
+		case r == '\n':
+			l.pos++
+			l.newline()
+		case r == '\r':
+			l.pos++
+			if l.peek(0) == '\n' {
+				l.pos++
+			}
+			l.newline()
+		case r == ' ' || r == '\t' || r == ',' || r == '\uFEFF':
+			l.pos++
+		case r == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return l.token()
+		}
+	}
+	return token{kind: tokenEOF, loc: l.loc()}, nil
+}
+
+func (l *lexer) token() (token, error) {
+	loc := l.loc()
+	r := l.src[l.pos]
+
+	switch {
+	case strings.ContainsRune("!$&()=:@[]{}|", r):
+		l.pos++
+		return token{kind: tokenPunct, text: string(r), loc: loc}, nil
+
+	case r == '.':
+		if l.peek(1) != '.' || l.peek(2) != '.' {
+			return token{}, l.errorf(`expected "..."`)
+		}
+		l.pos += 3
+		return token{kind: tokenPunct, text: "...", loc: loc}, nil
+
+	case isNameStart(r):
+		start := l.pos
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return token{kind: tokenName, text: string(l.src[start:l.pos]), loc: loc}, nil
+
+	case r == '-' || isDigit(r):
+		return l.number(loc)
+
+	case r == '"':
+		if l.peek(1) == '"' && l.peek(2) == '"' {
+			return l.blockString(loc)
+		}
+		return l.string(loc)
+	}
+
+	return token{}, l.errorf("unexpected character %q", r)
+}
+
+func (l *lexer) digits() int {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+func (l *lexer) number(loc Location) (token, error) {
+	start := l.pos
+	kind := tokenInt
+
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	if l.peek(0) == '0' && isDigit(l.peek(1)) {
+		return token{}, l.errorf("unexpected digit after 0")
+	}
+	if l.digits() == 0 {
+		return token{}, l.errorf("expected digit")
+	}
+	if l.peek(0) == '.' {
+		kind = tokenFloat
+		l.pos++
+		if l.digits() == 0 {
+			return token{}, l.errorf("expected digit after decimal point")
+		}
+	}
+	if r := l.peek(0); r == 'e' || r == 'E' {
+		kind = tokenFloat
+		l.pos++
+		if r := l.peek(0); r == '+' || r == '-' {
+			l.pos++
+		}
+		if l.digits() == 0 {
+			return token{}, l.errorf("expected digit in exponent")
+		}
+	}
+	if r := l.peek(0); r == '.' || isNameStart(r) {
+		return token{}, l.errorf("unexpected character %q after number", r)
+	}
+
+	return token{kind: kind, text: string(l.src[start:l.pos]), loc: loc}, nil
+}
+
+func (l *lexer) string(loc Location) (token, error) {
+	l.pos++
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+			return token{}, l.errorf("unterminated string")
+		}
+
+		r := l.src[l.pos]
+		l.pos++
+		switch r {
+		case '"':
+			return token{kind: tokenString, text: b.String(), loc: loc}, nil
+		case '\\':
+			escaped := l.peek(0)
+			l.pos++
+			switch escaped {
+			case '"', '\\', '/':
+				b.WriteRune(escaped)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.src) {
+					return token{}, l.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(string(l.src[l.pos:l.pos+4]), 16, 32)
+				if err != nil {
+					return token{}, l.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				l.pos += 4
+			default:
+				return token{}, l.errorf("invalid escape sequence \\%c", escaped)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// blockString reads a """-delimited string. Its common indentation and
+// leading and trailing blank lines are removed, as the spec requires.
+func (l *lexer) blockString(loc Location) (token, error) {
+	l.pos += 3
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			return token{}, l.errorf("unterminated block string")
+		}
+		switch {
+		case l.src[l.pos] == '"' && l.peek(1) == '"' && l.peek(2) == '"':
+			l.pos += 3
+			return token{kind: tokenString, text: dedentBlock(b.String()), loc: loc}, nil
+		case l.src[l.pos] == '\\' && l.peek(1) == '"' && l.peek(2) == '"' && l.peek(3) == '"':
+			b.WriteString(`"""`)
+			l.pos += 4
+		case l.src[l.pos] == '\n':
+			b.WriteByte('\n')
+			l.pos++
+			l.newline()
+		default:
+			b.WriteRune(l.src[l.pos])
+			l.pos++
+		}
+	}
+}
+
+func dedentBlock(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	indent := -1
+	for i, line := range lines {
+		if i == 0 {
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
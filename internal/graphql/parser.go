@@ -0,0 +1,555 @@
+package graphql
+
+// document is a parsed request document.
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	// kind is "query", "mutation" or "subscription".
+	kind       string
+	name       string
+	variables  []*variableDef
+	directives []*directive
+	selections []selection
+	loc        Location
+}
+
+type variableDef struct {
+	name string
+	typ  *typeRef
+	// def is the default value, nil when there is none.
+	def value
+	loc Location
+}
+
+// typeRef is a type as written in a variable definition: a named type, or
+// a list of elem, either of them possibly non-null.
+type typeRef struct {
+	name    string
+	elem    *typeRef
+	nonNull bool
+}
+
+func (t *typeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type fragment struct {
+	name          string
+	typeCondition string
+	directives    []*directive
+	selections    []selection
+	loc           Location
+}
+
+// selection is a *field, *fragmentSpread or *inlineFragment.
+type selection interface {
+	location() Location
+}
+
+type field struct {
+	alias      string
+	name       string
+	arguments  []*argument
+	directives []*directive
+	selections []selection
+	loc        Location
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []*directive
+	loc        Location
+}
+
+type inlineFragment struct {
+	// typeCondition is empty when the fragment has none.
+	typeCondition string
+	directives    []*directive
+	selections    []selection
+	loc           Location
+}
+
+func (f *field) location() Location          { return f.loc }
+func (f *fragmentSpread) location() Location { return f.loc }
+func (f *inlineFragment) location() Location { return f.loc }
+
+// responseKey is the key the field's value is returned under.
+func (f *field) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type argument struct {
+	name  string
+	value value
+	loc   Location
+}
+
+type directive struct {
+	name      string
+	arguments []*argument
+	loc       Location
+}
+
+// value is a literal or variable in a document.
+type value interface{}
+
+type (
+	variableValue struct {
+		name string
+		loc  Location
+	}
+	intValue    string
+	floatValue  string
+	stringValue string
+	boolValue   bool
+	nullValue   struct{}
+	enumValue   string
+	listValue   []value
+	objectValue []objectField
+)
+
+type objectField struct {
+	name  string
+	value value
+	loc   Location
+}
+
+// maxNesting limits how deeply selections and values may nest in the
+// document itself, before any schema limits apply.
+const maxNesting = 100
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func parse(src string) (*document, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	doc := &document{fragments: make(map[string]*fragment)}
+
+	if p.peek().kind == tokenEOF {
+		return nil, p.unexpected(p.peek(), "an operation")
+	}
+	for p.peek().kind != tokenEOF {
+		t := p.peek()
+		switch {
+		case t.kind == tokenPunct && t.text == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: selections, loc: t.loc})
+		case t.kind == tokenName && (t.text == "query" || t.text == "mutation" || t.text == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == tokenName && t.text == "fragment":
+			frag, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[frag.name]; ok {
+				return nil, newError(frag.loc, "there can be only one fragment named %q", frag.name)
+			}
+			doc.fragments[frag.name] = frag
+		default:
+			return nil, p.unexpected(t, "an operation or fragment")
+		}
+	}
+	return doc, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(t token, expected string) error {
+	return newError(t.loc, "syntax error: expected %s, found %s", expected, t.describe())
+}
+
+// punct reports whether the next token is the punctuator s.
+func (p *parser) punct(s string) bool {
+	t := p.peek()
+	return t.kind == tokenPunct && t.text == s
+}
+
+func (p *parser) expect(s string) (token, error) {
+	if !p.punct(s) {
+		return token{}, p.unexpected(p.peek(), `"`+s+`"`)
+	}
+	return p.next(), nil
+}
+
+func (p *parser) name() (token, error) {
+	if t := p.peek(); t.kind != tokenName {
+		return token{}, p.unexpected(t, "a name")
+	}
+	return p.next(), nil
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxNesting {
+		return newError(p.peek().loc, "document is nested too deeply")
+	}
+	return nil
+}
+
+func (p *parser) operation() (*operation, error) {
+	kind := p.next()
+	op := &operation{kind: kind.text, loc: kind.loc}
+
+	if p.peek().kind == tokenName {
+		op.name = p.next().text
+	}
+
+	if p.punct("(") {
+		p.next()
+		for !p.punct(")") {
+			def, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		p.next()
+	}
+
+	var err error
+	if op.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if op.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (p *parser) variableDef() (*variableDef, error) {
+	dollar, err := p.expect("$")
+	if err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	typ, err := p.typeRef()
+	if err != nil {
+		return nil, err
+	}
+
+	def := &variableDef{name: name.text, typ: typ, loc: dollar.loc}
+	if p.punct("=") {
+		p.next()
+		if def.def, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	return def, nil
+}
+
+func (p *parser) typeRef() (*typeRef, error) {
+	var t *typeRef
+	if p.punct("[") {
+		p.next()
+		elem, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		t = &typeRef{elem: elem}
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t = &typeRef{name: name.text}
+	}
+
+	if p.punct("!") {
+		p.next()
+		t.nonNull = true
+	}
+	return t, nil
+}
+
+func (p *parser) fragment() (*fragment, error) {
+	kw := p.next()
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name.text == "on" {
+		return nil, p.unexpected(name, "a fragment name")
+	}
+	if t := p.peek(); t.kind != tokenName || t.text != "on" {
+		return nil, p.unexpected(t, `"on"`)
+	}
+	p.next()
+	typeCondition, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	frag := &fragment{name: name.text, typeCondition: typeCondition.text, loc: kw.loc}
+	if frag.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if frag.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return frag, nil
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+
+	var selections []selection
+	for {
+		if p.punct("}") {
+			if len(selections) == 0 {
+				return nil, p.unexpected(p.peek(), "a selection")
+			}
+			p.next()
+			return selections, nil
+		}
+
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+}
+
+func (p *parser) selection() (selection, error) {
+	if !p.punct("...") {
+		return p.field()
+	}
+
+	dots := p.next()
+	if t := p.peek(); t.kind == tokenName && t.text != "on" {
+		p.next()
+		directives, err := p.directives()
+		if err != nil {
+			return nil, err
+		}
+		return &fragmentSpread{name: t.text, directives: directives, loc: dots.loc}, nil
+	}
+
+	frag := &inlineFragment{loc: dots.loc}
+	if t := p.peek(); t.kind == tokenName && t.text == "on" {
+		p.next()
+		typeCondition, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		frag.typeCondition = typeCondition.text
+	}
+
+	var err error
+	if frag.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if frag.selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return frag, nil
+}
+
+func (p *parser) field() (*field, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &field{name: name.text, loc: name.loc}
+
+	if p.punct(":") {
+		p.next()
+		actual, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		f.alias, f.name = f.name, actual.text
+	}
+
+	if f.arguments, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.punct("{") {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) arguments(constant bool) ([]*argument, error) {
+	if !p.punct("(") {
+		return nil, nil
+	}
+	p.next()
+
+	var args []*argument
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, &argument{name: name.text, value: v, loc: name.loc})
+	}
+	if len(args) == 0 {
+		return nil, p.unexpected(p.peek(), "an argument")
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *parser) directives() ([]*directive, error) {
+	var directives []*directive
+	for p.punct("@") {
+		at := p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, &directive{name: name.text, arguments: args, loc: at.loc})
+	}
+	return directives, nil
+}
+
+// value parses a value. Variables aren't allowed when constant is set, as in
+// default values.
+func (p *parser) value(constant bool) (value, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenInt:
+		p.next()
+		return intValue(t.text), nil
+	case tokenFloat:
+		p.next()
+		return floatValue(t.text), nil
+	case tokenString:
+		p.next()
+		return stringValue(t.text), nil
+	case tokenName:
+		p.next()
+		switch t.text {
+		case "true", "false":
+			return boolValue(t.text == "true"), nil
+		case "null":
+			return nullValue{}, nil
+		}
+		return enumValue(t.text), nil
+	}
+
+	switch {
+	case p.punct("$") && !constant:
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return variableValue{name: name.text, loc: t.loc}, nil
+
+	case p.punct("["):
+		p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+
+		list := listValue{}
+		for !p.punct("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+
+	case p.punct("{"):
+		p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+
+		object := objectValue{}
+		for !p.punct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, objectField{name: name.text, value: v, loc: name.loc})
+		}
+		p.next()
+		return object, nil
+	}
+
+	return nil, p.unexpected(t, "a value")
+}
@@ -0,0 +1,220 @@
+package graphql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []token
+	}{
+		{
+			"{ a(x: -1.5e3, y: 0) }",
+			[]token{
+				{kind: tokenPunct, text: "{"}, {kind: tokenName, text: "a"}, {kind: tokenPunct, text: "("},
+				{kind: tokenName, text: "x"}, {kind: tokenPunct, text: ":"}, {kind: tokenFloat, text: "-1.5e3"},
+				{kind: tokenName, text: "y"}, {kind: tokenPunct, text: ":"}, {kind: tokenInt, text: "0"},
+				{kind: tokenPunct, text: ")"}, {kind: tokenPunct, text: "}"},
+			},
+		},
+		{`"a\"b\\cé\n"`, []token{{kind: tokenString, text: "a\"b\\cé\n"}}},
+		{"\"\"\"\n    first\n      second\n\n  \"\"\"", []token{{kind: tokenString, text: "first\n  second"}}},
+		{`"""say \"""!"""`, []token{{kind: tokenString, text: `say """!`}}},
+		{"# comment\n...on", []token{{kind: tokenPunct, text: "..."}, {kind: tokenName, text: "on"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			tokens, err := lex(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []token
+			for _, tok := range tokens[:len(tokens)-1] {
+				got = append(got, token{kind: tok.kind, text: tok.text})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+			if last := tokens[len(tokens)-1]; last.kind != tokenEOF {
+				t.Errorf("last token is %v; want the end of the document", last)
+			}
+		})
+	}
+}
+
+func TestLexLocations(t *testing.T) {
+	tokens, err := lex("{\n  a\r\n\tb }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Location{{1, 1}, {2, 3}, {3, 2}, {3, 4}, {3, 5}}
+	for i, tok := range tokens {
+		if tok.loc != want[i] {
+			t.Errorf("token %d %s is at %v; want %v", i, tok.describe(), tok.loc, want[i])
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"01", "unexpected digit after 0"},
+		{"1.", "expected digit after decimal point"},
+		{"1e", "expected digit in exponent"},
+		{"12abc", `unexpected character 'a' after number`},
+		{"..", `expected "..."`},
+		{`"open`, "unterminated string"},
+		{"\"line\nbreak\"", "unterminated string"},
+		{`"\q"`, `invalid escape sequence \q`},
+		{`"\u12"`, "invalid unicode escape"},
+		{`"""open`, "unterminated block string"},
+		{"?", `unexpected character '?'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := lex(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v; want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	doc, err := parse(`
+		query Songs($artist: ID!, $limit: Int = 5, $tags: [String!]) @cached {
+			artist(id: $artist) {
+				name
+				top: songs(limit: $limit, filter: {tags: $tags, live: false, rating: null, kind: STUDIO}) @include(if: true) {
+					...SongFields
+					... on Song { length }
+					... @skip(if: false) { title }
+				}
+			}
+		}
+		mutation { addSong(input: {title: "x", tags: ["a", "b"]}) { title } }
+		fragment SongFields on Song { title }
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.operations) != 2 {
+		t.Fatalf("got %d operations; want 2", len(doc.operations))
+	}
+	query, mutation := doc.operations[0], doc.operations[1]
+	if query.kind != "query" || query.name != "Songs" || mutation.kind != "mutation" || mutation.name != "" {
+		t.Errorf("got operations %s %q and %s %q; want query \"Songs\" and mutation \"\"", query.kind, query.name, mutation.kind, mutation.name)
+	}
+
+	var vars []string
+	for _, v := range query.variables {
+		vars = append(vars, v.name+": "+v.typ.String())
+	}
+	if want := []string{"artist: ID!", "limit: Int", "tags: [String!]"}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("got variables %q; want %q", vars, want)
+	}
+	if def := query.variables[1].def; def != intValue("5") {
+		t.Errorf("got default %#v for $limit; want 5", def)
+	}
+	if len(query.directives) != 1 || query.directives[0].name != "cached" {
+		t.Errorf("got operation directives %v; want @cached", query.directives)
+	}
+
+	artist := query.selections[0].(*field)
+	if artist.name != "artist" || len(artist.arguments) != 1 || artist.arguments[0].value != (variableValue{name: "artist", loc: Location{3, 15}}) {
+		t.Errorf("got artist field %+v", artist)
+	}
+
+	top := artist.selections[1].(*field)
+	if top.alias != "top" || top.name != "songs" || top.responseKey() != "top" {
+		t.Errorf("got field %q aliased %q; want songs aliased top", top.name, top.alias)
+	}
+	wantFilter := objectValue{
+		{name: "tags", value: variableValue{name: "tags", loc: Location{5, 46}}, loc: Location{5, 40}},
+		{name: "live", value: boolValue(false), loc: Location{5, 53}},
+		{name: "rating", value: nullValue{}, loc: Location{5, 66}},
+		{name: "kind", value: enumValue("STUDIO"), loc: Location{5, 80}},
+	}
+	if got := top.arguments[1].value; !reflect.DeepEqual(got, wantFilter) {
+		t.Errorf("got filter %#v; want %#v", got, wantFilter)
+	}
+	if len(top.directives) != 1 || top.directives[0].name != "include" {
+		t.Errorf("got directives %v on songs; want @include", top.directives)
+	}
+
+	if spread, ok := top.selections[0].(*fragmentSpread); !ok || spread.name != "SongFields" {
+		t.Errorf("got %#v; want a spread of SongFields", top.selections[0])
+	}
+	if inline, ok := top.selections[1].(*inlineFragment); !ok || inline.typeCondition != "Song" {
+		t.Errorf("got %#v; want an inline fragment on Song", top.selections[1])
+	}
+	if inline, ok := top.selections[2].(*inlineFragment); !ok || inline.typeCondition != "" || len(inline.directives) != 1 {
+		t.Errorf("got %#v; want an inline fragment with @skip", top.selections[2])
+	}
+
+	frag, ok := doc.fragments["SongFields"]
+	if !ok || frag.typeCondition != "Song" || len(frag.selections) != 1 {
+		t.Errorf("got fragment %+v; want SongFields on Song", frag)
+	}
+
+	addSong := mutation.selections[0].(*field)
+	input := addSong.arguments[0].value.(objectValue)
+	if tags := input[1].value; !reflect.DeepEqual(tags, listValue{stringValue("a"), stringValue("b")}) {
+		t.Errorf("got tags %#v", tags)
+	}
+}
+
+func TestParseShorthandQuery(t *testing.T) {
+	doc, err := parse("{ a b }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 1 || doc.operations[0].kind != "query" || len(doc.operations[0].selections) != 2 {
+		t.Errorf("got %+v; want one anonymous query selecting two fields", doc.operations)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+		loc  Location
+	}{
+		{"", "syntax error: expected an operation, found end of document", Location{1, 1}},
+		{"{ }", `syntax error: expected a selection, found "}"`, Location{1, 3}},
+		{"{ a(", "syntax error: expected a name, found end of document", Location{1, 5}},
+		{"{ a() }", `syntax error: expected an argument, found ")"`, Location{1, 5}},
+		{"{ a(x: ) }", `syntax error: expected a value, found ")"`, Location{1, 8}},
+		{"{ a", `syntax error: expected a name, found end of document`, Location{1, 4}},
+		{"query ($x: Int = $y) { a }", `syntax error: expected a value, found "$"`, Location{1, 18}},
+		{"fragment on on T { a }", `syntax error: expected a fragment name, found "on"`, Location{1, 10}},
+		{"fragment F T { a }", `syntax error: expected "on", found "T"`, Location{1, 12}},
+		{"fragment F on T { a } fragment F on T { b }", `there can be only one fragment named "F"`, Location{1, 23}},
+		{"type T { a }", `syntax error: expected an operation or fragment, found "type"`, Location{1, 1}},
+		{strings.Repeat("{ a ", maxNesting+1) + strings.Repeat("}", maxNesting+1), "document is nested too deeply", Location{1, 4*maxNesting + 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := parse(tt.src)
+			gqlErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("got error %v; want an *Error", err)
+			}
+			if gqlErr.Message != tt.want {
+				t.Errorf("got message %q; want %q", gqlErr.Message, tt.want)
+			}
+			if len(gqlErr.Locations) != 1 || gqlErr.Locations[0] != tt.loc {
+				t.Errorf("got locations %v; want %v", gqlErr.Locations, tt.loc)
+			}
+		})
+	}
+}
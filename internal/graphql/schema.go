@@ -0,0 +1,423 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type is a GraphQL type: a *Scalar, *Object, *InputObject, *List or
+// *NonNull.
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type. Output values are encoded as they are, so
+// resolvers return values of a matching Go type.
+type Scalar struct {
+	Name        string
+	Description string
+	// coerce converts an input value, from a literal or a variable, or
+	// reports that it can't.
+	coerce func(interface{}) (interface{}, bool)
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// The built-in scalars. Input Int and Float values are coerced to int and
+// float64; ID accepts strings and integers and is coerced to string.
+var (
+	Int = &Scalar{Name: "Int", Description: "A signed 32-bit integer.", coerce: func(v interface{}) (interface{}, bool) {
+		f, ok := number(v)
+		if !ok || f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+			return nil, false
+		}
+		return int(f), true
+	}}
+	Float = &Scalar{Name: "Float", Description: "A double-precision floating-point number.", coerce: func(v interface{}) (interface{}, bool) {
+		f, ok := number(v)
+		return f, ok
+	}}
+	String = &Scalar{Name: "String", Description: "UTF-8 text.", coerce: func(v interface{}) (interface{}, bool) {
+		s, ok := v.(string)
+		return s, ok
+	}}
+	Boolean = &Scalar{Name: "Boolean", Description: "true or false.", coerce: func(v interface{}) (interface{}, bool) {
+		b, ok := v.(bool)
+		return b, ok
+	}}
+	ID = &Scalar{Name: "ID", Description: "A unique identifier, serialised as a string.", coerce: func(v interface{}) (interface{}, bool) {
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+		if f, ok := number(v); ok && f == math.Trunc(f) {
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+		return nil, false
+	}}
+)
+
+// number returns v as a float64 when it's an input number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Object is an output type with fields.
+type Object struct {
+	Name        string
+	Description string
+	Fields      Fields
+}
+
+func (o *Object) String() string { return o.Name }
+
+// Fields maps field names to their definitions.
+type Fields map[string]*Field
+
+// Field is a field of an Object.
+type Field struct {
+	Type        Type
+	Description string
+	Args        Args
+	// Resolve returns the field's value for p.Source. An object value is the
+	// Source of its own fields' resolvers; a list value is any slice.
+	Resolve func(p ResolveParams) (interface{}, error)
+	// Prepare, when set, is called for every source of the field in a
+	// selection before any of them is resolved, so lookups can be batched.
+	// Params.Flush runs once after the calls.
+	Prepare func(p ResolveParams)
+	// Cost returns the field's contribution to a query's complexity, given
+	// the combined cost of its selections. When nil it's 1 + childCost.
+	Cost func(args map[string]interface{}, childCost int) int
+}
+
+// Args maps argument names to their definitions.
+type Args map[string]*Argument
+
+// Argument is an argument of a field, or a field of an InputObject.
+type Argument struct {
+	Type        Type
+	Description string
+	// Default is used when the argument is omitted. It goes through input
+	// coercion like any other value.
+	Default interface{}
+}
+
+// InputObject is a structured argument type. Coerced values are
+// map[string]interface{} holding the fields that were given or have a
+// default.
+type InputObject struct {
+	Name        string
+	Description string
+	Fields      Args
+}
+
+func (o *InputObject) String() string { return o.Name }
+
+// List is a list of Of.
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+// NonNull is Of without null.
+type NonNull struct {
+	Of Type
+}
+
+func (n *NonNull) String() string { return n.Of.String() + "!" }
+
+// ResolveParams is passed to resolvers.
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+// Schema holds the root types. Mutation may be nil.
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+}
+
+// namedType strips List and NonNull from t.
+func namedType(t Type) Type {
+	for {
+		switch w := t.(type) {
+		case *List:
+			t = w.Of
+		case *NonNull:
+			t = w.Of
+		default:
+			return t
+		}
+	}
+}
+
+// types returns every named type reachable from the root types, by name.
+func (s *Schema) types() map[string]Type {
+	types := map[string]Type{}
+	for _, scalar := range []*Scalar{Int, Float, String, Boolean, ID} {
+		types[scalar.Name] = scalar
+	}
+
+	var walk func(t Type)
+	walk = func(t Type) {
+		t = namedType(t)
+		if _, ok := types[t.String()]; ok {
+			return
+		}
+		types[t.String()] = t
+
+		switch t := t.(type) {
+		case *Object:
+			for _, f := range t.Fields {
+				walk(f.Type)
+				for _, arg := range f.Args {
+					walk(arg.Type)
+				}
+			}
+		case *InputObject:
+			for _, f := range t.Fields {
+				walk(f.Type)
+			}
+		}
+	}
+
+	walk(s.Query)
+	if s.Mutation != nil {
+		walk(s.Mutation)
+	}
+	return types
+}
+
+// coerce converts an input value to t, as described for each type. v is
+// nil for an explicit null.
+func coerce(t Type, v interface{}) (interface{}, error) {
+	if n, ok := t.(*NonNull); ok {
+		if v == nil {
+			return nil, fmt.Errorf("expected a non-null %s", n.Of)
+		}
+		return coerce(n.Of, v)
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *Scalar:
+		if c, ok := t.coerce(v); ok {
+			return c, nil
+		}
+		return nil, fmt.Errorf("expected %s, found %s", t.Name, describeInput(v))
+
+	case *List:
+		items, ok := v.([]interface{})
+		if !ok {
+			// A single value stands for a list of one.
+			item, err := coerce(t.Of, v)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			c, err := coerce(t.Of, item)
+			if err != nil {
+				return nil, fmt.Errorf("at index %d: %w", i, err)
+			}
+			list[i] = c
+		}
+		return list, nil
+
+	case *InputObject:
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected %s, found %s", t.Name, describeInput(v))
+		}
+		for name := range fields {
+			if _, ok := t.Fields[name]; !ok {
+				return nil, fmt.Errorf("field %q is not defined by type %s", name, t.Name)
+			}
+		}
+		object := make(map[string]interface{}, len(t.Fields))
+		for _, name := range sortedKeys(t.Fields) {
+			def := t.Fields[name]
+			given, ok := fields[name]
+			if !ok {
+				if def.Default == nil {
+					if _, required := def.Type.(*NonNull); required {
+						return nil, fmt.Errorf("field %q of type %s is required", name, def.Type)
+					}
+					continue
+				}
+				given = def.Default
+			}
+			c, err := coerce(def.Type, given)
+			if err != nil {
+				return nil, fmt.Errorf("in field %q: %w", name, err)
+			}
+			object[name] = c
+		}
+		return object, nil
+	}
+
+	return nil, fmt.Errorf("%s is not an input type", t)
+}
+
+func describeInput(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case enumLiteral:
+		return "enum value " + string(v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprint(v)
+}
+
+// enumLiteral is an enum value from a document. None of the types here
+// are enums, so it never coerces; it's kept apart from strings so that the
+// error says what was found.
+type enumLiteral string
+
+func sortedKeys(m Args) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isInputType reports whether t may be used for arguments and variables.
+func isInputType(t Type) bool {
+	switch namedType(t).(type) {
+	case *Scalar, *InputObject:
+		return true
+	}
+	return false
+}
+
+// isNil reports whether a resolved value is null, including typed nil
+// pointers, maps, slices and interfaces.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// SDL returns the schema in the GraphQL schema definition language.
+func (s *Schema) SDL() string {
+	types := s.types()
+	names := make([]string, 0, len(types))
+	for name, t := range types {
+		switch t.(type) {
+		case *Object, *InputObject:
+			names = append(names, name)
+		}
+	}
+
+	// The root types go first, the rest alphabetically.
+	rank := func(name string) int {
+		switch {
+		case name == s.Query.Name:
+			return 0
+		case s.Mutation != nil && name == s.Mutation.Name:
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+			return ri < rj
+		}
+		return names[i] < names[j]
+	})
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		switch t := types[name].(type) {
+		case *Object:
+			writeDescription(&b, "", t.Description)
+			fmt.Fprintf(&b, "type %s {\n", t.Name)
+			for _, fieldName := range sortedFieldNames(t.Fields) {
+				f := t.Fields[fieldName]
+				writeDescription(&b, "  ", f.Description)
+				b.WriteString("  " + fieldName)
+				if len(f.Args) > 0 {
+					var args []string
+					for _, argName := range sortedKeys(f.Args) {
+						args = append(args, argumentSDL(argName, f.Args[argName]))
+					}
+					b.WriteString("(" + strings.Join(args, ", ") + ")")
+				}
+				fmt.Fprintf(&b, ": %s\n", f.Type)
+			}
+			b.WriteString("}\n")
+		case *InputObject:
+			writeDescription(&b, "", t.Description)
+			fmt.Fprintf(&b, "input %s {\n", t.Name)
+			for _, fieldName := range sortedKeys(t.Fields) {
+				f := t.Fields[fieldName]
+				writeDescription(&b, "  ", f.Description)
+				b.WriteString("  " + argumentSDL(fieldName, f) + "\n")
+			}
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+func sortedFieldNames(fields Fields) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func argumentSDL(name string, arg *Argument) string {
+	s := name + ": " + arg.Type.String()
+	if arg.Default != nil {
+		def, _ := json.Marshal(arg.Default)
+		s += " = " + string(def)
+	}
+	return s
+}
+
+func writeDescription(b *strings.Builder, indent, description string) {
+	if description != "" {
+		b.WriteString(indent + strconv.Quote(description) + "\n")
+	}
+}
@@ -11,6 +11,13 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+// Sender sends templated emails. Mailer is one; tests stub it.
+type Sender interface {
+	// Send mails the template named templateFile, rendered with data, to
+	// recipient.
+	Send(recipient, templateFile string, data interface{}) error
+}
+
 type Mailer struct {
 	dialer *mail.Dialer
 	sender string
@@ -0,0 +1,193 @@
+// Package mbz searches MusicBrainz for the recordings matching a music
+// record. Client is implemented by HTTPClient for the MusicBrainz web
+// service and can be stubbed in its place.
+package mbz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the MusicBrainz web service.
+const DefaultBaseURL = "https://musicbrainz.org/ws/2"
+
+// Query describes the recording to search for. An ISRC, when known, is
+// searched for on its own; otherwise the title and artist are.
+type Query struct {
+	ISRC   string
+	Title  string
+	Artist string
+	// Limit caps the recordings returned; MusicBrainz allows 1 to 100.
+	Limit int
+}
+
+// Recording is a recording found by a search.
+type Recording struct {
+	ID string `json:"id"`
+	// Score is how well MusicBrainz considers the recording to match, from
+	// 0 to 100.
+	Score  int    `json:"score"`
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	// Duration is in seconds, zero when MusicBrainz doesn't know it.
+	Duration         int      `json:"duration,omitempty"`
+	ISRCs            []string `json:"isrcs,omitempty"`
+	FirstReleaseDate string   `json:"first_release_date,omitempty"`
+	// Release is the title of the first release the recording appears on.
+	Release string `json:"release,omitempty"`
+}
+
+// Client searches for recordings.
+type Client interface {
+	// SearchRecordings returns the recordings matching q, best first. A
+	// failed search returns an *Error.
+	SearchRecordings(ctx context.Context, q Query) ([]Recording, error)
+}
+
+// Error reports a MusicBrainz request that failed.
+type Error struct {
+	// Status is the HTTP status MusicBrainz answered with, zero when it
+	// couldn't be reached.
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("mbz: musicbrainz answered %d: %v", e.Status, e.Err)
+	}
+	return fmt.Sprintf("mbz: %v", e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// HTTPClient is a Client for the MusicBrainz web service. Its requests are
+// spaced by a token bucket refilling once a second, the rate MusicBrainz
+// allows each application, so concurrent searches queue up rather than
+// getting the application blocked. It is safe for concurrent use.
+type HTTPClient struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+	limiter   *rate.Limiter
+}
+
+// New returns a client for the web service at baseURL. MusicBrainz asks for
+// a userAgent naming the application and a way to contact its operator.
+func New(baseURL, userAgent string) *HTTPClient {
+	return &HTTPClient{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		userAgent: userAgent,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		limiter:   rate.NewLimiter(rate.Every(time.Second), 1),
+	}
+}
+
+func (c *HTTPClient) SearchRecordings(ctx context.Context, q Query) ([]Recording, error) {
+	var search string
+	switch {
+	case q.ISRC != "":
+		search = "isrc:" + q.ISRC
+	case q.Artist != "":
+		search = fmt.Sprintf(`recording:"%s" AND artist:"%s"`, escape(q.Title), escape(q.Artist))
+	default:
+		search = fmt.Sprintf(`recording:"%s"`, escape(q.Title))
+	}
+
+	params := url.Values{"query": {search}, "fmt": {"json"}}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, &Error{Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/recording?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, &Error{Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, &Error{Status: res.StatusCode, Err: fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))}
+	}
+
+	var result struct {
+		Recordings []struct {
+			ID               string   `json:"id"`
+			Score            int      `json:"score"`
+			Title            string   `json:"title"`
+			Length           int      `json:"length"`
+			ISRCs            []string `json:"isrcs"`
+			FirstReleaseDate string   `json:"first-release-date"`
+			ArtistCredit     []struct {
+				Name       string `json:"name"`
+				JoinPhrase string `json:"joinphrase"`
+			} `json:"artist-credit"`
+			Releases []struct {
+				Title string `json:"title"`
+			} `json:"releases"`
+		} `json:"recordings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, &Error{Status: res.StatusCode, Err: err}
+	}
+
+	recordings := make([]Recording, len(result.Recordings))
+	for i, found := range result.Recordings {
+		var artist strings.Builder
+		for _, credit := range found.ArtistCredit {
+			artist.WriteString(credit.Name + credit.JoinPhrase)
+		}
+
+		recordings[i] = Recording{
+			ID:               found.ID,
+			Score:            found.Score,
+			Title:            found.Title,
+			Artist:           artist.String(),
+			Duration:         int(math.Round(float64(found.Length) / 1000)),
+			ISRCs:            found.ISRCs,
+			FirstReleaseDate: found.FirstReleaseDate,
+		}
+		if len(found.Releases) > 0 {
+			recordings[i].Release = found.Releases[0].Title
+		}
+	}
+	return recordings, nil
+}
+
+// luceneSpecial are the characters with a meaning in the Lucene query
+// syntax MusicBrainz searches use.
+const luceneSpecial = `+-&|!(){}[]^"~*?:\/`
+
+// escape quotes s for use in a Lucene phrase.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(luceneSpecial, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,292 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// maxDepth bounds the nesting of the documents ToJSON converts.
+const maxDepth = 1000
+
+var (
+	// ErrTruncated is returned for a document that ends mid-value.
+	ErrTruncated = errors.New("msgpack: unexpected end of data")
+	// ErrTrailingData is returned for data left over after the document.
+	ErrTrailingData = errors.New("msgpack: data after the end of the document")
+)
+
+// ToJSON converts the MessagePack document data to JSON, keeping the order
+// (and any repetition) of map keys. Map keys must be strings. bin values
+// become base64 strings, as encoding/json writes []byte, and timestamps
+// (extension type -1) RFC 3339 strings; other extension types are refused,
+// as are NaN and infinite floats.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data}
+	if err := d.value(0); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, ErrTrailingData
+	}
+	return d.out.Bytes(), nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	out  bytes.Buffer
+}
+
+// next returns the following n bytes of the document.
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads a big-endian length of size bytes.
+func (d *decoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	if n > uint64(len(d.data)) {
+		// No document holds more elements or bytes than it has bytes.
+		return 0, ErrTruncated
+	}
+	return int(n), nil
+}
+
+func (d *decoder) value(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("msgpack: document nested deeper than %d levels", maxDepth)
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		d.out.WriteString(strconv.Itoa(int(c)))
+		return nil
+	case c >= 0xe0:
+		d.out.WriteString(strconv.Itoa(int(int8(c))))
+		return nil
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		d.out.WriteString("null")
+	case 0xc2:
+		d.out.WriteString("false")
+	case 0xc3:
+		d.out.WriteString("true")
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return err
+		}
+		bin, err := d.next(n)
+		if err != nil {
+			return err
+		}
+		d.out.WriteByte('"')
+		d.out.WriteString(base64.StdEncoding.EncodeToString(bin))
+		d.out.WriteByte('"')
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (c - 0xc7))
+		if err != nil {
+			return err
+		}
+		return d.ext(n)
+	case 0xca:
+		b, err := d.next(4)
+		if err != nil {
+			return err
+		}
+		return d.float(float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 32)
+	case 0xcb:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		return d.float(math.Float64frombits(binary.BigEndian.Uint64(b)), 64)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return err
+		}
+		var u uint64
+		for _, x := range b {
+			u = u<<8 | uint64(x)
+		}
+		d.out.WriteString(strconv.FormatUint(u, 10))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		b, err := d.next(size)
+		if err != nil {
+			return err
+		}
+		var u uint64
+		for _, x := range b {
+			u = u<<8 | uint64(x)
+		}
+		// Sign-extend from the size of the value.
+		shift := uint(64 - 8*size)
+		d.out.WriteString(strconv.FormatInt(int64(u<<shift)>>shift, 10))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return err
+		}
+		return d.object(n, depth)
+	default:
+		return fmt.Errorf("msgpack: invalid format byte 0x%02x at offset %d", c, d.pos-1)
+	}
+	return nil
+}
+
+func (d *decoder) str(n int) error {
+	b, err := d.next(n)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(string(b))
+	if err != nil {
+		return err
+	}
+	d.out.Write(js)
+	return nil
+}
+
+func (d *decoder) float(f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("msgpack: unsupported value %s", strconv.FormatFloat(f, 'g', -1, bits))
+	}
+	d.out.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+	return nil
+}
+
+func (d *decoder) array(n, depth int) error {
+	d.out.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			d.out.WriteByte(',')
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	d.out.WriteByte(']')
+	return nil
+}
+
+func (d *decoder) object(n, depth int) error {
+	d.out.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			d.out.WriteByte(',')
+		}
+		if err := d.key(); err != nil {
+			return err
+		}
+		d.out.WriteByte(':')
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	d.out.WriteByte('}')
+	return nil
+}
+
+func (d *decoder) key() error {
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	c := b[0]
+
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c >= 0xd9 && c <= 0xdb:
+		if n, err = d.length(1 << (c - 0xd9)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("msgpack: map key at offset %d is not a string", d.pos-1)
+	}
+	return d.str(n)
+}
+
+// ext converts an extension value with n bytes of data. Only timestamps are
+// understood.
+func (d *decoder) ext(n int) error {
+	b, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	typ := int8(b[0])
+	payload, err := d.next(n)
+	if err != nil {
+		return err
+	}
+	if typ != -1 {
+		return fmt.Errorf("msgpack: unsupported extension type %d", typ)
+	}
+
+	var t time.Time
+	switch n {
+	case 4:
+		t = time.Unix(int64(binary.BigEndian.Uint32(payload)), 0)
+	case 8:
+		v := binary.BigEndian.Uint64(payload)
+		t = time.Unix(int64(v&0x3ffffffff), int64(v>>34))
+	case 12:
+		t = time.Unix(int64(binary.BigEndian.Uint64(payload[4:])), int64(binary.BigEndian.Uint32(payload)))
+	default:
+		return fmt.Errorf("msgpack: invalid timestamp of %d bytes", n)
+	}
+	d.out.WriteByte('"')
+	d.out.WriteString(t.UTC().Format(time.RFC3339Nano))
+	d.out.WriteByte('"')
+	return nil
+}
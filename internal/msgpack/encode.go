@@ -0,0 +1,586 @@
+// Package msgpack implements the subset of MessagePack
+// (https://msgpack.org/) the API needs to serve it as an alternative to
+// JSON: Marshal encodes values under the names and rules of their json
+// struct tags, and ToJSON converts a MessagePack document into the
+// equivalent JSON, so request bodies can go through the JSON decoding path.
+package msgpack
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Marshal returns the MessagePack encoding of v. It follows encoding/json:
+// struct fields are named by their json tags, honouring "-", omitempty and
+// the string option, anonymous struct fields are inlined, map keys are
+// sorted, and time.Time values are RFC 3339 strings. Types with a
+// MarshalJSON method are encoded from their JSON, and encoding.TextMarshaler
+// types as strings. Byte slices become bin values rather than base64.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf.WriteByte(0xc0)
+		return nil
+	}
+
+	t := v.Type()
+	if t == timeType {
+		e.writeString(v.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	}
+	if m, ok := marshaler(v, jsonMarshalerType); ok {
+		if m == nil {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		js, err := m.(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return e.encodeJSON(js)
+	}
+	if m, ok := marshaler(v, textMarshalerType); ok {
+		if m == nil {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		text, err := m.(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.writeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		return e.writeFloat(v.Float(), 32)
+	case reflect.Float64:
+		return e.writeFloat(v.Float(), 64)
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.writeBin(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.writeArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+// marshaler returns v as an implementation of iface, checking the pointer
+// method set too when v is addressable. A nil pointer is reported as a nil
+// implementation.
+func marshaler(v reflect.Value, iface reflect.Type) (interface{}, bool) {
+	t := v.Type()
+	if t.Implements(iface) {
+		if (t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface) && v.IsNil() {
+			return nil, true
+		}
+		return v.Interface(), true
+	}
+	if t.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(t).Implements(iface) {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+func (e *encoder) encodeMap(v reflect.Value) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	e.writeMapHeader(len(entries))
+	for _, entry := range entries {
+		e.writeString(entry.key)
+		if err := e.encode(entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapKey renders a map key as encoding/json would.
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if m, ok := marshaler(k, textMarshalerType); ok && m != nil {
+		text, err := m.(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type %s", k.Type())
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+
+	present := make([]reflect.Value, len(fields))
+	n := 0
+	for i, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		present[i] = fv
+		n++
+	}
+
+	e.writeMapHeader(n)
+	for i, f := range fields {
+		fv := present[i]
+		if !fv.IsValid() {
+			continue
+		}
+		e.writeString(f.name)
+		if f.quoted {
+			if err := e.encodeQuoted(fv); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeQuoted encodes a field tagged with the string option, which holds
+// its scalar value as a string.
+func (e *encoder) encodeQuoted(v reflect.Value) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		e.writeString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32:
+		e.writeString(strconv.FormatFloat(v.Float(), 'g', -1, 32))
+	case reflect.Float64:
+		e.writeString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	default:
+		return e.encode(v)
+	}
+	return nil
+}
+
+// fieldByIndex follows index from v, reporting false when it passes through
+// a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is an encoded struct field.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	quoted    bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+func cachedFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.([]field)
+}
+
+// typeFields lists the fields of struct type t that encoding/json would
+// encode, in its order. Of fields sharing a name the shallowest wins, and a
+// tie at the same depth drops them all.
+func typeFields(t reflect.Type) []field {
+	type candidate struct {
+		field
+		depth  int
+		tagged bool
+	}
+
+	var candidates []candidate
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts := tag, ""
+			if comma := strings.IndexByte(tag, ','); comma >= 0 {
+				name, opts = tag[:comma], tag[comma:]
+			}
+
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if sf.Anonymous {
+				if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+					continue
+				}
+				if name == "" && ft.Kind() == reflect.Struct {
+					walk(ft, append(append([]int(nil), index...), i), depth+1)
+					continue
+				}
+			} else if sf.PkgPath != "" {
+				continue
+			}
+
+			tagged := name != ""
+			if !tagged {
+				name = sf.Name
+			}
+			quoted := false
+			if strings.Contains(opts, ",string") {
+				switch ft.Kind() {
+				case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+					reflect.Float32, reflect.Float64, reflect.String:
+					quoted = ft.Kind() != reflect.String
+				}
+			}
+			candidates = append(candidates, candidate{
+				field: field{
+					name:      name,
+					index:     append(append([]int(nil), index...), i),
+					omitEmpty: strings.Contains(opts, ",omitempty"),
+					quoted:    quoted,
+				},
+				depth:  depth,
+				tagged: tagged,
+			})
+		}
+	}
+	walk(t, nil, 0)
+
+	byName := make(map[string][]int)
+	for i, c := range candidates {
+		byName[c.name] = append(byName[c.name], i)
+	}
+
+	var fields []field
+	for i, c := range candidates {
+		// Of the fields named c.name at the shallowest depth, the one
+		// encoded is the only one there, or else the only tagged one.
+		var shallowest, tagged []int
+		for _, j := range byName[c.name] {
+			o := candidates[j]
+			if len(shallowest) > 0 && o.depth > candidates[shallowest[0]].depth {
+				continue
+			}
+			if len(shallowest) > 0 && o.depth < candidates[shallowest[0]].depth {
+				shallowest, tagged = nil, nil
+			}
+			shallowest = append(shallowest, j)
+			if o.tagged {
+				tagged = append(tagged, j)
+			}
+		}
+		if (len(shallowest) == 1 && shallowest[0] == i) || (len(tagged) == 1 && tagged[0] == i) {
+			fields = append(fields, c.field)
+		}
+	}
+	return fields
+}
+
+// encodeJSON encodes the JSON document js, keeping the order of object keys.
+func (e *encoder) encodeJSON(js []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return e.encodeJSONValue(dec)
+}
+
+func (e *encoder) encodeJSONValue(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok := tok.(type) {
+	case nil:
+		e.buf.WriteByte(0xc0)
+	case bool:
+		e.encode(reflect.ValueOf(tok))
+	case string:
+		e.writeString(tok)
+	case json.Number:
+		if i, err := strconv.ParseInt(string(tok), 10, 64); err == nil {
+			e.writeInt(i)
+		} else if u, err := strconv.ParseUint(string(tok), 10, 64); err == nil {
+			e.writeUint(u)
+		} else {
+			f, err := tok.Float64()
+			if err != nil {
+				return err
+			}
+			return e.writeFloat(f, 64)
+		}
+	case json.Delim:
+		// The length comes first in MessagePack, so the elements are encoded
+		// aside and copied in after the header.
+		inner := &encoder{}
+		n := 0
+		for dec.More() {
+			if tok == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				inner.writeString(key.(string))
+			}
+			if err := inner.encodeJSONValue(dec); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		if tok == '{' {
+			e.writeMapHeader(n)
+		} else {
+			e.writeArrayHeader(n)
+		}
+		e.buf.Write(inner.buf.Bytes())
+	}
+	return nil
+}
+
+func (e *encoder) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.writeUint(uint64(i))
+	case i >= -32:
+		e.buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		e.buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		e.buf.Write([]byte{0xd1, byte(i >> 8), byte(i)})
+	case i >= math.MinInt32:
+		e.buf.WriteByte(0xd2)
+		e.writeBE(uint64(i), 4)
+	default:
+		e.buf.WriteByte(0xd3)
+		e.writeBE(uint64(i), 8)
+	}
+}
+
+func (e *encoder) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		e.buf.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		e.buf.Write([]byte{0xcd, byte(u >> 8), byte(u)})
+	case u <= math.MaxUint32:
+		e.buf.WriteByte(0xce)
+		e.writeBE(u, 4)
+	default:
+		e.buf.WriteByte(0xcf)
+		e.writeBE(u, 8)
+	}
+}
+
+// writeFloat writes f as a float of the given size. Like encoding/json, it
+// refuses NaN and the infinities.
+func (e *encoder) writeFloat(f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("msgpack: unsupported value %s", strconv.FormatFloat(f, 'g', -1, bits))
+	}
+	if bits == 32 {
+		e.buf.WriteByte(0xca)
+		e.writeBE(uint64(math.Float32bits(float32(f))), 4)
+		return nil
+	}
+	e.buf.WriteByte(0xcb)
+	e.writeBE(math.Float64bits(f), 8)
+	return nil
+}
+
+// writeString writes s as a str value, replacing invalid UTF-8 as
+// encoding/json does.
+func (e *encoder) writeString(s string) {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	n := len(s)
+	switch {
+	case n <= 31:
+		e.buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf.Write([]byte{0xda, byte(n >> 8), byte(n)})
+	default:
+		e.buf.WriteByte(0xdb)
+		e.writeBE(uint64(n), 4)
+	}
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) writeBin(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf.Write([]byte{0xc4, byte(n)})
+	case n <= math.MaxUint16:
+		e.buf.Write([]byte{0xc5, byte(n >> 8), byte(n)})
+	default:
+		e.buf.WriteByte(0xc6)
+		e.writeBE(uint64(n), 4)
+	}
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.buf.Write([]byte{0xdc, byte(n >> 8), byte(n)})
+	default:
+		e.buf.WriteByte(0xdd)
+		e.writeBE(uint64(n), 4)
+	}
+}
+
+func (e *encoder) writeMapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.buf.Write([]byte{0xde, byte(n >> 8), byte(n)})
+	default:
+		e.buf.WriteByte(0xdf)
+		e.writeBE(uint64(n), 4)
+	}
+}
+
+// writeBE writes the low size bytes of u, big-endian.
+func (e *encoder) writeBE(u uint64, size int) {
+	for shift := (size - 1) * 8; shift >= 0; shift -= 8 {
+		e.buf.WriteByte(byte(u >> uint(shift)))
+	}
+}
@@ -0,0 +1,141 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SPA-Final/musicdb/internal/data"
+)
+
+// listEnvelope is a page of n musics as the API lists them.
+func listEnvelope(n int) map[string]interface{} {
+	at := time.Date(2021, 6, 1, 12, 0, 30, 500000000, time.UTC)
+	musics := make([]*data.Music, n)
+	for i := range musics {
+		musics[i] = &data.Music{
+			Id:         int64(i + 1),
+			ISRC:       fmt.Sprintf("USS1Z99%05d", i),
+			Title:      fmt.Sprintf("Song n°%d", i+1),
+			Artist:     "Band",
+			Duration:   int16(120 + i),
+			Popularity: float32(i%10) / 10,
+			Genres:     []string{"rock", "pop"}[:i%3%2+1],
+			CreatedAt:  at,
+			UpdatedAt:  at.Add(time.Duration(i) * time.Minute),
+			Version:    int32(i%4 + 1),
+		}
+	}
+	next := "/v1/musics?page=2"
+	return map[string]interface{}{
+		"musics":   musics,
+		"metadata": data.Metadata{CurrentPage: 1, PageSize: n, FirstPage: 1, LastPage: 3, TotalRecords: 3 * n, NextPageURL: &next},
+	}
+}
+
+// decodeJSON decodes js as a generic value.
+func decodeJSON(t *testing.T, js []byte) interface{} {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal(js, &v); err != nil {
+		t.Fatalf("%v: %s", err, js)
+	}
+	return v
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"list", listEnvelope(100)},
+		{"empty list", listEnvelope(0)},
+		{"music", map[string]interface{}{"music": listEnvelope(1)["musics"].([]*data.Music)[0]}},
+		{"scalars", map[string]interface{}{"int": -40000, "uint": uint64(1) << 40, "float": 1.5, "bool": true, "nil": nil, "string": "a \"quoted\" ☃"}},
+		{"long string", map[string]interface{}{"s": string(make([]byte, 70000))}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packed, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			js, err := ToJSON(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := decodeJSON(t, js), decodeJSON(t, want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s; want %s", js, want)
+			}
+		})
+	}
+}
+
+func TestListSmallerThanJSON(t *testing.T) {
+	env := listEnvelope(100)
+	packed, err := Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) >= len(js) {
+		t.Errorf("got %d bytes of MessagePack; want fewer than the %d bytes of JSON", len(packed), len(js))
+	}
+}
+
+// BenchmarkEncodeList compares encoding a page of 100 musics as JSON and as
+// MessagePack; payload-bytes is the size of the result.
+func BenchmarkEncodeList(b *testing.B) {
+	env := listEnvelope(100)
+
+	encoders := []struct {
+		name    string
+		marshal func(interface{}) ([]byte, error)
+	}{
+		{"json", json.Marshal},
+		{"msgpack", Marshal},
+	}
+
+	for _, enc := range encoders {
+		b.Run(enc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var size int
+			for i := 0; i < b.N; i++ {
+				res, err := enc.marshal(env)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(res)
+			}
+			b.ReportMetric(float64(size), "payload-bytes")
+		})
+	}
+}
+
+// BenchmarkDecodeList measures turning a MessagePack page of 100 musics
+// back into JSON, the extra step MessagePack request bodies take.
+func BenchmarkDecodeList(b *testing.B) {
+	packed, err := Marshal(listEnvelope(100))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ToJSON(packed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package pwned checks passwords against the Pwned Passwords breach data.
+// Checker is implemented by HTTPChecker for the Pwned Passwords range API
+// and can be stubbed in its place.
+package pwned
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the Pwned Passwords range API.
+const DefaultBaseURL = "https://api.pwnedpasswords.com/range"
+
+// Checker checks passwords against breach data.
+type Checker interface {
+	// Breached reports whether password appears in the breach data.
+	Breached(ctx context.Context, password string) (bool, error)
+}
+
+// Doer sends HTTP requests; *http.Client is one.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// HTTPChecker is a Checker for the range API. Only the first five
+// characters of the password's SHA-1 hash are sent, and the suffixes
+// answered for them are compared here, so neither the password nor its
+// hash leaves the server. It is safe for concurrent use.
+type HTTPChecker struct {
+	baseURL string
+	client  Doer
+}
+
+// New returns a checker for the range API at baseURL, sending its requests
+// with client, or with an http.Client with a short timeout when client is
+// nil.
+func New(baseURL string, client Doer) *HTTPChecker {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &HTTPChecker{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+func (c *HTTPChecker) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/"+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding makes every answer about as long, so its size doesn't hint
+	// at the prefix.
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("pwned: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pwned: range API answered %d", resp.StatusCode)
+	}
+
+	// Each line is a hash suffix and its count, which is 0 for padding.
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], suffix) {
+			continue
+		}
+		return strings.TrimLeft(line[i+1:], "0") != "", nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("pwned: %w", err)
+	}
+	return false, nil
+}
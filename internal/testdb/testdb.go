@@ -0,0 +1,115 @@
+// Package testdb gives tests a migrated PostgreSQL database of their own. It
+// needs a server to connect to, named by the MUSIC_TEST_DB_DSN environment
+// variable; tests using it are skipped when that isn't set. Each call gets a
+// fresh schema with every up migration applied, dropped again when the test
+// ends, so tests can't see each other's rows.
+package testdb
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	_ "github.com/lib/pq"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// EnvDSN is the environment variable naming the test server.
+const EnvDSN = "MUSIC_TEST_DB_DSN"
+
+// Open returns a connection pool to a new schema holding the migrated
+// tables, skipping t if no test server is configured.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(EnvDSN)
+	if dsn == "" {
+		t.Skipf("%s not set; skipping test that needs PostgreSQL", EnvDSN)
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// Extensions are per database, so they live in public where every
+	// test schema finds them; the migrations' CREATE EXTENSION IF NOT
+	// EXISTS then has nothing to do.
+	for _, ext := range []string{"pg_trgm", "unaccent"} {
+		if _, err := admin.Exec("CREATE EXTENSION IF NOT EXISTS " + ext + " SCHEMA public"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(b)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer admin.Close()
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema+",public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, file := range migrations(t) {
+		stmts, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(stmts)); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(file), err)
+		}
+	}
+	return db
+}
+
+// withSearchPath adds search_path to dsn, in either of the forms lib/pq
+// accepts. lib/pq passes settings it doesn't know itself on to the server.
+func withSearchPath(dsn, path string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", path)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + path
+}
+
+// migrations returns the up migrations in the order they apply.
+func migrations(t testing.TB) []string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("testdb: can't locate the migrations directory")
+	}
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(file), "..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,111 @@
+package totp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B gives eight digit codes; six digit ones are
+	// their last six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		got := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if want := tt.want[2:]; got != want {
+			t.Errorf("Code at %d: got %q; want %q", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name   string
+		step   int64
+		wantOK bool
+	}{
+		{"current step", current, true},
+		{"previous step", current - 1, true},
+		{"next step", current + 1, true},
+		{"two steps behind", current - 2, false},
+		{"two steps ahead", current + 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, Code(rfcSecret, tt.step), now)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %t; want %t", ok, tt.wantOK)
+			}
+			if ok && step != tt.step {
+				t.Errorf("got step %d; want %d", step, tt.step)
+			}
+		})
+	}
+
+	for _, code := range []string{"", "05047", "0504711", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	sealed, err := Seal(key, rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, rfcSecret) {
+		t.Error("sealed secret contains the plaintext")
+	}
+
+	secret, err := Open(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, rfcSecret) {
+		t.Errorf("got %q; want %q", secret, rfcSecret)
+	}
+
+	other := bytes.Repeat([]byte{8}, 32)
+	if _, err := Open(other, sealed); err != ErrSealed {
+		t.Errorf("wrong key: got error %v; want %v", err, ErrSealed)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Open(key, sealed); err != ErrSealed {
+		t.Errorf("tampered: got error %v; want %v", err, ErrSealed)
+	}
+	if _, err := Seal(key[:16], rfcSecret); err == nil {
+		t.Error("Seal accepted a 16 byte key")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("musicdb", "alice@example.com", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/musicdb:alice@example.com?") {
+		t.Errorf("unexpected URI %q", uri)
+	}
+	if !strings.Contains(uri, "secret="+Encode(rfcSecret)) {
+		t.Errorf("URI %q is missing the secret", uri)
+	}
+}
@@ -0,0 +1,428 @@
+package validator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message identifiers for validation failures. Each is resolved to text in
+// the client's language by Translate.
+const (
+	MsgRequired                  = "required"
+	MsgMinBytes                  = "min_bytes"
+	MsgMaxBytes                  = "max_bytes"
+	MsgExactBytes                = "exact_bytes"
+	MsgInteger                   = "integer"
+	MsgBoolean                   = "boolean"
+	MsgPositiveInteger           = "positive_integer"
+	MsgPositiveNumber            = "positive_number"
+	MsgGreaterThanZero           = "greater_than_zero"
+	MsgMaxValue                  = "max_value"
+	MsgMaxPage                   = "max_page"
+	MsgMinGenres                 = "min_genres"
+	MsgMaxGenres                 = "max_genres"
+	MsgDuplicateValues           = "duplicate_values"
+	MsgInvalidISRC               = "invalid_isrc"
+	MsgInvalidEmail              = "invalid_email"
+	MsgInvalidSort               = "invalid_sort"
+	MsgUnknownField              = "unknown_field"
+	MsgMaxIDs                    = "max_ids"
+	MsgPositiveIDs               = "positive_ids"
+	MsgNoUpdatableFields         = "no_updatable_fields"
+	MsgDuplicateEmail            = "duplicate_email"
+	MsgInvalidActivationToken    = "invalid_activation_token"
+	MsgInvalidPasswordResetToken = "invalid_password_reset_token"
+	MsgInvalidEmailChangeToken   = "invalid_email_change_token"
+	MsgMustDiffer                = "must_differ"
+	MsgRequiredOneOf             = "required_one_of"
+	MsgOverlap                   = "overlap"
+	MsgTooManyMatches            = "too_many_matches"
+	MsgGenreOverflow             = "genre_overflow"
+	MsgDuplicateISRC             = "duplicate_isrc"
+	MsgNotNegative               = "not_negative"
+	MsgGenresRange               = "genres_range"
+	MsgUnknownReference          = "unknown_reference"
+	MsgMinValue                  = "min_value"
+	MsgNumber                    = "number"
+	MsgRange                     = "range"
+	MsgTimestamp                 = "timestamp"
+	MsgRelevanceNeedsTitle       = "relevance_needs_title"
+	MsgOneOf                     = "one_of"
+	MsgEmptyValues               = "empty_values"
+	MsgExclusive                 = "exclusive"
+	MsgNotSupported              = "not_supported"
+	MsgMinChars                  = "min_chars"
+	MsgPageCeiling               = "page_ceiling"
+	MsgInvalidExpression         = "invalid_expression"
+	MsgInvalidQuery              = "invalid_query"
+	MsgURL                       = "url"
+	MsgDuplicateName             = "duplicate_name"
+	MsgInvalidUUID               = "invalid_uuid"
+	MsgEmailChangeSeparate       = "email_change_separate"
+	MsgCurrentEmail              = "current_email"
+	MsgCommonPassword            = "common_password"
+	MsgBreachedPassword          = "breached_password"
+	MsgInvalidTOTP               = "invalid_totp"
+)
+
+// DefaultLanguage is used when a client accepts none of the catalogue's
+// languages, and for messages missing from a translation.
+const DefaultLanguage = "en"
+
+// Message is a message identifier together with the arguments for its
+// format string.
+type Message struct {
+	ID   string
+	Args []interface{}
+}
+
+func (m Message) Text(lang string) string {
+	return Translate(lang, m.ID, m.Args...)
+}
+
+// catalogue maps a language to the format strings of its messages. Besides
+// the validation messages above it holds the top-level error messages, keyed
+// by the API's error codes.
+var catalogue = map[string]map[string]string{
+	"en": {
+		MsgRequired:                  "must be provided",
+		MsgMinBytes:                  "must be at least %d bytes long",
+		MsgMaxBytes:                  "must not be more than %d bytes long",
+		MsgExactBytes:                "must be %d bytes long",
+		MsgInteger:                   "must be an integer value",
+		MsgBoolean:                   "must be a boolean value",
+		MsgPositiveInteger:           "must be a positive integer",
+		MsgPositiveNumber:            "must be a positive number",
+		MsgGreaterThanZero:           "must be greater than zero",
+		MsgMaxValue:                  "must be a maximum of %d",
+		MsgMaxPage:                   "must be a maximum of 10 million",
+		MsgMinGenres:                 "must contain at least 1 genre",
+		MsgMaxGenres:                 "must not contain more than %d genres",
+		MsgDuplicateValues:           "must not contain duplicate values",
+		MsgInvalidISRC:               "must be a valid 12 character ISRC",
+		MsgInvalidEmail:              "must be a valid email address",
+		MsgInvalidSort:               "invalid sort value",
+		MsgUnknownField:              "unknown field %q, valid fields are: %s",
+		MsgMaxIDs:                    "must not contain more than %d ids",
+		MsgPositiveIDs:               "must contain only positive integers (got %v)",
+		MsgNoUpdatableFields:         "must contain at least one updatable field: %s",
+		MsgDuplicateEmail:            "a user with this email address already exists",
+		MsgInvalidActivationToken:    "invalid or expired activation token",
+		MsgInvalidPasswordResetToken: "invalid or expired password reset token",
+		MsgInvalidEmailChangeToken:   "invalid or expired email change token",
+		MsgMustDiffer:                "must be different from %s",
+		MsgRequiredOneOf:             "at least one of %s must be provided",
+		MsgOverlap:                   "must not contain values also in %s",
+		MsgTooManyMatches:            "matches more than %d records, narrow the filter",
+		MsgGenreOverflow:             "would leave more than %d genres on records %s",
+		MsgDuplicateISRC:             "a music with this ISRC already exists",
+		MsgNotNegative:               "must not be negative",
+		MsgGenresRange:               "must contain between %d and %d genres",
+		MsgUnknownReference:          "refers to a record that does not exist",
+		MsgMinValue:                  "must not be less than %s",
+		MsgNumber:                    "must be a number",
+		MsgRange:                     "must be between %v and %v",
+		MsgTimestamp:                 "must be an RFC 3339 timestamp or a YYYY-MM-DD date",
+		MsgRelevanceNeedsTitle:       "relevance sorting requires a title or q search",
+		MsgOneOf:                     "must be one of: %s",
+		MsgEmptyValues:               "must not contain empty values",
+		MsgExclusive:                 "must not be combined with %s",
+		MsgNotSupported:              "is not supported by this endpoint",
+		MsgMinChars:                  "must be at least %d characters long",
+		MsgPageCeiling:               "must be at most %d at this page_size; narrow the filters or reverse the sort to reach later records",
+		MsgInvalidExpression:         "invalid expression at character %d: %s",
+		MsgInvalidQuery:              "must be a valid URL query string",
+		MsgURL:                       "must be an absolute http or https URL",
+		MsgDuplicateName:             "you already have one with this name",
+		MsgInvalidUUID:               "must be a UUID such as 123e4567-e89b-12d3-a456-426614174000",
+		MsgEmailChangeSeparate:       "can't be changed here, as a new address has to be verified first",
+		MsgCurrentEmail:              "is already your email address",
+		MsgCommonPassword:            "is too common, choose one that is harder to guess",
+		MsgBreachedPassword:          "appears in data from a known breach, choose a different one",
+		MsgInvalidTOTP:               "must be the current code from your authenticator app",
+
+		"server_error":                 "the server encountered a problem and could not process your request",
+		"record_not_found":             "the requested resource could not be found",
+		"method_not_allowed":           "the %s method is not supported for this resource",
+		"validation_failed":            "one or more fields failed validation",
+		"rate_limited":                 "rate limit exceeded",
+		"edit_conflict":                "unable to update the record due to an edit conflict, please re-fetch the record and try again",
+		"precondition_failed":          "the record has changed since you last fetched it, please re-fetch it and try again",
+		"idempotency_key_reused":       "this idempotency key has already been used with a different request",
+		"idempotency_key_in_progress":  "a request with this idempotency key is still being processed, please try again later",
+		"invalid_credentials":          "invalid authentication credentials",
+		"invalid_authentication_token": "invalid or missing authentication token",
+		"authentication_required":      "you must be authenticated to access this resource",
+		"inactive_account":             "your user account must be activated to access this resource",
+		"account_suspended":            "your user account has been suspended",
+		"not_permitted":                "your user account doesn't have the necessary permissions to access this resource",
+		"read_only_token":              "this authentication token is read-only and can't be used to make changes",
+		"query_timeout":                "the query took too long to run, please try again later or narrow the filters",
+		"export_too_large":             "the export would contain %d records, more than the limit of %d; narrow the filters",
+		"unsupported_media_type":       "the request body must be %s",
+		"body_too_large":               "the request body must not be larger than %d bytes",
+		"not_acceptable":               "the response can only be sent as one of %s",
+		"unsupported_content_encoding": "the %s content encoding is not supported; send the body uncompressed or gzipped",
+		"enrichment_unavailable":       "metadata enrichment is not configured on this server",
+		"upstream_failed":              "the %s service could not answer the request, please try again later",
+		"upstream_rate_limited":        "the %s service is limiting our requests, please try again in %d seconds",
+		"export_not_ready":             "the export is %s; only completed exports can be downloaded",
+		"export_expired":               "the export has expired and its file was removed, please start a new one",
+		"import_finished":              "the import is already %s and can't be cancelled",
+		"last_holder":                  "you are the only user with the %s permission; grant it to another user before deleting your account",
+		"last_holder_revoke":           "the user is the only one with the %s permission; grant it to another user before revoking it",
+		"last_holder_suspend":          "the user is the only active one with the %s permission; grant it to another user before suspending them",
+		"totp_required":                "this account has two-factor authentication enabled; supply a totp_code from your authenticator app or a recovery code",
+		"invalid_totp_code":            "invalid or already used two-factor code",
+		"two_factor_enabled":           "two-factor authentication is already enabled for this account",
+		"two_factor_not_pending":       "there is no two-factor setup to confirm; start one first",
+		"two_factor_unavailable":       "two-factor authentication is not configured on this server",
+	},
+	"ru": {
+		MsgRequired:                  "обязательное поле",
+		MsgMinBytes:                  "должно быть не короче %d байт",
+		MsgMaxBytes:                  "должно быть не длиннее %d байт",
+		MsgExactBytes:                "должно быть длиной %d байт",
+		MsgInteger:                   "должно быть целым числом",
+		MsgBoolean:                   "должно быть логическим значением",
+		MsgPositiveInteger:           "должно быть положительным целым числом",
+		MsgPositiveNumber:            "должно быть положительным числом",
+		MsgGreaterThanZero:           "должно быть больше нуля",
+		MsgMaxValue:                  "должно быть не больше %d",
+		MsgMaxPage:                   "должно быть не больше 10 миллионов",
+		MsgMinGenres:                 "должно содержать хотя бы один жанр",
+		MsgMaxGenres:                 "должно содержать не более %d жанров",
+		MsgDuplicateValues:           "не должно содержать повторяющихся значений",
+		MsgInvalidISRC:               "должно быть корректным 12-символьным кодом ISRC",
+		MsgInvalidEmail:              "должно быть корректным адресом электронной почты",
+		MsgInvalidSort:               "недопустимое значение сортировки",
+		MsgUnknownField:              "неизвестное поле %q, допустимые поля: %s",
+		MsgMaxIDs:                    "должно содержать не более %d идентификаторов",
+		MsgPositiveIDs:               "должно содержать только положительные целые числа (получено %v)",
+		MsgNoUpdatableFields:         "должно содержать хотя бы одно изменяемое поле: %s",
+		MsgDuplicateEmail:            "пользователь с таким адресом электронной почты уже существует",
+		MsgInvalidActivationToken:    "недействительный или просроченный токен активации",
+		MsgInvalidPasswordResetToken: "недействительный или просроченный токен сброса пароля",
+		MsgInvalidEmailChangeToken:   "недействительный или просроченный токен смены email",
+		MsgMustDiffer:                "должно отличаться от %s",
+		MsgRequiredOneOf:             "необходимо указать хотя бы одно из полей: %s",
+		MsgOverlap:                   "не должно содержать значений из %s",
+		MsgTooManyMatches:            "соответствует более чем %d записям, сузьте фильтр",
+		MsgGenreOverflow:             "оставит более %d жанров у записей %s",
+		MsgDuplicateISRC:             "музыка с таким ISRC уже существует",
+		MsgNotNegative:               "не должно быть отрицательным",
+		MsgGenresRange:               "должно содержать от %d до %d жанров",
+		MsgUnknownReference:          "ссылается на несуществующую запись",
+		MsgMinValue:                  "не должно быть меньше %s",
+		MsgNumber:                    "должно быть числом",
+		MsgRange:                     "должно быть от %v до %v",
+		MsgTimestamp:                 "должно быть временем в формате RFC 3339 или датой ГГГГ-ММ-ДД",
+		MsgRelevanceNeedsTitle:       "сортировка по релевантности требует поиска по title или q",
+		MsgOneOf:                     "должно быть одним из: %s",
+		MsgEmptyValues:               "не должно содержать пустых значений",
+		MsgExclusive:                 "нельзя использовать вместе с %s",
+		MsgNotSupported:              "не поддерживается этим методом",
+		MsgMinChars:                  "должно содержать не менее %d символов",
+		MsgPageCeiling:               "должно быть не больше %d при таком page_size; уточните фильтры или обратите сортировку, чтобы добраться до дальних записей",
+		MsgInvalidExpression:         "некорректное выражение в позиции %d: %s",
+		MsgInvalidQuery:              "должно быть корректной строкой запроса URL",
+		MsgURL:                       "должно быть абсолютным URL с http или https",
+		MsgDuplicateName:             "у вас уже есть запись с таким именем",
+		MsgInvalidUUID:               "должно быть UUID, например 123e4567-e89b-12d3-a456-426614174000",
+		MsgEmailChangeSeparate:       "нельзя изменить здесь: новый адрес сначала нужно подтвердить",
+		MsgCurrentEmail:              "уже является вашим адресом email",
+		MsgCommonPassword:            "слишком распространён, выберите пароль, который сложнее угадать",
+		MsgBreachedPassword:          "встречается в данных известной утечки, выберите другой",
+		MsgInvalidTOTP:               "должно быть текущим кодом из приложения-аутентификатора",
+
+		"server_error":                 "на сервере возникла проблема, и он не смог обработать ваш запрос",
+		"record_not_found":             "запрошенный ресурс не найден",
+		"method_not_allowed":           "метод %s не поддерживается для этого ресурса",
+		"validation_failed":            "одно или несколько полей не прошли проверку",
+		"rate_limited":                 "превышен лимит запросов",
+		"edit_conflict":                "не удалось обновить запись из-за конфликта изменений, получите запись заново и повторите попытку",
+		"precondition_failed":          "запись изменилась с момента последнего получения, получите её заново и повторите попытку",
+		"idempotency_key_reused":       "этот ключ идемпотентности уже использован с другим запросом",
+		"idempotency_key_in_progress":  "запрос с этим ключом идемпотентности ещё обрабатывается, повторите попытку позже",
+		"invalid_credentials":          "неверные учётные данные",
+		"invalid_authentication_token": "недействительный или отсутствующий токен аутентификации",
+		"authentication_required":      "для доступа к этому ресурсу необходимо пройти аутентификацию",
+		"inactive_account":             "для доступа к этому ресурсу ваша учётная запись должна быть активирована",
+		"account_suspended":            "ваша учётная запись заблокирована",
+		"not_permitted":                "у вашей учётной записи нет прав для доступа к этому ресурсу",
+		"read_only_token":              "этот токен аутентификации только для чтения и не позволяет вносить изменения",
+		"query_timeout":                "запрос выполнялся слишком долго, повторите попытку позже или уточните фильтры",
+		"export_too_large":             "экспорт содержал бы %d записей, больше допустимых %d; уточните фильтры",
+		"unsupported_media_type":       "тело запроса должно быть в формате %s",
+		"body_too_large":               "тело запроса должно быть не больше %d байт",
+		"not_acceptable":               "ответ может быть отправлен только в одном из форматов: %s",
+		"unsupported_content_encoding": "кодировка содержимого %s не поддерживается; отправьте тело без сжатия или в gzip",
+		"enrichment_unavailable":       "дополнение метаданных не настроено на этом сервере",
+		"upstream_failed":              "сервис %s не смог ответить на запрос, повторите попытку позже",
+		"upstream_rate_limited":        "сервис %s ограничивает наши запросы, повторите попытку через %d с",
+		"export_not_ready":             "экспорт в состоянии %s; скачать можно только завершённый экспорт",
+		"export_expired":               "срок хранения экспорта истёк и его файл удалён, запустите новый экспорт",
+		"import_finished":              "импорт уже в состоянии %s и не может быть отменён",
+		"last_holder":                  "вы единственный пользователь с правом %s; выдайте его другому пользователю, прежде чем удалять аккаунт",
+		"last_holder_revoke":           "право %s есть только у этого пользователя; выдайте его другому пользователю, прежде чем отзывать",
+		"last_holder_suspend":          "право %s есть только у этого активного пользователя; выдайте его другому пользователю, прежде чем блокировать его",
+		"totp_required":                "для этой учётной записи включена двухфакторная аутентификация; укажите totp_code из приложения-аутентификатора или код восстановления",
+		"invalid_totp_code":            "недействительный или уже использованный код двухфакторной аутентификации",
+		"two_factor_enabled":           "двухфакторная аутентификация для этой учётной записи уже включена",
+		"two_factor_not_pending":       "нет настройки двухфакторной аутентификации для подтверждения; сначала начните её",
+		"two_factor_unavailable":       "двухфакторная аутентификация не настроена на этом сервере",
+	},
+	"kk": {
+		MsgRequired:                  "міндетті өріс",
+		MsgMinBytes:                  "ұзындығы кемінде %d байт болуы керек",
+		MsgMaxBytes:                  "ұзындығы %d байттан аспауы керек",
+		MsgExactBytes:                "ұзындығы %d байт болуы керек",
+		MsgInteger:                   "бүтін сан болуы керек",
+		MsgBoolean:                   "логикалық мән болуы керек",
+		MsgPositiveInteger:           "оң бүтін сан болуы керек",
+		MsgPositiveNumber:            "оң сан болуы керек",
+		MsgGreaterThanZero:           "нөлден үлкен болуы керек",
+		MsgMaxValue:                  "%d мәнінен аспауы керек",
+		MsgMaxPage:                   "10 миллионнан аспауы керек",
+		MsgMinGenres:                 "кемінде бір жанр болуы керек",
+		MsgMaxGenres:                 "%d жанрдан артық болмауы керек",
+		MsgDuplicateValues:           "қайталанатын мәндер болмауы керек",
+		MsgInvalidISRC:               "12 таңбалы жарамды ISRC коды болуы керек",
+		MsgInvalidEmail:              "жарамды электрондық пошта мекенжайы болуы керек",
+		MsgInvalidSort:               "сұрыптау мәні жарамсыз",
+		MsgUnknownField:              "белгісіз өріс %q, жарамды өрістер: %s",
+		MsgMaxIDs:                    "%d идентификатордан артық болмауы керек",
+		MsgPositiveIDs:               "тек оң бүтін сандар болуы керек (алынғаны %v)",
+		MsgNoUpdatableFields:         "кемінде бір өзгертілетін өріс болуы керек: %s",
+		MsgDuplicateEmail:            "бұл электрондық пошта мекенжайымен пайдаланушы бұрыннан бар",
+		MsgInvalidActivationToken:    "белсендіру токені жарамсыз немесе мерзімі өткен",
+		MsgInvalidPasswordResetToken: "құпиясөзді қалпына келтіру токені жарамсыз немесе мерзімі өткен",
+		MsgInvalidEmailChangeToken:   "email ауыстыру токені жарамсыз немесе мерзімі өткен",
+		MsgMustDiffer:                "%s мәнінен өзгеше болуы керек",
+		MsgRequiredOneOf:             "келесі өрістердің кемінде біреуі көрсетілуі керек: %s",
+		MsgOverlap:                   "%s өрісіндегі мәндерді қамтымауы керек",
+		MsgTooManyMatches:            "%d жазбадан көп сәйкес келеді, сүзгіні тарылтыңыз",
+		MsgGenreOverflow:             "%[2]s жазбаларында %[1]d жанрдан артық қалдырады",
+		MsgDuplicateISRC:             "бұл ISRC коды бар музыка бұрыннан бар",
+		MsgNotNegative:               "теріс сан болмауы керек",
+		MsgGenresRange:               "%d мен %d аралығында жанр болуы керек",
+		MsgUnknownReference:          "жоқ жазбаға сілтеме жасайды",
+		MsgMinValue:                  "%s мәнінен кем болмауы керек",
+		MsgNumber:                    "сан болуы керек",
+		MsgRange:                     "%v мен %v аралығында болуы керек",
+		MsgTimestamp:                 "RFC 3339 форматындағы уақыт немесе ЖЖЖЖ-АА-КК күні болуы керек",
+		MsgRelevanceNeedsTitle:       "өзектілік бойынша сұрыптау үшін title немесе q бойынша іздеу қажет",
+		MsgOneOf:                     "мыналардың бірі болуы керек: %s",
+		MsgEmptyValues:               "бос мәндерден тұрмауы керек",
+		MsgExclusive:                 "%s өрісімен бірге қолдануға болмайды",
+		MsgNotSupported:              "бұл әдіс қолдамайды",
+		MsgMinChars:                  "кемінде %d таңбадан тұруы керек",
+		MsgPageCeiling:               "осы page_size кезінде %d аспауы керек; алыстағы жазбаларға жету үшін сүзгілерді нақтылаңыз немесе сұрыптауды керісінше қойыңыз",
+		MsgInvalidExpression:         "%d-позициядағы өрнек қате: %s",
+		MsgInvalidQuery:              "жарамды URL сұраныс жолы болуы керек",
+		MsgURL:                       "http немесе https абсолютті URL болуы керек",
+		MsgDuplicateName:             "сізде мұндай атаумен жазба бар",
+		MsgInvalidUUID:               "UUID болуы керек, мысалы 123e4567-e89b-12d3-a456-426614174000",
+		MsgEmailChangeSeparate:       "мұнда өзгертілмейді: жаңа мекенжай алдымен расталуы керек",
+		MsgCurrentEmail:              "қазірдің өзінде сіздің email мекенжайыңыз",
+		MsgCommonPassword:            "тым кең таралған, болжау қиынырақ құпиясөз таңдаңыз",
+		MsgBreachedPassword:          "белгілі деректер жылыстауында кездеседі, басқасын таңдаңыз",
+		MsgInvalidTOTP:               "аутентификатор қолданбасындағы ағымдағы код болуы керек",
+
+		"server_error":                 "серверде ақау орын алып, сұранысыңыз өңделмеді",
+		"record_not_found":             "сұралған ресурс табылмады",
+		"method_not_allowed":           "бұл ресурс үшін %s әдісіне қолдау көрсетілмейді",
+		"validation_failed":            "бір немесе бірнеше өріс тексеруден өтпеді",
+		"rate_limited":                 "сұраныс шегінен асып кетті",
+		"edit_conflict":                "өзгерістер қайшылығына байланысты жазбаны жаңарту мүмкін болмады, жазбаны қайта алып, әрекетті қайталаңыз",
+		"precondition_failed":          "жазба соңғы алынғаннан бері өзгерді, оны қайта алып, әрекетті қайталаңыз",
+		"idempotency_key_reused":       "бұл идемпотенттілік кілті басқа сұраныспен қолданылған",
+		"idempotency_key_in_progress":  "осы идемпотенттілік кілті бар сұраныс әлі өңделуде, кейінірек қайталаңыз",
+		"invalid_credentials":          "тіркелгі деректері қате",
+		"invalid_authentication_token": "аутентификация токені жарамсыз немесе жоқ",
+		"authentication_required":      "бұл ресурсқа қол жеткізу үшін аутентификациядан өту керек",
+		"inactive_account":             "бұл ресурсқа қол жеткізу үшін тіркелгіңіз белсендірілуі керек",
+		"account_suspended":            "тіркелгіңіз бұғатталған",
+		"not_permitted":                "тіркелгіңізде бұл ресурсқа қол жеткізу құқығы жоқ",
+		"read_only_token":              "бұл аутентификация токені тек оқуға арналған, онымен өзгеріс енгізуге болмайды",
+		"query_timeout":                "сұраныс тым ұзақ орындалды, кейінірек қайталап көріңіз немесе сүзгілерді нақтылаңыз",
+		"export_too_large":             "экспортта %d жазба болар еді, бұл %d шегінен көп; сүзгілерді нақтылаңыз",
+		"unsupported_media_type":       "сұраныс денесі %s форматында болуы керек",
+		"body_too_large":               "сұраныс денесі %d байттан аспауы керек",
+		"not_acceptable":               "жауап тек мына форматтардың бірінде жіберіле алады: %s",
+		"unsupported_content_encoding": "%s мазмұн кодтауына қолдау көрсетілмейді; денені сықпай немесе gzip түрінде жіберіңіз",
+		"enrichment_unavailable":       "бұл серверде метадеректерді толықтыру бапталмаған",
+		"upstream_failed":              "%s қызметі сұранысқа жауап бере алмады, кейінірек қайталап көріңіз",
+		"upstream_rate_limited":        "%s қызметі сұраныстарымызды шектеп тұр, %d секундтан кейін қайталап көріңіз",
+		"export_not_ready":             "экспорт %s күйінде; тек аяқталған экспортты жүктеп алуға болады",
+		"export_expired":               "экспорттың сақталу мерзімі өтіп, файлы жойылды, жаңа экспортты іске қосыңыз",
+		"import_finished":              "импорт %s күйінде, оны енді тоқтату мүмкін емес",
+		"last_holder":                  "%s құқығы тек сізде бар; аккаунтты жоймас бұрын оны басқа пайдаланушыға беріңіз",
+		"last_holder_revoke":           "%s құқығы тек осы пайдаланушыда бар; оны қайтарып алмас бұрын басқа пайдаланушыға беріңіз",
+		"last_holder_suspend":          "%s құқығы тек осы белсенді пайдаланушыда бар; оны бұғаттамас бұрын құқықты басқа пайдаланушыға беріңіз",
+		"totp_required":                "бұл тіркелгіде екі факторлы аутентификация қосылған; аутентификатор қолданбасынан totp_code немесе қалпына келтіру кодын беріңіз",
+		"invalid_totp_code":            "екі факторлы аутентификация коды жарамсыз немесе бұрын пайдаланылған",
+		"two_factor_enabled":           "бұл тіркелгі үшін екі факторлы аутентификация әлдеқашан қосылған",
+		"two_factor_not_pending":       "растайтын екі факторлы аутентификация баптауы жоқ; алдымен оны бастаңыз",
+		"two_factor_unavailable":       "бұл серверде екі факторлы аутентификация бапталмаған",
+	},
+}
+
+// Translate renders the message id in lang, falling back to DefaultLanguage
+// and, for ids missing from the catalogue, to the id itself.
+func Translate(lang, id string, args ...interface{}) string {
+	format, ok := catalogue[lang][id]
+	if !ok {
+		format, ok = catalogue[DefaultLanguage][id]
+	}
+	if !ok {
+		return id
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Language picks the catalogue language best matching an Accept-Language
+// header such as "ru-RU,ru;q=0.9,en;q=0.8", or DefaultLanguage when none of
+// the accepted languages are available.
+func Language(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params := part, ""
+		if i := strings.Index(part, ";"); i != -1 {
+			tag, params = part[:i], part[i+1:]
+		}
+
+		lang := strings.ToLower(strings.TrimSpace(tag))
+		if i := strings.Index(lang, "-"); i != -1 {
+			lang = lang[:i]
+		}
+		if _, ok := catalogue[lang]; !ok {
+			continue
+		}
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return DefaultLanguage
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
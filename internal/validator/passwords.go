@@ -0,0 +1,32 @@
+package validator
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+//go:embed "common_passwords.txt"
+var commonPasswordList string
+
+// commonPasswords is the set of the passwords in common_passwords.txt, one
+// per line in lower case, built on first use.
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswords     map[string]bool
+)
+
+// NotCommonPassword reports whether password is missing from the list of
+// the most common passwords, ignoring case.
+func NotCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		lines := strings.Split(commonPasswordList, "\n")
+		commonPasswords = make(map[string]bool, len(lines))
+		for _, line := range lines {
+			if line = strings.TrimSpace(line); line != "" {
+				commonPasswords[line] = true
+			}
+		}
+	})
+	return !commonPasswords[strings.ToLower(password)]
+}
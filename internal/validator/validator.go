@@ -5,30 +5,32 @@ import (
 )
 
 var (
+	ISRCRX  = regexp.MustCompile("^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$")
+	UUIDRX  = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
 type Validator struct {
-	Errors map[string]string
+	Errors map[string]Message
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string]Message)}
 }
 
 func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
-func (v *Validator) AddError(key, message string) {
+func (v *Validator) AddError(key, id string, args ...interface{}) {
 	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
+		v.Errors[key] = Message{ID: id, Args: args}
 	}
 }
 
-func (v *Validator) Check(ok bool, key, message string) {
+func (v *Validator) Check(ok bool, key, id string, args ...interface{}) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddError(key, id, args...)
 	}
 }
 
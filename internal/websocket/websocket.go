@@ -0,0 +1,321 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455): the opening handshake, reading and writing messages, and the
+// ping/pong and close control frames. Extensions and subprotocols aren't
+// supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message and control frame opcodes.
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Close codes.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// acceptGUID is appended to the client's key to derive Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrBadHandshake is wrapped by the errors Upgrade returns for requests
+	// that aren't valid WebSocket handshakes.
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	// ErrMessageTooBig is returned by ReadMessage when a message is longer
+	// than the read limit.
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// CloseError is returned by ReadMessage once the peer sent a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by peer (%d %s)", e.Code, e.Reason)
+}
+
+// Conn is an upgraded connection. One goroutine may read while another
+// writes; writes are serialised, so control frames can be sent from either.
+type Conn struct {
+	// ReadLimit caps the size of a message, zero meaning no limit.
+	ReadLimit int64
+	// PongHandler, when set, is called by ReadMessage for every pong.
+	PongHandler func()
+
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Upgrade completes the handshake for r and takes over its connection. On
+// error nothing has been written to w, so the caller can still respond.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	switch {
+	case r.Method != http.MethodGet:
+		return nil, fmt.Errorf("%w: method must be GET", ErrBadHandshake)
+	case !headerHasToken(r.Header, "Connection", "upgrade"):
+		return nil, fmt.Errorf("%w: Connection header must include upgrade", ErrBadHandshake)
+	case !headerHasToken(r.Header, "Upgrade", "websocket"):
+		return nil, fmt.Errorf("%w: Upgrade header must be websocket", ErrBadHandshake)
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		return nil, fmt.Errorf("%w: Sec-WebSocket-Version must be 13", ErrBadHandshake)
+	}
+
+	key := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: response writer does not support hijacking")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// The server's read and write timeouts were set for the HTTP exchange;
+	// from here on the caller manages deadlines.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+// headerHasToken reports whether the comma separated header name lists
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadDeadline sets the deadline for reads, as on net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes, as on net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs passed to PongHandler along the way. A close frame is answered
+// in kind and reported as a *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		opcode  int
+		message []byte
+	)
+
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.PongHandler != nil {
+				c.PongHandler()
+			}
+			continue
+		case CloseMessage:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.WriteClose(CloseNormal, "")
+			return 0, nil, closeErr
+		case continuationFrame:
+			if opcode == 0 {
+				return 0, nil, c.protocolError("unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if opcode != 0 {
+				return 0, nil, c.protocolError("expected continuation frame")
+			}
+			opcode = frameOpcode
+		default:
+			return 0, nil, c.protocolError(fmt.Sprintf("unknown opcode %d", frameOpcode))
+		}
+
+		message = append(message, payload...)
+		if c.ReadLimit > 0 && int64(len(message)) > c.ReadLimit {
+			c.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooBig
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.protocolError("reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.protocolError("client frames must be masked")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= CloseMessage && (!fin || length > 125) {
+		return false, 0, nil, c.protocolError("invalid control frame")
+	}
+	if c.ReadLimit > 0 && length > uint64(c.ReadLimit) {
+		c.WriteClose(CloseMessageTooBig, "")
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// protocolError closes the connection with a protocol error and returns it.
+func (c *Conn) protocolError(reason string) error {
+	c.WriteClose(CloseProtocolError, reason)
+	return fmt.Errorf("websocket: protocol error: %s", reason)
+}
+
+// WriteMessage sends data as a single, unfragmented frame.
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return errors.New("websocket: write after close")
+	}
+	return c.writeFrame(opcode, data)
+}
+
+// WriteClose starts, or answers, the closing handshake. Only the first close
+// frame is sent; later calls do nothing.
+func (c *Conn) WriteClose(code int, reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(CloseMessage, append(payload, reason...))
+}
+
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	header := make([]byte, 2, 10+len(data))
+	header[0] = 0x80 | byte(opcode)
+
+	switch n := len(data); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	_, err := c.conn.Write(append(header, data...))
+	return err
+}
@@ -0,0 +1 @@
+ALTER TABLE musics DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,2 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+UPDATE musics SET updated_at = created_at;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    key          text                        NOT NULL,
+    user_id      bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    request_hash bytea                       NOT NULL,
+    status       integer,
+    headers      jsonb,
+    body         bytea,
+    expiry       timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (key, user_id)
+);
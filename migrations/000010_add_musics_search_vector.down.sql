@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS musics_search_vector_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,2 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', title)) STORED;
+CREATE INDEX IF NOT EXISTS musics_search_vector_idx ON musics USING GIN (search_vector);
@@ -0,0 +1,2 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS musics_title_trgm_idx ON musics USING GIN (title gin_trgm_ops);
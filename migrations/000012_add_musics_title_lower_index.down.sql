@@ -0,0 +1 @@
+DROP INDEX IF EXISTS musics_title_lower_idx;
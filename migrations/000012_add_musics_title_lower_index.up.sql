@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS musics_title_lower_idx ON musics (lower(title));
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS musics_title_prefix_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS artist;
@@ -0,0 +1,2 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS artist text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS musics_title_prefix_idx ON musics (lower(title) text_pattern_ops);
@@ -0,0 +1,3 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS search_document tsvector
+    GENERATED ALWAYS AS (setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', artist), 'B')) STORED;
+CREATE INDEX IF NOT EXISTS musics_search_document_idx ON musics USING GIN (search_document);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS musics_created_at_id_idx;
@@ -0,0 +1,2 @@
+-- Matches ORDER BY created_at DESC, id ASC, the "-created_at" listing order.
+CREATE INDEX IF NOT EXISTS musics_created_at_id_idx ON musics (created_at DESC, id);
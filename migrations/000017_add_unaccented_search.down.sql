@@ -0,0 +1,20 @@
+DROP INDEX IF EXISTS musics_title_normalized_idx;
+CREATE INDEX IF NOT EXISTS musics_title_lower_idx ON musics (lower(title));
+
+DROP INDEX IF EXISTS musics_title_trgm_idx;
+CREATE INDEX musics_title_trgm_idx ON musics USING GIN (title gin_trgm_ops);
+
+DROP INDEX IF EXISTS musics_search_document_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS search_document;
+ALTER TABLE musics ADD COLUMN search_document tsvector
+    GENERATED ALWAYS AS (setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', artist), 'B')) STORED;
+CREATE INDEX musics_search_document_idx ON musics USING GIN (search_document);
+
+DROP INDEX IF EXISTS musics_search_vector_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE musics ADD COLUMN search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', title)) STORED;
+CREATE INDEX musics_search_vector_idx ON musics USING GIN (search_vector);
+
+DROP FUNCTION IF EXISTS normalize_text(text);
+DROP EXTENSION IF EXISTS unaccent;
@@ -0,0 +1,25 @@
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+-- unaccent() is only STABLE because its dictionary could change; pinning the
+-- dictionary makes the wrapper safe to use in generated columns and indexes.
+CREATE OR REPLACE FUNCTION normalize_text(text) RETURNS text
+    AS $$ SELECT lower(public.unaccent('public.unaccent'::regdictionary, $1)) $$
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT;
+
+DROP INDEX IF EXISTS musics_search_vector_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE musics ADD COLUMN search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', normalize_text(title))) STORED;
+CREATE INDEX musics_search_vector_idx ON musics USING GIN (search_vector);
+
+DROP INDEX IF EXISTS musics_search_document_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS search_document;
+ALTER TABLE musics ADD COLUMN search_document tsvector
+    GENERATED ALWAYS AS (setweight(to_tsvector('simple', normalize_text(title)), 'A') || setweight(to_tsvector('simple', normalize_text(artist)), 'B')) STORED;
+CREATE INDEX musics_search_document_idx ON musics USING GIN (search_document);
+
+DROP INDEX IF EXISTS musics_title_trgm_idx;
+CREATE INDEX musics_title_trgm_idx ON musics USING GIN (normalize_text(title) gin_trgm_ops);
+
+DROP INDEX IF EXISTS musics_title_lower_idx;
+CREATE INDEX musics_title_normalized_idx ON musics (normalize_text(title));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS enrichment_jobs;
+ALTER TABLE musics DROP COLUMN IF EXISTS enriched_at;
+ALTER TABLE musics DROP COLUMN IF EXISTS enrichment_source;
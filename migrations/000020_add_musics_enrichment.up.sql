@@ -0,0 +1,20 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS enrichment_source text;
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS enriched_at timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS enrichment_jobs (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    query text NOT NULL,
+    overwrite boolean NOT NULL,
+    status text NOT NULL DEFAULT 'running',
+    total integer NOT NULL,
+    processed integer NOT NULL DEFAULT 0,
+    enriched integer NOT NULL DEFAULT 0,
+    skipped integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS enrichment_jobs_status_idx ON enrichment_jobs (status);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS musics_musicbrainz_id_idx;
+ALTER TABLE musics DROP COLUMN IF EXISTS musicbrainz_id;
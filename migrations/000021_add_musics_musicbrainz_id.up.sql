@@ -0,0 +1,2 @@
+ALTER TABLE musics ADD COLUMN IF NOT EXISTS musicbrainz_id uuid;
+CREATE INDEX IF NOT EXISTS musics_musicbrainz_id_idx ON musics (musicbrainz_id);
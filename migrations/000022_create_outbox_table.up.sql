@@ -0,0 +1,14 @@
+CREATE SEQUENCE IF NOT EXISTS outbox_sequence;
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    sequence bigint UNIQUE,
+    event text NOT NULL,
+    music_id bigint NOT NULL,
+    version integer NOT NULL DEFAULT 0,
+    payload json NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    sent_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
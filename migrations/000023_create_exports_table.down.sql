@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS exports;
+DELETE FROM permissions WHERE code = 'musics:export';
@@ -0,0 +1,22 @@
+INSERT INTO permissions (code)
+VALUES ('musics:export');
+
+CREATE TABLE IF NOT EXISTS exports (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    query text NOT NULL,
+    format text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    total integer NOT NULL,
+    rows_written integer NOT NULL DEFAULT 0,
+    size bigint NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    completed_at timestamp(0) with time zone,
+    expires_at timestamp(0) with time zone,
+    swept_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS exports_user_id_idx ON exports (user_id);
+CREATE INDEX IF NOT EXISTS exports_unswept_idx ON exports (expires_at) WHERE swept_at IS NULL;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS imports (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    size bigint NOT NULL,
+    language text NOT NULL,
+    total integer NOT NULL DEFAULT 0,
+    processed integer NOT NULL DEFAULT 0,
+    imported integer NOT NULL DEFAULT 0,
+    rejected integer NOT NULL DEFAULT 0,
+    last_line integer NOT NULL DEFAULT 1,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS imports_status_idx ON imports (status);
+
+CREATE TABLE IF NOT EXISTS import_errors (
+    import_id bigint NOT NULL REFERENCES imports ON DELETE CASCADE,
+    line integer NOT NULL,
+    fields jsonb NOT NULL,
+    PRIMARY KEY (import_id, line)
+);
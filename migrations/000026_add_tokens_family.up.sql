@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
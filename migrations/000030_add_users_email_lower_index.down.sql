@@ -0,0 +1,2 @@
+-- The emails lower-cased by the up migration stay that way.
+DROP INDEX IF EXISTS users_email_lower_key;
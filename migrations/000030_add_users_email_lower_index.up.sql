@@ -0,0 +1,25 @@
+-- Emails are stored lower-cased from now on. Two users whose emails differ
+-- only in case would both be lower-cased into one address, so the migration
+-- stops and names them instead; they have to be merged or one renamed first.
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(emails, '; ') INTO duplicates
+    FROM (
+        SELECT string_agg(id || ' <' || email || '>', ', ' ORDER BY id) AS emails
+        FROM users
+        GROUP BY lower(email::text)
+        HAVING count(*) > 1
+    ) d;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'users with emails differing only in case: %', duplicates;
+    END IF;
+END
+$$;
+
+UPDATE users SET email = lower(email::text) WHERE email::text <> lower(email::text);
+UPDATE users SET pending_email = lower(pending_email::text) WHERE pending_email::text <> lower(pending_email::text);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (lower(email::text));
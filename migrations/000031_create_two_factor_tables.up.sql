@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS two_factor (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    -- The TOTP secret, encrypted with the server's key.
+    secret bytea NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    -- The step of the last code accepted, which can't be used again.
+    last_step bigint NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_recovery_codes (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    PRIMARY KEY (user_id, hash)
+);
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS read_only boolean NOT NULL DEFAULT false;
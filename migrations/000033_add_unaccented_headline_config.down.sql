@@ -0,0 +1 @@
+DROP TEXT SEARCH CONFIGURATION IF EXISTS simple_unaccent;
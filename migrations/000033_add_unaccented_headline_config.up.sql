@@ -0,0 +1,6 @@
+-- ts_headline parses the title itself, so highlighting needs a configuration
+-- that folds accents and case the way normalize_text() does.
+DROP TEXT SEARCH CONFIGURATION IF EXISTS simple_unaccent;
+CREATE TEXT SEARCH CONFIGURATION simple_unaccent (COPY = simple);
+ALTER TEXT SEARCH CONFIGURATION simple_unaccent
+    ALTER MAPPING FOR asciiword, asciihword, hword_asciipart, word, hword, hword_part WITH public.unaccent, simple;